@@ -0,0 +1,44 @@
+package main
+
+import (
+	"log/slog"
+	"reflect"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// attributeChangeFunc is called with a user's old and new value of a watched attribute when a
+// record changes it. An attribute missing from one of the images is passed as NULL.
+type attributeChangeFunc func(userID, attr string, old, new events.DynamoDBAttributeValue)
+
+// logAttributeChange is the attribute change hook used unless another is injected. Only the
+// attribute name is logged, since watched attributes such as email are often personal data.
+func logAttributeChange(logger *slog.Logger) attributeChangeFunc {
+	return func(userID, attr string, _, _ events.DynamoDBAttributeValue) {
+		logger.Info("user attribute changed",
+			slog.String("userId", userID),
+			slog.String("attribute", attr))
+	}
+}
+
+// notifyAttributeChanges calls the attribute change hook for every watched attribute whose value
+// differs between a record's old and new images. Records without both images, such as INSERT
+// and REMOVE records or records from a stream without old images, are not diffed.
+func (p *processor) notifyAttributeChanges(der events.DynamoDBEventRecord, userKey string) {
+	if p.onAttributeChange == nil || len(p.watchAttributes) == 0 || der.Change.OldImage == nil || der.Change.NewImage == nil {
+		return
+	}
+	for _, attr := range p.watchAttributes {
+		old, ok := der.Change.OldImage[attr]
+		if !ok {
+			old = events.NewNullAttribute()
+		}
+		new, ok := der.Change.NewImage[attr]
+		if !ok {
+			new = events.NewNullAttribute()
+		}
+		if !reflect.DeepEqual(old, new) {
+			p.onAttributeChange(extractUserID(userKey), attr, old, new)
+		}
+	}
+}
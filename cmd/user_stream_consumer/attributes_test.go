@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+)
+
+// Test_handler_attributeChange verifies the attribute change hook fires for a watched attribute
+// changed by a MODIFY event, and not for watched attributes left unchanged
+func Test_handler_attributeChange(t *testing.T) {
+	client := &mockDynamoDBClient{batchWriteItemFunc: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+		return &dynamodb.BatchWriteItemOutput{}, nil
+	}}
+	env := testEnv(map[string]string{"TABLE_NAME": "test-table", "WATCH_ATTRIBUTES": "email,status"})
+	p := newProcessor(slog.New(slog.NewJSONHandler(io.Discard, nil)), client, nil, nil, nil, mustLoadConfig(t, env), fixedClock)
+
+	type change struct {
+		userID, attr, old, new string
+	}
+	var changes []change
+	p.onAttributeChange = func(userID, attr string, old, new events.DynamoDBAttributeValue) {
+		changes = append(changes, change{userID, attr, old.String(), new.String()})
+	}
+
+	body := `{
+		"eventName": "MODIFY",
+		"dynamodb": {
+			"OldImage": {"pk": {"S": "USER#123"}, "email": {"S": "jane@old.example.com"}, "status": {"S": "active"}, "organizations": {"L": [{"S": "org1"}]}},
+			"NewImage": {"pk": {"S": "USER#123"}, "email": {"S": "jane@new.example.com"}, "status": {"S": "active"}, "organizations": {"L": [{"S": "org1"}]}}
+		}
+	}`
+	if _, err := p.lambdaHandler(nil)(context.Background(), events.SQSEvent{Records: []events.SQSMessage{{Body: body}}}); err != nil {
+		t.Fatalf("handler() unexpected error = %v", err)
+	}
+
+	want := []change{{"123", "email", "jane@old.example.com", "jane@new.example.com"}}
+	if len(changes) != len(want) || changes[0] != want[0] {
+		t.Errorf("expected changes %v, got %v", want, changes)
+	}
+}
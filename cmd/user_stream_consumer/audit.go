@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// defaultActor is attributed to changes whose user image does not carry a modified_by attribute.
+const defaultActor = "system"
+
+// Audit event actions.
+const (
+	auditActionAdd        = "add"
+	auditActionRemove     = "remove"
+	auditActionRoleChange = "role_change"
+)
+
+// auditEvent describes a single membership change and who made it. It is also the line written
+// to the audit writer for the change.
+type auditEvent struct {
+	Actor          string    `json:"actor"`
+	Action         string    `json:"action"`
+	UserID         string    `json:"userId"`
+	OrganizationID string    `json:"organizationId"`
+	Timestamp      time.Time `json:"timestamp"`
+}
+
+// extractActor returns who made the change described by a record, read from the modified_by
+// attribute of the new image, or the old image for REMOVE events. defaultActor is returned when
+// the attribute is absent or not a string.
+func extractActor(der events.DynamoDBEventRecord) string {
+	image := der.Change.NewImage
+	if der.EventName == string(events.DynamoDBOperationTypeRemove) {
+		image = der.Change.OldImage
+	}
+	if actor, ok := image["modified_by"]; ok && actor.DataType() == events.DataTypeString && actor.String() != "" {
+		return actor.String()
+	}
+	return defaultActor
+}
+
+// auditEvents builds the audit events for a user's added and removed organizations, and for
+// those whose roles changed.
+func auditEvents(actor, userPK string, toAdd, toRemove, toUpdate []string, timestamp time.Time) []auditEvent {
+	userID := extractUserID(userPK)
+	audit := make([]auditEvent, 0, len(toAdd)+len(toRemove)+len(toUpdate))
+	for _, orgID := range toRemove {
+		audit = append(audit, auditEvent{Actor: actor, Action: auditActionRemove, UserID: userID, OrganizationID: orgID, Timestamp: timestamp})
+	}
+	for _, orgID := range toUpdate {
+		audit = append(audit, auditEvent{Actor: actor, Action: auditActionRoleChange, UserID: userID, OrganizationID: orgID, Timestamp: timestamp})
+	}
+	for _, orgID := range toAdd {
+		audit = append(audit, auditEvent{Actor: actor, Action: auditActionAdd, UserID: userID, OrganizationID: orgID, Timestamp: timestamp})
+	}
+	return audit
+}
+
+// emitAuditEvents logs an audit event for every membership change when audit events are enabled.
+func (p *processor) emitAuditEvents(ctx context.Context, audit []auditEvent) {
+	if !p.auditEvents {
+		return
+	}
+	for _, e := range audit {
+		p.logger.InfoContext(ctx, "membership audit event",
+			slog.String("actor", p.redact(e.Actor)),
+			slog.String("action", e.Action),
+			slog.String("userId", e.UserID),
+			slog.String("organizationId", e.OrganizationID),
+			slog.Time("timestamp", e.Timestamp))
+	}
+}
+
+// writeAuditRecords appends every membership change to the audit writer as a compact JSON line,
+// independently of the operational logs and of AUDIT_EVENTS. A failed write is retryable; the
+// membership writes are idempotent, so the record can safely be applied again.
+func (p *processor) writeAuditRecords(audit []auditEvent) error {
+	if p.auditWriter == nil {
+		return nil
+	}
+	for _, e := range audit {
+		b, err := json.Marshal(e)
+		if err != nil {
+			return fmt.Errorf("failed to marshal audit record: %w", err)
+		}
+		if _, err := p.auditWriter.Write(append(b, '\n')); err != nil {
+			return fmt.Errorf("failed to write audit record: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+)
+
+// Test_extractActor verifies the actor is read from modified_by and defaults to system
+func Test_extractActor(t *testing.T) {
+	tests := []struct {
+		name string
+		der  events.DynamoDBEventRecord
+		want string
+	}{
+		{
+			name: "modified_by on new image",
+			der: events.DynamoDBEventRecord{
+				EventName: "MODIFY",
+				Change: events.DynamoDBStreamRecord{NewImage: map[string]events.DynamoDBAttributeValue{
+					"modified_by": events.NewStringAttribute("admin@example.org"),
+				}},
+			},
+			want: "admin@example.org",
+		},
+		{
+			name: "modified_by on old image for remove",
+			der: events.DynamoDBEventRecord{
+				EventName: "REMOVE",
+				Change: events.DynamoDBStreamRecord{OldImage: map[string]events.DynamoDBAttributeValue{
+					"modified_by": events.NewStringAttribute("cleanup-job"),
+				}},
+			},
+			want: "cleanup-job",
+		},
+		{
+			name: "absent defaults to system",
+			der: events.DynamoDBEventRecord{
+				EventName: "INSERT",
+				Change:    events.DynamoDBStreamRecord{NewImage: map[string]events.DynamoDBAttributeValue{}},
+			},
+			want: defaultActor,
+		},
+		{
+			name: "non-string defaults to system",
+			der: events.DynamoDBEventRecord{
+				EventName: "INSERT",
+				Change: events.DynamoDBStreamRecord{NewImage: map[string]events.DynamoDBAttributeValue{
+					"modified_by": events.NewNumberAttribute("42"),
+				}},
+			},
+			want: defaultActor,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := extractActor(tt.der); got != tt.want {
+				t.Errorf("extractActor() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// Test_handler_auditEvents verifies audit events carry the actor for each membership change
+func Test_handler_auditEvents(t *testing.T) {
+	tests := []struct {
+		name      string
+		body      string
+		wantActor string
+	}{
+		{
+			name: "actor from modified_by",
+			body: `{
+				"eventName": "MODIFY",
+				"dynamodb": {
+					"OldImage": {"pk": {"S": "USER#123"}, "organizations": {"L": [{"S": "org1"}]}},
+					"NewImage": {"pk": {"S": "USER#123"}, "modified_by": {"S": "admin@example.org"}, "organizations": {"L": [{"S": "org2"}]}}
+				}
+			}`,
+			wantActor: "admin@example.org",
+		},
+		{
+			name: "default actor",
+			body: `{
+				"eventName": "MODIFY",
+				"dynamodb": {
+					"OldImage": {"pk": {"S": "USER#123"}, "organizations": {"L": [{"S": "org1"}]}},
+					"NewImage": {"pk": {"S": "USER#123"}, "organizations": {"L": [{"S": "org2"}]}}
+				}
+			}`,
+			wantActor: defaultActor,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			logger := slog.New(slog.NewJSONHandler(&buf, nil))
+			client := &mockDynamoDBClient{batchWriteItemFunc: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+				return &dynamodb.BatchWriteItemOutput{}, nil
+			}}
+
+			h := handler(logger, client, nil, nil, nil, mustLoadConfig(t, testEnv(map[string]string{"TABLE_NAME": "test-table", "AUDIT_EVENTS": "true"})), fixedClock, nil)
+			if _, err := h(context.Background(), events.SQSEvent{Records: []events.SQSMessage{{Body: tt.body}}}); err != nil {
+				t.Fatalf("handler() unexpected error = %v", err)
+			}
+
+			audit := findLogs(parseLogs(t, &buf), "membership audit event")
+			if len(audit) != 2 {
+				t.Fatalf("expected 2 audit events, got %d", len(audit))
+			}
+			for i, want := range []struct{ action, org string }{{auditActionRemove, "org1"}, {auditActionAdd, "org2"}} {
+				if audit[i]["actor"] != tt.wantActor || audit[i]["action"] != want.action || audit[i]["organizationId"] != want.org || audit[i]["userId"] != "123" {
+					t.Errorf("audit event %d: got %v, want actor=%s action=%s org=%s", i, audit[i], tt.wantActor, want.action, want.org)
+				}
+			}
+		})
+	}
+}
+
+// Test_handler_auditWriter verifies a compact JSON audit line is written for each membership
+// change, independently of the operational logs
+func Test_handler_auditWriter(t *testing.T) {
+	client := &mockDynamoDBClient{batchWriteItemFunc: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+		return &dynamodb.BatchWriteItemOutput{}, nil
+	}}
+	p := newProcessor(slog.New(slog.NewJSONHandler(io.Discard, nil)), client, nil, nil, nil, mustLoadConfig(t, testEnv(map[string]string{"TABLE_NAME": "test-table"})), fixedClock)
+	var audit bytes.Buffer
+	p.auditWriter = &audit
+
+	body := `{
+		"eventName": "MODIFY",
+		"dynamodb": {
+			"OldImage": {"pk": {"S": "USER#123"}, "organizations": {"L": [{"S": "org1"}]}},
+			"NewImage": {"pk": {"S": "USER#123"}, "modified_by": {"S": "admin@example.org"}, "organizations": {"L": [{"S": "org2"}]}}
+		}
+	}`
+	if _, err := p.lambdaHandler(nil)(context.Background(), events.SQSEvent{Records: []events.SQSMessage{{Body: body}}}); err != nil {
+		t.Fatalf("handler() unexpected error = %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(audit.String(), "\n"), "\n")
+	want := []auditEvent{
+		{Actor: "admin@example.org", Action: auditActionRemove, UserID: "123", OrganizationID: "org1", Timestamp: fixedClock()},
+		{Actor: "admin@example.org", Action: auditActionAdd, UserID: "123", OrganizationID: "org2", Timestamp: fixedClock()},
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("expected %d audit lines, got %d: %q", len(want), len(lines), audit.String())
+	}
+	for i, line := range lines {
+		var got auditEvent
+		if err := json.Unmarshal([]byte(line), &got); err != nil {
+			t.Fatalf("audit line %d is not JSON: %v", i, err)
+		}
+		if got.Actor != want[i].Actor || got.Action != want[i].Action || got.UserID != want[i].UserID || got.OrganizationID != want[i].OrganizationID || !got.Timestamp.Equal(want[i].Timestamp) {
+			t.Errorf("audit line %d = %+v, want %+v", i, got, want[i])
+		}
+	}
+	if want := `{"actor":"admin@example.org","action":"remove","userId":"123","organizationId":"org1","timestamp":"` + fixedClock().Format(time.RFC3339Nano) + `"}`; lines[0] != want {
+		t.Errorf("audit line 0 = %s, want %s", lines[0], want)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// baselineSource provides the organizations a user is known to belong to according to an
+// external source of truth, such as an identity provider export. When configured, the baseline
+// replaces the stream's old image as the current state that desired organizations are diffed
+// against.
+type baselineSource interface {
+	// LoadBaseline returns the baseline organizations for userPK. ok is false when the baseline
+	// has no entry for the user.
+	LoadBaseline(ctx context.Context, userPK string) (orgs []string, ok bool, err error)
+}
+
+// tableBaseline is a baselineSource backed by a DynamoDB table holding one item per user, keyed
+// by pk, with an "organizations" attribute in the same List or Map shape as the users table.
+type tableBaseline struct {
+	client    dynamoDBClient
+	tableName string
+}
+
+// LoadBaseline implements baselineSource.
+func (b *tableBaseline) LoadBaseline(ctx context.Context, userPK string) ([]string, bool, error) {
+	out, err := b.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(b.tableName),
+		Key: map[string]types.AttributeValue{
+			"pk": &types.AttributeValueMemberS{Value: userPK},
+		},
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	if out == nil || len(out.Item) == 0 {
+		return nil, false, nil
+	}
+
+	orgs, _ := extractOrganizations(map[string]events.DynamoDBAttributeValue{defaultOrgAttribute: fromAttributeValue(out.Item[defaultOrgAttribute])}, defaultOrgAttribute)
+	return orgs, true, nil
+}
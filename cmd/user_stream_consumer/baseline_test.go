@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Test_tableBaseline verifies baseline organizations are read from the baseline table by pk
+func Test_tableBaseline(t *testing.T) {
+	tests := []struct {
+		name     string
+		item     map[string]types.AttributeValue
+		getErr   error
+		wantOrgs []string
+		wantOK   bool
+		wantErr  bool
+	}{
+		{
+			name: "list organizations",
+			item: map[string]types.AttributeValue{
+				"pk": &types.AttributeValueMemberS{Value: "USER#123"},
+				"organizations": &types.AttributeValueMemberL{Value: []types.AttributeValue{
+					&types.AttributeValueMemberS{Value: "org1"},
+					&types.AttributeValueMemberS{Value: "org2"},
+				}},
+			},
+			wantOrgs: []string{"org1", "org2"},
+			wantOK:   true,
+		},
+		{
+			name:     "entry without organizations",
+			item:     map[string]types.AttributeValue{"pk": &types.AttributeValueMemberS{Value: "USER#123"}},
+			wantOrgs: nil,
+			wantOK:   true,
+		},
+		{
+			name:   "no entry for user",
+			wantOK: false,
+		},
+		{
+			name:    "read failure",
+			getErr:  errors.New("simulated throttling"),
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &mockDynamoDBClient{
+				getItemFunc: func(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+					if *params.TableName != "baseline-table" {
+						t.Errorf("expected GetItem on baseline-table, got %s", *params.TableName)
+					}
+					if pk := params.Key["pk"].(*types.AttributeValueMemberS).Value; pk != "USER#123" {
+						t.Errorf("expected key pk USER#123, got %s", pk)
+					}
+					if tt.getErr != nil {
+						return nil, tt.getErr
+					}
+					return &dynamodb.GetItemOutput{Item: tt.item}, nil
+				},
+			}
+
+			b := &tableBaseline{client: client, tableName: "baseline-table"}
+			orgs, ok, err := b.LoadBaseline(context.Background(), "USER#123")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadBaseline() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if ok != tt.wantOK || !reflect.DeepEqual(orgs, tt.wantOrgs) {
+				t.Errorf("LoadBaseline() = %v, %v, want %v, %v", orgs, ok, tt.wantOrgs, tt.wantOK)
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"sort"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// coalescedRun is a run of MODIFY records for one user item that is applied once, by the record
+// with the latest sequence number.
+type coalescedRun struct {
+	oldImage map[string]events.DynamoDBAttributeValue // Old image of the run's earliest record
+	skipped  []string                                 // Message IDs of the run's other records, in sequence order
+}
+
+// planCoalescing finds runs of MODIFY records for the same user item within a batch and plans
+// for each to be applied as a single net change, from the earliest record's old image to the
+// latest record's new image, so organizations changed and changed back within a batch are not
+// deleted and re-added. Only records with a message ID, an inline body and both images are
+// coalesced. Any other record ends its item's run, and a record that cannot be decoded here
+// could belong to any user, so it ends every run.
+func (p *processor) planCoalescing(ctx context.Context, inv *invocation, records []events.SQSMessage) {
+	type member struct {
+		messageID string
+		der       events.DynamoDBEventRecord
+	}
+	runs := make(map[string][]member)
+	flush := func(key string) {
+		run := runs[key]
+		delete(runs, key)
+		if len(run) < 2 {
+			return
+		}
+		sort.SliceStable(run, func(i, j int) bool {
+			return compareSequenceNumbers(run[i].der.Change.SequenceNumber, run[j].der.Change.SequenceNumber) < 0
+		})
+		latest := run[len(run)-1]
+		planned := coalescedRun{oldImage: run[0].der.Change.OldImage}
+		for _, m := range run[:len(run)-1] {
+			planned.skipped = append(planned.skipped, m.messageID)
+			inv.coalescedInto[m.messageID] = latest.messageID
+		}
+		inv.coalesced[latest.messageID] = planned
+		p.logger.DebugContext(ctx, "coalescing modify records",
+			slog.String("messageId", latest.messageID),
+			slog.String("userKey", recordUserKey(latest.der)),
+			slog.Int("records", len(run)))
+	}
+
+	for _, record := range records {
+		der, ok := inlineRecord(record)
+		if !ok {
+			for key := range runs {
+				flush(key)
+			}
+			continue
+		}
+		userKey := recordUserKey(der)
+		key := userKey + "\x00" + recordUserSK(der)
+		if record.MessageId == "" || userKey == "" || der.EventName != string(events.DynamoDBOperationTypeModify) || der.Change.OldImage == nil || der.Change.NewImage == nil {
+			flush(key)
+			continue
+		}
+		runs[key] = append(runs[key], member{messageID: record.MessageId, der: der})
+	}
+	for key := range runs {
+		flush(key)
+	}
+}
+
+// inlineRecord decodes a message body carried inline, without reading offloaded bodies or
+// backfilling images. ok is false when the body cannot be decoded this way.
+func inlineRecord(record events.SQSMessage) (der events.DynamoDBEventRecord, ok bool) {
+	if _, offloaded := parseS3Pointer(record.Body); offloaded {
+		return der, false
+	}
+	body, err := decodeBody(record)
+	if err != nil {
+		return der, false
+	}
+	if err := json.Unmarshal(body, &der); err != nil {
+		return der, false
+	}
+	der.EventName = normalizeEventName(der.EventName)
+	return der, true
+}
+
+// itemFailures returns the batch item failures for a failed message. Messages coalesced into it
+// fail with it, since their changes are only applied through it.
+func itemFailures(inv *invocation, messageID string) []events.SQSBatchItemFailure {
+	failures := []events.SQSBatchItemFailure{{ItemIdentifier: messageID}}
+	for _, skipped := range inv.coalesced[messageID].skipped {
+		failures = append(failures, events.SQSBatchItemFailure{ItemIdentifier: skipped})
+	}
+	return failures
+}
+
+// dedupeItemFailures drops repeated batch item failures for the same message, keeping the first.
+func dedupeItemFailures(failures []events.SQSBatchItemFailure) []events.SQSBatchItemFailure {
+	seen := make(map[string]struct{}, len(failures))
+	deduped := failures[:0]
+	for _, f := range failures {
+		if _, ok := seen[f.ItemIdentifier]; ok {
+			continue
+		}
+		seen[f.ItemIdentifier] = struct{}{}
+		deduped = append(deduped, f)
+	}
+	return deduped
+}
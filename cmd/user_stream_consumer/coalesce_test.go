@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+)
+
+// coalesceBatch is two MODIFY records for the same user, org1 to org2 and then org2 to org3,
+// with another user's record between them.
+var coalesceBatch = events.SQSEvent{Records: []events.SQSMessage{
+	{MessageId: "first", Body: `{"eventName": "MODIFY", "dynamodb": {"SequenceNumber": "100",
+		"OldImage": {"pk": {"S": "USER#123"}, "organizations": {"L": [{"S": "org1"}]}},
+		"NewImage": {"pk": {"S": "USER#123"}, "organizations": {"L": [{"S": "org2"}]}}}}`},
+	{MessageId: "other", Body: `{"eventName": "INSERT", "dynamodb": {"SequenceNumber": "150",
+		"NewImage": {"pk": {"S": "USER#456"}, "organizations": {"L": [{"S": "org9"}]}}}}`},
+	{MessageId: "second", Body: `{"eventName": "MODIFY", "dynamodb": {"SequenceNumber": "200",
+		"OldImage": {"pk": {"S": "USER#123"}, "organizations": {"L": [{"S": "org2"}]}},
+		"NewImage": {"pk": {"S": "USER#123"}, "organizations": {"L": [{"S": "org3"}]}}}}`},
+}}
+
+// Test_handler_coalesceModifies verifies two MODIFY records for one user in a batch are applied
+// as a single net diff from the first old image to the last new image
+func Test_handler_coalesceModifies(t *testing.T) {
+	type write struct {
+		pk     string
+		delete bool
+	}
+	var writes [][]write
+	client := &mockDynamoDBClient{batchWriteItemFunc: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+		var call []write
+		for _, req := range params.RequestItems["test-table"] {
+			if req.DeleteRequest != nil {
+				call = append(call, write{req.DeleteRequest.Key["pk"].(*types.AttributeValueMemberS).Value, true})
+				continue
+			}
+			call = append(call, write{req.PutRequest.Item["pk"].(*types.AttributeValueMemberS).Value, false})
+		}
+		writes = append(writes, call)
+		return &dynamodb.BatchWriteItemOutput{}, nil
+	}}
+
+	p := newProcessor(slog.New(slog.NewJSONHandler(io.Discard, nil)), client, nil, nil, nil, mustLoadConfig(t, testEnv(map[string]string{"TABLE_NAME": "test-table", "COALESCE_MODIFIES": "true"})), fixedClock)
+	res, response, err := p.processBatch(context.Background(), coalesceBatch)
+	if err != nil {
+		t.Fatalf("processBatch() unexpected error = %v", err)
+	}
+	if len(response.BatchItemFailures) != 0 {
+		t.Errorf("expected no batch item failures, got %v", response.BatchItemFailures)
+	}
+
+	want := [][]write{
+		{{"ORGANIZATION#org9", false}},
+		{{"ORGANIZATION#org1", true}, {"ORGANIZATION#org3", false}},
+	}
+	if !reflect.DeepEqual(writes, want) {
+		t.Errorf("writes = %v, want %v", writes, want)
+	}
+	if res.Processed != 3 || res.Adds != 2 || res.Removes != 1 {
+		t.Errorf("unexpected result %+v", res)
+	}
+}
+
+// Test_handler_coalesceModifies_failure verifies the records coalesced into a failed record are
+// retried with it
+func Test_handler_coalesceModifies_failure(t *testing.T) {
+	client := &mockDynamoDBClient{batchWriteItemFunc: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+		// Only the coalesced write carries a delete.
+		for _, req := range params.RequestItems["test-table"] {
+			if req.DeleteRequest != nil {
+				return nil, errors.New("simulated outage")
+			}
+		}
+		return &dynamodb.BatchWriteItemOutput{}, nil
+	}}
+
+	env := testEnv(map[string]string{"TABLE_NAME": "test-table", "COALESCE_MODIFIES": "true", "FAILURE_MODE": "best_effort"})
+	p := newProcessor(slog.New(slog.NewJSONHandler(io.Discard, nil)), client, nil, nil, nil, mustLoadConfig(t, env), fixedClock)
+	_, response, err := p.processBatch(context.Background(), coalesceBatch)
+	if err != nil {
+		t.Fatalf("processBatch() unexpected error = %v", err)
+	}
+
+	var failed []string
+	for _, f := range response.BatchItemFailures {
+		failed = append(failed, f.ItemIdentifier)
+	}
+	sort.Strings(failed)
+	if want := []string{"first", "second"}; !reflect.DeepEqual(failed, want) {
+		t.Errorf("failed messages = %v, want %v", failed, want)
+	}
+}
+
+// Test_handler_coalesceModifies_deadLetter verifies the records coalesced into a dead-lettered
+// record are dead-lettered with it, ahead of it, rather than acknowledged
+func Test_handler_coalesceModifies_deadLetter(t *testing.T) {
+	client := &mockDynamoDBClient{batchWriteItemFunc: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+		return &dynamodb.BatchWriteItemOutput{}, nil
+	}}
+	var sent []string
+	dlq := &mockSQSClient{sendMessageFunc: func(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error) {
+		sent = append(sent, *params.MessageBody)
+		return &sqs.SendMessageOutput{}, nil
+	}}
+
+	env := testEnv(map[string]string{"TABLE_NAME": "test-table", "COALESCE_MODIFIES": "true", "DLQ_URL": "https://sqs.us-east-1.amazonaws.com/123456789012/user-dynamo-stream-deadletter"})
+	p := newProcessor(slog.New(slog.NewJSONHandler(io.Discard, nil)), client, dlq, nil, nil, mustLoadConfig(t, env), fixedClock)
+	p.process = func(ctx context.Context, inv *invocation, record events.SQSMessage) error {
+		if record.MessageId == "second" {
+			return &permanentError{err: errors.New("simulated permanent failure")}
+		}
+		return p.processRecord(ctx, inv, record)
+	}
+	_, response, err := p.processBatch(context.Background(), coalesceBatch)
+	if err != nil {
+		t.Fatalf("processBatch() unexpected error = %v", err)
+	}
+
+	if len(response.BatchItemFailures) != 0 {
+		t.Errorf("expected no batch item failures, got %v", response.BatchItemFailures)
+	}
+	if want := []string{coalesceBatch.Records[0].Body, coalesceBatch.Records[2].Body}; !reflect.DeepEqual(sent, want) {
+		t.Errorf("dead-lettered %v, want %v", sent, want)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// sequenceAttribute is the membership attribute SEQUENCE_CONDITIONS stamps with the sequence
+// number of the stream record that last wrote the item.
+const sequenceAttribute = "sequenceNumber"
+
+// sequenceWidth is the maximum length of a DynamoDB stream sequence number. Stamped sequence
+// numbers are zero padded to it, so DynamoDB's lexical string comparison orders them
+// numerically.
+const sequenceWidth = 40
+
+// tombstoneAttribute marks a membership deleted under SEQUENCE_CONDITIONS. The delete is written
+// as a tombstone carrying the delete's sequence number instead of removing the item, so an
+// older put redelivered afterwards still has a sequence number to fail against. Readers of the
+// membership and reverse index tables skip items that carry it.
+const tombstoneAttribute = "deleted"
+
+// sequenceCondition lets a write through when the item does not exist, was written without a
+// stamped sequence number, or was last written by a record no later than the incoming one.
+const sequenceCondition = "attribute_not_exists(#seq) OR #seq <= :seq"
+
+// conditionalWriteMemberships writes the membership requests, and the reverse index requests
+// when present, one PutItem or DeleteItem call at a time, conditioned on the sequence number of
+// the record they come from. Puts stamp the record's sequence number on the item, and deletes
+// replace the item with a tombstone stamped the same way; see tombstoneAttribute. A write whose
+// condition fails was overtaken by a later record for the same membership, such as when an
+// older record is redelivered after a newer one was applied, or after the membership was
+// deleted, so it is skipped as already superseded and counted as StaleWritesSkipped. Records
+// without a sequence number, such as replayed or exported items, are written unconditionally
+// and their deletes remove the item. The skipped membership requests are returned.
+func (p *processor) conditionalWriteMemberships(ctx context.Context, inv *invocation, writeRequests, reverseRequests []types.WriteRequest, sequenceNumber string) ([]types.WriteRequest, error) {
+	var seq string
+	if sequenceNumber != "" {
+		seq = padSequenceNumber(sequenceNumber)
+	}
+
+	requestItems := map[string][]types.WriteRequest{p.tableName: writeRequests}
+	if len(reverseRequests) > 0 {
+		requestItems[p.reverseIndexTable] = reverseRequests
+	}
+	p.logger.InfoContext(ctx, "conditionally writing organization memberships",
+		slog.String("table", p.tableName),
+		slog.String("sequenceNumber", sequenceNumber),
+		slog.Int("requestCount", countRequests(requestItems)))
+
+	var skipped []types.WriteRequest
+	for _, table := range []string{p.tableName, p.reverseIndexTable} {
+		requests, dropped := dedupeWriteRequests(requestItems[table])
+		if dropped > 0 {
+			inv.metrics.increment("DedupedWrites", dropped)
+		}
+		for _, req := range requests {
+			written, err := p.conditionalWrite(ctx, inv, table, req, seq)
+			if err != nil {
+				return nil, err
+			}
+			if !written && table == p.tableName {
+				skipped = append(skipped, req)
+			}
+		}
+	}
+	return skipped, nil
+}
+
+// conditionalWrite makes a single conditional PutItem or DeleteItem call for a write request,
+// reporting whether it was written rather than skipped as superseded. An empty seq writes
+// unconditionally.
+func (p *processor) conditionalWrite(ctx context.Context, inv *invocation, table string, req types.WriteRequest, seq string) (bool, error) {
+	var (
+		condition *string
+		names     map[string]string
+		values    map[string]types.AttributeValue
+	)
+	if seq != "" {
+		condition = aws.String(sequenceCondition)
+		names = map[string]string{"#seq": sequenceAttribute}
+		values = map[string]types.AttributeValue{":seq": &types.AttributeValueMemberS{Value: seq}}
+	}
+
+	if p.writeLimiter != nil {
+		if err := p.writeLimiter.Wait(ctx); err != nil {
+			return false, fmt.Errorf("failed to wait for write capacity: %w", err)
+		}
+	}
+	if err := p.acquireWriteSlot(ctx); err != nil {
+		return false, fmt.Errorf("failed to wait for an in-flight write slot: %w", err)
+	}
+	defer p.releaseWriteSlot()
+	inv.metrics.increment("ConditionalWriteCalls", 1)
+	inv.metrics.increment("WriteRequestsTotal", 1)
+	var err error
+	switch {
+	case req.DeleteRequest != nil && seq != "":
+		tombstone := maps.Clone(req.DeleteRequest.Key)
+		tombstone[sequenceAttribute] = &types.AttributeValueMemberS{Value: seq}
+		tombstone[tombstoneAttribute] = &types.AttributeValueMemberBOOL{Value: true}
+		_, err = p.client.PutItem(ctx, &dynamodb.PutItemInput{
+			TableName:                 aws.String(table),
+			Item:                      tombstone,
+			ConditionExpression:       condition,
+			ExpressionAttributeNames:  names,
+			ExpressionAttributeValues: values,
+		})
+		if err == nil {
+			inv.metrics.increment("TombstonesWritten", 1)
+		}
+	case req.DeleteRequest != nil:
+		_, err = p.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+			TableName:                 aws.String(table),
+			Key:                       req.DeleteRequest.Key,
+			ConditionExpression:       condition,
+			ExpressionAttributeNames:  names,
+			ExpressionAttributeValues: values,
+		})
+	default:
+		item := req.PutRequest.Item
+		if seq != "" {
+			item = maps.Clone(item)
+			item[sequenceAttribute] = &types.AttributeValueMemberS{Value: seq}
+		}
+		_, err = p.client.PutItem(ctx, &dynamodb.PutItemInput{
+			TableName:                 aws.String(table),
+			Item:                      item,
+			ConditionExpression:       condition,
+			ExpressionAttributeNames:  names,
+			ExpressionAttributeValues: values,
+		})
+	}
+
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		inv.metrics.increment("StaleWritesSkipped", 1)
+		pk, sk, _ := strings.Cut(writeRequestKey(req), "\x00")
+		p.logger.InfoContext(ctx, "skipping membership write superseded by a later record",
+			slog.String("table", table),
+			slog.String("pk", pk),
+			slog.String("sk", sk))
+		return false, nil
+	}
+	if err != nil {
+		p.logger.ErrorContext(ctx, "failed to conditionally write membership",
+			slog.String("error", err.Error()),
+			slog.String("table", table))
+		return false, fmt.Errorf("failed to conditionally write organization membership: %w", err)
+	}
+	return true, nil
+}
+
+// padSequenceNumber left pads a sequence number with zeros to sequenceWidth.
+func padSequenceNumber(sequenceNumber string) string {
+	if len(sequenceNumber) >= sequenceWidth {
+		return sequenceNumber
+	}
+	return strings.Repeat("0", sequenceWidth-len(sequenceNumber)) + sequenceNumber
+}
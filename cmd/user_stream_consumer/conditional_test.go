@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// sequenceItem is the stamped sequence number of a membership in a sequenceTable, and whether
+// it is a tombstone.
+type sequenceItem struct {
+	seq     string
+	deleted bool
+}
+
+// sequenceTable is an in-memory membership table that evaluates sequenceCondition the way
+// DynamoDB would, keyed by pk.
+type sequenceTable map[string]sequenceItem
+
+func (s sequenceTable) allowed(pk string, values map[string]types.AttributeValue) bool {
+	stored, ok := s[pk]
+	return !ok || values == nil || stored.seq <= values[":seq"].(*types.AttributeValueMemberS).Value
+}
+
+func (s sequenceTable) client(t *testing.T) *mockDynamoDBClient {
+	return &mockDynamoDBClient{
+		batchWriteItemFunc: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+			t.Error("BatchWriteItem should not be called with SEQUENCE_CONDITIONS")
+			return &dynamodb.BatchWriteItemOutput{}, nil
+		},
+		putItemFunc: func(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+			pk := params.Item["pk"].(*types.AttributeValueMemberS).Value
+			if !s.allowed(pk, params.ExpressionAttributeValues) {
+				return nil, &types.ConditionalCheckFailedException{}
+			}
+			_, deleted := params.Item[tombstoneAttribute]
+			s[pk] = sequenceItem{seq: params.Item[sequenceAttribute].(*types.AttributeValueMemberS).Value, deleted: deleted}
+			return &dynamodb.PutItemOutput{}, nil
+		},
+		deleteItemFunc: func(ctx context.Context, params *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error) {
+			pk := params.Key["pk"].(*types.AttributeValueMemberS).Value
+			if !s.allowed(pk, params.ExpressionAttributeValues) {
+				return nil, &types.ConditionalCheckFailedException{}
+			}
+			delete(s, pk)
+			return &dynamodb.DeleteItemOutput{}, nil
+		},
+	}
+}
+
+// sequenceRecord is a message whose record moves USER#123 from the old to the new organizations.
+func sequenceRecord(messageID, eventName, sequenceNumber, oldOrgs, newOrgs string) events.SQSMessage {
+	body := `{"eventName": "` + eventName + `", "dynamodb": {"SequenceNumber": "` + sequenceNumber + `"`
+	if oldOrgs != "" {
+		body += `, "OldImage": {"pk": {"S": "USER#123"}, "organizations": {"L": [` + oldOrgs + `]}}`
+	}
+	return events.SQSMessage{MessageId: messageID, Body: body + `, "NewImage": {"pk": {"S": "USER#123"}, "organizations": {"L": [` + newOrgs + `]}}}}`}
+}
+
+// Test_handler_sequenceConditions verifies memberships are stamped with the sequence number of
+// the record that wrote them, deletes leave stamped tombstones, and a redelivered older record
+// cannot overwrite a newer one or bring back a deleted membership
+func Test_handler_sequenceConditions(t *testing.T) {
+	tests := []struct {
+		name        string
+		records     []events.SQSMessage
+		wantTable   sequenceTable
+		wantReplica []string // Membership writes forwarded to the replica, as put or delete and pk
+		wantSkipped int
+	}{
+		{
+			name: "in order",
+			records: []events.SQSMessage{
+				sequenceRecord("insert", "INSERT", "100", "", `{"S": "org1"}`),
+				sequenceRecord("modify", "MODIFY", "200", `{"S": "org1"}`, `{"S": "org2"}`),
+			},
+			wantTable: sequenceTable{
+				"ORGANIZATION#org1": {seq: padSequenceNumber("200"), deleted: true},
+				"ORGANIZATION#org2": {seq: padSequenceNumber("200")},
+			},
+			wantReplica: []string{"put ORGANIZATION#org1", "delete ORGANIZATION#org1", "put ORGANIZATION#org2"},
+		},
+		{
+			name: "out of order",
+			records: []events.SQSMessage{
+				sequenceRecord("modify", "MODIFY", "200", `{"S": "org2"}`, `{"S": "org1"}`),
+				sequenceRecord("insert", "INSERT", "100", "", `{"S": "org1"}`),
+			},
+			wantTable: sequenceTable{
+				"ORGANIZATION#org1": {seq: padSequenceNumber("200")},
+				"ORGANIZATION#org2": {seq: padSequenceNumber("200"), deleted: true},
+			},
+			wantReplica: []string{"delete ORGANIZATION#org2", "put ORGANIZATION#org1"},
+			wantSkipped: 1,
+		},
+		{
+			name: "delete then older put",
+			records: []events.SQSMessage{
+				sequenceRecord("delete", "MODIFY", "2", `{"S": "org1"}`, ""),
+				sequenceRecord("put", "INSERT", "1", "", `{"S": "org1"}`),
+			},
+			wantTable:   sequenceTable{"ORGANIZATION#org1": {seq: padSequenceNumber("2"), deleted: true}},
+			wantReplica: []string{"delete ORGANIZATION#org1"},
+			wantSkipped: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			table := sequenceTable{}
+			var replicated []string
+			replicas := []replica{{region: "us-west-2", tableName: "orgs-west", client: &mockDynamoDBClient{
+				batchWriteItemFunc: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+					for _, req := range params.RequestItems["orgs-west"] {
+						pk, _, _ := strings.Cut(writeRequestKey(req), "\x00")
+						if req.DeleteRequest != nil {
+							replicated = append(replicated, "delete "+pk)
+						} else {
+							replicated = append(replicated, "put "+pk)
+						}
+					}
+					return &dynamodb.BatchWriteItemOutput{}, nil
+				},
+			}}}
+			var buf bytes.Buffer
+			env := testEnv(map[string]string{"TABLE_NAME": "test-table", "SEQUENCE_CONDITIONS": "true"})
+			h := handler(slog.New(slog.NewJSONHandler(&buf, nil)), table.client(t), nil, nil, replicas, mustLoadConfig(t, env), fixedClock, nil)
+			// Each record arrives in its own invocation, as a redelivery would.
+			for _, record := range tt.records {
+				response, err := h(context.Background(), events.SQSEvent{Records: []events.SQSMessage{record}})
+				if err != nil {
+					t.Fatalf("handler() unexpected error = %v", err)
+				}
+				if len(response.BatchItemFailures) != 0 {
+					t.Fatalf("expected no batch item failures, got %v", response.BatchItemFailures)
+				}
+			}
+
+			if !reflect.DeepEqual(table, tt.wantTable) {
+				t.Errorf("table = %v, want %v", table, tt.wantTable)
+			}
+			if !reflect.DeepEqual(replicated, tt.wantReplica) {
+				t.Errorf("replicated %v, want %v", replicated, tt.wantReplica)
+			}
+			var skipped int
+			for _, entry := range findLogs(parseLogs(t, &buf), "metrics") {
+				if n, ok := entry["StaleWritesSkipped"].(float64); ok {
+					skipped += int(n)
+				}
+			}
+			if skipped != tt.wantSkipped {
+				t.Errorf("expected StaleWritesSkipped %d, got %d", tt.wantSkipped, skipped)
+			}
+		})
+	}
+}
+
+// Test_padSequenceNumber verifies padded sequence numbers sort lexically in numeric order
+func Test_padSequenceNumber(t *testing.T) {
+	seqs := []string{padSequenceNumber("1000"), padSequenceNumber("999"), padSequenceNumber("4100000000000000000000000001")}
+	sort.Strings(seqs)
+	want := []string{padSequenceNumber("999"), padSequenceNumber("1000"), padSequenceNumber("4100000000000000000000000001")}
+	if !reflect.DeepEqual(seqs, want) {
+		t.Errorf("sorted = %v, want %v", seqs, want)
+	}
+	if n := len(padSequenceNumber("999")); n != sequenceWidth {
+		t.Errorf("expected padded length %d, got %d", sequenceWidth, n)
+	}
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultTableName is the organizations table written to unless TABLE_NAME overrides it.
+const defaultTableName = "poc-organizations"
+
+// environmentLocal is the ENVIRONMENT of a developer's machine, where only tables named with the
+// allowed local prefix may be written to.
+const environmentLocal = "local"
+
+// defaultAllowedTablePrefix is the prefix local tables must carry unless ALLOWED_TABLE_PREFIX
+// overrides it.
+const defaultAllowedTablePrefix = "local-"
+
+// config holds every option read from the environment, parsed and validated once at startup.
+// The zero value of an option leaves its feature disabled unless noted otherwise.
+type config struct {
+	// Logging
+	LogFormat   string // "json" or "text"; anything else logs JSON
+	LogLevel    string // Minimum level logged; anything unrecognised logs info
+	MaxLogItems int    // Write requests logged per table in the debug batch write input; zero logs them all
+	RedactEmail bool   // Mask email addresses in logged user data
+
+	// AWS clients
+	SDKMaxRetries         int    // SDK retries per call; negative keeps the SDK default
+	AssumeRoleARN         string // Role assumed for DynamoDB calls; empty uses the function's credentials
+	AssumeRoleSessionName string // Session name used when assuming AssumeRoleARN
+	ReplicaTables         string // Comma-separated region=table pairs membership writes are fanned out to
+	ValidateStreamTable   string // Users table whose stream view type is checked at startup
+	DLQURL                string // Queue permanently failing records are sent to
+	SNSTopicARN           string // Topic a message is published to for every membership change
+
+	// Run modes
+	Environment        string        // Deployment environment, such as environmentLocal
+	AllowedTablePrefix string        // Prefix every written table must carry when Environment is environmentLocal
+	ReplayFile         string        // Event records replayed instead of starting the runtime; "-" reads stdin
+	ExportFile         string        // DynamoDB table export items processed as INSERT records instead of starting the runtime; "-" reads stdin
+	PollMode           bool          // Consume QueueURL directly instead of starting the runtime
+	QueueURL           string        // Queue consumed in poll mode
+	HeartbeatInterval  time.Duration // How often poll mode extends the visibility of a batch in flight
+	DryRun             bool          // Compute membership writes without making them
+	DryRunOutput       string        // File the computed writes are appended to in a dry run
+
+	// Membership records
+	TableName          string              // Organizations table memberships are written to
+	TableNameParam     string              // SSM parameter TableName is read from at startup, overriding TABLE_NAME
+	OrgPKPrefix        string              // Prefix of the organization ID in membership partition keys
+	EncodeIDs          bool                // Encode organization and user IDs in membership keys
+	AppNamespace       string              // Namespace in membership sort keys
+	OrgAttribute       string              // User image attribute organizations are read from
+	RoleMemberships    bool                // Write a membership per role of each organization
+	UserIDAttribute    string              // User image attribute the user ID is read from instead of the pk
+	DeleteFlag         string              // Boolean user attribute that marks a MODIFY as a soft delete
+	SourceTableName    string              // Users table read to backfill KEYS_ONLY records
+	ReverseIndexTable  string              // Table user-to-organization records are written to
+	ReconcileRemoves   bool                // Query the reverse index for REMOVE records without organizations
+	TransactWrites     bool                // Write forward and reverse records in transactions
+	WriteAPI           string              // writeAPIBatch or writeAPIPartiQL
+	SequenceConditions bool                // Condition each membership write on the record's sequence number
+	SeparatePasses     bool                // Batch write all deletes before any puts
+	GSIKeys            bool                // Write GSI key attributes on membership items
+	NormalizeOrgs      bool                // Trim whitespace from organization IDs
+	LowercaseOrgs      bool                // Lowercase organization IDs
+	Versions           bool                // Write a version attribute on membership items
+	TimePrefixSK       bool                // Prefix membership sort keys with the join time
+	IncludeUserSK      bool                // Append the user's sort key to membership sort keys
+	SourceTag          string              // Written as source on membership items
+	OwnedDeletes       bool                // Only delete memberships whose source is SourceTag
+	ProjectAttributes  []string            // User attributes copied onto membership puts
+	WatchAttributes    []string            // User attributes whose changes are reported to the attribute change hook
+	OrgAllowlist       map[string]struct{} // Organizations memberships are maintained for; empty maintains all
+	EventTypes         map[string]struct{} // Event names that are processed; empty processes all
+	BaselineSource     string              // Table diffed against instead of the old image
+	IdempotencyTable   string              // Table processed EventIDs are recorded in
+
+	// Write tuning
+	MaxWritesPerSec     float64       // Cap on BatchWriteItem calls per second; zero is unlimited
+	MaxInflightWrites   int           // Cap on concurrent BatchWriteItem calls; zero is unlimited
+	FlushThreshold      int           // Requests per BatchWriteItem call, from 1 to maxBatchWriteItems
+	RetryBudget         int           // Unprocessed item retries allowed per invocation
+	AdaptiveBackoffBase time.Duration // Write delay after the first throttled call of an invocation
+	AdaptiveBackoffMax  time.Duration // Cap on the adaptive write delay; zero disables adaptive backoff
+	LatencyFirstCalls   bool          // Observe BatchWriteLatencyMillis for a chunk's first call only, excluding retries
+
+	// Failure handling
+	FailureMode         string        // failureModeFailFast or failureModeBestEffort
+	MaxFailureRatio     float64       // Fraction of failing records above which the whole batch fails; zero disables it
+	IngestLatencyWarn   time.Duration // Ingest latency above which a record is logged as slow; zero disables it
+	MaxBatchSize        int           // Records per invocation above which a warning is logged; zero disables it
+	CheckSequence       bool          // Warn when a user's records arrive out of sequence number order
+	SortBySequence      bool          // Process a batch's records in stream sequence number order
+	CoalesceModifies    bool          // Apply each run of MODIFY records for a user item in a batch as one net change
+	PerOrgMetrics       bool          // Emit membership change metrics dimensioned by organization
+	AuditEvents         bool          // Log an audit event for every membership change
+	AuditOutput         string        // File an audit line for every membership change is appended to
+	SNSFailOnError      bool          // Fail the record when a membership change cannot be published
+	SNSMaxPublishPerSec float64       // Cap on SNS publishes per second; zero is unlimited
+	CheckRemovals       bool          // Check removals against the last known organization count
+	RemovalSanityMargin int           // Removals allowed beyond the known organization count
+}
+
+// loadConfig reads every option through getenv, applying defaults for unset options. Invalid
+// values, and options that need another option to take effect, are all reported together in
+// the returned error rather than one at a time.
+func loadConfig(getenv func(string) string) (config, error) {
+	cfg := config{
+		LogFormat:             getenv("LOG_FORMAT"),
+		LogLevel:              getenv("LOG_LEVEL"),
+		RedactEmail:           getenv("REDACT_EMAIL") == "true",
+		SDKMaxRetries:         -1,
+		AssumeRoleARN:         getenv("ASSUME_ROLE_ARN"),
+		AssumeRoleSessionName: getenv("ASSUME_ROLE_SESSION_NAME"),
+		ReplicaTables:         getenv("REPLICA_TABLES"),
+		ValidateStreamTable:   getenv("VALIDATE_STREAM_TABLE"),
+		DLQURL:                getenv("DLQ_URL"),
+		SNSTopicARN:           getenv("SNS_TOPIC_ARN"),
+		Environment:           getenv("ENVIRONMENT"),
+		AllowedTablePrefix:    getenv("ALLOWED_TABLE_PREFIX"),
+		ReplayFile:            getenv("REPLAY_FILE"),
+		ExportFile:            getenv("EXPORT_FILE"),
+		PollMode:              getenv("POLL_MODE") == "true",
+		QueueURL:              getenv("QUEUE_URL"),
+		DryRun:                getenv("DRY_RUN") == "true",
+		DryRunOutput:          getenv("DRY_RUN_OUTPUT"),
+		TableName:             getenv("TABLE_NAME"),
+		TableNameParam:        getenv("TABLE_NAME_PARAM"),
+		OrgPKPrefix:           getenv("ORG_PK_PREFIX"),
+		EncodeIDs:             getenv("ENCODE_IDS") == "true",
+		AppNamespace:          getenv("APP_NAMESPACE"),
+		OrgAttribute:          getenv("ORG_ATTRIBUTE_NAME"),
+		UserIDAttribute:       getenv("USER_ID_ATTRIBUTE"),
+		RoleMemberships:       getenv("ROLE_MEMBERSHIPS") == "true",
+		DeleteFlag:            getenv("DELETE_FLAG_ATTRIBUTE"),
+		SourceTableName:       getenv("SOURCE_TABLE_NAME"),
+		ReverseIndexTable:     getenv("REVERSE_INDEX_TABLE"),
+		ReconcileRemoves:      getenv("RECONCILE_REMOVES") == "true",
+		TransactWrites:        getenv("TRANSACT_WRITES") == "true",
+		WriteAPI:              getenv("WRITE_API"),
+		SequenceConditions:    getenv("SEQUENCE_CONDITIONS") == "true",
+		SeparatePasses:        getenv("SEPARATE_PUT_DELETE_PASSES") == "true",
+		GSIKeys:               getenv("WRITE_GSI_KEYS") == "true",
+		NormalizeOrgs:         getenv("NORMALIZE_ORG_IDS") == "true",
+		LowercaseOrgs:         getenv("LOWERCASE_ORG_IDS") == "true",
+		Versions:              getenv("WRITE_VERSION") == "true",
+		TimePrefixSK:          getenv("SK_TIME_PREFIX") == "true",
+		IncludeUserSK:         getenv("INCLUDE_USER_SK") == "true",
+		SourceTag:             getenv("SOURCE_TAG"),
+		OwnedDeletes:          getenv("OWNED_DELETES") == "true",
+		ProjectAttributes:     splitList(getenv("PROJECT_ATTRIBUTES")),
+		WatchAttributes:       splitList(getenv("WATCH_ATTRIBUTES")),
+		OrgAllowlist:          parseAllowlist(getenv("ORG_ALLOWLIST")),
+		EventTypes:            parseAllowlist(getenv("EVENT_TYPES")),
+		BaselineSource:        getenv("BASELINE_SOURCE"),
+		IdempotencyTable:      getenv("IDEMPOTENCY_TABLE"),
+		PerOrgMetrics:         getenv("PER_ORG_METRICS") == "true",
+		FlushThreshold:        maxBatchWriteItems,
+		RetryBudget:           defaultRetryBudget,
+		MaxBatchSize:          defaultMaxBatchSize,
+		AdaptiveBackoffBase:   defaultAdaptiveBackoffBase,
+		FailureMode:           getenv("FAILURE_MODE"),
+		LatencyFirstCalls:     getenv("LATENCY_EXCLUDE_RETRIES") == "true",
+		CheckSequence:         getenv("CHECK_SEQUENCE_ORDER") == "true",
+		SortBySequence:        getenv("SORT_BY_SEQUENCE") == "true",
+		CoalesceModifies:      getenv("COALESCE_MODIFIES") == "true",
+		AuditEvents:           getenv("AUDIT_EVENTS") == "true",
+		AuditOutput:           getenv("AUDIT_OUTPUT"),
+		SNSFailOnError:        getenv("SNS_FAIL_ON_ERROR") == "true",
+	}
+	if cfg.TableName == "" {
+		cfg.TableName = defaultTableName
+	}
+	if cfg.OrgPKPrefix == "" {
+		cfg.OrgPKPrefix = defaultOrgPKPrefix
+	}
+	if cfg.OrgAttribute == "" {
+		cfg.OrgAttribute = defaultOrgAttribute
+	}
+	if cfg.AssumeRoleSessionName == "" {
+		cfg.AssumeRoleSessionName = defaultAssumeRoleSessionName
+	}
+	if cfg.FailureMode == "" {
+		cfg.FailureMode = failureModeFailFast
+	}
+	if cfg.WriteAPI == "" {
+		cfg.WriteAPI = writeAPIBatch
+	}
+	if cfg.AllowedTablePrefix == "" {
+		cfg.AllowedTablePrefix = defaultAllowedTablePrefix
+	}
+
+	var errs []error
+	parseInt := func(name string, min, max int, dst *int) {
+		v := getenv(name)
+		if v == "" {
+			return
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < min || n > max {
+			errs = append(errs, fmt.Errorf("invalid %s %q", name, v))
+			return
+		}
+		*dst = n
+	}
+	parseFloat := func(name string, valid func(float64) bool, dst *float64) {
+		v := getenv(name)
+		if v == "" {
+			return
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || !valid(f) {
+			errs = append(errs, fmt.Errorf("invalid %s %q", name, v))
+			return
+		}
+		*dst = f
+	}
+
+	const unbounded = int(^uint(0) >> 1)
+	parseInt("SDK_MAX_RETRIES", 0, unbounded, &cfg.SDKMaxRetries)
+	parseInt("MAX_LOG_ITEMS", 0, unbounded, &cfg.MaxLogItems)
+	if getenv("MAX_LOG_ITEMS") == "" {
+		// LOG_INPUT_MAX_ITEMS is accepted as another name for MAX_LOG_ITEMS.
+		parseInt("LOG_INPUT_MAX_ITEMS", 0, unbounded, &cfg.MaxLogItems)
+	}
+	parseInt("MAX_INFLIGHT_WRITES", 0, unbounded, &cfg.MaxInflightWrites)
+	parseInt("FLUSH_THRESHOLD", 1, maxBatchWriteItems, &cfg.FlushThreshold)
+	parseInt("MAX_BATCH_SIZE", 0, unbounded, &cfg.MaxBatchSize)
+	parseInt("RETRY_BUDGET", 0, unbounded, &cfg.RetryBudget)
+	if getenv("REMOVAL_SANITY_MARGIN") != "" {
+		cfg.RemovalSanityMargin = -1
+		parseInt("REMOVAL_SANITY_MARGIN", 0, unbounded, &cfg.RemovalSanityMargin)
+		cfg.CheckRemovals = cfg.RemovalSanityMargin >= 0
+	}
+
+	var latencyMS int
+	parseInt("INGEST_LATENCY_WARN_MS", 0, unbounded, &latencyMS)
+	cfg.IngestLatencyWarn = time.Duration(latencyMS) * time.Millisecond
+
+	parseFloat("MAX_WRITES_PER_SEC", func(f float64) bool { return f >= 0 }, &cfg.MaxWritesPerSec)
+	parseFloat("SNS_MAX_PUBLISH_PER_SEC", func(f float64) bool { return f >= 0 }, &cfg.SNSMaxPublishPerSec)
+	parseFloat("MAX_FAILURE_RATIO", func(f float64) bool { return f > 0 && f <= 1 }, &cfg.MaxFailureRatio)
+
+	parseDuration := func(name string, valid func(time.Duration) bool, dst *time.Duration) {
+		v := getenv(name)
+		if v == "" {
+			return
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil || !valid(d) {
+			errs = append(errs, fmt.Errorf("invalid %s %q", name, v))
+			return
+		}
+		*dst = d
+	}
+	parseDuration("HEARTBEAT_INTERVAL", func(d time.Duration) bool { return d >= 0 }, &cfg.HeartbeatInterval)
+	parseDuration("ADAPTIVE_BACKOFF_BASE", func(d time.Duration) bool { return d > 0 }, &cfg.AdaptiveBackoffBase)
+	parseDuration("ADAPTIVE_BACKOFF_MAX", func(d time.Duration) bool { return d >= 0 }, &cfg.AdaptiveBackoffMax)
+
+	if cfg.FailureMode != failureModeFailFast && cfg.FailureMode != failureModeBestEffort {
+		errs = append(errs, fmt.Errorf("invalid FAILURE_MODE %q", cfg.FailureMode))
+	}
+	if cfg.WriteAPI != writeAPIBatch && cfg.WriteAPI != writeAPIPartiQL {
+		errs = append(errs, fmt.Errorf("invalid WRITE_API %q", cfg.WriteAPI))
+	}
+	if cfg.WriteAPI == writeAPIPartiQL && cfg.TransactWrites {
+		errs = append(errs, errors.New("TRANSACT_WRITES cannot be combined with WRITE_API partiql"))
+	}
+	if cfg.SequenceConditions && (cfg.TransactWrites || cfg.WriteAPI == writeAPIPartiQL) {
+		errs = append(errs, errors.New("SEQUENCE_CONDITIONS cannot be combined with TRANSACT_WRITES or WRITE_API partiql"))
+	}
+	if cfg.RoleMemberships && cfg.TransactWrites {
+		// Transactions pair each membership with its reverse index record one to one.
+		errs = append(errs, errors.New("ROLE_MEMBERSHIPS cannot be combined with TRANSACT_WRITES"))
+	}
+	if cfg.OwnedDeletes && cfg.SourceTag == "" {
+		errs = append(errs, errors.New("OWNED_DELETES requires SOURCE_TAG"))
+	}
+	if cfg.OwnedDeletes && (cfg.TransactWrites || cfg.SequenceConditions || cfg.WriteAPI == writeAPIPartiQL) {
+		errs = append(errs, errors.New("OWNED_DELETES cannot be combined with TRANSACT_WRITES, SEQUENCE_CONDITIONS or WRITE_API partiql"))
+	}
+	if cfg.ReconcileRemoves && cfg.ReverseIndexTable == "" {
+		errs = append(errs, errors.New("RECONCILE_REMOVES requires REVERSE_INDEX_TABLE"))
+	}
+	if cfg.ReplayFile != "" && cfg.ExportFile != "" {
+		errs = append(errs, errors.New("REPLAY_FILE cannot be combined with EXPORT_FILE"))
+	}
+	if cfg.PollMode && cfg.QueueURL == "" {
+		errs = append(errs, errors.New("POLL_MODE requires QUEUE_URL"))
+	}
+	if cfg.DryRunOutput != "" && !cfg.DryRun {
+		errs = append(errs, errors.New("DRY_RUN_OUTPUT requires DRY_RUN"))
+	}
+
+	if cfg.Environment == environmentLocal {
+		// Guard against a developer's profile pointing a local run at a shared table. A table
+		// name read from TABLE_NAME_PARAM is checked once it is resolved; see resolveTableName.
+		tableName := cfg.TableName
+		if cfg.TableNameParam != "" {
+			tableName = ""
+		}
+		written := []struct{ name, table string }{
+			{"TABLE_NAME", tableName},
+			{"REVERSE_INDEX_TABLE", cfg.ReverseIndexTable},
+			{"IDEMPOTENCY_TABLE", cfg.IdempotencyTable},
+		}
+		// A malformed REPLICA_TABLES is reported when the replicas are created.
+		replicas, _ := parseReplicaTables(cfg.ReplicaTables, func(string) dynamoDBClient { return nil })
+		for _, r := range replicas {
+			written = append(written, struct{ name, table string }{"REPLICA_TABLES", r.tableName})
+		}
+		for _, w := range written {
+			if w.table != "" && !strings.HasPrefix(w.table, cfg.AllowedTablePrefix) {
+				errs = append(errs, fmt.Errorf("%s %q does not start with ALLOWED_TABLE_PREFIX %q in the local environment", w.name, w.table, cfg.AllowedTablePrefix))
+			}
+		}
+	}
+
+	return cfg, errors.Join(errs...)
+}
+
+// splitList splits a comma-separated list, trimming whitespace and dropping empty entries.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test_loadConfig_defaults verifies the defaults applied when no options are set
+func Test_loadConfig_defaults(t *testing.T) {
+	cfg, err := loadConfig(testEnv(nil))
+	if err != nil {
+		t.Fatalf("loadConfig() unexpected error = %v", err)
+	}
+
+	want := config{
+		SDKMaxRetries:         -1,
+		AssumeRoleSessionName: defaultAssumeRoleSessionName,
+		TableName:             defaultTableName,
+		OrgPKPrefix:           defaultOrgPKPrefix,
+		OrgAttribute:          defaultOrgAttribute,
+		FlushThreshold:        maxBatchWriteItems,
+		RetryBudget:           defaultRetryBudget,
+		MaxBatchSize:          defaultMaxBatchSize,
+		AdaptiveBackoffBase:   defaultAdaptiveBackoffBase,
+		FailureMode:           failureModeFailFast,
+		WriteAPI:              writeAPIBatch,
+		AllowedTablePrefix:    defaultAllowedTablePrefix,
+	}
+	if !reflect.DeepEqual(cfg, want) {
+		t.Errorf("loadConfig() = %+v, want %+v", cfg, want)
+	}
+}
+
+// Test_loadConfig verifies valid values are parsed into their options
+func Test_loadConfig(t *testing.T) {
+	cfg, err := loadConfig(testEnv(map[string]string{
+		"TABLE_NAME":                 "test-table",
+		"LOG_FORMAT":                 "text",
+		"LOG_LEVEL":                  "debug",
+		"SDK_MAX_RETRIES":            "0",
+		"ASSUME_ROLE_ARN":            "arn:aws:iam::123456789012:role/poc-organizations-writer",
+		"ASSUME_ROLE_SESSION_NAME":   "test-session",
+		"POLL_MODE":                  "true",
+		"QUEUE_URL":                  "https://sqs.us-east-1.amazonaws.com/123456789012/user-dynamo-stream.fifo",
+		"HEARTBEAT_INTERVAL":         "30s",
+		"DRY_RUN":                    "true",
+		"DRY_RUN_OUTPUT":             "writes.jsonl",
+		"REVERSE_INDEX_TABLE":        "reverse-table",
+		"RECONCILE_REMOVES":          "true",
+		"SEPARATE_PUT_DELETE_PASSES": "true",
+		"TRANSACT_WRITES":            "yes",
+		"PROJECT_ATTRIBUTES":         "display_name, tier,,",
+		"ORG_ALLOWLIST":              "org1, org3",
+		"EVENT_TYPES":                "INSERT,REMOVE",
+		"MAX_WRITES_PER_SEC":         "2.5",
+		"MAX_INFLIGHT_WRITES":        "4",
+		"FLUSH_THRESHOLD":            "10",
+		"RETRY_BUDGET":               "0",
+		"ADAPTIVE_BACKOFF_BASE":      "20ms",
+		"ADAPTIVE_BACKOFF_MAX":       "2s",
+		"FAILURE_MODE":               "best_effort",
+		"MAX_FAILURE_RATIO":          "0.5",
+		"INGEST_LATENCY_WARN_MS":     "1500",
+		"MAX_BATCH_SIZE":             "0",
+		"REMOVAL_SANITY_MARGIN":      "0",
+	}))
+	if err != nil {
+		t.Fatalf("loadConfig() unexpected error = %v", err)
+	}
+
+	checks := []struct {
+		name      string
+		got, want any
+	}{
+		{"TableName", cfg.TableName, "test-table"},
+		{"LogFormat", cfg.LogFormat, "text"},
+		{"LogLevel", cfg.LogLevel, "debug"},
+		{"SDKMaxRetries", cfg.SDKMaxRetries, 0},
+		{"AssumeRoleARN", cfg.AssumeRoleARN, "arn:aws:iam::123456789012:role/poc-organizations-writer"},
+		{"AssumeRoleSessionName", cfg.AssumeRoleSessionName, "test-session"},
+		{"PollMode", cfg.PollMode, true},
+		{"HeartbeatInterval", cfg.HeartbeatInterval, 30 * time.Second},
+		{"DryRun", cfg.DryRun, true},
+		{"DryRunOutput", cfg.DryRunOutput, "writes.jsonl"},
+		{"ReconcileRemoves", cfg.ReconcileRemoves, true},
+		{"SeparatePasses", cfg.SeparatePasses, true},
+		{"TransactWrites", cfg.TransactWrites, false},
+		{"ProjectAttributes", cfg.ProjectAttributes, []string{"display_name", "tier"}},
+		{"OrgAllowlist", cfg.OrgAllowlist, map[string]struct{}{"org1": {}, "org3": {}}},
+		{"EventTypes", cfg.EventTypes, map[string]struct{}{"INSERT": {}, "REMOVE": {}}},
+		{"MaxWritesPerSec", cfg.MaxWritesPerSec, 2.5},
+		{"MaxInflightWrites", cfg.MaxInflightWrites, 4},
+		{"FlushThreshold", cfg.FlushThreshold, 10},
+		{"RetryBudget", cfg.RetryBudget, 0},
+		{"AdaptiveBackoffBase", cfg.AdaptiveBackoffBase, 20 * time.Millisecond},
+		{"AdaptiveBackoffMax", cfg.AdaptiveBackoffMax, 2 * time.Second},
+		{"FailureMode", cfg.FailureMode, failureModeBestEffort},
+		{"MaxFailureRatio", cfg.MaxFailureRatio, 0.5},
+		{"IngestLatencyWarn", cfg.IngestLatencyWarn, 1500 * time.Millisecond},
+		{"MaxBatchSize", cfg.MaxBatchSize, 0},
+		{"CheckRemovals", cfg.CheckRemovals, true},
+		{"RemovalSanityMargin", cfg.RemovalSanityMargin, 0},
+	}
+	for _, c := range checks {
+		if !reflect.DeepEqual(c.got, c.want) {
+			t.Errorf("%s = %v, want %v", c.name, c.got, c.want)
+		}
+	}
+}
+
+// Test_loadConfig_invalid verifies invalid values and options missing their dependencies are
+// rejected, naming the option in the error
+func Test_loadConfig_invalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantErr string
+	}{
+		{name: "non-numeric SDK_MAX_RETRIES", env: map[string]string{"SDK_MAX_RETRIES": "lots"}, wantErr: `invalid SDK_MAX_RETRIES "lots"`},
+		{name: "negative SDK_MAX_RETRIES", env: map[string]string{"SDK_MAX_RETRIES": "-1"}, wantErr: `invalid SDK_MAX_RETRIES "-1"`},
+		{name: "negative MAX_LOG_ITEMS", env: map[string]string{"MAX_LOG_ITEMS": "-5"}, wantErr: `invalid MAX_LOG_ITEMS "-5"`},
+		{name: "negative LOG_INPUT_MAX_ITEMS", env: map[string]string{"LOG_INPUT_MAX_ITEMS": "-5"}, wantErr: `invalid LOG_INPUT_MAX_ITEMS "-5"`},
+		{name: "zero FLUSH_THRESHOLD", env: map[string]string{"FLUSH_THRESHOLD": "0"}, wantErr: `invalid FLUSH_THRESHOLD "0"`},
+		{name: "FLUSH_THRESHOLD above the batch limit", env: map[string]string{"FLUSH_THRESHOLD": "26"}, wantErr: `invalid FLUSH_THRESHOLD "26"`},
+		{name: "negative RETRY_BUDGET", env: map[string]string{"RETRY_BUDGET": "-1"}, wantErr: `invalid RETRY_BUDGET "-1"`},
+		{name: "non-numeric REMOVAL_SANITY_MARGIN", env: map[string]string{"REMOVAL_SANITY_MARGIN": "some"}, wantErr: `invalid REMOVAL_SANITY_MARGIN "some"`},
+		{name: "fractional INGEST_LATENCY_WARN_MS", env: map[string]string{"INGEST_LATENCY_WARN_MS": "1.5"}, wantErr: `invalid INGEST_LATENCY_WARN_MS "1.5"`},
+		{name: "negative MAX_WRITES_PER_SEC", env: map[string]string{"MAX_WRITES_PER_SEC": "-1"}, wantErr: `invalid MAX_WRITES_PER_SEC "-1"`},
+		{name: "negative SNS_MAX_PUBLISH_PER_SEC", env: map[string]string{"SNS_MAX_PUBLISH_PER_SEC": "-1"}, wantErr: `invalid SNS_MAX_PUBLISH_PER_SEC "-1"`},
+		{name: "negative MAX_INFLIGHT_WRITES", env: map[string]string{"MAX_INFLIGHT_WRITES": "-2"}, wantErr: `invalid MAX_INFLIGHT_WRITES "-2"`},
+		{name: "negative MAX_BATCH_SIZE", env: map[string]string{"MAX_BATCH_SIZE": "-1"}, wantErr: `invalid MAX_BATCH_SIZE "-1"`},
+		{name: "zero MAX_FAILURE_RATIO", env: map[string]string{"MAX_FAILURE_RATIO": "0"}, wantErr: `invalid MAX_FAILURE_RATIO "0"`},
+		{name: "MAX_FAILURE_RATIO above one", env: map[string]string{"MAX_FAILURE_RATIO": "1.5"}, wantErr: `invalid MAX_FAILURE_RATIO "1.5"`},
+		{name: "HEARTBEAT_INTERVAL without a unit", env: map[string]string{"HEARTBEAT_INTERVAL": "30"}, wantErr: `invalid HEARTBEAT_INTERVAL "30"`},
+		{name: "negative HEARTBEAT_INTERVAL", env: map[string]string{"HEARTBEAT_INTERVAL": "-1s"}, wantErr: `invalid HEARTBEAT_INTERVAL "-1s"`},
+		{name: "zero ADAPTIVE_BACKOFF_BASE", env: map[string]string{"ADAPTIVE_BACKOFF_BASE": "0s"}, wantErr: `invalid ADAPTIVE_BACKOFF_BASE "0s"`},
+		{name: "ADAPTIVE_BACKOFF_MAX without a unit", env: map[string]string{"ADAPTIVE_BACKOFF_MAX": "1"}, wantErr: `invalid ADAPTIVE_BACKOFF_MAX "1"`},
+		{name: "unknown FAILURE_MODE", env: map[string]string{"FAILURE_MODE": "retry"}, wantErr: `invalid FAILURE_MODE "retry"`},
+		{name: "unknown WRITE_API", env: map[string]string{"WRITE_API": "rest"}, wantErr: `invalid WRITE_API "rest"`},
+		{name: "WRITE_API partiql with TRANSACT_WRITES", env: map[string]string{"WRITE_API": "partiql", "TRANSACT_WRITES": "true"}, wantErr: "TRANSACT_WRITES cannot be combined with WRITE_API partiql"},
+		{name: "SEQUENCE_CONDITIONS with TRANSACT_WRITES", env: map[string]string{"SEQUENCE_CONDITIONS": "true", "TRANSACT_WRITES": "true"}, wantErr: "SEQUENCE_CONDITIONS cannot be combined with TRANSACT_WRITES or WRITE_API partiql"},
+		{name: "OWNED_DELETES without SOURCE_TAG", env: map[string]string{"OWNED_DELETES": "true"}, wantErr: "OWNED_DELETES requires SOURCE_TAG"},
+		{name: "OWNED_DELETES with TRANSACT_WRITES", env: map[string]string{"OWNED_DELETES": "true", "SOURCE_TAG": "consumer-a", "TRANSACT_WRITES": "true"}, wantErr: "OWNED_DELETES cannot be combined with TRANSACT_WRITES, SEQUENCE_CONDITIONS or WRITE_API partiql"},
+		{name: "ROLE_MEMBERSHIPS with TRANSACT_WRITES", env: map[string]string{"ROLE_MEMBERSHIPS": "true", "TRANSACT_WRITES": "true"}, wantErr: "ROLE_MEMBERSHIPS cannot be combined with TRANSACT_WRITES"},
+		{name: "REPLAY_FILE with EXPORT_FILE", env: map[string]string{"REPLAY_FILE": "records.jsonl", "EXPORT_FILE": "export.json.gz"}, wantErr: "REPLAY_FILE cannot be combined with EXPORT_FILE"},
+		{name: "RECONCILE_REMOVES without REVERSE_INDEX_TABLE", env: map[string]string{"RECONCILE_REMOVES": "true"}, wantErr: "RECONCILE_REMOVES requires REVERSE_INDEX_TABLE"},
+		{name: "POLL_MODE without QUEUE_URL", env: map[string]string{"POLL_MODE": "true"}, wantErr: "POLL_MODE requires QUEUE_URL"},
+		{name: "DRY_RUN_OUTPUT without DRY_RUN", env: map[string]string{"DRY_RUN_OUTPUT": "writes.jsonl"}, wantErr: "DRY_RUN_OUTPUT requires DRY_RUN"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadConfig(testEnv(tt.env))
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("loadConfig() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// Test_loadConfig_reportsEveryError verifies every invalid option is reported at once
+func Test_loadConfig_reportsEveryError(t *testing.T) {
+	_, err := loadConfig(testEnv(map[string]string{
+		"FLUSH_THRESHOLD": "100",
+		"FAILURE_MODE":    "retry",
+		"POLL_MODE":       "true",
+	}))
+	if err == nil {
+		t.Fatal("loadConfig() expected an error")
+	}
+	for _, want := range []string{"FLUSH_THRESHOLD", "FAILURE_MODE", "POLL_MODE requires QUEUE_URL"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("loadConfig() error = %q, want it to mention %s", err, want)
+		}
+	}
+}
+
+// Test_loadConfig_localTableGuard verifies a local environment may only write to tables named
+// with the allowed prefix, and other environments are not checked
+func Test_loadConfig_localTableGuard(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantErr string
+	}{
+		{
+			name: "local table in the local environment",
+			env:  map[string]string{"ENVIRONMENT": "local", "TABLE_NAME": "local-organizations"},
+		},
+		{
+			name: "custom prefix in the local environment",
+			env:  map[string]string{"ENVIRONMENT": "local", "ALLOWED_TABLE_PREFIX": "dev-", "TABLE_NAME": "dev-organizations", "REVERSE_INDEX_TABLE": "dev-reverse"},
+		},
+		{
+			name: "shared table outside the local environment",
+			env:  map[string]string{"ENVIRONMENT": "prod", "TABLE_NAME": "poc-organizations"},
+		},
+		{
+			name: "table name parameter in the local environment",
+			env:  map[string]string{"ENVIRONMENT": "local", "TABLE_NAME_PARAM": "/poc/local/table-name"},
+		},
+		{
+			name:    "default table in the local environment",
+			env:     map[string]string{"ENVIRONMENT": "local"},
+			wantErr: `TABLE_NAME "poc-organizations" does not start with ALLOWED_TABLE_PREFIX "local-" in the local environment`,
+		},
+		{
+			name:    "shared reverse index in the local environment",
+			env:     map[string]string{"ENVIRONMENT": "local", "TABLE_NAME": "local-organizations", "REVERSE_INDEX_TABLE": "poc-user-organizations"},
+			wantErr: `REVERSE_INDEX_TABLE "poc-user-organizations" does not start with ALLOWED_TABLE_PREFIX "local-" in the local environment`,
+		},
+		{
+			name: "local replica table in the local environment",
+			env:  map[string]string{"ENVIRONMENT": "local", "TABLE_NAME": "local-organizations", "REPLICA_TABLES": "us-west-2=local-organizations"},
+		},
+		{
+			name:    "shared replica table in the local environment",
+			env:     map[string]string{"ENVIRONMENT": "local", "TABLE_NAME": "local-organizations", "REPLICA_TABLES": "us-west-2=local-organizations,eu-west-1=poc-organizations"},
+			wantErr: `REPLICA_TABLES "poc-organizations" does not start with ALLOWED_TABLE_PREFIX "local-" in the local environment`,
+		},
+		{
+			name:    "table without a custom prefix in the local environment",
+			env:     map[string]string{"ENVIRONMENT": "local", "ALLOWED_TABLE_PREFIX": "dev-", "TABLE_NAME": "local-organizations"},
+			wantErr: `TABLE_NAME "local-organizations" does not start with ALLOWED_TABLE_PREFIX "dev-" in the local environment`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadConfig(testEnv(tt.env))
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("loadConfig() unexpected error = %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr) {
+				t.Errorf("loadConfig() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
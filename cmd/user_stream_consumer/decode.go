@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// decodeRecord unmarshals an SQS message body, reading it from S3 first when it was offloaded and
+// decompressing it when it is gzip encoded, into a DynamoDB event record with its event name
+// upper-cased. A failed S3 read is retryable; a body that cannot be decoded or unmarshaled is a
+// permanent error. When a source table is configured and an INSERT or MODIFY record only carries
+// Keys (a KEYS_ONLY stream), the current item is fetched from the source table to stand in for
+// the NewImage; a failed fetch is retryable since the record itself is valid.
+func (p *processor) decodeRecord(ctx context.Context, record events.SQSMessage) (events.DynamoDBEventRecord, error) {
+	var der events.DynamoDBEventRecord
+	if pointer, ok := parseS3Pointer(record.Body); ok {
+		payload, err := p.fetchPayload(ctx, pointer)
+		if err != nil {
+			p.logger.ErrorContext(ctx, "failed to fetch offloaded message body",
+				slog.String("error", err.Error()),
+				slog.String("messageId", record.MessageId),
+				slog.String("bucket", pointer.Bucket),
+				slog.String("key", pointer.Key))
+			return der, err
+		}
+		record.Body = payload
+	}
+	body, err := decodeBody(record)
+	if err != nil {
+		p.logger.ErrorContext(ctx, "failed to decode message body",
+			slog.String("error", err.Error()),
+			slog.String("messageId", record.MessageId))
+		return der, &permanentError{err: fmt.Errorf("failed to decode message body: %w", err)}
+	}
+	if err := json.Unmarshal(body, &der); err != nil {
+		// Retry tolerating lowercase attribute type tags before giving up on the record.
+		normalized, ok := normalizeTypeTags(body)
+		der = events.DynamoDBEventRecord{}
+		if !ok || json.Unmarshal(normalized, &der) != nil {
+			p.logger.ErrorContext(ctx, "failed to unmarshal dynamo event",
+				slog.String("error", err.Error()),
+				slog.String("body", p.redact(record.Body)))
+			return der, &permanentError{err: fmt.Errorf("failed to unmarshal DynamoDB event record: %w", err)}
+		}
+		p.logger.WarnContext(ctx, "decoded dynamo event with lowercase attribute type tags",
+			slog.String("messageId", record.MessageId))
+	}
+	der.EventName = normalizeEventName(der.EventName)
+
+	if !p.needsBackfill(der) {
+		return der, nil
+	}
+
+	image, err := p.fetchImage(ctx, der.Change.Keys)
+	if err != nil {
+		return der, fmt.Errorf("failed to backfill keys-only record: %w", err)
+	}
+	der.Change.NewImage = image
+	return der, nil
+}
+
+// normalizeEventName upper-cases an event name, since some upstream serializers emit
+// eventName in lowercase, such as insert, which would otherwise match no operation type.
+func normalizeEventName(name string) string {
+	return strings.ToUpper(strings.TrimSpace(name))
+}
+
+// decodeBody returns the JSON payload of an SQS message. Producers that compress large change
+// payloads set the Content-Encoding message attribute to gzip and base64 encode the compressed
+// bytes; bodies without the attribute are plain JSON.
+func decodeBody(record events.SQSMessage) ([]byte, error) {
+	encoding, ok := record.MessageAttributes["Content-Encoding"]
+	if !ok || encoding.StringValue == nil || *encoding.StringValue == "" {
+		return []byte(record.Body), nil
+	}
+	if *encoding.StringValue != "gzip" {
+		return nil, fmt.Errorf("unsupported Content-Encoding %q", *encoding.StringValue)
+	}
+
+	compressed, err := base64.StdEncoding.DecodeString(record.Body)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64 body: %w", err)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, fmt.Errorf("invalid gzip body: %w", err)
+	}
+	defer zr.Close()
+	body, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid gzip body: %w", err)
+	}
+	return body, nil
+}
+
+// normalizeTypeTags rewrites the attribute type tags in a record's Keys, NewImage and OldImage
+// to upper case, such as {"s": "USER#123"} to {"S": "USER#123"}, for upstream tooling that
+// lowercases them. Wrapper keys need no rewriting because encoding/json matches field names
+// case-insensitively. ok is false when the body is not a JSON object with a stream record.
+func normalizeTypeTags(body []byte) (normalized []byte, ok bool) {
+	var raw map[string]any
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return nil, false
+	}
+	for name, change := range raw {
+		change, isObject := change.(map[string]any)
+		if !strings.EqualFold(name, "dynamodb") || !isObject {
+			continue
+		}
+		for field, image := range change {
+			image, isObject := image.(map[string]any)
+			if !isObject || !(strings.EqualFold(field, "Keys") || strings.EqualFold(field, "NewImage") || strings.EqualFold(field, "OldImage")) {
+				continue
+			}
+			for attr, value := range image {
+				image[attr] = normalizeAttribute(value)
+			}
+		}
+		ok = true
+	}
+	if !ok {
+		return nil, false
+	}
+	normalized, err := json.Marshal(raw)
+	if err != nil {
+		return nil, false
+	}
+	return normalized, true
+}
+
+// normalizeAttribute upper cases the type tag of a single attribute value, recursing into List
+// and Map values.
+func normalizeAttribute(value any) any {
+	av, ok := value.(map[string]any)
+	if !ok || len(av) != 1 {
+		return value
+	}
+	for tag, v := range av {
+		tag = strings.ToUpper(tag)
+		switch v := v.(type) {
+		case []any:
+			if tag == "L" {
+				for i := range v {
+					v[i] = normalizeAttribute(v[i])
+				}
+			}
+		case map[string]any:
+			if tag == "M" {
+				for name := range v {
+					v[name] = normalizeAttribute(v[name])
+				}
+			}
+		}
+		return map[string]any{tag: v}
+	}
+	return value
+}
+
+// needsBackfill reports whether a record is missing the NewImage it needs and can recover it by
+// reading the source table. REMOVE records cannot be backfilled because the item no longer exists.
+func (p *processor) needsBackfill(der events.DynamoDBEventRecord) bool {
+	if p.sourceTableName == "" || der.Change.NewImage != nil || len(der.Change.Keys) == 0 {
+		return false
+	}
+	return der.EventName == string(events.DynamoDBOperationTypeInsert) ||
+		der.EventName == string(events.DynamoDBOperationTypeModify)
+}
+
+// fetchImage reads the item identified by keys from the source table using a consistent read.
+// A nil image is returned when the item no longer exists.
+func (p *processor) fetchImage(ctx context.Context, keys map[string]events.DynamoDBAttributeValue) (map[string]events.DynamoDBAttributeValue, error) {
+	key := make(map[string]types.AttributeValue, len(keys))
+	for name, value := range keys {
+		key[name] = toAttributeValue(value)
+	}
+
+	out, err := p.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(p.sourceTableName),
+		Key:            key,
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if out == nil || len(out.Item) == 0 {
+		return nil, nil
+	}
+
+	image := make(map[string]events.DynamoDBAttributeValue, len(out.Item))
+	for name, value := range out.Item {
+		image[name] = fromAttributeValue(value)
+	}
+	return image, nil
+}
+
+// toAttributeValue converts a stream event attribute into its DynamoDB API equivalent.
+func toAttributeValue(av events.DynamoDBAttributeValue) types.AttributeValue {
+	switch av.DataType() {
+	case events.DataTypeString:
+		return &types.AttributeValueMemberS{Value: av.String()}
+	case events.DataTypeNumber:
+		return &types.AttributeValueMemberN{Value: av.Number()}
+	case events.DataTypeBinary:
+		return &types.AttributeValueMemberB{Value: av.Binary()}
+	case events.DataTypeBoolean:
+		return &types.AttributeValueMemberBOOL{Value: av.Boolean()}
+	case events.DataTypeStringSet:
+		return &types.AttributeValueMemberSS{Value: av.StringSet()}
+	case events.DataTypeNumberSet:
+		return &types.AttributeValueMemberNS{Value: av.NumberSet()}
+	case events.DataTypeBinarySet:
+		return &types.AttributeValueMemberBS{Value: av.BinarySet()}
+	case events.DataTypeList:
+		list := make([]types.AttributeValue, 0, len(av.List()))
+		for _, item := range av.List() {
+			list = append(list, toAttributeValue(item))
+		}
+		return &types.AttributeValueMemberL{Value: list}
+	case events.DataTypeMap:
+		m := make(map[string]types.AttributeValue, len(av.Map()))
+		for name, item := range av.Map() {
+			m[name] = toAttributeValue(item)
+		}
+		return &types.AttributeValueMemberM{Value: m}
+	default:
+		return &types.AttributeValueMemberNULL{Value: true}
+	}
+}
+
+// fromAttributeValue converts a DynamoDB API attribute into its stream event equivalent.
+func fromAttributeValue(av types.AttributeValue) events.DynamoDBAttributeValue {
+	switch v := av.(type) {
+	case *types.AttributeValueMemberS:
+		return events.NewStringAttribute(v.Value)
+	case *types.AttributeValueMemberN:
+		return events.NewNumberAttribute(v.Value)
+	case *types.AttributeValueMemberB:
+		return events.NewBinaryAttribute(v.Value)
+	case *types.AttributeValueMemberBOOL:
+		return events.NewBooleanAttribute(v.Value)
+	case *types.AttributeValueMemberSS:
+		return events.NewStringSetAttribute(v.Value)
+	case *types.AttributeValueMemberNS:
+		return events.NewNumberSetAttribute(v.Value)
+	case *types.AttributeValueMemberBS:
+		return events.NewBinarySetAttribute(v.Value)
+	case *types.AttributeValueMemberL:
+		list := make([]events.DynamoDBAttributeValue, 0, len(v.Value))
+		for _, item := range v.Value {
+			list = append(list, fromAttributeValue(item))
+		}
+		return events.NewListAttribute(list)
+	case *types.AttributeValueMemberM:
+		m := make(map[string]events.DynamoDBAttributeValue, len(v.Value))
+		for name, item := range v.Value {
+			m[name] = fromAttributeValue(item)
+		}
+		return events.NewMapAttribute(m)
+	default:
+		return events.NewNullAttribute()
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"log/slog"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Test_decodeRecord verifies unmarshaling, keys-only backfill, and failure classification
+func Test_decodeRecord(t *testing.T) {
+	keysOnlyInsert := `{
+		"eventName": "INSERT",
+		"dynamodb": {
+			"Keys": {"pk": {"S": "USER#123"}, "sk": {"S": "METADATA"}},
+			"StreamViewType": "KEYS_ONLY"
+		}
+	}`
+
+	tests := []struct {
+		name            string
+		body            string
+		sourceTableName string
+		mockGetItem     func(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error)
+		wantErr         bool
+		wantRetryable   bool
+		wantOrgs        []string
+	}{
+		{
+			name:          "invalid body is permanent",
+			body:          `{not json`,
+			wantErr:       true,
+			wantRetryable: false,
+		},
+		{
+			name:            "keys-only record is backfilled from source table",
+			body:            keysOnlyInsert,
+			sourceTableName: "poc-users",
+			mockGetItem: func(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+				if *params.TableName != "poc-users" {
+					t.Errorf("expected GetItem on poc-users, got %s", *params.TableName)
+				}
+				if pk := params.Key["pk"].(*types.AttributeValueMemberS).Value; pk != "USER#123" {
+					t.Errorf("expected key pk USER#123, got %s", pk)
+				}
+				return &dynamodb.GetItemOutput{Item: map[string]types.AttributeValue{
+					"pk": &types.AttributeValueMemberS{Value: "USER#123"},
+					"organizations": &types.AttributeValueMemberL{Value: []types.AttributeValue{
+						&types.AttributeValueMemberS{Value: "org1"},
+					}},
+				}}, nil
+			},
+			wantOrgs: []string{"org1"},
+		},
+		{
+			name:            "transient GetItem failure is retryable",
+			body:            keysOnlyInsert,
+			sourceTableName: "poc-users",
+			mockGetItem: func(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+				return nil, errors.New("simulated throttling")
+			},
+			wantErr:       true,
+			wantRetryable: true,
+		},
+		{
+			name: "keys-only record without source table is left as-is",
+			body: keysOnlyInsert,
+			mockGetItem: func(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+				t.Error("GetItem should not be called without a source table")
+				return nil, nil
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &processor{
+				logger:          slog.New(slog.NewJSONHandler(io.Discard, nil)),
+				client:          &mockDynamoDBClient{getItemFunc: tt.mockGetItem},
+				sourceTableName: tt.sourceTableName,
+			}
+
+			der, err := p.decodeRecord(context.Background(), events.SQSMessage{Body: tt.body})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decodeRecord() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if got := isRetryable(err); got != tt.wantRetryable {
+					t.Errorf("isRetryable() = %v, want %v", got, tt.wantRetryable)
+				}
+				return
+			}
+			if orgs, _ := extractOrganizations(der.Change.NewImage, defaultOrgAttribute); !reflect.DeepEqual(orgs, tt.wantOrgs) {
+				t.Errorf("extractOrganizations() = %v, want %v", orgs, tt.wantOrgs)
+			}
+		})
+	}
+}
+
+// Test_attributeValueConversion verifies stream attributes survive a round trip through the API types
+func Test_attributeValueConversion(t *testing.T) {
+	original := events.NewMapAttribute(map[string]events.DynamoDBAttributeValue{
+		"s":    events.NewStringAttribute("value"),
+		"n":    events.NewNumberAttribute("42"),
+		"b":    events.NewBinaryAttribute([]byte("bytes")),
+		"bool": events.NewBooleanAttribute(true),
+		"ss":   events.NewStringSetAttribute([]string{"a", "b"}),
+		"ns":   events.NewNumberSetAttribute([]string{"1", "2"}),
+		"bs":   events.NewBinarySetAttribute([][]byte{[]byte("x")}),
+		"null": events.NewNullAttribute(),
+		"l": events.NewListAttribute([]events.DynamoDBAttributeValue{
+			events.NewStringAttribute("item"),
+		}),
+	})
+
+	got := fromAttributeValue(toAttributeValue(original))
+	if !reflect.DeepEqual(got, original) {
+		t.Errorf("round trip = %v, want %v", got, original)
+	}
+}
+
+// gzipBody gzips and base64 encodes body as a compressing producer would.
+func gzipBody(t *testing.T, body string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write([]byte(body)); err != nil {
+		t.Fatalf("failed to gzip body: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("failed to gzip body: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+// Test_handler_gzipBody verifies gzipped and plain bodies produce identical write requests
+func Test_handler_gzipBody(t *testing.T) {
+	body := insertBody("USER#123", 3)
+	gzipEncoding := map[string]events.SQSMessageAttribute{
+		"Content-Encoding": {DataType: "String", StringValue: aws.String("gzip")},
+	}
+
+	var writes []map[string][]types.WriteRequest
+	client := &mockDynamoDBClient{
+		batchWriteItemFunc: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+			writes = append(writes, params.RequestItems)
+			return &dynamodb.BatchWriteItemOutput{}, nil
+		},
+	}
+	h := handler(slog.New(slog.NewJSONHandler(io.Discard, nil)), client, nil, nil, nil, mustLoadConfig(t, testEnv(map[string]string{"TABLE_NAME": "test-table"})), fixedClock, nil)
+	_, err := h(context.Background(), events.SQSEvent{Records: []events.SQSMessage{
+		{MessageId: "plain", Body: body},
+		{MessageId: "gzip", Body: gzipBody(t, body), MessageAttributes: gzipEncoding},
+	}})
+	if err != nil {
+		t.Fatalf("handler() unexpected error = %v", err)
+	}
+	if len(writes) != 2 {
+		t.Fatalf("expected 2 batch writes, got %d", len(writes))
+	}
+	if !reflect.DeepEqual(writes[0], writes[1]) {
+		t.Errorf("gzip body wrote %v, plain body wrote %v", writes[1], writes[0])
+	}
+}
+
+// Test_handler_lowercaseTypeTags verifies images with lowercase attribute type tags still produce
+// the same write requests as the standard encoding
+func Test_handler_lowercaseTypeTags(t *testing.T) {
+	const mixedBody = `{
+		"eventName": "INSERT",
+		"dynamodb": {
+			"Keys": {"pk": {"s": "USER#123"}},
+			"NewImage": {
+				"pk": {"s": "USER#123"},
+				"organizations": {"l": [{"S": "org0"}, {"s": "org1"}, {"s": "org2"}]}
+			}
+		}
+	}`
+
+	var buf bytes.Buffer
+	var writes []map[string][]types.WriteRequest
+	client := &mockDynamoDBClient{
+		batchWriteItemFunc: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+			writes = append(writes, params.RequestItems)
+			return &dynamodb.BatchWriteItemOutput{}, nil
+		},
+	}
+	h := handler(slog.New(slog.NewJSONHandler(&buf, nil)), client, nil, nil, nil, mustLoadConfig(t, testEnv(map[string]string{"TABLE_NAME": "test-table"})), fixedClock, nil)
+	_, err := h(context.Background(), events.SQSEvent{Records: []events.SQSMessage{
+		{MessageId: "standard", Body: insertBody("USER#123", 3)},
+		{MessageId: "mixed", Body: mixedBody},
+	}})
+	if err != nil {
+		t.Fatalf("handler() unexpected error = %v", err)
+	}
+	if len(writes) != 2 {
+		t.Fatalf("expected 2 batch writes, got %d", len(writes))
+	}
+	if !reflect.DeepEqual(writes[0], writes[1]) {
+		t.Errorf("mixed casing wrote %v, standard encoding wrote %v", writes[1], writes[0])
+	}
+	if fallbacks := findLogs(parseLogs(t, &buf), "decoded dynamo event with lowercase attribute type tags"); len(fallbacks) != 1 || fallbacks[0]["messageId"] != "mixed" {
+		t.Errorf("expected one fallback log for the mixed record, got %v", fallbacks)
+	}
+}
+
+// Test_decodeBody verifies malformed or unsupported encodings are rejected
+func Test_decodeBody(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		encoding string
+		wantErr  bool
+	}{
+		{name: "plain", body: `{}`},
+		{name: "gzip", body: gzipBody(t, `{}`), encoding: "gzip"},
+		{name: "invalid base64", body: "not base64!", encoding: "gzip", wantErr: true},
+		{name: "not gzip", body: base64.StdEncoding.EncodeToString([]byte(`{}`)), encoding: "gzip", wantErr: true},
+		{name: "unsupported encoding", body: `{}`, encoding: "br", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			record := events.SQSMessage{Body: tt.body}
+			if tt.encoding != "" {
+				record.MessageAttributes = map[string]events.SQSMessageAttribute{
+					"Content-Encoding": {DataType: "String", StringValue: aws.String(tt.encoding)},
+				}
+			}
+			body, err := decodeBody(record)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decodeBody() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && string(body) != `{}` {
+				t.Errorf("decodeBody() = %s, want {}", body)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// sqsClient defines the SQS operations used to dead-letter records.
+type sqsClient interface {
+	SendMessage(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error)
+}
+
+// deadLetterRun dead-letters a record along with every message coalesced into it, since the
+// body sent for the record carries only the run's latest image and the intermediate changes
+// would otherwise be lost with the acknowledged skipped messages. The skipped messages, found in
+// records, are sent first, in sequence order, ahead of the record itself.
+func (p *processor) deadLetterRun(ctx context.Context, inv *invocation, records []events.SQSMessage, record events.SQSMessage, cause error) error {
+	for _, skipped := range inv.coalesced[record.MessageId].skipped {
+		for _, r := range records {
+			if r.MessageId != skipped {
+				continue
+			}
+			if err := p.deadLetter(ctx, inv, r, fmt.Errorf("coalesced into %s: %w", record.MessageId, cause)); err != nil {
+				return err
+			}
+			break
+		}
+	}
+	return p.deadLetter(ctx, inv, record, cause)
+}
+
+// deadLetter sends a record that failed with a permanent error to the dead-letter queue, so it
+// can be acknowledged immediately instead of being redelivered until SQS gives up on it. The
+// original body and message attributes are sent unchanged, so an encoded body can still be
+// decoded on redrive, with the failure attached as the ErrorMessage attribute. FIFO queues also
+// need a message group, taken from the original message, and a deduplication ID. A dry run
+// only logs the record it would have sent.
+func (p *processor) deadLetter(ctx context.Context, inv *invocation, record events.SQSMessage, cause error) error {
+	if p.dryRun {
+		p.logger.InfoContext(ctx, "dry run: skipping dead-letter send",
+			slog.String("messageId", record.MessageId),
+			slog.String("cause", cause.Error()))
+		return nil
+	}
+
+	attributes := make(map[string]sqstypes.MessageAttributeValue, len(record.MessageAttributes)+1)
+	for name, attr := range record.MessageAttributes {
+		attributes[name] = sqstypes.MessageAttributeValue{
+			DataType:    aws.String(attr.DataType),
+			StringValue: attr.StringValue,
+			BinaryValue: attr.BinaryValue,
+		}
+	}
+	attributes["ErrorMessage"] = sqstypes.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(cause.Error())}
+
+	input := &sqs.SendMessageInput{
+		QueueUrl:          aws.String(p.dlqURL),
+		MessageBody:       aws.String(record.Body),
+		MessageAttributes: attributes,
+	}
+	if strings.HasSuffix(p.dlqURL, ".fifo") {
+		groupID := record.Attributes["MessageGroupId"]
+		if groupID == "" {
+			groupID = record.MessageId
+		}
+		input.MessageGroupId = aws.String(groupID)
+		input.MessageDeduplicationId = aws.String(record.MessageId)
+	}
+
+	if _, err := p.dlq.SendMessage(ctx, input); err != nil {
+		p.logger.ErrorContext(ctx, "failed to dead-letter record",
+			slog.String("error", err.Error()),
+			slog.String("messageId", record.MessageId))
+		return fmt.Errorf("failed to send record %s to dead-letter queue: %w", record.MessageId, err)
+	}
+
+	p.logger.WarnContext(ctx, "dead-lettered record",
+		slog.String("messageId", record.MessageId),
+		slog.String("cause", cause.Error()))
+	inv.metrics.increment("DeadLetteredRecords", 1)
+	return nil
+}
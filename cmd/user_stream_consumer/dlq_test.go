@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+)
+
+// mockSQSClient implements sqsClient interface for testing
+type mockSQSClient struct {
+	sendMessageFunc func(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error)
+}
+
+func (m *mockSQSClient) SendMessage(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error) {
+	return m.sendMessageFunc(ctx, params, optFns...)
+}
+
+// Test_handler_deadLetter verifies permanently failing records are sent to the DLQ and acknowledged
+func Test_handler_deadLetter(t *testing.T) {
+	const badBody = `{not json`
+
+	tests := []struct {
+		name     string
+		dlqURL   string
+		sendErr  error
+		wantErr  bool
+		wantSent int
+		wantFIFO bool
+	}{
+		{
+			name:     "permanent failure is dead-lettered and acknowledged",
+			dlqURL:   "https://sqs.us-east-1.amazonaws.com/123456789012/user-dynamo-stream-deadletter",
+			wantSent: 1,
+		},
+		{
+			name:     "fifo queue gets a group and deduplication id",
+			dlqURL:   "https://sqs.us-east-1.amazonaws.com/123456789012/user-dynamo-stream-deadletter.fifo",
+			wantSent: 1,
+			wantFIFO: true,
+		},
+		{
+			name:     "failed send fails the batch",
+			dlqURL:   "https://sqs.us-east-1.amazonaws.com/123456789012/user-dynamo-stream-deadletter",
+			sendErr:  errors.New("simulated outage"),
+			wantErr:  true,
+			wantSent: 1,
+		},
+		{
+			name:    "without a dlq the batch fails",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			logger := slog.New(slog.NewJSONHandler(&buf, nil))
+
+			var sent []*sqs.SendMessageInput
+			dlq := &mockSQSClient{
+				sendMessageFunc: func(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error) {
+					sent = append(sent, params)
+					if tt.sendErr != nil {
+						return nil, tt.sendErr
+					}
+					return &sqs.SendMessageOutput{}, nil
+				},
+			}
+			var writes int
+			client := &mockDynamoDBClient{
+				batchWriteItemFunc: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+					writes++
+					return &dynamodb.BatchWriteItemOutput{}, nil
+				},
+			}
+
+			h := handler(logger, client, dlq, nil, nil, mustLoadConfig(t, testEnv(map[string]string{"TABLE_NAME": "test-table", "DLQ_URL": tt.dlqURL})), fixedClock, nil)
+			resp, err := h(context.Background(), events.SQSEvent{Records: []events.SQSMessage{
+				{MessageId: "msg-1", Body: badBody, Attributes: map[string]string{"MessageGroupId": "default-group"}},
+				{MessageId: "msg-2", Body: insertBody("USER#123", 1)},
+			}})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("handler() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(resp.BatchItemFailures) != 0 {
+				t.Errorf("expected no batch item failures, got %v", resp.BatchItemFailures)
+			}
+			if len(sent) != tt.wantSent {
+				t.Fatalf("expected %d dead-lettered messages, got %d", tt.wantSent, len(sent))
+			}
+			if tt.wantErr {
+				return
+			}
+
+			if writes != 1 {
+				t.Errorf("expected the rest of the batch to be written, got %d writes", writes)
+			}
+			msg := sent[0]
+			if *msg.QueueUrl != tt.dlqURL || *msg.MessageBody != badBody {
+				t.Errorf("expected original body sent to %s, got %s to %s", tt.dlqURL, *msg.MessageBody, *msg.QueueUrl)
+			}
+			if _, ok := msg.MessageAttributes["ErrorMessage"]; !ok {
+				t.Errorf("expected ErrorMessage attribute, got %v", msg.MessageAttributes)
+			}
+			if tt.wantFIFO && (msg.MessageGroupId == nil || *msg.MessageGroupId != "default-group" || msg.MessageDeduplicationId == nil || *msg.MessageDeduplicationId != "msg-1") {
+				t.Errorf("expected group default-group and deduplication id msg-1, got %v and %v", msg.MessageGroupId, msg.MessageDeduplicationId)
+			}
+			if !tt.wantFIFO && (msg.MessageGroupId != nil || msg.MessageDeduplicationId != nil) {
+				t.Errorf("expected no group or deduplication id on a standard queue")
+			}
+
+			metrics := findLogs(parseLogs(t, &buf), "metrics")
+			if len(metrics) != 1 || metrics[0]["DeadLetteredRecords"] != 1.0 {
+				t.Errorf("expected DeadLetteredRecords 1, got %v", metrics)
+			}
+		})
+	}
+}
+
+// Test_handler_deadLetter_compressed verifies a dead-lettered gzip record keeps its message
+// attributes, so its body can still be decoded when it is redriven
+func Test_handler_deadLetter_compressed(t *testing.T) {
+	const badBody = `{not json`
+
+	var sent []*sqs.SendMessageInput
+	dlq := &mockSQSClient{
+		sendMessageFunc: func(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error) {
+			sent = append(sent, params)
+			return &sqs.SendMessageOutput{}, nil
+		},
+	}
+	client := &mockDynamoDBClient{
+		batchWriteItemFunc: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+			return &dynamodb.BatchWriteItemOutput{}, nil
+		},
+	}
+
+	env := testEnv(map[string]string{"TABLE_NAME": "test-table", "DLQ_URL": "https://sqs.us-east-1.amazonaws.com/123456789012/user-dynamo-stream-deadletter"})
+	h := handler(slog.New(slog.NewJSONHandler(io.Discard, nil)), client, dlq, nil, nil, mustLoadConfig(t, env), fixedClock, nil)
+	if _, err := h(context.Background(), events.SQSEvent{Records: []events.SQSMessage{
+		{
+			MessageId: "msg-1",
+			Body:      gzipBody(t, badBody),
+			MessageAttributes: map[string]events.SQSMessageAttribute{
+				"Content-Encoding": {DataType: "String", StringValue: aws.String("gzip")},
+				"Trace":            {DataType: "Binary", BinaryValue: []byte("trace-1")},
+			},
+		},
+	}}); err != nil {
+		t.Fatalf("handler() unexpected error = %v", err)
+	}
+	if len(sent) != 1 {
+		t.Fatalf("expected 1 dead-lettered message, got %d", len(sent))
+	}
+
+	msg := sent[0]
+	if _, ok := msg.MessageAttributes["ErrorMessage"]; !ok {
+		t.Errorf("expected ErrorMessage attribute, got %v", msg.MessageAttributes)
+	}
+	if trace := msg.MessageAttributes["Trace"]; aws.ToString(trace.DataType) != "Binary" || string(trace.BinaryValue) != "trace-1" {
+		t.Errorf("expected binary Trace attribute to be kept, got %v", trace)
+	}
+
+	redriven := events.SQSMessage{Body: *msg.MessageBody, MessageAttributes: map[string]events.SQSMessageAttribute{}}
+	for name, attr := range msg.MessageAttributes {
+		redriven.MessageAttributes[name] = events.SQSMessageAttribute{DataType: aws.ToString(attr.DataType), StringValue: attr.StringValue, BinaryValue: attr.BinaryValue}
+	}
+	body, err := decodeBody(redriven)
+	if err != nil {
+		t.Fatalf("decodeBody() of the dead-lettered message error = %v", err)
+	}
+	if string(body) != badBody {
+		t.Errorf("decoded dead-lettered body %q, want %q", body, badBody)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// dryRunRecord is the line written to the dry run output for each record that would have
+// written memberships. Writes are keyed by table, in the order they would have been made.
+type dryRunRecord struct {
+	MessageID string                     `json:"messageId"`
+	EventID   string                     `json:"eventId,omitempty"`
+	EventName string                     `json:"eventName"`
+	Writes    map[string][]dryRunRequest `json:"writes"`
+}
+
+// dryRunRequest is a put or delete request rendered as plain JSON values, so golden files stay
+// readable.
+type dryRunRequest struct {
+	Put    map[string]any `json:"put,omitempty"`
+	Delete map[string]any `json:"delete,omitempty"`
+}
+
+// recordDryRun logs the membership writes a record would have made instead of making them and,
+// when a dry run output is configured, appends them to it as a JSON line for diffing against
+// golden expectations.
+func (p *processor) recordDryRun(ctx context.Context, record events.SQSMessage, der events.DynamoDBEventRecord, writeRequests, reverseRequests []types.WriteRequest) error {
+	p.logger.InfoContext(ctx, "dry run: skipping membership writes",
+		slog.String("messageId", record.MessageId),
+		slog.Int("requestCount", len(writeRequests)+len(reverseRequests)))
+	if p.dryRunOutput == nil {
+		return nil
+	}
+
+	line := dryRunRecord{
+		MessageID: record.MessageId,
+		EventID:   der.EventID,
+		EventName: der.EventName,
+		Writes:    map[string][]dryRunRequest{p.tableName: dryRunRequests(writeRequests)},
+	}
+	if len(reverseRequests) > 0 {
+		line.Writes[p.reverseIndexTable] = dryRunRequests(reverseRequests)
+	}
+	b, err := json.Marshal(line)
+	if err != nil {
+		return fmt.Errorf("failed to marshal dry run writes: %w", err)
+	}
+	if _, err := p.dryRunOutput.Write(append(b, '\n')); err != nil {
+		return fmt.Errorf("failed to write dry run output: %w", err)
+	}
+	return nil
+}
+
+// dryRunRequests renders write requests for the dry run output. Items that cannot be rendered
+// are left empty rather than dropping the request.
+func dryRunRequests(requests []types.WriteRequest) []dryRunRequest {
+	rendered := make([]dryRunRequest, 0, len(requests))
+	for _, req := range requests {
+		var r dryRunRequest
+		switch {
+		case req.DeleteRequest != nil:
+			_ = attributevalue.UnmarshalMap(req.DeleteRequest.Key, &r.Delete)
+		case req.PutRequest != nil:
+			_ = attributevalue.UnmarshalMap(req.PutRequest.Item, &r.Put)
+		}
+		rendered = append(rendered, r)
+	}
+	return rendered
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+)
+
+// Test_handler_dryRunOutput verifies a dry run writes nothing to DynamoDB and serializes the
+// computed write requests to the dry run output
+func Test_handler_dryRunOutput(t *testing.T) {
+	client := &mockDynamoDBClient{
+		batchWriteItemFunc: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+			t.Error("expected no batch write in a dry run")
+			return &dynamodb.BatchWriteItemOutput{}, nil
+		},
+	}
+
+	env := testEnv(map[string]string{"TABLE_NAME": "test-table", "REVERSE_INDEX_TABLE": "reverse-table", "DRY_RUN": "true"})
+	p := newProcessor(slog.New(slog.NewJSONHandler(io.Discard, nil)), client, nil, nil, nil, mustLoadConfig(t, env), fixedClock)
+	var output bytes.Buffer
+	p.dryRunOutput = &output
+
+	_, err := p.lambdaHandler(nil)(context.Background(), events.SQSEvent{Records: []events.SQSMessage{
+		{MessageId: "modify", Body: `{"eventID": "event-1", "eventName": "MODIFY", "dynamodb": {"OldImage": {"pk": {"S": "USER#123"}, "organizations": {"L": [{"S": "org1"}, {"S": "org2"}]}}, "NewImage": {"pk": {"S": "USER#123"}, "organizations": {"L": [{"S": "org2"}, {"S": "org3"}]}}}}`},
+	}})
+	if err != nil {
+		t.Fatalf("handler() unexpected error = %v", err)
+	}
+
+	want := `{
+		"messageId": "modify",
+		"eventId": "event-1",
+		"eventName": "MODIFY",
+		"writes": {
+			"test-table": [
+				{"delete": {"pk": "ORGANIZATION#org1", "sk": "MEMBERSHIP#123"}},
+				{"put": {"pk": "ORGANIZATION#org3", "sk": "MEMBERSHIP#123", "createdAt": "2023-11-14T22:13:20Z", "schemaVersion": 1}}
+			],
+			"reverse-table": [
+				{"delete": {"pk": "USER#123", "sk": "ORGANIZATION#org1"}},
+				{"put": {"pk": "USER#123", "sk": "ORGANIZATION#org3"}}
+			]
+		}
+	}`
+	var got, expected any
+	if err := json.Unmarshal(output.Bytes(), &got); err != nil {
+		t.Fatalf("failed to decode dry run output %q: %v", output.String(), err)
+	}
+	if err := json.Unmarshal([]byte(want), &expected); err != nil {
+		t.Fatalf("failed to decode expected output: %v", err)
+	}
+	gotJSON, _ := json.Marshal(got)
+	wantJSON, _ := json.Marshal(expected)
+	if !bytes.Equal(gotJSON, wantJSON) {
+		t.Errorf("dry run output = %s, want %s", gotJSON, wantJSON)
+	}
+	if bytes.Count(output.Bytes(), []byte("\n")) != 1 {
+		t.Errorf("expected a single JSON line, got %q", output.String())
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// exportFile processes the items in the DynamoDB table export data file at path, or standard
+// input when path is "-". Export data files are written gzip compressed, which is detected from
+// the file's contents, so files can be used as downloaded from the export's S3 prefix.
+func exportFile(ctx context.Context, p *processor, path string) error {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("failed to open export file: %w", err)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return fmt.Errorf("failed to read export file: %w", err)
+		}
+		defer zr.Close()
+		_, err = p.importExport(ctx, zr)
+		return err
+	}
+	_, err := p.importExport(ctx, br)
+	return err
+}
+
+// importExport reads a DynamoDB table export to S3 in DynamoDB JSON format, one {"Item": {...}}
+// object per line, and processes each item as a synthetic INSERT record, so the memberships
+// table can be bootstrapped from an existing users table. Items are processed as replay
+// describes.
+func (p *processor) importExport(ctx context.Context, r io.Reader) (result, error) {
+	return p.replayLines(ctx, r, exportRecordBody)
+}
+
+// exportRecordBody wraps an export line's item as the NewImage of an INSERT event record body.
+func exportRecordBody(line []byte) (string, error) {
+	var export struct {
+		Item json.RawMessage `json:"Item"`
+	}
+	if err := json.Unmarshal(line, &export); err != nil {
+		return "", fmt.Errorf("failed to unmarshal export line: %w", err)
+	}
+	if len(export.Item) == 0 || string(export.Item) == "null" {
+		return "", errors.New("export line has no Item")
+	}
+
+	type change struct {
+		NewImage json.RawMessage `json:"NewImage"`
+	}
+	body, err := json.Marshal(struct {
+		EventName string `json:"eventName"`
+		Change    change `json:"dynamodb"`
+	}{EventName: "INSERT", Change: change{NewImage: export.Item}})
+	if err != nil {
+		return "", fmt.Errorf("failed to wrap export item: %w", err)
+	}
+	return string(body), nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// exportLines are two users as written by a DynamoDB table export to S3 in DynamoDB JSON format.
+const exportLines = `{"Item":{"pk":{"S":"USER#1"},"sk":{"S":"METADATA"},"organizations":{"L":[{"S":"org1"},{"S":"org2"}]}}}
+{"Item":{"pk":{"S":"USER#2"},"sk":{"S":"METADATA"},"organizations":{"L":[{"S":"org3"}]}}}
+`
+
+// Test_importExport verifies each exported item is processed as an INSERT, writing a
+// membership put for each of its organizations
+func Test_importExport(t *testing.T) {
+	var puts []string
+	client := &mockDynamoDBClient{
+		batchWriteItemFunc: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+			for _, req := range params.RequestItems["test-table"] {
+				if req.PutRequest == nil {
+					t.Errorf("expected only puts, got %v", req)
+					continue
+				}
+				item := req.PutRequest.Item
+				puts = append(puts, item["pk"].(*types.AttributeValueMemberS).Value+" "+item["sk"].(*types.AttributeValueMemberS).Value)
+			}
+			return &dynamodb.BatchWriteItemOutput{}, nil
+		},
+	}
+	p := newProcessor(slog.New(slog.NewJSONHandler(io.Discard, nil)), client, nil, nil, nil, mustLoadConfig(t, testEnv(map[string]string{"TABLE_NAME": "test-table"})), fixedClock)
+
+	res, err := p.importExport(context.Background(), strings.NewReader(exportLines+`{"NotAnItem":{}}`+"\n"))
+	if err == nil || err.Error() != "1 of 3 records failed to replay" {
+		t.Errorf("importExport() error = %v, want 1 of 3 records failed", err)
+	}
+	if res.Processed != 2 || res.Adds != 3 {
+		t.Errorf("importExport() = %+v, want 2 processed and 3 adds", res)
+	}
+
+	sort.Strings(puts)
+	want := []string{"ORGANIZATION#org1 MEMBERSHIP#1", "ORGANIZATION#org2 MEMBERSHIP#1", "ORGANIZATION#org3 MEMBERSHIP#2"}
+	if !reflect.DeepEqual(puts, want) {
+		t.Errorf("puts = %v, want %v", puts, want)
+	}
+}
+
+// Test_exportFile verifies gzip compressed export data files are read as downloaded
+func Test_exportFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "export.json.gz")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := gzip.NewWriter(f)
+	if _, err := zw.Write([]byte(exportLines)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var writes int
+	client := &mockDynamoDBClient{
+		batchWriteItemFunc: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+			writes += len(params.RequestItems["test-table"])
+			return &dynamodb.BatchWriteItemOutput{}, nil
+		},
+	}
+	p := newProcessor(slog.New(slog.NewJSONHandler(io.Discard, nil)), client, nil, nil, nil, mustLoadConfig(t, testEnv(map[string]string{"TABLE_NAME": "test-table"})), fixedClock)
+	if err := exportFile(context.Background(), p, path); err != nil {
+		t.Fatalf("exportFile() unexpected error = %v", err)
+	}
+	if writes != 3 {
+		t.Errorf("expected 3 membership writes, got %d", writes)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// defaultIdempotencyTTL is how long processed EventIDs are remembered. It only needs to outlast
+// the source queue's retention and redrive window.
+const defaultIdempotencyTTL = 24 * time.Hour
+
+// Idempotency record statuses.
+const (
+	idempotencyInProgress = "IN_PROGRESS"
+	idempotencyCompleted  = "COMPLETED"
+)
+
+// idempotencyTable records the EventIDs of processed stream records in a DynamoDB table keyed by
+// pk, so records redelivered in a later invocation are skipped. Items carry an expiresAt epoch
+// seconds attribute for use as the table's TTL attribute.
+//
+// A record is claimed before it is applied and marked completed only after its writes succeed.
+// An in-progress claim can be taken again, so a crash between the two leaves the record to be
+// applied again on redelivery: processing stays at-least-once, and the table only removes the
+// redeliveries of records that finished.
+type idempotencyTable struct {
+	client    dynamoDBClient
+	tableName string
+	ttl       time.Duration
+}
+
+// claim records that eventID is being processed. It returns false when the record has already
+// been completed and should be skipped.
+func (t *idempotencyTable) claim(ctx context.Context, eventID string, now time.Time) (bool, error) {
+	_, err := t.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(t.tableName),
+		Item:                t.item(eventID, idempotencyInProgress, now),
+		ConditionExpression: aws.String("attribute_not_exists(pk) OR #status = :inProgress"),
+		ExpressionAttributeNames: map[string]string{
+			"#status": "status",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":inProgress": &types.AttributeValueMemberS{Value: idempotencyInProgress},
+		},
+	})
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// complete marks eventID as processed.
+func (t *idempotencyTable) complete(ctx context.Context, eventID string, now time.Time) error {
+	_, err := t.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(t.tableName),
+		Item:      t.item(eventID, idempotencyCompleted, now),
+	})
+	return err
+}
+
+// item builds the idempotency item for eventID.
+func (t *idempotencyTable) item(eventID, status string, now time.Time) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"pk":        &types.AttributeValueMemberS{Value: eventID},
+		"status":    &types.AttributeValueMemberS{Value: status},
+		"expiresAt": &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Add(t.ttl).Unix(), 10)},
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Test_handler_idempotency verifies records are claimed in the idempotency table before they are
+// applied, marked completed afterwards, and skipped when already completed
+func Test_handler_idempotency(t *testing.T) {
+	const body = `{
+		"eventID": "event-1",
+		"eventName": "INSERT",
+		"dynamodb": {
+			"NewImage": {
+				"pk": {"S": "USER#123"},
+				"organizations": {"L": [{"S": "org1"}]}
+			}
+		}
+	}`
+
+	tests := []struct {
+		name         string
+		claimErr     error
+		writeErr     error
+		wantErr      bool
+		wantWrites   int
+		wantStatuses []string
+		wantSkips    float64
+	}{
+		{
+			name:         "unseen record is claimed, applied and completed",
+			wantWrites:   1,
+			wantStatuses: []string{idempotencyInProgress, idempotencyCompleted},
+		},
+		{
+			name:         "completed record is skipped",
+			claimErr:     &types.ConditionalCheckFailedException{Message: aws.String("The conditional request failed")},
+			wantStatuses: []string{idempotencyInProgress},
+			wantSkips:    1,
+		},
+		{
+			name:         "failed write leaves the claim in progress",
+			writeErr:     errors.New("simulated throttling"),
+			wantErr:      true,
+			wantWrites:   1,
+			wantStatuses: []string{idempotencyInProgress},
+		},
+		{
+			name:         "failed claim fails the batch",
+			claimErr:     errors.New("simulated outage"),
+			wantErr:      true,
+			wantStatuses: []string{idempotencyInProgress},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			logger := slog.New(slog.NewJSONHandler(&buf, nil))
+
+			var statuses []string
+			var writes int
+			client := &mockDynamoDBClient{
+				putItemFunc: func(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+					if *params.TableName != "idempotency-table" {
+						t.Errorf("expected PutItem on idempotency-table, got %s", *params.TableName)
+					}
+					if pk := params.Item["pk"].(*types.AttributeValueMemberS).Value; pk != "event-1" {
+						t.Errorf("expected key pk event-1, got %s", pk)
+					}
+					if ttl := params.Item["expiresAt"].(*types.AttributeValueMemberN).Value; ttl != "1700086400" {
+						t.Errorf("expected expiresAt 1700086400, got %s", ttl)
+					}
+					status := params.Item["status"].(*types.AttributeValueMemberS).Value
+					statuses = append(statuses, status)
+					if status == idempotencyInProgress {
+						if params.ConditionExpression == nil {
+							t.Errorf("expected claim to be conditional")
+						}
+						if tt.claimErr != nil {
+							return nil, tt.claimErr
+						}
+					}
+					return &dynamodb.PutItemOutput{}, nil
+				},
+				batchWriteItemFunc: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+					writes++
+					if tt.writeErr != nil {
+						return nil, tt.writeErr
+					}
+					return &dynamodb.BatchWriteItemOutput{}, nil
+				},
+			}
+
+			h := handler(logger, client, nil, nil, nil, mustLoadConfig(t, testEnv(map[string]string{"TABLE_NAME": "test-table", "IDEMPOTENCY_TABLE": "idempotency-table"})), fixedClock, nil)
+			_, err := h(context.Background(), events.SQSEvent{Records: []events.SQSMessage{{MessageId: "msg-1", Body: body}}})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("handler() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if writes != tt.wantWrites {
+				t.Errorf("expected %d batch writes, got %d", tt.wantWrites, writes)
+			}
+			if len(statuses) != len(tt.wantStatuses) {
+				t.Fatalf("expected idempotency writes %v, got %v", tt.wantStatuses, statuses)
+			}
+			for i := range statuses {
+				if statuses[i] != tt.wantStatuses[i] {
+					t.Errorf("expected idempotency writes %v, got %v", tt.wantStatuses, statuses)
+				}
+			}
+
+			metrics := findLogs(parseLogs(t, &buf), "metrics")
+			if tt.wantSkips > 0 && (len(metrics) != 1 || metrics[0]["IdempotentSkips"] != tt.wantSkips) {
+				t.Errorf("expected IdempotentSkips %v, got %v", tt.wantSkips, metrics)
+			}
+		})
+	}
+}
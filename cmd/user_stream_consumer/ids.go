@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/base32"
+	"strings"
+)
+
+// idEncoding encodes organization and user IDs in membership keys with ENCODE_IDS. Unpadded
+// base32 uses only A-Z and 2-7, so an encoded ID can never contain the # that separates the
+// parts of a composite key.
+var idEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// encodeID encodes an ID for use in a membership key.
+func encodeID(id string) string {
+	return idEncoding.EncodeToString([]byte(id))
+}
+
+// decodeID decodes an ID read from a membership key written with ENCODE_IDS.
+func decodeID(encoded string) (string, error) {
+	b, err := idEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// keyOrgID returns the organization ID written into membership keys, encoded when EncodeIDs is
+// set.
+func (a membershipAttributes) keyOrgID(orgID string) string {
+	if !a.EncodeIDs {
+		return orgID
+	}
+	return encodeID(orgID)
+}
+
+// keyUserPK returns the user key membership keys are built from. When EncodeIDs is set, the
+// whole ID after the key's first #, including any further # it contains, is encoded, so
+// extractUserID returns it intact.
+func (a membershipAttributes) keyUserPK(userPK string) string {
+	if !a.EncodeIDs {
+		return userPK
+	}
+	id := userPK
+	if _, after, ok := strings.Cut(userPK, "#"); ok {
+		id = after
+	}
+	return "USER#" + encodeID(id)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Test_encodeID verifies IDs containing key delimiters round-trip through encoding and that
+// their encoded form never contains the delimiter
+func Test_encodeID(t *testing.T) {
+	for _, id := range []string{"org1", "org#1", "a#b#c", "#", "acme/eu-west", "ünïcode#ид", ""} {
+		encoded := encodeID(id)
+		if strings.Contains(encoded, "#") {
+			t.Errorf("encodeID(%q) = %q contains #", id, encoded)
+		}
+		decoded, err := decodeID(encoded)
+		if err != nil {
+			t.Fatalf("decodeID(%q) unexpected error = %v", encoded, err)
+		}
+		if decoded != id {
+			t.Errorf("decodeID(encodeID(%q)) = %q", id, decoded)
+		}
+	}
+	if _, err := decodeID("not base32!"); err == nil {
+		t.Error("expected an error decoding an invalid ID")
+	}
+}
+
+// Test_handler_encodeIDs verifies ENCODE_IDS encodes organization and user IDs containing # in
+// every key, so the delete for a membership matches the key it was put with
+func Test_handler_encodeIDs(t *testing.T) {
+	var puts, deletes []string
+	client := &mockDynamoDBClient{batchWriteItemFunc: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+		for table, requests := range params.RequestItems {
+			for _, req := range requests {
+				pk, sk, _ := strings.Cut(writeRequestKey(req), "\x00")
+				if req.PutRequest != nil {
+					puts = append(puts, table+" "+pk+" "+sk)
+				} else {
+					deletes = append(deletes, table+" "+pk+" "+sk)
+				}
+			}
+		}
+		return &dynamodb.BatchWriteItemOutput{}, nil
+	}}
+
+	env := testEnv(map[string]string{"TABLE_NAME": "test-table", "REVERSE_INDEX_TABLE": "reverse-table", "ENCODE_IDS": "true"})
+	h := handler(slog.New(slog.NewJSONHandler(io.Discard, nil)), client, nil, nil, nil, mustLoadConfig(t, env), fixedClock, nil)
+	image := `{"pk": {"S": "USER#a#b"}, "organizations": {"L": [{"S": "org#1"}]}}`
+	for _, body := range []string{
+		`{"eventName": "INSERT", "dynamodb": {"NewImage": ` + image + `}}`,
+		`{"eventName": "REMOVE", "dynamodb": {"OldImage": ` + image + `}}`,
+	} {
+		if _, err := h(context.Background(), events.SQSEvent{Records: []events.SQSMessage{{Body: body}}}); err != nil {
+			t.Fatalf("handler() unexpected error = %v", err)
+		}
+	}
+
+	user, org := encodeID("a#b"), encodeID("org#1")
+	want := []string{
+		"reverse-table USER#" + user + " ORGANIZATION#" + org,
+		"test-table ORGANIZATION#" + org + " MEMBERSHIP#" + user,
+	}
+	sort.Strings(puts)
+	sort.Strings(deletes)
+	if !reflect.DeepEqual(puts, want) {
+		t.Errorf("puts = %v, want %v", puts, want)
+	}
+	if !reflect.DeepEqual(deletes, want) {
+		t.Errorf("deletes = %v, want %v", deletes, want)
+	}
+}
+
+// Test_reconcileMemberships_encodeIDs verifies reconciling with ENCODE_IDS reads the encoded user
+// partition and decodes the organization IDs it holds
+func Test_reconcileMemberships_encodeIDs(t *testing.T) {
+	client := &mockDynamoDBClient{queryFunc: func(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error) {
+		if pk := params.ExpressionAttributeValues[":pk"].(*types.AttributeValueMemberS).Value; pk != "USER#"+encodeID("a#b") {
+			t.Errorf("expected Query for the encoded user, got %s", pk)
+		}
+		return &dynamodb.QueryOutput{Items: []map[string]types.AttributeValue{
+			{"sk": &types.AttributeValueMemberS{Value: "ORGANIZATION#" + encodeID("org#1")}},
+			{"sk": &types.AttributeValueMemberS{Value: "ORGANIZATION#not-encoded!"}},
+		}}, nil
+	}}
+	env := testEnv(map[string]string{"TABLE_NAME": "test-table", "REVERSE_INDEX_TABLE": "reverse-table", "ENCODE_IDS": "true"})
+	p := newProcessor(slog.New(slog.NewJSONHandler(io.Discard, nil)), client, nil, nil, nil, mustLoadConfig(t, env), fixedClock)
+
+	orgs, err := p.reconcileMemberships(context.Background(), newInvocation(), "USER#a#b")
+	if err != nil {
+		t.Fatalf("reconcileMemberships() unexpected error = %v", err)
+	}
+	if want := []string{"org#1"}; !reflect.DeepEqual(orgs, want) {
+		t.Errorf("reconcileMemberships() = %v, want %v", orgs, want)
+	}
+}
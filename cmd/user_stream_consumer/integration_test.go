@@ -0,0 +1,130 @@
+//go:build integration
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// newIntegrationTable creates a temporary membership table in the DynamoDB Local instance at
+// DYNAMODB_ENDPOINT, deleted when the test ends, skipping the test when the variable is unset.
+func newIntegrationTable(t *testing.T) (*dynamodb.Client, string) {
+	t.Helper()
+	endpoint := os.Getenv("DYNAMODB_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("DYNAMODB_ENDPOINT is not set")
+	}
+
+	client := dynamodb.New(dynamodb.Options{
+		BaseEndpoint: aws.String(endpoint),
+		Region:       "us-east-1",
+		Credentials:  credentials.NewStaticCredentialsProvider("local", "local", ""),
+	})
+	table := fmt.Sprintf("local-integration-%d", time.Now().UnixNano())
+	ctx := context.Background()
+	_, err := client.CreateTable(ctx, &dynamodb.CreateTableInput{
+		TableName: aws.String(table),
+		AttributeDefinitions: []types.AttributeDefinition{
+			{AttributeName: aws.String("pk"), AttributeType: types.ScalarAttributeTypeS},
+			{AttributeName: aws.String("sk"), AttributeType: types.ScalarAttributeTypeS},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String("pk"), KeyType: types.KeyTypeHash},
+			{AttributeName: aws.String("sk"), KeyType: types.KeyTypeRange},
+		},
+		BillingMode: types.BillingModePayPerRequest,
+	})
+	if err != nil {
+		t.Fatalf("failed to create table %s: %v", table, err)
+	}
+	t.Cleanup(func() {
+		if _, err := client.DeleteTable(context.Background(), &dynamodb.DeleteTableInput{TableName: aws.String(table)}); err != nil {
+			t.Errorf("failed to delete table %s: %v", table, err)
+		}
+	})
+	if err := dynamodb.NewTableExistsWaiter(client).Wait(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(table)}, time.Minute); err != nil {
+		t.Fatalf("table %s did not become active: %v", table, err)
+	}
+	return client, table
+}
+
+// members queries the membership sort keys of an organization.
+func members(t *testing.T, client *dynamodb.Client, table, org string) []string {
+	t.Helper()
+	out, err := client.Query(context.Background(), &dynamodb.QueryInput{
+		TableName:                 aws.String(table),
+		KeyConditionExpression:    aws.String("pk = :pk"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{":pk": &types.AttributeValueMemberS{Value: "ORGANIZATION#" + org}},
+		ConsistentRead:            aws.Bool(true),
+	})
+	if err != nil {
+		t.Fatalf("failed to query organization %s: %v", org, err)
+	}
+	sks := []string{}
+	for _, item := range out.Items {
+		sks = append(sks, item["sk"].(*types.AttributeValueMemberS).Value)
+	}
+	sort.Strings(sks)
+	return sks
+}
+
+// Test_integration_handler runs INSERT, MODIFY and REMOVE records for a user through the handler
+// against DynamoDB Local and checks the memberships left in the table after each
+func Test_integration_handler(t *testing.T) {
+	client, table := newIntegrationTable(t)
+	h := handler(slog.New(slog.NewJSONHandler(io.Discard, nil)), client, nil, nil, nil, mustLoadConfig(t, testEnv(map[string]string{"TABLE_NAME": table})), time.Now, nil)
+
+	steps := []struct {
+		name string
+		body string
+		want map[string][]string
+	}{
+		{
+			name: "insert",
+			body: `{"eventID": "1", "eventName": "INSERT", "dynamodb": {"SequenceNumber": "100",
+				"NewImage": {"pk": {"S": "USER#123"}, "sk": {"S": "METADATA"}, "organizations": {"L": [{"S": "org1"}, {"S": "org2"}]}}}}`,
+			want: map[string][]string{"org1": {"MEMBERSHIP#123"}, "org2": {"MEMBERSHIP#123"}, "org3": {}},
+		},
+		{
+			name: "modify",
+			body: `{"eventID": "2", "eventName": "MODIFY", "dynamodb": {"SequenceNumber": "200",
+				"OldImage": {"pk": {"S": "USER#123"}, "sk": {"S": "METADATA"}, "organizations": {"L": [{"S": "org1"}, {"S": "org2"}]}},
+				"NewImage": {"pk": {"S": "USER#123"}, "sk": {"S": "METADATA"}, "organizations": {"L": [{"S": "org2"}, {"S": "org3"}]}}}}`,
+			want: map[string][]string{"org1": {}, "org2": {"MEMBERSHIP#123"}, "org3": {"MEMBERSHIP#123"}},
+		},
+		{
+			name: "remove",
+			body: `{"eventID": "3", "eventName": "REMOVE", "dynamodb": {"SequenceNumber": "300",
+				"OldImage": {"pk": {"S": "USER#123"}, "sk": {"S": "METADATA"}, "organizations": {"L": [{"S": "org2"}, {"S": "org3"}]}}}}`,
+			want: map[string][]string{"org1": {}, "org2": {}, "org3": {}},
+		},
+	}
+	for _, step := range steps {
+		response, err := h(context.Background(), events.SQSEvent{Records: []events.SQSMessage{{MessageId: step.name, Body: step.body}}})
+		if err != nil {
+			t.Fatalf("%s: handler() unexpected error = %v", step.name, err)
+		}
+		if len(response.BatchItemFailures) != 0 {
+			t.Fatalf("%s: unexpected batch item failures %v", step.name, response.BatchItemFailures)
+		}
+		for org, want := range step.want {
+			if got := members(t, client, table, org); !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: members of %s = %v, want %v", step.name, org, got, want)
+			}
+		}
+	}
+}
@@ -2,19 +2,36 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"os"
+	"os/signal"
+	"reflect"
+	"runtime/debug"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
-	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"golang.org/x/time/rate"
 )
 
 // Package main provides a Lambda function that processes DynamoDB stream events from SQS
@@ -33,14 +50,51 @@ type user struct {
 // organizationMembership represents a membership record in the organizations table
 // linking an organization to a user.
 type organizationMembership struct {
-	PK string `dynamodbav:"pk"` // Primary key in format "ORGANIZATION#<id>"
-	SK string `dynamodbav:"sk"` // Sort key in format "MEMBERSHIP#<user_id>"
+	PK            string `dynamodbav:"pk"`                  // Primary key in format "ORGANIZATION#<id>", or with ORG_PK_PREFIX
+	SK            string `dynamodbav:"sk"`                  // Sort key in format "MEMBERSHIP#<user_id>"
+	Role          string `dynamodbav:"role,omitempty"`      // User's role in the organization, when known
+	CreatedAt     string `dynamodbav:"createdAt,omitempty"` // RFC 3339 time the membership was created
+	JoinedAt      string `dynamodbav:"joinedAt,omitempty"`  // RFC 3339 time the user joined the organization, when known
+	GSI1PK        string `dynamodbav:"gsi1pk,omitempty"`    // GSI partition key in format "USER#<user_id>", when enabled
+	GSI1SK        string `dynamodbav:"gsi1sk,omitempty"`    // GSI sort key in format "ORG#<org_id>", when enabled
+	Version       int    `dynamodbav:"version,omitempty"`   // Item version for optimistic concurrency, when enabled
+	Source        string `dynamodbav:"source,omitempty"`    // Consumer deployment, such as a region, that wrote the item
+	SchemaVersion int    `dynamodbav:"schemaVersion"`       // membershipSchemaVersion of the code that wrote the item
+}
+
+// userMembership represents a reverse index record linking a user to an organization,
+// allowing a user's memberships to be queried by user.
+type userMembership struct {
+	PK string `dynamodbav:"pk"` // Primary key in format "USER#<user_id>"
+	SK string `dynamodbav:"sk"` // Sort key in format "ORGANIZATION#<id>"
 }
 
 // dynamoDBClient defines the interface for DynamoDB operations required by the Lambda function.
 // This interface helps with testing by allowing mock implementations.
 type dynamoDBClient interface {
 	BatchWriteItem(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error)
+	GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error)
+	PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error)
+	DeleteItem(ctx context.Context, params *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error)
+	Query(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error)
+	DescribeTable(ctx context.Context, params *dynamodb.DescribeTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DescribeTableOutput, error)
+	TransactWriteItems(ctx context.Context, params *dynamodb.TransactWriteItemsInput, optFns ...func(*dynamodb.Options)) (*dynamodb.TransactWriteItemsOutput, error)
+	BatchExecuteStatement(ctx context.Context, params *dynamodb.BatchExecuteStatementInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchExecuteStatementOutput, error)
+}
+
+// permanentError marks a record failure that retrying cannot fix, such as a body that is not
+// a valid DynamoDB event record. Errors that are not marked permanent are treated as retryable.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// isRetryable reports whether a record that failed with err may succeed if processed again.
+func isRetryable(err error) bool {
+	var pe *permanentError
+	return !errors.As(err, &pe)
 }
 
 // extractUserID extracts the ID portion from a composite key (e.g., "USER#123" -> "123").
@@ -53,6 +107,111 @@ func extractUserID(compositeKey string) string {
 	return parts[1]
 }
 
+// extractPK reads the pk attribute of an image as a string. Binary keys, from tables created
+// with a B-typed partition key, are read as their UTF-8 bytes. Empty is returned when the
+// attribute is missing or of any other type.
+func extractPK(image map[string]events.DynamoDBAttributeValue) string {
+	pk, ok := image["pk"]
+	if !ok {
+		return ""
+	}
+	switch pk.DataType() {
+	case events.DataTypeString:
+		return pk.String()
+	case events.DataTypeBinary:
+		return string(pk.Binary())
+	default:
+		return ""
+	}
+}
+
+// defaultOrgAttribute is the user image attribute organizations are read from unless
+// ORG_ATTRIBUTE_NAME overrides it.
+const defaultOrgAttribute = "organizations"
+
+// extractOrganizations reads the organization IDs from the attr attribute of an image. The
+// attribute may be a List of org IDs or a Map keyed by org ID; Map keys are returned sorted so
+// the resulting write requests are deterministic. Number elements in a List are read as their
+// canonical string, so {"N": "42"} and {"S": "42"} name the same organization. Missing or
+// unsupported attributes yield nil. present is false when the attribute is missing or NULL,
+// which says nothing about the user's organizations, as opposed to an empty List or Map, which
+// clears them.
+func extractOrganizations(image map[string]events.DynamoDBAttributeValue, attr string) (organizations []string, present bool) {
+	orgs, ok := image[attr]
+	if !ok || orgs.DataType() == events.DataTypeNull {
+		return nil, false
+	}
+
+	switch orgs.DataType() {
+	case events.DataTypeList:
+		for _, org := range orgs.List() {
+			if org.DataType() == events.DataTypeNumber {
+				organizations = append(organizations, canonicalNumber(org.Number()))
+				continue
+			}
+			organizations = append(organizations, org.String())
+		}
+	case events.DataTypeMap:
+		for orgID := range orgs.Map() {
+			organizations = append(organizations, orgID)
+		}
+		sort.Strings(organizations)
+	}
+	return organizations, true
+}
+
+// canonicalNumber formats an integer number attribute without a sign or leading zeros, such as
+// "042" to "42". Other numbers are returned unchanged.
+func canonicalNumber(n string) string {
+	i, err := strconv.ParseInt(n, 10, 64)
+	if err != nil {
+		return n
+	}
+	return strconv.FormatInt(i, 10)
+}
+
+// organizationMetadata holds the per-organization fields of a Map-typed organizations attribute.
+// Fields missing from the Map, or of the wrong type, are left zero.
+type organizationMetadata struct {
+	Role     string    // User's role in the organization, from a "role" string
+	Roles    []string  // User's roles in the organization, from a "roles" list of strings or string set
+	JoinedAt time.Time // When the user joined, from a "joinedAt" number of Unix seconds
+}
+
+// extractOrganizationMetadata reads per-organization metadata from a Map-typed attr attribute,
+// where each value is itself a Map that may carry the fields of organizationMetadata.
+// Organizations without any metadata, and List-typed attributes, are omitted from the result.
+func extractOrganizationMetadata(image map[string]events.DynamoDBAttributeValue, attr string) map[string]organizationMetadata {
+	orgs, ok := image[attr]
+	if !ok || orgs.DataType() != events.DataTypeMap {
+		return nil
+	}
+
+	metadata := make(map[string]organizationMetadata)
+	for orgID, value := range orgs.Map() {
+		if value.DataType() != events.DataTypeMap {
+			continue
+		}
+		var meta organizationMetadata
+		fields := value.Map()
+		if role, ok := fields["role"]; ok && role.DataType() == events.DataTypeString {
+			meta.Role = role.String()
+		}
+		if roles, ok := fields["roles"]; ok {
+			meta.Roles = extractRoles(roles)
+		}
+		if joined, ok := fields["joinedAt"]; ok && joined.DataType() == events.DataTypeNumber {
+			if secs, err := strconv.ParseInt(joined.Number(), 10, 64); err == nil {
+				meta.JoinedAt = time.Unix(secs, 0).UTC()
+			}
+		}
+		if meta.Role != "" || len(meta.Roles) > 0 || !meta.JoinedAt.IsZero() {
+			metadata[orgID] = meta
+		}
+	}
+	return metadata
+}
+
 // main is the entry point for the Lambda function. It initializes the runtime
 // with a background context and standard output/environment configuration.
 func main() {
@@ -64,182 +223,1556 @@ func main() {
 
 // run initializes the Lambda handler with AWS configuration and starts the runtime.
 // It accepts a context for AWS operations, an io.Writer for logging output, and
-// a function to retrieve environment variables.
+// a function to retrieve environment variables, which are parsed and validated once by
+// loadConfig before anything else starts. When REPLAY_FILE is set, the records in the
+// file are replayed instead of starting the runtime, and when EXPORT_FILE is set, the items in
+// the table export are processed as INSERT records. When POLL_MODE is enabled, QUEUE_URL is
+// consumed directly until SIGTERM or an interrupt.
 func run(ctx context.Context, stdout io.Writer, getenv func(string) string) error {
-	logger := slog.New(slog.NewJSONHandler(stdout, nil))
+	cfg, err := loadConfig(getenv)
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+	logger := newLogger(stdout, cfg.LogFormat, cfg.LogLevel)
 
-	cfg, err := config.LoadDefaultConfig(ctx)
+	awsCfg, err := awsconfig.LoadDefaultConfig(ctx, configOptions(cfg)...)
 	if err != nil {
 		return fmt.Errorf("failed to load AWS config: %w", err)
 	}
+	if cfg, err = resolveTableName(ctx, ssm.NewFromConfig(awsCfg), cfg); err != nil {
+		return fmt.Errorf("failed to resolve TABLE_NAME_PARAM: %w", err)
+	}
+
+	dynamoCfg := dynamoDBConfig(awsCfg, cfg)
+	client := dynamodb.NewFromConfig(dynamoCfg)
+	replicas, err := parseReplicaTables(cfg.ReplicaTables, func(region string) dynamoDBClient {
+		return dynamodb.NewFromConfig(dynamoCfg, func(o *dynamodb.Options) { o.Region = region })
+	})
+	if err != nil {
+		return fmt.Errorf("failed to parse REPLICA_TABLES: %w", err)
+	}
+
+	if cfg.ValidateStreamTable != "" {
+		checkStreamViewType(ctx, logger, client, cfg.ValidateStreamTable)
+	}
 
-	client := dynamodb.NewFromConfig(cfg)
-	handler := handler(logger, client, getenv)
-	lambda.Start(handler)
+	var dlq sqsClient
+	if cfg.DLQURL != "" {
+		dlq = sqs.NewFromConfig(awsCfg)
+	}
+	payloads := s3.NewFromConfig(awsCfg)
+
+	// The processor is configured once, so every run mode below writes the same outputs.
+	p := newProcessor(logger, client, dlq, payloads, replicas, cfg, time.Now)
+	if cfg.DryRunOutput != "" {
+		f, err := os.OpenFile(cfg.DryRunOutput, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+		if err != nil {
+			return fmt.Errorf("failed to open DRY_RUN_OUTPUT: %w", err)
+		}
+		defer f.Close()
+		p.dryRunOutput = f
+	}
+	if cfg.AuditOutput != "" {
+		f, err := os.OpenFile(cfg.AuditOutput, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+		if err != nil {
+			return fmt.Errorf("failed to open AUDIT_OUTPUT: %w", err)
+		}
+		defer f.Close()
+		p.auditWriter = f
+	}
+	if cfg.SNSTopicARN != "" {
+		p.notifier = sns.NewFromConfig(awsCfg)
+	}
+	if cfg.LogFormat == "text" {
+		// CloudWatch only extracts EMF metrics from JSON lines.
+		p.metricsLogger = newLogger(stdout, "json", cfg.LogLevel)
+	}
+
+	if cfg.ReplayFile != "" {
+		return replayFile(ctx, p, cfg.ReplayFile)
+	}
+	if cfg.ExportFile != "" {
+		return exportFile(ctx, p, cfg.ExportFile)
+	}
+	if cfg.PollMode {
+		ctx, stop := signal.NotifyContext(ctx, syscall.SIGTERM, os.Interrupt)
+		defer stop()
+		return p.poll(ctx, sqs.NewFromConfig(awsCfg), cfg.QueueURL)
+	}
+
+	lambda.Start(p.lambdaHandler(nil))
 	return nil
 }
 
+// configOptions returns the AWS config load options for cfg. SDKMaxRetries sets how many times
+// the SDK's standard retryer retries a failed DynamoDB call before the error reaches the handler;
+// a negative value keeps the SDK default.
+func configOptions(cfg config) []func(*awsconfig.LoadOptions) error {
+	var opts []func(*awsconfig.LoadOptions) error
+	if cfg.SDKMaxRetries >= 0 {
+		opts = append(opts, awsconfig.WithRetryMaxAttempts(cfg.SDKMaxRetries+1))
+	}
+	return opts
+}
+
+// defaultAssumeRoleSessionName identifies the consumer's sessions in the organizations account's
+// CloudTrail unless ASSUME_ROLE_SESSION_NAME overrides it.
+const defaultAssumeRoleSessionName = "user-stream-consumer"
+
+// dynamoDBConfig returns the config DynamoDB clients are created from. When ASSUME_ROLE_ARN is
+// set, credentials come from assuming that role through STS, for an organizations table that
+// lives in another account; credentials are cached and refreshed before they expire. Other
+// clients keep the function's own credentials.
+func dynamoDBConfig(awsCfg aws.Config, cfg config) aws.Config {
+	if cfg.AssumeRoleARN == "" {
+		return awsCfg
+	}
+
+	assumed := awsCfg.Copy()
+	assumed.Credentials = aws.NewCredentialsCache(stscreds.NewAssumeRoleProvider(sts.NewFromConfig(awsCfg), cfg.AssumeRoleARN, func(o *stscreds.AssumeRoleOptions) {
+		o.RoleSessionName = cfg.AssumeRoleSessionName
+	}))
+	return assumed
+}
+
+// newLogger creates a logger writing to w in the given format, "json" or "text", at the given
+// level, such as "debug" or "warn". Text output is easier to read during local development; any
+// other format falls back to JSON, and an unrecognised level falls back to info.
+func newLogger(w io.Writer, format, level string) *slog.Logger {
+	var opts slog.HandlerOptions
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err == nil {
+		opts.Level = lvl
+	}
+	if format == "text" {
+		return slog.New(slog.NewTextHandler(w, &opts))
+	}
+	return slog.New(slog.NewJSONHandler(w, &opts))
+}
+
 // handler creates a Lambda handler that processes DynamoDB stream events from SQS.
 // For each user record change, it creates or updates corresponding organization membership
 // records in a target DynamoDB table. It handles INSERT, MODIFY, and REMOVE events,
 // maintaining consistency between user organizations and membership records.
-func handler(logger *slog.Logger, client dynamoDBClient, getenv func(string) string) func(ctx context.Context, event events.SQSEvent) error {
-	tableName := getenv("TABLE_NAME")
-	if tableName == "" {
-		tableName = "poc-organizations"
+// Membership writes are also fanned out to any replicas, and permanently failing records are
+// sent to the dead-letter queue through dlq when a DLQ URL is configured. Message bodies
+// offloaded to S3 are read through payloads. The now function supplies the current time,
+// allowing tests to control the clock. When onComplete is not nil it is called with the result
+// of every batch before the handler returns.
+func handler(logger *slog.Logger, client dynamoDBClient, dlq sqsClient, payloads s3Client, replicas []replica, cfg config, now func() time.Time, onComplete func(result)) func(ctx context.Context, event events.SQSEvent) (events.SQSEventResponse, error) {
+	return newProcessor(logger, client, dlq, payloads, replicas, cfg, now).lambdaHandler(onComplete)
+}
+
+// coldStart is true until the first invocation in this execution environment has started. It is
+// initialized with the package, so it is already set when lambda.Start begins serving
+// invocations, and the runtime invokes the handler serially, so it needs no locking.
+var coldStart = true
+
+// lambdaHandler returns a Lambda handler that processes every SQS event with p. When onComplete
+// is not nil it is called with the result of every batch before the handler returns. Each
+// invocation logs whether it was a cold start, for latency analysis.
+func (p *processor) lambdaHandler(onComplete func(result)) func(ctx context.Context, event events.SQSEvent) (events.SQSEventResponse, error) {
+	return func(ctx context.Context, event events.SQSEvent) (events.SQSEventResponse, error) {
+		// Tie every log line to the invocation; contexts outside the Lambda runtime, such as in
+		// tests, carry no request ID.
+		p := p
+		if lc, ok := lambdacontext.FromContext(ctx); ok && lc.AwsRequestID != "" {
+			scoped := *p
+			scoped.logger = p.logger.With(slog.String("requestId", lc.AwsRequestID))
+			p = &scoped
+		}
+
+		cold := coldStart
+		coldStart = false
+		p.logger.InfoContext(ctx, "invocation started", slog.Bool("coldStart", cold))
+
+		res, response, err := p.processBatch(ctx, event)
+		if onComplete != nil {
+			onComplete(res)
+		}
+		return response, err
 	}
+}
 
-	return func(ctx context.Context, event events.SQSEvent) error {
-		logger.InfoContext(ctx, "processing sqs event", slog.Int("records", len(event.Records)))
+// newProcessor creates a processor from cfg, which loadConfig has already validated.
+func newProcessor(logger *slog.Logger, client dynamoDBClient, dlq sqsClient, payloads s3Client, replicas []replica, cfg config, now func() time.Time) *processor {
+	var writeLimiter *rate.Limiter
+	if cfg.MaxWritesPerSec > 0 {
+		writeLimiter = rate.NewLimiter(rate.Limit(cfg.MaxWritesPerSec), 1)
+	}
 
-		for _, record := range event.Records {
-			var der events.DynamoDBEventRecord
-			if err := json.Unmarshal([]byte(record.Body), &der); err != nil {
-				logger.ErrorContext(ctx, "failed to unmarshal dynamo event",
-					slog.String("error", err.Error()),
-					slog.String("body", record.Body))
-				return fmt.Errorf("failed to unmarshal DynamoDB event record: %w", err)
-			}
+	var publishLimiter *rate.Limiter
+	if cfg.SNSMaxPublishPerSec > 0 {
+		publishLimiter = rate.NewLimiter(rate.Limit(cfg.SNSMaxPublishPerSec), 1)
+	}
 
-			var writeRequests []types.WriteRequest
+	var writeSlots chan struct{}
+	if cfg.MaxInflightWrites > 0 {
+		writeSlots = make(chan struct{}, cfg.MaxInflightWrites)
+	}
 
-			switch der.EventName {
-			case string(events.DynamoDBOperationTypeRemove):
-				if der.Change.OldImage == nil {
-					continue
-				}
-				var oldUser user
-				oldUser.PK = der.Change.OldImage["pk"].String()
-				if orgs, ok := der.Change.OldImage["organizations"]; ok {
-					for _, org := range orgs.List() {
-						oldUser.Organizations = append(oldUser.Organizations, org.String())
-					}
-				}
-				writeRequests = createWriteRequests(oldUser.PK, oldUser.Organizations, true)
+	var orgCounts *orgCountCache
+	if cfg.CheckRemovals {
+		orgCounts = newOrgCountCache()
+	}
 
-			case string(events.DynamoDBOperationTypeModify):
-				if der.Change.NewImage == nil {
-					continue
-				}
+	var baseline baselineSource
+	if cfg.BaselineSource != "" {
+		baseline = &tableBaseline{client: client, tableName: cfg.BaselineSource}
+	}
 
-				// Get old and new organizations
-				var oldOrgs, newOrgs []string
-				if der.Change.OldImage != nil {
-					if orgs, ok := der.Change.OldImage["organizations"]; ok {
-						for _, org := range orgs.List() {
-							oldOrgs = append(oldOrgs, org.String())
-						}
-					}
-				}
+	var idempotency *idempotencyTable
+	if cfg.IdempotencyTable != "" {
+		idempotency = &idempotencyTable{client: client, tableName: cfg.IdempotencyTable, ttl: defaultIdempotencyTTL}
+	}
 
-				userPK := der.Change.NewImage["pk"].String()
-				if orgs, ok := der.Change.NewImage["organizations"]; ok {
-					for _, org := range orgs.List() {
-						newOrgs = append(newOrgs, org.String())
-					}
-				}
+	return &processor{
+		logger:              logger,
+		client:              client,
+		dlq:                 dlq,
+		payloads:            payloads,
+		dlqURL:              cfg.DLQURL,
+		bestEffort:          cfg.FailureMode == failureModeBestEffort,
+		maxFailureRatio:     cfg.MaxFailureRatio,
+		now:                 now,
+		replicas:            replicas,
+		latencyThreshold:    cfg.IngestLatencyWarn,
+		maxBatchSize:        cfg.MaxBatchSize,
+		tableName:           cfg.TableName,
+		orgPKPrefix:         cfg.OrgPKPrefix,
+		encodeIDs:           cfg.EncodeIDs,
+		appNamespace:        cfg.AppNamespace,
+		orgAttribute:        cfg.OrgAttribute,
+		deleteFlag:          cfg.DeleteFlag,
+		userIDAttribute:     cfg.UserIDAttribute,
+		roleMemberships:     cfg.RoleMemberships,
+		perOrgMetrics:       cfg.PerOrgMetrics,
+		sourceTableName:     cfg.SourceTableName,
+		reverseIndexTable:   cfg.ReverseIndexTable,
+		reconcileRemoves:    cfg.ReconcileRemoves,
+		transactWrites:      cfg.TransactWrites,
+		partiqlWrites:       cfg.WriteAPI == writeAPIPartiQL,
+		sequenceConditions:  cfg.SequenceConditions,
+		separatePasses:      cfg.SeparatePasses,
+		gsiKeys:             cfg.GSIKeys,
+		normalizeOrgs:       cfg.NormalizeOrgs,
+		lowercaseOrgs:       cfg.LowercaseOrgs,
+		versions:            cfg.Versions,
+		timePrefixSK:        cfg.TimePrefixSK,
+		includeUserSK:       cfg.IncludeUserSK,
+		sourceTag:           cfg.SourceTag,
+		ownedDeletes:        cfg.OwnedDeletes,
+		maxLogItems:         cfg.MaxLogItems,
+		redactEmail:         cfg.RedactEmail,
+		dryRun:              cfg.DryRun,
+		auditWriter:         io.Discard,
+		heartbeatInterval:   cfg.HeartbeatInterval,
+		pollRetryDelay:      defaultPollRetryDelay,
+		writeLimiter:        writeLimiter,
+		snsTopicARN:         cfg.SNSTopicARN,
+		snsFailOnError:      cfg.SNSFailOnError,
+		publishLimiter:      publishLimiter,
+		writeSlots:          writeSlots,
+		flushThreshold:      cfg.FlushThreshold,
+		retryBudget:         cfg.RetryBudget,
+		retryBaseDelay:      defaultRetryBaseDelay,
+		adaptiveBackoffBase: cfg.AdaptiveBackoffBase,
+		adaptiveBackoffMax:  cfg.AdaptiveBackoffMax,
+		latencyFirstCalls:   cfg.LatencyFirstCalls,
+		checkSequence:       cfg.CheckSequence,
+		sortBySequence:      cfg.SortBySequence,
+		coalesceModifies:    cfg.CoalesceModifies,
+		auditEvents:         cfg.AuditEvents,
+		baseline:            baseline,
+		idempotency:         idempotency,
+		orgAllowlist:        cfg.OrgAllowlist,
+		eventTypes:          cfg.EventTypes,
+		projected:           projectableAttributes(logger, cfg.ProjectAttributes),
+		watchAttributes:     cfg.WatchAttributes,
+		onAttributeChange:   logAttributeChange(logger),
+		orgCounts:           orgCounts,
+		removalMargin:       cfg.RemovalSanityMargin,
+	}
+}
 
-				// Find organizations to remove and add
-				toRemove := make([]string, 0)
-				for _, org := range oldOrgs {
-					found := false
-					for _, newOrg := range newOrgs {
-						if org == newOrg {
-							found = true
-							break
-						}
-					}
-					if !found {
-						toRemove = append(toRemove, org)
-					}
-				}
+// Failure modes selected by FAILURE_MODE.
+const (
+	failureModeFailFast   = "fail_fast"
+	failureModeBestEffort = "best_effort"
+)
 
-				toAdd := make([]string, 0)
-				for _, org := range newOrgs {
-					found := false
-					for _, oldOrg := range oldOrgs {
-						if org == oldOrg {
-							found = true
-							break
-						}
-					}
-					if !found {
-						toAdd = append(toAdd, org)
-					}
-				}
+// result summarises the outcome of processing a batch.
+type result struct {
+	Processed int // Records handled without error, including skipped records
+	Adds      int // Memberships written
+	Removes   int // Memberships deleted
+	Updates   int // Memberships rewritten because their roles changed
+	Skipped   int // Records handled without writing any memberships
+	Failed    int // Records that failed, whether reported, dead-lettered, or failing the batch
+}
 
-				// Create write requests for removals and additions
-				writeRequests = append(writeRequests, createWriteRequests(userPK, toRemove, true)...)
-				writeRequests = append(writeRequests, createWriteRequests(userPK, toAdd, false)...)
+// defaultMaxBatchSize is the most records an invocation is expected to receive unless
+// MAX_BATCH_SIZE overrides it, matching the default batch size of an SQS event source mapping.
+const defaultMaxBatchSize = 10
 
-			case string(events.DynamoDBOperationTypeInsert):
-				if der.Change.NewImage == nil {
-					continue
-				}
-				var user user
-				user.PK = der.Change.NewImage["pk"].String()
-				if orgs, ok := der.Change.NewImage["organizations"]; ok {
-					for _, org := range orgs.List() {
-						user.Organizations = append(user.Organizations, org.String())
-					}
+// metricsLog returns the logger EMF metrics are written to: metricsLogger when set, otherwise
+// logger.
+func (p *processor) metricsLog() *slog.Logger {
+	if p.metricsLogger != nil {
+		return p.metricsLogger
+	}
+	return p.logger
+}
+
+// processBatch processes every record in an SQS event. A record that panics, or that runs past
+// its share of the invocation's remaining time, is reported as a batch item failure so the rest
+// of the batch can continue. When a dead-letter queue is configured, a record that fails with a
+// permanent error is sent there and acknowledged; any other record error fails the whole batch,
+// unless best-effort mode reports it as a batch item failure and continues. Records from a FIFO
+// queue are not continued past: the first one reported is returned with every record after it,
+// unprocessed, so a retried record cannot land after later changes in its message group. When
+// the fraction of batch item failures exceeds the maximum failure ratio, the whole batch fails
+// instead.
+func (p *processor) processBatch(ctx context.Context, event events.SQSEvent) (result, events.SQSEventResponse, error) {
+	p.logger.InfoContext(ctx, "processing sqs event", slog.Int("records", len(event.Records)))
+
+	inv := newInvocation()
+	// A batch larger than expected is still processed, but may point at an event source mapping
+	// misconfigured with a huge batch size or window.
+	if p.maxBatchSize > 0 && len(event.Records) > p.maxBatchSize {
+		p.logger.WarnContext(ctx, "batch exceeds the expected maximum size",
+			slog.Int("records", len(event.Records)),
+			slog.Int("maxBatchSize", p.maxBatchSize))
+		inv.metrics.increment("OversizedBatches", 1)
+	}
+	defer func() {
+		// Records that wrote nothing, such as no-op modifies and filtered events, show how much
+		// of the traffic could be filtered out upstream instead.
+		if inv.result.Processed > 0 {
+			inv.metrics.increment("RecordsProcessed", inv.result.Processed)
+			inv.metrics.increment("ZeroWriteRecords", inv.result.Skipped)
+			p.logger.InfoContext(ctx, "batch summary",
+				slog.Int("processed", inv.result.Processed),
+				slog.Int("zeroWriteRecords", inv.result.Skipped),
+				slog.Int("failed", inv.result.Failed))
+		}
+		if calls := inv.metrics.count("BatchWriteCalls"); calls > 0 {
+			requests := inv.metrics.count("WriteRequestsTotal")
+			p.logger.InfoContext(ctx, "batch write summary",
+				slog.Int("batchWriteCalls", calls),
+				slog.Int("writeRequests", requests),
+				slog.Float64("requestsPerCall", float64(requests)/float64(calls)))
+		}
+		inv.metrics.emit(ctx, p.metricsLog(), p.now())
+	}()
+
+	if p.sortBySequence {
+		event.Records = p.sortRecords(ctx, inv, event.Records)
+	}
+	if p.coalesceModifies {
+		p.planCoalescing(ctx, inv, event.Records)
+	}
+
+	var response events.SQSEventResponse
+	// reportFailure reports the record at i as a batch item failure, returning whether the rest
+	// of the batch must be left unprocessed. FIFO records carry a MessageGroupId; later records
+	// in the group would be applied before the failed one is redelivered, so they are reported
+	// with it instead.
+	reportFailure := func(i int) bool {
+		response.BatchItemFailures = append(response.BatchItemFailures, itemFailures(inv, event.Records[i].MessageId)...)
+		if event.Records[i].Attributes["MessageGroupId"] == "" {
+			return false
+		}
+		rest := event.Records[i+1:]
+		for _, record := range rest {
+			response.BatchItemFailures = append(response.BatchItemFailures, itemFailures(inv, record.MessageId)...)
+		}
+		response.BatchItemFailures = dedupeItemFailures(response.BatchItemFailures)
+		if len(rest) > 0 {
+			p.logger.WarnContext(ctx, "stopping fifo batch at failed record",
+				slog.String("messageId", event.Records[i].MessageId),
+				slog.Int("unprocessed", len(rest)))
+			inv.metrics.increment("UnprocessedRecords", len(rest))
+		}
+		return true
+	}
+
+	for i, record := range event.Records {
+		if sent, ok := record.Attributes["SentTimestamp"]; ok {
+			latency, err := ingestLatency(sent, p.now())
+			if err != nil {
+				p.logger.WarnContext(ctx, "invalid SentTimestamp attribute",
+					slog.String("error", err.Error()),
+					slog.String("messageId", record.MessageId))
+			} else {
+				inv.metrics.observe("IngestLatencyMillis", unitMilliseconds, float64(latency.Milliseconds()))
+				if p.latencyThreshold > 0 && latency > p.latencyThreshold {
+					p.logger.WarnContext(ctx, "ingest latency exceeds threshold",
+						slog.String("messageId", record.MessageId),
+						slog.Int64("latencyMillis", latency.Milliseconds()),
+						slog.Int64("thresholdMillis", p.latencyThreshold.Milliseconds()))
 				}
-				writeRequests = createWriteRequests(user.PK, user.Organizations, false)
 			}
+		}
 
-			if len(writeRequests) == 0 {
-				continue
+		recordCtx, cancel := recordContext(ctx, len(event.Records)-i)
+		err := p.countRecord(recordCtx, inv, record)
+		timedOut := err != nil && errors.Is(recordCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil
+		cancel()
+		if err == nil {
+			continue
+		}
+
+		if timedOut {
+			p.logger.ErrorContext(ctx, "record timed out",
+				slog.String("error", err.Error()),
+				slog.String("messageId", record.MessageId))
+			inv.metrics.increment("RecordTimeouts", 1)
+			if reportFailure(i) {
+				break
 			}
+			continue
+		}
 
-			input := &dynamodb.BatchWriteItemInput{
-				RequestItems: map[string][]types.WriteRequest{
-					tableName: writeRequests,
-				},
+		var pe *panicError
+		if errors.As(err, &pe) {
+			if reportFailure(i) {
+				break
 			}
+			continue
+		}
+		if !isRetryable(err) && p.dlqURL != "" {
+			err = p.deadLetterRun(ctx, inv, event.Records, record, err)
+		}
+		if err != nil && !p.bestEffort {
+			return inv.result, response, err
+		}
+		if err != nil {
+			p.logger.ErrorContext(ctx, "failed to process record",
+				slog.String("error", err.Error()),
+				slog.String("messageId", record.MessageId))
+			if reportFailure(i) {
+				break
+			}
+		}
+	}
 
-			logger.InfoContext(ctx, "writing organization memberships",
-				slog.String("table", tableName),
-				slog.Int("requestCount", len(writeRequests)),
-				slog.Any("input", input))
+	// When most of a batch is failing, such as while the table is unavailable, retrying it whole
+	// avoids churning individual messages through the queue.
+	if failures := len(response.BatchItemFailures); p.maxFailureRatio > 0 && failures > 0 {
+		if ratio := float64(failures) / float64(len(event.Records)); ratio > p.maxFailureRatio {
+			p.logger.ErrorContext(ctx, "failure ratio exceeded, failing the batch",
+				slog.Int("failures", failures),
+				slog.Int("records", len(event.Records)),
+				slog.Float64("maxFailureRatio", p.maxFailureRatio))
+			inv.metrics.increment("FailureRatioExceeded", 1)
+			return inv.result, events.SQSEventResponse{}, fmt.Errorf("%d of %d records failed, exceeding the maximum failure ratio of %g", failures, len(event.Records), p.maxFailureRatio)
+		}
+	}
 
-			if _, err := client.BatchWriteItem(ctx, input); err != nil {
-				logger.ErrorContext(ctx, "failed to batch write memberships",
-					slog.String("error", err.Error()),
-					slog.String("table", tableName),
-					slog.Int("requestCount", len(writeRequests)))
-				return fmt.Errorf("failed to batch write organization memberships: %w", err)
+	return inv.result, response, nil
+}
+
+// responseMargin is the time recordContext holds back from the invocation deadline so the batch
+// item failures can still be built and returned after the last record times out.
+const responseMargin = 500 * time.Millisecond
+
+// recordContext derives the context for processing the next of remaining records, splitting the
+// time left before the invocation deadline, less responseMargin, evenly between them so a single
+// slow record cannot consume the whole invocation. ctx is returned unchanged when it has no
+// deadline, such as in poll mode.
+func recordContext(ctx context.Context, remaining int) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return ctx, func() {}
+	}
+	now := time.Now()
+	return context.WithDeadline(ctx, now.Add((deadline.Sub(now)-responseMargin)/time.Duration(remaining)))
+}
+
+// countRecord processes a record, tallying the outcome in the invocation result.
+func (p *processor) countRecord(ctx context.Context, inv *invocation, record events.SQSMessage) error {
+	writes := inv.result.Adds + inv.result.Removes + inv.result.Updates
+	if err := p.recoverRecord(ctx, inv, record); err != nil {
+		inv.result.Failed++
+		return err
+	}
+	inv.result.Processed++
+	if inv.result.Adds+inv.result.Removes+inv.result.Updates == writes {
+		inv.result.Skipped++
+	}
+	return nil
+}
+
+// recordFunc processes a single SQS message within an invocation.
+type recordFunc func(ctx context.Context, inv *invocation, record events.SQSMessage) error
+
+// panicError reports a panic recovered while processing a record.
+type panicError struct {
+	value any
+}
+
+func (e *panicError) Error() string {
+	return fmt.Sprintf("panic processing record: %v", e.value)
+}
+
+// recoverRecord processes a record, converting a panic into a panicError so one malformed
+// record cannot crash the whole invocation.
+func (p *processor) recoverRecord(ctx context.Context, inv *invocation, record events.SQSMessage) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			p.logger.ErrorContext(ctx, "recovered panic processing record",
+				slog.String("messageId", record.MessageId),
+				slog.String("panic", fmt.Sprint(r)),
+				slog.String("stack", string(debug.Stack())))
+			inv.metrics.increment("RecordPanics", 1)
+			err = &panicError{value: r}
+		}
+	}()
+
+	process := recordFunc(p.processRecord)
+	if p.process != nil {
+		process = p.process
+	}
+	return process(ctx, inv, record)
+}
+
+// processor holds the configuration and clients used to turn stream records into
+// organization membership writes.
+type processor struct {
+	logger              *slog.Logger
+	metricsLogger       *slog.Logger // JSON logger EMF metrics are written to; nil writes them to logger
+	client              dynamoDBClient
+	dlq                 sqsClient
+	payloads            s3Client // Reads message bodies offloaded to S3 by the SQS extended client
+	dlqURL              string   // Queue permanently failing records are sent to; empty leaves them to the redrive policy
+	bestEffort          bool     // Report failed records as batch item failures and continue instead of failing the batch
+	maxFailureRatio     float64  // Fraction of batch item failures above which the whole batch fails; zero disables it
+	now                 func() time.Time
+	process             recordFunc          // Replaces processRecord when set, allowing tests to stub record processing
+	replicas            []replica           // Regional tables membership writes are fanned out to
+	latencyThreshold    time.Duration       // Ingest latency above which a warning is logged; zero disables it
+	maxBatchSize        int                 // Records per invocation above which a warning is logged; zero disables it
+	tableName           string              // Table membership records are written to
+	orgPKPrefix         string              // Prefix of the organization ID in membership partition keys
+	encodeIDs           bool                // Encode organization and user IDs in membership keys
+	appNamespace        string              // Namespace in membership sort keys for tables shared between apps
+	orgAttribute        string              // User image attribute organizations are read from
+	perOrgMetrics       bool                // Count membership changes per organization in metrics dimensioned by OrganizationId
+	roleMemberships     bool                // Write a membership per role listed in an organization's roles, with the role appended to the SK
+	userIDAttribute     string              // String or number user attribute the user ID is read from instead of the pk; empty parses the pk
+	deleteFlag          string              // Boolean user attribute whose true value in a MODIFY's new image removes every membership; empty disables it
+	normalizeOrgs       bool                // Trim whitespace from organization IDs before building keys
+	lowercaseOrgs       bool                // Lowercase organization IDs before building keys
+	sourceTableName     string              // Users table read to backfill KEYS_ONLY records; empty disables backfill
+	reverseIndexTable   string              // Table user-to-organization records are written to; empty disables the reverse index
+	reconcileRemoves    bool                // Query the reverse index for REMOVE records without organizations in their old image
+	transactWrites      bool                // Use TransactWriteItems so forward and reverse writes for an org are atomic
+	partiqlWrites       bool                // Write with PartiQL statements through BatchExecuteStatement instead of BatchWriteItem
+	sequenceConditions  bool                // Write each membership conditioned on the record's sequence number so stale records cannot overwrite newer ones
+	separatePasses      bool                // Batch write all deletes before any puts
+	gsiKeys             bool                // Write GSI key attributes on membership items
+	versions            bool                // Write a version attribute on membership items
+	timePrefixSK        bool                // Prefix membership sort keys with the join time; deletes are skipped
+	includeUserSK       bool                // Append the user's sort key to membership sort keys
+	sourceTag           string              // Written as source on membership items; empty omits it
+	ownedDeletes        bool                // Only delete memberships whose source is sourceTag
+	maxLogItems         int                 // Maximum write requests logged per table; zero logs them all
+	redactEmail         bool                // Mask email addresses in logged user data
+	dryRun              bool                // Compute membership writes without making them
+	dryRunOutput        io.Writer           // Receives the computed writes as JSON lines in a dry run; nil only logs them
+	auditWriter         io.Writer           // Receives an audit line for every membership change written; discards them by default
+	heartbeatInterval   time.Duration       // How often poll mode extends the visibility of a batch in flight; zero never does
+	pollRetryDelay      time.Duration       // Backoff after a failed receive in poll mode, doubling with each consecutive failure
+	writeLimiter        *rate.Limiter       // Spaces out BatchWriteItem calls; nil leaves them unlimited
+	notifier            snsClient           // Publishes membership changes to snsTopicARN; nil disables notifications
+	snsTopicARN         string              // SNS topic membership changes are published to
+	snsFailOnError      bool                // Fail the record when a membership change cannot be published
+	publishLimiter      *rate.Limiter       // Spaces out SNS publishes; nil leaves them unlimited
+	writeSlots          chan struct{}       // Bounds concurrent BatchWriteItem calls; nil leaves them unbounded
+	flushThreshold      int                 // Requests per BatchWriteItem call, up to maxBatchWriteItems; zero uses the limit
+	retryBudget         int                 // Unprocessed item retries allowed per invocation, across all chunks
+	retryBaseDelay      time.Duration       // Backoff before the first unprocessed item retry, doubling after each
+	adaptiveBackoffBase time.Duration       // Write delay after the first throttled call, doubling with each further one
+	adaptiveBackoffMax  time.Duration       // Cap on the adaptive write delay; zero disables adaptive backoff
+	latencyFirstCalls   bool                // Observe BatchWriteLatencyMillis for a chunk's first call only, excluding retries
+	checkSequence       bool                // Warn when a user's records arrive out of sequence number order
+	sortBySequence      bool                // Process a batch's records in stream sequence number order
+	coalesceModifies    bool                // Apply each run of MODIFY records for a user item in a batch as one net change
+	auditEvents         bool                // Log an audit event for every membership change
+	baseline            baselineSource      // Source of truth diffed against instead of the old image; nil uses the old image
+	idempotency         *idempotencyTable   // Records processed EventIDs across invocations; nil disables it
+	orgAllowlist        map[string]struct{} // Organizations memberships are maintained for; empty maintains all
+	eventTypes          map[string]struct{} // Event names that are processed; empty processes all
+	projected           []string            // User image attributes copied onto membership puts
+	watchAttributes     []string            // User image attributes whose changes are passed to onAttributeChange
+	onAttributeChange   attributeChangeFunc // Called for every watched attribute a record changes; logs the change by default
+	orgCounts           *orgCountCache      // Last known organization count per user; nil disables the removal check
+	removalMargin       int                 // Removals allowed beyond the known organization count
+}
+
+// invocation holds the state scoped to a single handler invocation.
+type invocation struct {
+	metrics         *metrics
+	result          result
+	lastSequence    map[string]string       // Highest sequence number seen per user key
+	processedEvents map[string]struct{}     // EventIDs of stream records already applied
+	retries         int                     // In-process write retries made, counted against the retry budget
+	writeDelay      time.Duration           // Pause before each new chunk's BatchWriteItem call, adapted to throttling
+	coalesced       map[string]coalescedRun // Runs of MODIFY records applied by the message ID they are keyed by
+	coalescedInto   map[string]string       // Message ID each skipped MODIFY record was coalesced into
+}
+
+// newInvocation creates the state for a new handler invocation.
+func newInvocation() *invocation {
+	return &invocation{
+		metrics:         newMetrics(),
+		lastSequence:    make(map[string]string),
+		processedEvents: make(map[string]struct{}),
+		coalesced:       make(map[string]coalescedRun),
+		coalescedInto:   make(map[string]string),
+	}
+}
+
+// processRecord decodes a single SQS message into a DynamoDB event record and applies the
+// resulting membership changes, then reports any changed watched attributes. Errors that
+// retrying cannot fix are wrapped in permanentError; all other errors are retryable.
+func (p *processor) processRecord(ctx context.Context, inv *invocation, record events.SQSMessage) error {
+	if into, ok := inv.coalescedInto[record.MessageId]; ok {
+		p.logger.InfoContext(ctx, "skipping coalesced modify record",
+			slog.String("messageId", record.MessageId),
+			slog.String("coalescedInto", into))
+		inv.metrics.increment("CoalescedModifies", 1)
+		return nil
+	}
+
+	der, err := p.decodeRecord(ctx, record)
+	if err != nil {
+		p.logger.ErrorContext(ctx, "failed to decode record",
+			slog.String("error", err.Error()),
+			slog.String("messageId", record.MessageId),
+			slog.Bool("retryable", isRetryable(err)))
+		return err
+	}
+	if run, ok := inv.coalesced[record.MessageId]; ok {
+		der.Change.OldImage = run.oldImage
+	}
+
+	userKey := recordUserKey(der)
+	actor := extractActor(der)
+	p.logger.InfoContext(ctx, "processing dynamo event record",
+		slog.String("messageId", record.MessageId),
+		slog.String("eventId", der.EventID),
+		slog.String("eventName", der.EventName),
+		slog.String("sequenceNumber", der.Change.SequenceNumber),
+		slog.String("userKey", userKey),
+		slog.String("actor", p.redact(actor)))
+
+	if err := validateRecord(der); err != nil {
+		if onlyUnknownEventName(err) {
+			// A new operation type or upstream schema drift; skip the record but make it visible.
+			p.logger.WarnContext(ctx, "unknown event name",
+				slog.String("messageId", record.MessageId),
+				slog.String("eventId", der.EventID),
+				slog.String("eventName", der.EventName))
+			inv.metrics.increment("UnknownEventName", 1)
+			return nil
+		}
+		p.logger.ErrorContext(ctx, "malformed stream record",
+			slog.String("error", err.Error()),
+			slog.String("messageId", record.MessageId),
+			slog.String("eventId", der.EventID))
+		inv.metrics.increment("MalformedRecords", 1)
+		return &permanentError{err: fmt.Errorf("malformed stream record %s: %w", record.MessageId, err)}
+	}
+
+	// A pk such as "USER#" carries no user ID, and would produce "MEMBERSHIP#" sort keys.
+	if strings.TrimSpace(extractUserID(p.recordUserPK(der, userKey))) == "" {
+		p.logger.WarnContext(ctx, "skipping record with empty user ID",
+			slog.String("messageId", record.MessageId),
+			slog.String("eventId", der.EventID),
+			slog.String("userKey", userKey))
+		inv.metrics.increment("InvalidUserID", 1)
+		return nil
+	}
+
+	if !p.eventTypeAllowed(der.EventName) {
+		p.logger.InfoContext(ctx, "skipping filtered event type",
+			slog.String("messageId", record.MessageId),
+			slog.String("eventName", der.EventName))
+		inv.metrics.increment("FilteredByEventType", 1)
+		return nil
+	}
+
+	// A redrive can place the same stream record in a batch more than once.
+	if _, ok := inv.processedEvents[der.EventID]; ok && der.EventID != "" {
+		p.logger.InfoContext(ctx, "skipping duplicate stream record",
+			slog.String("messageId", record.MessageId),
+			slog.String("eventId", der.EventID))
+		inv.metrics.increment("DuplicateRecordsSkipped", 1)
+		return nil
+	}
+
+	if p.checkSequence {
+		p.checkSequenceOrder(ctx, inv, userKey, der.Change.SequenceNumber)
+	}
+
+	// Records are claimed before they are applied and only marked completed afterwards, so a
+	// crash part way through leaves the claim open and the redelivered record is applied again.
+	// A dry run never claims records, so a later real run still applies them.
+	if p.idempotency == nil || der.EventID == "" || p.dryRun {
+		if err := p.applyRecord(ctx, inv, record, der, userKey, actor); err != nil {
+			return err
+		}
+		p.notifyAttributeChanges(der, userKey)
+		return nil
+	}
+	claimed, err := p.idempotency.claim(ctx, der.EventID, p.now())
+	if err != nil {
+		p.logger.ErrorContext(ctx, "failed to claim stream record",
+			slog.String("error", err.Error()),
+			slog.String("messageId", record.MessageId),
+			slog.String("eventId", der.EventID))
+		return fmt.Errorf("failed to claim stream record %s: %w", der.EventID, err)
+	}
+	if !claimed {
+		p.logger.InfoContext(ctx, "skipping already processed stream record",
+			slog.String("messageId", record.MessageId),
+			slog.String("eventId", der.EventID))
+		inv.metrics.increment("IdempotentSkips", 1)
+		return nil
+	}
+	if err := p.applyRecord(ctx, inv, record, der, userKey, actor); err != nil {
+		return err
+	}
+	if err := p.idempotency.complete(ctx, der.EventID, p.now()); err != nil {
+		p.logger.ErrorContext(ctx, "failed to mark stream record completed",
+			slog.String("error", err.Error()),
+			slog.String("messageId", record.MessageId),
+			slog.String("eventId", der.EventID))
+		return fmt.Errorf("failed to mark stream record %s completed: %w", der.EventID, err)
+	}
+	p.notifyAttributeChanges(der, userKey)
+	return nil
+}
+
+// applyRecord applies the membership changes described by a decoded stream record.
+func (p *processor) applyRecord(ctx context.Context, inv *invocation, record events.SQSMessage, der events.DynamoDBEventRecord, userKey, actor string) error {
+	var (
+		userPK   string
+		toAdd    []string
+		toRemove []string
+		// Organizations held before and after whose roles changed, rewritten in place rather
+		// than removed and added again.
+		toUpdate []string
+		metadata map[string]organizationMetadata
+		// Metadata of the organizations in toRemove, from the old image, so every role variant
+		// of a removed membership is deleted.
+		removedMetadata map[string]organizationMetadata
+	)
+
+	switch der.EventName {
+	case string(events.DynamoDBOperationTypeRemove):
+		orgs, present := p.organizations(der.Change.OldImage)
+		if !present && p.reconcileRemoves {
+			// A KEYS_ONLY stream carries no old image to say which memberships to clean up.
+			userPK = userKey
+			reconciled, err := p.reconcileMemberships(ctx, inv, userPK)
+			if err != nil {
+				return err
 			}
+			toRemove = reconciled
+			break
+		}
+		if der.Change.OldImage == nil {
+			p.logger.WarnContext(ctx, "remove record without old image",
+				slog.String("messageId", record.MessageId),
+				slog.String("userId", extractUserID(userKey)))
+			return nil
+		}
+		var oldUser user
+		oldUser.PK = p.userPK(der.Change.OldImage, userKey)
+		oldUser.Organizations = orgs
+		removedMetadata = p.organizationMetadata(der.Change.OldImage)
+		userPK, toRemove = oldUser.PK, oldUser.Organizations
+
+	case string(events.DynamoDBOperationTypeModify):
+		if der.Change.NewImage == nil {
+			return nil
+		}
+
+		userPK = p.userPK(der.Change.NewImage, userKey)
+		if p.softDeleted(der.Change.NewImage) {
+			// Producers that flag users as deleted instead of removing them still need every
+			// membership cleaned up, whatever happened to the organizations attribute.
+			orgs, present := p.organizations(der.Change.OldImage)
+			if !present && p.reconcileRemoves {
+				reconciled, err := p.reconcileMemberships(ctx, inv, userPK)
+				if err != nil {
+					return err
+				}
+				orgs = reconciled
+			}
+			removedMetadata = p.organizationMetadata(der.Change.OldImage)
+			inv.metrics.increment("SoftDeletes", 1)
+			p.logger.InfoContext(ctx, "treating soft deleted user as removed",
+				slog.String("messageId", record.MessageId),
+				slog.String("userId", extractUserID(userPK)),
+				slog.String("attribute", p.deleteFlag))
+			toRemove = orgs
+			break
+		}
+
+		// Most modifications touch attributes other than organizations, so skip them before
+		// reading or diffing anything. A baseline replaces the old image, so its loaded
+		// organizations are compared below instead.
+		if p.baseline == nil && !p.hasMembershipChange(der.Change.OldImage, der.Change.NewImage) {
+			inv.metrics.increment("NoopModify", 1)
+			p.recordProcessed(inv, userKey, der)
+			return nil
+		}
+
+		// Get old and new organizations
+		var oldOrgs []string
+		if der.Change.OldImage != nil {
+			oldOrgs, _ = p.organizations(der.Change.OldImage)
+		}
+		if baseline, ok, err := p.loadBaseline(ctx, userPK); err != nil {
+			return err
+		} else if ok {
+			oldOrgs = baseline
+		}
+		newOrgs, present := p.organizations(der.Change.NewImage)
+		metadata = p.organizationMetadata(der.Change.NewImage)
+		removedMetadata = p.organizationMetadata(der.Change.OldImage)
+		roleChanged := p.roleChangedOrgs(removedMetadata, metadata, oldOrgs, newOrgs)
+		if !present || (sameOrganizations(oldOrgs, newOrgs) && len(roleChanged) == 0) {
+			inv.metrics.increment("NoopModify", 1)
+			p.recordProcessed(inv, userKey, der)
+			return nil
 		}
 
+		toAdd, toRemove = diffOrganizations(oldOrgs, newOrgs)
+		p.logger.DebugContext(ctx, "membership diff",
+			slog.String("userId", extractUserID(userPK)),
+			slog.Any("added", toAdd),
+			slog.Any("removed", toRemove))
+
+		if err := p.checkRemovalCount(ctx, inv, userKey, len(toRemove)); err != nil {
+			return err
+		}
+		toUpdate = roleChanged
+
+	case string(events.DynamoDBOperationTypeInsert):
+		if der.Change.NewImage == nil {
+			return nil
+		}
+		var user user
+		user.PK = p.userPK(der.Change.NewImage, userKey)
+		var present bool
+		user.Organizations, present = p.organizations(der.Change.NewImage)
+		if !present {
+			// Users are normally created with their organizations; one without any may point
+			// to a bug upstream.
+			inv.metrics.increment("InsertWithoutOrgs", 1)
+			p.logger.DebugContext(ctx, "insert without organizations attribute",
+				slog.String("messageId", record.MessageId),
+				slog.String("userId", extractUserID(user.PK)),
+				slog.String("attribute", p.orgAttribute))
+		}
+		userPK, toAdd = user.PK, user.Organizations
+		metadata = p.organizationMetadata(der.Change.NewImage)
+
+		if baseline, ok, err := p.loadBaseline(ctx, userPK); err != nil {
+			return err
+		} else if ok {
+			toAdd, toRemove = diffOrganizations(baseline, user.Organizations)
+		}
+
+	default:
+		// validateRecord has already skipped or rejected every other event name.
+		return nil
+	}
+
+	toAdd = p.filterAllowlisted(inv, p.dropEmptyOrganizations(ctx, inv, userPK, toAdd))
+	toRemove = p.filterAllowlisted(inv, p.dropEmptyOrganizations(ctx, inv, userPK, toRemove))
+	toUpdate = p.filterAllowlisted(inv, p.dropEmptyOrganizations(ctx, inv, userPK, toUpdate))
+	if p.timePrefixSK && len(toRemove) > 0 {
+		// The join time in a prefixed sort key is not known when the membership is removed.
+		p.logger.WarnContext(ctx, "cannot delete time-prefixed memberships",
+			slog.String("userId", extractUserID(userPK)),
+			slog.Any("organizations", toRemove))
+		inv.metrics.increment("UnresolvedDeletes", len(toRemove))
+		toRemove = nil
+	}
+
+	// Create write requests for removals and additions
+	changedAt := changeTime(der, p.now)
+	var userSK string
+	if p.includeUserSK {
+		userSK = recordUserSK(der)
+	}
+	attrs := membershipAttributes{OrgPKPrefix: p.orgPKPrefix, Namespace: p.appNamespace, UserSK: userSK, RoleSKs: p.roleMemberships, Metadata: metadata, CreatedAt: changedAt, GSIKeys: p.gsiKeys, Version: p.versions, TimePrefix: p.timePrefixSK, Source: p.sourceTag, EncodeIDs: p.encodeIDs}
+	if len(toAdd) > 0 || len(toUpdate) > 0 {
+		attrs.Projected = p.projectAttributes(ctx, userPK, der.Change.NewImage)
+	}
+	removedAttrs := membershipAttributes{OrgPKPrefix: p.orgPKPrefix, Namespace: p.appNamespace, UserSK: userSK, RoleSKs: p.roleMemberships, Metadata: removedMetadata, EncodeIDs: p.encodeIDs}
+	writeRequests := createWriteRequests(userPK, toRemove, removedAttrs, true)
+	if p.timePrefixSK {
+		// As with removals, the old role items' time-prefixed sort keys are not known.
+		writeRequests = append(writeRequests, createWriteRequests(userPK, toUpdate, attrs, false)...)
+	} else {
+		writeRequests = append(writeRequests, createRoleChangeRequests(userPK, toUpdate, removedAttrs, attrs)...)
+	}
+	writeRequests = append(writeRequests, createWriteRequests(userPK, toAdd, attrs, false)...)
+	if len(writeRequests) == 0 {
+		p.recordProcessed(inv, userKey, der)
+		return nil
+	}
+
+	deletes, puts := splitDeletes(writeRequests)
+	inv.metrics.increment("PutRequests", len(puts))
+	inv.metrics.increment("DeleteRequests", len(deletes))
+	if p.perOrgMetrics {
+		for _, org := range toRemove {
+			inv.metrics.incrementOrg(org, 1)
+		}
+		for _, org := range toAdd {
+			inv.metrics.incrementOrg(org, 1)
+		}
+		for _, org := range toUpdate {
+			inv.metrics.incrementOrg(org, 1)
+		}
+	}
+
+	var reverseRequests []types.WriteRequest
+	if p.reverseIndexTable != "" {
+		reverseRequests = append(createReverseWriteRequests(userPK, toRemove, attrs, true), createReverseWriteRequests(userPK, toAdd, attrs, false)...)
+	}
+
+	if p.dryRun {
+		if err := p.recordDryRun(ctx, record, der, writeRequests, reverseRequests); err != nil {
+			return err
+		}
+		p.recordProcessed(inv, userKey, der)
 		return nil
 	}
+
+	write := p.batchWriteMemberships
+	if p.transactWrites {
+		write = p.transactWriteMemberships
+	}
+	if p.partiqlWrites {
+		write = p.partiqlWriteMemberships
+	}
+	// Membership writes the primary table refused are not forwarded to the replicas.
+	var refused []types.WriteRequest
+	if p.ownedDeletes {
+		write = func(ctx context.Context, inv *invocation, writeRequests, reverseRequests []types.WriteRequest) (err error) {
+			refused, err = p.ownedWriteMemberships(ctx, inv, writeRequests, reverseRequests)
+			return err
+		}
+	}
+	if p.sequenceConditions {
+		write = func(ctx context.Context, inv *invocation, writeRequests, reverseRequests []types.WriteRequest) (err error) {
+			refused, err = p.conditionalWriteMemberships(ctx, inv, writeRequests, reverseRequests, der.Change.SequenceNumber)
+			return err
+		}
+	}
+	if err := write(ctx, inv, writeRequests, reverseRequests); err != nil {
+		return err
+	}
+
+	inv.result.Adds += len(toAdd)
+	inv.result.Removes += len(toRemove)
+	inv.result.Updates += len(toUpdate)
+	p.writeReplicas(ctx, inv, acceptedWrites(writeRequests, refused))
+	audit := auditEvents(actor, userPK, toAdd, toRemove, toUpdate, changedAt)
+	p.emitAuditEvents(ctx, audit)
+	if err := p.writeAuditRecords(audit); err != nil {
+		p.logger.ErrorContext(ctx, "failed to write audit records",
+			slog.String("error", err.Error()),
+			slog.String("messageId", record.MessageId))
+		return err
+	}
+	if err := p.publishMembershipChanges(ctx, inv, audit); err != nil {
+		return err
+	}
+	p.recordProcessed(inv, userKey, der)
+	return nil
+}
+
+// softDeleted reports whether an image has the delete flag attribute set to true. Attributes of
+// any other type, including the string "true", do not count.
+func (p *processor) softDeleted(image map[string]events.DynamoDBAttributeValue) bool {
+	if p.deleteFlag == "" {
+		return false
+	}
+	flag, ok := image[p.deleteFlag]
+	return ok && flag.DataType() == events.DataTypeBoolean && flag.Boolean()
+}
+
+// organizations reads the user's organizations from an image, normalized for use in keys.
+func (p *processor) organizations(image map[string]events.DynamoDBAttributeValue) ([]string, bool) {
+	orgs, present := extractOrganizations(image, p.orgAttribute)
+	return p.normalizeOrganizations(orgs), present
+}
+
+// organizationMetadata reads the user's metadata per organization from an image, keyed by the
+// normalized organization ID.
+func (p *processor) organizationMetadata(image map[string]events.DynamoDBAttributeValue) map[string]organizationMetadata {
+	metadata := extractOrganizationMetadata(image, p.orgAttribute)
+	if metadata == nil || (!p.normalizeOrgs && !p.lowercaseOrgs) {
+		return metadata
+	}
+	normalized := make(map[string]organizationMetadata, len(metadata))
+	for org, meta := range metadata {
+		normalized[p.normalizeOrgID(org)] = meta
+	}
+	return normalized
+}
+
+// normalizeOrganizations normalizes every organization ID, dropping IDs that become duplicates
+// so a batch never writes the same key twice. Adds and removes are both read through it, so a
+// delete always matches the key of the earlier put.
+func (p *processor) normalizeOrganizations(orgs []string) []string {
+	if orgs == nil || (!p.normalizeOrgs && !p.lowercaseOrgs) {
+		return orgs
+	}
+	normalized := make([]string, 0, len(orgs))
+	seen := make(map[string]struct{}, len(orgs))
+	for _, org := range orgs {
+		org = p.normalizeOrgID(org)
+		if _, ok := seen[org]; ok {
+			continue
+		}
+		seen[org] = struct{}{}
+		normalized = append(normalized, org)
+	}
+	return normalized
+}
+
+// normalizeOrgID trims and lowercases an organization ID as configured.
+func (p *processor) normalizeOrgID(org string) string {
+	if p.normalizeOrgs {
+		org = strings.TrimSpace(org)
+	}
+	if p.lowercaseOrgs {
+		org = strings.ToLower(org)
+	}
+	return org
+}
+
+// hasMembershipChange reports whether a MODIFY record's old and new images describe different
+// memberships. An organizations attribute left byte-for-byte unchanged is recognised without
+// reading it; otherwise the normalized organization IDs are compared as sets, so reordering or a
+// change to per-organization metadata alone is not a membership change, unless ROLE_MEMBERSHIPS
+// writes a membership per role and an organization's roles changed. A missing or NULL attribute
+// in the new image leaves memberships unchanged rather than clearing them; only an explicitly
+// empty list removes every membership.
+func (p *processor) hasMembershipChange(old, new map[string]events.DynamoDBAttributeValue) bool {
+	newAttr, ok := new[p.orgAttribute]
+	if !ok || newAttr.DataType() == events.DataTypeNull {
+		return false
+	}
+	if oldAttr, ok := old[p.orgAttribute]; ok && reflect.DeepEqual(oldAttr, newAttr) {
+		return false
+	}
+	oldOrgs, _ := p.organizations(old)
+	newOrgs, _ := p.organizations(new)
+	if !sameOrganizations(oldOrgs, newOrgs) {
+		return true
+	}
+	return len(p.roleChangedOrgs(p.organizationMetadata(old), p.organizationMetadata(new), oldOrgs, newOrgs)) > 0
+}
+
+// sameOrganizations reports whether a and b hold the same set of organizations, ignoring order
+// and duplicates.
+func sameOrganizations(a, b []string) bool {
+	set := make(map[string]struct{}, len(a))
+	for _, org := range a {
+		set[org] = struct{}{}
+	}
+	seen := make(map[string]struct{}, len(b))
+	for _, org := range b {
+		if _, ok := set[org]; !ok {
+			return false
+		}
+		seen[org] = struct{}{}
+	}
+	return len(seen) == len(set)
+}
+
+// dropEmptyOrganizations removes empty and whitespace-only organization IDs, which would
+// otherwise produce an "ORGANIZATION#" key, logging a warning for each one dropped.
+func (p *processor) dropEmptyOrganizations(ctx context.Context, inv *invocation, userPK string, orgs []string) []string {
+	valid := make([]string, 0, len(orgs))
+	for _, org := range orgs {
+		if strings.TrimSpace(org) == "" {
+			p.logger.WarnContext(ctx, "skipping empty organization ID",
+				slog.String("userId", extractUserID(userPK)),
+				slog.String("organizationId", org))
+			inv.metrics.increment("SkippedEmptyOrg", 1)
+			continue
+		}
+		valid = append(valid, org)
+	}
+	return valid
+}
+
+// filterAllowlisted keeps only the organizations on the allowlist, counting the rest as
+// FilteredOrgs. Every organization is kept when no allowlist is configured.
+func (p *processor) filterAllowlisted(inv *invocation, orgs []string) []string {
+	if len(p.orgAllowlist) == 0 {
+		return orgs
+	}
+	allowed := make([]string, 0, len(orgs))
+	for _, org := range orgs {
+		if _, ok := p.orgAllowlist[org]; !ok {
+			inv.metrics.increment("FilteredOrgs", 1)
+			continue
+		}
+		allowed = append(allowed, org)
+	}
+	return allowed
+}
+
+// eventTypeAllowed reports whether records with eventName should be processed. Every event
+// type is allowed when no event types are configured.
+func (p *processor) eventTypeAllowed(eventName string) bool {
+	if len(p.eventTypes) == 0 {
+		return true
+	}
+	_, ok := p.eventTypes[eventName]
+	return ok
+}
+
+// reservedMembershipAttributes are the membership item attributes written by the consumer, which
+// projected attributes may not overwrite.
+var reservedMembershipAttributes = map[string]struct{}{
+	"pk": {}, "sk": {}, "role": {}, "createdAt": {}, "joinedAt": {}, "gsi1pk": {}, "gsi1sk": {}, "version": {}, "source": {}, "schemaVersion": {}, sequenceAttribute: {}, tombstoneAttribute: {},
+}
+
+// projectableAttributes returns the user attribute names to copy onto memberships, dropping any
+// that would overwrite a membership attribute with a warning.
+func projectableAttributes(logger *slog.Logger, names []string) []string {
+	var projectable []string
+	for _, name := range names {
+		if _, ok := reservedMembershipAttributes[name]; ok {
+			logger.Warn("ignoring reserved PROJECT_ATTRIBUTES attribute", slog.String("attribute", name))
+			continue
+		}
+		projectable = append(projectable, name)
+	}
+	return projectable
+}
+
+// projectAttributes reads the projected attributes from a user image. Attributes that are
+// missing or not strings are skipped with a warning.
+func (p *processor) projectAttributes(ctx context.Context, userPK string, image map[string]events.DynamoDBAttributeValue) map[string]string {
+	if len(p.projected) == 0 {
+		return nil
+	}
+	projected := make(map[string]string, len(p.projected))
+	for _, name := range p.projected {
+		av, ok := image[name]
+		if !ok || av.DataType() != events.DataTypeString {
+			p.logger.WarnContext(ctx, "skipping projected attribute",
+				slog.String("userId", extractUserID(userPK)),
+				slog.String("attribute", name),
+				slog.Bool("present", ok))
+			continue
+		}
+		projected[name] = av.String()
+	}
+	return projected
+}
+
+// parseAllowlist parses a comma-separated list, such as organization IDs or event names. An
+// empty value yields no allowlist.
+func parseAllowlist(value string) map[string]struct{} {
+	var allowlist map[string]struct{}
+	for _, org := range strings.Split(value, ",") {
+		if org = strings.TrimSpace(org); org == "" {
+			continue
+		}
+		if allowlist == nil {
+			allowlist = make(map[string]struct{})
+		}
+		allowlist[org] = struct{}{}
+	}
+	return allowlist
+}
+
+// diffOrganizations returns the organizations in newOrgs but not oldOrgs, in newOrgs order, and
+// those in oldOrgs but not newOrgs, in oldOrgs order. Membership is checked against sets so the
+// diff stays linear for users with hundreds of organizations.
+func diffOrganizations(oldOrgs, newOrgs []string) (toAdd, toRemove []string) {
+	oldSet := make(map[string]struct{}, len(oldOrgs))
+	for _, org := range oldOrgs {
+		oldSet[org] = struct{}{}
+	}
+	newSet := make(map[string]struct{}, len(newOrgs))
+	for _, org := range newOrgs {
+		newSet[org] = struct{}{}
+	}
+
+	toRemove = make([]string, 0)
+	for _, org := range oldOrgs {
+		if _, ok := newSet[org]; !ok {
+			toRemove = append(toRemove, org)
+		}
+	}
+
+	toAdd = make([]string, 0)
+	for _, org := range newOrgs {
+		if _, ok := oldSet[org]; !ok {
+			toAdd = append(toAdd, org)
+		}
+	}
+	return toAdd, toRemove
+}
+
+// loadBaseline reads the user's baseline organizations when a baseline source is configured.
+// ok is false when there is no baseline source or it has no entry for the user, in which case
+// the stream's old image is diffed against instead. A failed load is retryable.
+func (p *processor) loadBaseline(ctx context.Context, userPK string) ([]string, bool, error) {
+	if p.baseline == nil {
+		return nil, false, nil
+	}
+	orgs, ok, err := p.baseline.LoadBaseline(ctx, userPK)
+	if err != nil {
+		p.logger.ErrorContext(ctx, "failed to load baseline organizations",
+			slog.String("error", err.Error()),
+			slog.String("userPK", userPK))
+		return nil, false, fmt.Errorf("failed to load baseline for %s: %w", userPK, err)
+	}
+	return p.normalizeOrganizations(orgs), ok, nil
+}
+
+// recordProcessed notes that a stream record has been applied so duplicates later in the
+// batch are skipped and subsequent records can be sanity checked against it.
+func (p *processor) recordProcessed(inv *invocation, userKey string, der events.DynamoDBEventRecord) {
+	if der.EventID != "" {
+		inv.processedEvents[der.EventID] = struct{}{}
+	}
+	p.rememberOrgCount(userKey, der)
+}
+
+// checkRemovalCount fails a record that removes more organizations than the user is known to
+// have had, allowing removalMargin extra, as this indicates corrupted input. The check is
+// skipped when it is disabled or the user's prior count is not known.
+func (p *processor) checkRemovalCount(ctx context.Context, inv *invocation, userKey string, removals int) error {
+	if p.orgCounts == nil {
+		return nil
+	}
+	known, ok := p.orgCounts.get(userKey)
+	if !ok || removals <= known+p.removalMargin {
+		return nil
+	}
+
+	p.logger.WarnContext(ctx, "record removes more organizations than the user is known to have",
+		slog.String("userKey", userKey),
+		slog.Int("removals", removals),
+		slog.Int("knownCount", known),
+		slog.Int("margin", p.removalMargin))
+	inv.metrics.increment("OverRemovalRecords", 1)
+	return &permanentError{err: fmt.Errorf("record removes %d organizations but user %s is known to have %d", removals, userKey, known)}
+}
+
+// rememberOrgCount records the user's organization count after a successfully processed record
+// so later records can be sanity checked against it.
+func (p *processor) rememberOrgCount(userKey string, der events.DynamoDBEventRecord) {
+	if p.orgCounts == nil || userKey == "" {
+		return
+	}
+	if der.EventName == string(events.DynamoDBOperationTypeRemove) {
+		p.orgCounts.remove(userKey)
+		return
+	}
+	if orgs, present := p.organizations(der.Change.NewImage); present {
+		p.orgCounts.set(userKey, len(orgs))
+	}
+}
+
+// checkSequenceOrder warns when a record for userKey carries a lower sequence number than one
+// already processed for that user in this invocation, which indicates the records were
+// reordered before reaching the consumer. Ordering across invocations is not checked.
+func (p *processor) checkSequenceOrder(ctx context.Context, inv *invocation, userKey, sequenceNumber string) {
+	if userKey == "" || sequenceNumber == "" {
+		return
+	}
+	last, ok := inv.lastSequence[userKey]
+	if ok && compareSequenceNumbers(sequenceNumber, last) < 0 {
+		p.logger.WarnContext(ctx, "out of order stream record",
+			slog.String("userKey", userKey),
+			slog.String("sequenceNumber", sequenceNumber),
+			slog.String("lastSequenceNumber", last))
+		return
+	}
+	inv.lastSequence[userKey] = sequenceNumber
+}
+
+// compareSequenceNumbers compares two DynamoDB stream sequence numbers, returning -1, 0, or +1.
+// Sequence numbers are arbitrarily long decimal strings, so they are compared by length and
+// then lexically rather than parsed.
+func compareSequenceNumbers(a, b string) int {
+	a, b = strings.TrimLeft(a, "0"), strings.TrimLeft(b, "0")
+	if len(a) != len(b) {
+		if len(a) < len(b) {
+			return -1
+		}
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+// recordUserKey returns the user's partition key for a record, preferring the stream Keys and
+// falling back to the new and then old image. Empty is returned when no pk is present.
+func recordUserKey(der events.DynamoDBEventRecord) string {
+	for _, image := range []map[string]events.DynamoDBAttributeValue{der.Change.Keys, der.Change.NewImage, der.Change.OldImage} {
+		if pk := extractPK(image); pk != "" {
+			return pk
+		}
+	}
+	return ""
+}
+
+// imagePK returns the user's partition key from an image, falling back to the record's key,
+// normally taken from the stream Keys, when the image carries no usable pk.
+func imagePK(image map[string]events.DynamoDBAttributeValue, userKey string) string {
+	if pk := extractPK(image); pk != "" {
+		return pk
+	}
+	return userKey
+}
+
+// userPK returns the user's partition key for an image. When USER_ID_ATTRIBUTE is set and the
+// image carries it, the key is built from that attribute as "USER#<id>", so membership keys are
+// built the same way as from a pk embedding the ID; otherwise it is the image's pk, as imagePK.
+func (p *processor) userPK(image map[string]events.DynamoDBAttributeValue, userKey string) string {
+	if id := attributeUserID(image, p.userIDAttribute); id != "" {
+		return "USER#" + id
+	}
+	return imagePK(image, userKey)
+}
+
+// recordUserPK returns the user's partition key for a record, reading USER_ID_ATTRIBUTE from
+// the new and then old image when it is set, and falling back to userKey.
+func (p *processor) recordUserPK(der events.DynamoDBEventRecord, userKey string) string {
+	for _, image := range []map[string]events.DynamoDBAttributeValue{der.Change.NewImage, der.Change.OldImage} {
+		if id := attributeUserID(image, p.userIDAttribute); id != "" {
+			return "USER#" + id
+		}
+	}
+	return userKey
+}
+
+// attributeUserID reads a user ID from a string or number attribute of an image. Empty is
+// returned when name is empty or the attribute is missing or of any other type.
+func attributeUserID(image map[string]events.DynamoDBAttributeValue, name string) string {
+	if name == "" {
+		return ""
+	}
+	attr, ok := image[name]
+	if !ok {
+		return ""
+	}
+	switch attr.DataType() {
+	case events.DataTypeString:
+		return attr.String()
+	case events.DataTypeNumber:
+		return attr.Number()
+	default:
+		return ""
+	}
+}
+
+// ingestLatency returns the time elapsed between SQS receiving a message and now, given the
+// message's SentTimestamp attribute in milliseconds since the Unix epoch.
+func ingestLatency(sentTimestamp string, now time.Time) (time.Duration, error) {
+	ms, err := strconv.ParseInt(sentTimestamp, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse SentTimestamp %q: %w", sentTimestamp, err)
+	}
+	return now.Sub(time.UnixMilli(ms)), nil
+}
+
+// membershipAttributes holds the attributes used to build membership requests. OrgPKPrefix,
+// Namespace, UserSK and EncodeIDs shape the key of both puts and deletes; the remaining
+// attributes are only copied onto puts.
+type membershipAttributes struct {
+	OrgPKPrefix string                          // Prefix of the membership PK; empty uses defaultOrgPKPrefix
+	Namespace   string                          // App namespace in the membership SK; empty omits it
+	UserSK      string                          // User's sort key appended to the membership SK; empty omits it
+	RoleSKs     bool                            // Write a membership per role in Metadata, with the role appended to the SK
+	Metadata    map[string]organizationMetadata // Role and join time per organization ID, when known
+	CreatedAt   time.Time                       // When the membership was created
+	GSIKeys     bool                            // Write gsi1pk/gsi1sk so memberships can be queried by user
+	Version     bool                            // Write version 1, the starting point for optimistic concurrency
+	TimePrefix  bool                            // Prefix the SK with CreatedAt so members sort in join order
+	Source      string                          // Tag of the consumer deployment writing the membership; empty omits it
+	Projected   map[string]string               // User attributes copied verbatim onto the membership
+	EncodeIDs   bool                            // Encode organization and user IDs in keys with encodeID
+}
+
+// defaultOrgPKPrefix prefixes the organization ID in membership partition keys unless
+// ORG_PK_PREFIX overrides it.
+const defaultOrgPKPrefix = "ORGANIZATION#"
+
+// membershipPK formats the partition key of a membership record as <prefix><org_id>, using
+// defaultOrgPKPrefix when prefix is empty.
+func membershipPK(orgID, prefix string) string {
+	if prefix == "" {
+		prefix = defaultOrgPKPrefix
+	}
+	return prefix + orgID
+}
+
+// membershipSK formats the sort key of a membership record as MEMBERSHIP#<user>, or
+// MEMBERSHIP#<namespace>#<user> when apps sharing an organization partition are namespaced.
+func membershipSK(userPK, namespace string) string {
+	if namespace == "" {
+		return fmt.Sprintf("MEMBERSHIP#%s", extractUserID(userPK))
+	}
+	return fmt.Sprintf("MEMBERSHIP#%s#%s", namespace, extractUserID(userPK))
+}
+
+// joinOrderSK formats the sort key of a membership record as MEMBERSHIP#<ts>#<user>, or
+// MEMBERSHIP#<namespace>#<ts>#<user>, where ts is the join time in Unix milliseconds zero-padded
+// to 13 digits so sort keys order members by when they joined.
+func joinOrderSK(userPK, namespace string, joined time.Time) string {
+	ts := fmt.Sprintf("%013d", joined.UnixMilli())
+	if namespace == "" {
+		return fmt.Sprintf("MEMBERSHIP#%s#%s", ts, extractUserID(userPK))
+	}
+	return fmt.Sprintf("MEMBERSHIP#%s#%s#%s", namespace, ts, extractUserID(userPK))
+}
+
+// withUserSK appends the user's sort key to a membership sort key, as <sk>#<userSK>, so users
+// with several profile records keep a membership per profile. sk is returned unchanged when
+// userSK is empty.
+func withUserSK(sk, userSK string) string {
+	if userSK == "" {
+		return sk
+	}
+	return sk + "#" + userSK
+}
+
+// recordUserSK returns the user's sort key for a record, read like recordUserKey from the
+// stream Keys and then the new and old images. Empty is returned when no string sk is present.
+func recordUserSK(der events.DynamoDBEventRecord) string {
+	for _, image := range []map[string]events.DynamoDBAttributeValue{der.Change.Keys, der.Change.NewImage, der.Change.OldImage} {
+		if sk, ok := image["sk"]; ok && sk.DataType() == events.DataTypeString && sk.String() != "" {
+			return sk.String()
+		}
+	}
+	return ""
+}
+
+// changeTime returns when the change described by a record occurred, used as the creation time
+// of the memberships it adds. The stream's ApproximateCreationDateTime is preferred so
+// redelivered records keep their original time, falling back to now when the record does not
+// carry it.
+func changeTime(der events.DynamoDBEventRecord, now func() time.Time) time.Time {
+	if created := der.Change.ApproximateCreationDateTime; !created.IsZero() {
+		return created.Time
+	}
+	return now()
 }
 
 // createWriteRequests creates a slice of DynamoDB WriteRequests for the given user and organizations.
 // For each organization, it creates either a PutRequest or DeleteRequest based on the isDelete flag.
+// Put requests carry the given attributes; delete requests only use the key attributes. With
+// RoleSKs, an organization gets a request per role, as returned by membershipRoles.
+// Requests are returned in organization ID order, whatever the order of organizations, so the
+// output is reproducible when the organizations come from a map.
 // The requests are used to maintain organization membership records in the target table.
-func createWriteRequests(userPK string, organizations []string, isDelete bool) []types.WriteRequest {
+func createWriteRequests(userPK string, organizations []string, attrs membershipAttributes, isDelete bool) []types.WriteRequest {
 	requests := make([]types.WriteRequest, 0, len(organizations))
-	for _, orgID := range organizations {
-		if isDelete {
-			requests = append(requests, types.WriteRequest{
-				DeleteRequest: &types.DeleteRequest{
-					Key: map[string]types.AttributeValue{
-						"pk": &types.AttributeValueMemberS{Value: fmt.Sprintf("ORGANIZATION#%s", orgID)},
-						"sk": &types.AttributeValueMemberS{Value: fmt.Sprintf("MEMBERSHIP#%s", extractUserID(userPK))},
+	for _, orgID := range slices.Sorted(slices.Values(organizations)) {
+		for _, role := range membershipRoles(attrs, orgID, isDelete) {
+			if isDelete {
+				requests = append(requests, types.WriteRequest{
+					DeleteRequest: &types.DeleteRequest{
+						Key: map[string]types.AttributeValue{
+							"pk": &types.AttributeValueMemberS{Value: membershipPK(attrs.keyOrgID(orgID), attrs.OrgPKPrefix)},
+							"sk": &types.AttributeValueMemberS{Value: roleSK(withUserSK(membershipSK(attrs.keyUserPK(userPK), attrs.Namespace), attrs.UserSK), role)},
+						},
 					},
-				},
-			})
-			continue
+				})
+				continue
+			}
+			if request, ok := createPutRequest(userPK, orgID, role, attrs); ok {
+				requests = append(requests, request)
+			}
 		}
+	}
+	return requests
+}
+
+// createPutRequest creates the membership put request for an organization, for the given role
+// when it is not empty.
+func createPutRequest(userPK, orgID, role string, attrs membershipAttributes) (types.WriteRequest, bool) {
+	keyUserPK, keyOrgID := attrs.keyUserPK(userPK), attrs.keyOrgID(orgID)
+	membership := organizationMembership{
+		PK:            membershipPK(keyOrgID, attrs.OrgPKPrefix),
+		SK:            membershipSK(keyUserPK, attrs.Namespace),
+		Role:          attrs.Metadata[orgID].Role,
+		Source:        attrs.Source,
+		SchemaVersion: membershipSchemaVersion,
+	}
+	if role != "" {
+		membership.Role = role
+	}
+	if joined := attrs.Metadata[orgID].JoinedAt; !joined.IsZero() {
+		membership.JoinedAt = joined.UTC().Format(time.RFC3339)
+	}
+	if attrs.TimePrefix {
+		membership.SK = joinOrderSK(keyUserPK, attrs.Namespace, attrs.CreatedAt)
+	}
+	membership.SK = roleSK(withUserSK(membership.SK, attrs.UserSK), role)
+	if !attrs.CreatedAt.IsZero() {
+		membership.CreatedAt = attrs.CreatedAt.UTC().Format(time.RFC3339)
+	}
+	if attrs.GSIKeys {
+		membership.GSI1PK = fmt.Sprintf("USER#%s", extractUserID(keyUserPK))
+		membership.GSI1SK = fmt.Sprintf("ORG#%s", keyOrgID)
+	}
+	if attrs.Version {
+		membership.Version = 1
+	}
+	item, err := attributevalue.MarshalMap(membership)
+	if err != nil {
+		return types.WriteRequest{}, false // skip invalid items
+	}
+	for name, value := range attrs.Projected {
+		item[name] = &types.AttributeValueMemberS{Value: value}
+	}
+	return types.WriteRequest{PutRequest: &types.PutRequest{Item: item}}, true
+}
 
-		membership := organizationMembership{
-			PK: fmt.Sprintf("ORGANIZATION#%s", orgID),
-			SK: fmt.Sprintf("MEMBERSHIP#%s", extractUserID(userPK)),
+// createReverseWriteRequests creates the reverse index WriteRequests for the given user and
+// organizations, mirroring createWriteRequests with the user as the partition key. Requests
+// are returned in the same organization ID order so each pairs with its forward request.
+// With EncodeIDs, the IDs in the keys are encoded the same way as the forward keys.
+func createReverseWriteRequests(userPK string, organizations []string, attrs membershipAttributes, isDelete bool) []types.WriteRequest {
+	requests := make([]types.WriteRequest, 0, len(organizations))
+	for _, orgID := range slices.Sorted(slices.Values(organizations)) {
+		membership := userMembership{
+			PK: fmt.Sprintf("USER#%s", extractUserID(attrs.keyUserPK(userPK))),
+			SK: fmt.Sprintf("ORGANIZATION#%s", attrs.keyOrgID(orgID)),
 		}
 		item, err := attributevalue.MarshalMap(membership)
 		if err != nil {
 			continue // skip invalid items
 		}
+		if isDelete {
+			requests = append(requests, types.WriteRequest{
+				DeleteRequest: &types.DeleteRequest{Key: item},
+			})
+			continue
+		}
 		requests = append(requests, types.WriteRequest{
 			PutRequest: &types.PutRequest{Item: item},
 		})
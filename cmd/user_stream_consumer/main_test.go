@@ -1,26 +1,138 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
 )
 
 // mockDynamoDBClient implements dynamoDBClient interface for testing
 type mockDynamoDBClient struct {
 	batchWriteItemFunc func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error)
+	getItemFunc        func(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error)
+	putItemFunc        func(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error)
+	deleteItemFunc     func(ctx context.Context, params *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error)
+	queryFunc          func(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error)
+	describeTableFunc  func(ctx context.Context, params *dynamodb.DescribeTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DescribeTableOutput, error)
+	transactWriteFunc  func(ctx context.Context, params *dynamodb.TransactWriteItemsInput, optFns ...func(*dynamodb.Options)) (*dynamodb.TransactWriteItemsOutput, error)
+	executeBatchFunc   func(ctx context.Context, params *dynamodb.BatchExecuteStatementInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchExecuteStatementOutput, error)
 }
 
 func (m *mockDynamoDBClient) BatchWriteItem(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
 	return m.batchWriteItemFunc(ctx, params, optFns...)
 }
 
+func (m *mockDynamoDBClient) GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	return m.getItemFunc(ctx, params, optFns...)
+}
+
+func (m *mockDynamoDBClient) PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	return m.putItemFunc(ctx, params, optFns...)
+}
+
+func (m *mockDynamoDBClient) DeleteItem(ctx context.Context, params *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error) {
+	return m.deleteItemFunc(ctx, params, optFns...)
+}
+
+func (m *mockDynamoDBClient) Query(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error) {
+	return m.queryFunc(ctx, params, optFns...)
+}
+
+func (m *mockDynamoDBClient) DescribeTable(ctx context.Context, params *dynamodb.DescribeTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DescribeTableOutput, error) {
+	return m.describeTableFunc(ctx, params, optFns...)
+}
+
+func (m *mockDynamoDBClient) TransactWriteItems(ctx context.Context, params *dynamodb.TransactWriteItemsInput, optFns ...func(*dynamodb.Options)) (*dynamodb.TransactWriteItemsOutput, error) {
+	return m.transactWriteFunc(ctx, params, optFns...)
+}
+
+func (m *mockDynamoDBClient) BatchExecuteStatement(ctx context.Context, params *dynamodb.BatchExecuteStatementInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchExecuteStatementOutput, error) {
+	return m.executeBatchFunc(ctx, params, optFns...)
+}
+
+// fixedClock returns a constant time so tests can assert time-derived values.
+func fixedClock() time.Time {
+	return time.UnixMilli(1700000000000)
+}
+
+// insertBody returns an INSERT event record body for userPK with orgCount organizations
+// named org0 through org<orgCount-1>.
+func insertBody(userPK string, orgCount int) string {
+	orgs := make([]string, orgCount)
+	for i := range orgs {
+		orgs[i] = fmt.Sprintf(`{"S": "org%d"}`, i)
+	}
+	return fmt.Sprintf(`{
+		"eventName": "INSERT",
+		"dynamodb": {
+			"NewImage": {
+				"pk": {"S": %q},
+				"organizations": {"L": [%s]}
+			}
+		}
+	}`, userPK, strings.Join(orgs, ", "))
+}
+
+// testEnv returns a getenv function backed by the given map.
+func testEnv(env map[string]string) func(string) string {
+	return func(key string) string {
+		return env[key]
+	}
+}
+
+// mustLoadConfig loads the config read through getenv, failing the test if it is invalid.
+func mustLoadConfig(t *testing.T, getenv func(string) string) config {
+	t.Helper()
+	cfg, err := loadConfig(getenv)
+	if err != nil {
+		t.Fatalf("loadConfig() unexpected error = %v", err)
+	}
+	return cfg
+}
+
+// parseLogs decodes JSON log lines written by the handler's logger.
+func parseLogs(t *testing.T, r io.Reader) []map[string]any {
+	t.Helper()
+	var logs []map[string]any
+	dec := json.NewDecoder(r)
+	for dec.More() {
+		var entry map[string]any
+		if err := dec.Decode(&entry); err != nil {
+			t.Fatalf("failed to decode log line: %v", err)
+		}
+		logs = append(logs, entry)
+	}
+	return logs
+}
+
+// findLogs returns the log entries with the given message.
+func findLogs(logs []map[string]any, msg string) []map[string]any {
+	var found []map[string]any
+	for _, entry := range logs {
+		if entry["msg"] == msg {
+			found = append(found, entry)
+		}
+	}
+	return found
+}
+
 // Test_handler verifies the Lambda handler's behavior for different DynamoDB stream events
 func Test_handler(t *testing.T) {
 	tests := []struct {
@@ -30,6 +142,8 @@ func Test_handler(t *testing.T) {
 		expectedError  error
 		expectedWrites int
 		mockBatchWrite func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error)
+		mockGetItem    func(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error)
+		verifyLogs     func(t *testing.T, logs []map[string]any)
 	}{
 		{
 			name: "successful write with multiple organizations",
@@ -51,7 +165,7 @@ func Test_handler(t *testing.T) {
 					},
 				},
 			},
-			getenv: func(string) string { return "test-table" },
+			getenv: testEnv(map[string]string{"TABLE_NAME": "test-table"}),
 			mockBatchWrite: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
 				if len(params.RequestItems["test-table"]) != 2 {
 					t.Errorf("expected 2 write requests, got %d", len(params.RequestItems["test-table"]))
@@ -68,13 +182,14 @@ func Test_handler(t *testing.T) {
 						Body: `{
 							"eventName": "REMOVE",
 							"dynamodb": {
+								"Keys": {"pk": {"S": "USER#123"}},
 								"NewImage": null
 							}
 						}`,
 					},
 				},
 			},
-			getenv: func(string) string { return "test-table" },
+			getenv: testEnv(map[string]string{"TABLE_NAME": "test-table"}),
 			mockBatchWrite: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
 				t.Error("BatchWriteItem should not be called for REMOVE events")
 				return nil, nil
@@ -101,7 +216,7 @@ func Test_handler(t *testing.T) {
 					},
 				},
 			},
-			getenv:        func(string) string { return "test-table" },
+			getenv:        testEnv(map[string]string{"TABLE_NAME": "test-table"}),
 			expectedError: fmt.Errorf("failed to batch write organization memberships: simulated batch write error"),
 			mockBatchWrite: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
 				return nil, fmt.Errorf("simulated batch write error")
@@ -127,7 +242,7 @@ func Test_handler(t *testing.T) {
 					},
 				},
 			},
-			getenv: func(string) string { return "test-table" },
+			getenv: testEnv(map[string]string{"TABLE_NAME": "test-table"}),
 			mockBatchWrite: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
 				if len(params.RequestItems["test-table"]) != 2 {
 					t.Errorf("expected 2 delete requests, got %d", len(params.RequestItems["test-table"]))
@@ -167,7 +282,7 @@ func Test_handler(t *testing.T) {
 					},
 				},
 			},
-			getenv: func(string) string { return "test-table" },
+			getenv: testEnv(map[string]string{"TABLE_NAME": "test-table"}),
 			mockBatchWrite: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
 				if len(params.RequestItems["test-table"]) != 2 {
 					t.Errorf("expected 2 requests, got %d", len(params.RequestItems["test-table"]))
@@ -188,117 +303,2573 @@ func Test_handler(t *testing.T) {
 				return &dynamodb.BatchWriteItemOutput{}, nil
 			},
 		},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
-			mockClient := &mockDynamoDBClient{
-				batchWriteItemFunc: tt.mockBatchWrite,
-			}
-
-			h := handler(logger, mockClient, tt.getenv)
-			err := h(context.Background(), tt.event)
-
-			if tt.expectedError == nil {
-				if err != nil {
-					t.Errorf("handler() unexpected error = %v", err)
+		{
+			name: "ingest latency from sent timestamp",
+			event: events.SQSEvent{
+				Records: []events.SQSMessage{
+					{
+						MessageId:  "msg-1",
+						Attributes: map[string]string{"SentTimestamp": "1699999998500"},
+						Body: `{
+							"eventName": "INSERT",
+							"dynamodb": {
+								"NewImage": {
+									"pk": {"S": "USER#123"},
+									"organizations": {"L": [{"S": "org1"}]}
+								}
+							}
+						}`,
+					},
+					{
+						MessageId:  "msg-2",
+						Attributes: map[string]string{"SentTimestamp": "not-a-number"},
+						Body:       `{"eventName": "INSERT", "dynamodb": {"NewImage": {"pk": {"S": "USER#456"}}}}`,
+					},
+				},
+			},
+			getenv: testEnv(map[string]string{"TABLE_NAME": "test-table", "INGEST_LATENCY_WARN_MS": "1000"}),
+			mockBatchWrite: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+				return &dynamodb.BatchWriteItemOutput{}, nil
+			},
+			verifyLogs: func(t *testing.T, logs []map[string]any) {
+				metrics := findLogs(logs, "metrics")
+				if len(metrics) != 1 {
+					t.Fatalf("expected 1 metrics log, got %d", len(metrics))
 				}
-			} else if err == nil || err.Error() != tt.expectedError.Error() {
-				t.Errorf("handler() error = %v, want %v", err, tt.expectedError)
-			}
-		})
-	}
-}
-
-// Test_extractUserID verifies the user ID extraction from composite keys
-func Test_extractUserID(t *testing.T) {
-	tests := []struct {
-		name     string
-		input    string
-		expected string
-	}{
+				if latency := metrics[0]["IngestLatencyMillis"]; latency != 1500.0 {
+					t.Errorf("expected IngestLatencyMillis 1500, got %v", latency)
+				}
+				if _, ok := metrics[0]["_aws"]; !ok {
+					t.Error("expected _aws metadata in metrics log")
+				}
+				if n := len(findLogs(logs, "ingest latency exceeds threshold")); n != 1 {
+					t.Errorf("expected 1 latency warning, got %d", n)
+				}
+				if n := len(findLogs(logs, "invalid SentTimestamp attribute")); n != 1 {
+					t.Errorf("expected 1 invalid timestamp warning, got %d", n)
+				}
+			},
+		},
 		{
-			name:     "valid composite key",
-			input:    "USER#123",
-			expected: "123",
+			name: "transient backfill failure fails the record as retryable",
+			event: events.SQSEvent{
+				Records: []events.SQSMessage{
+					{
+						MessageId: "msg-1",
+						Body: `{
+							"eventName": "MODIFY",
+							"dynamodb": {
+								"Keys": {"pk": {"S": "USER#123"}, "sk": {"S": "METADATA"}},
+								"StreamViewType": "KEYS_ONLY"
+							}
+						}`,
+					},
+				},
+			},
+			getenv:        testEnv(map[string]string{"TABLE_NAME": "test-table", "SOURCE_TABLE_NAME": "poc-users"}),
+			expectedError: fmt.Errorf("failed to backfill keys-only record: simulated throttling"),
+			mockGetItem: func(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+				return nil, fmt.Errorf("simulated throttling")
+			},
+			mockBatchWrite: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+				t.Error("BatchWriteItem should not be called when backfill fails")
+				return nil, nil
+			},
+			verifyLogs: func(t *testing.T, logs []map[string]any) {
+				failures := findLogs(logs, "failed to decode record")
+				if len(failures) != 1 || failures[0]["retryable"] != true {
+					t.Errorf("expected 1 retryable decode failure, got %v", failures)
+				}
+			},
 		},
 		{
-			name:     "no separator",
-			input:    "USER123",
-			expected: "USER123",
+			name: "keys only remove identifies the user from keys",
+			event: events.SQSEvent{
+				Records: []events.SQSMessage{
+					{
+						MessageId: "msg-1",
+						Body: `{
+							"eventName": "REMOVE",
+							"dynamodb": {
+								"Keys": {"pk": {"S": "USER#123"}, "sk": {"S": "METADATA"}},
+								"StreamViewType": "KEYS_ONLY"
+							}
+						}`,
+					},
+				},
+			},
+			getenv: testEnv(map[string]string{"TABLE_NAME": "test-table"}),
+			mockBatchWrite: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+				t.Error("BatchWriteItem should not be called without an old image or reconciliation")
+				return nil, nil
+			},
+			verifyLogs: func(t *testing.T, logs []map[string]any) {
+				warnings := findLogs(logs, "remove record without old image")
+				if len(warnings) != 1 || warnings[0]["userId"] != "123" {
+					t.Errorf("expected 1 warning for user 123, got %v", warnings)
+				}
+			},
 		},
 		{
-			name:     "empty string",
-			input:    "",
-			expected: "",
+			name: "remove with an old image missing pk falls back to keys",
+			event: events.SQSEvent{
+				Records: []events.SQSMessage{
+					{
+						Body: `{
+							"eventName": "REMOVE",
+							"dynamodb": {
+								"Keys": {"pk": {"S": "USER#123"}},
+								"OldImage": {"organizations": {"L": [{"S": "org1"}]}}
+							}
+						}`,
+					},
+				},
+			},
+			getenv: testEnv(map[string]string{"TABLE_NAME": "test-table"}),
+			mockBatchWrite: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+				requests := params.RequestItems["test-table"]
+				if len(requests) != 1 || requests[0].DeleteRequest == nil {
+					t.Fatalf("expected 1 delete request, got %v", requests)
+				}
+				if sk := requests[0].DeleteRequest.Key["sk"].(*types.AttributeValueMemberS).Value; sk != "MEMBERSHIP#123" {
+					t.Errorf("expected delete for MEMBERSHIP#123, got %s", sk)
+				}
+				return &dynamodb.BatchWriteItemOutput{}, nil
+			},
 		},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			result := extractUserID(tt.input)
-			if result != tt.expected {
-				t.Errorf("extractUserID() = %v, want %v", result, tt.expected)
-			}
-		})
-	}
-}
-
-// Test_createWriteRequests verifies the creation of DynamoDB write requests
-func Test_createWriteRequests(t *testing.T) {
-	tests := []struct {
-		name     string
-		userPK   string
-		orgs     []string
-		isDelete bool
-
-		wantLen      int
-		verifyResult func(t *testing.T, requests []types.WriteRequest)
-	}{
 		{
-			name:     "create put requests",
-			userPK:   "USER#123",
-			orgs:     []string{"org1", "org2"},
-			isDelete: false,
-			wantLen:  2,
-			verifyResult: func(t *testing.T, requests []types.WriteRequest) {
-				for i, req := range requests {
-					if req.PutRequest == nil {
-						t.Errorf("request %d: expected PutRequest, got DeleteRequest", i)
-					}
-					item := req.PutRequest.Item
-					pk := item["pk"].(*types.AttributeValueMemberS).Value
-					sk := item["sk"].(*types.AttributeValueMemberS).Value
-					expectedPK := fmt.Sprintf("ORGANIZATION#%s", []string{"org1", "org2"}[i])
-					expectedSK := "MEMBERSHIP#123"
-					if pk != expectedPK || sk != expectedSK {
-						t.Errorf("request %d: got pk=%s, sk=%s, want pk=%s, sk=%s",
-							i, pk, sk, expectedPK, expectedSK)
-					}
+			name: "empty user ID is skipped without writes",
+			event: events.SQSEvent{
+				Records: []events.SQSMessage{
+					{
+						MessageId: "msg-1",
+						Body: `{
+							"eventName": "INSERT",
+							"dynamodb": {
+								"NewImage": {
+									"pk": {"S": "USER#"},
+									"organizations": {"L": [{"S": "org1"}]}
+								}
+							}
+						}`,
+					},
+				},
+			},
+			getenv: testEnv(map[string]string{"TABLE_NAME": "test-table"}),
+			mockBatchWrite: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+				t.Error("BatchWriteItem should not be called for an empty user ID")
+				return nil, nil
+			},
+			verifyLogs: func(t *testing.T, logs []map[string]any) {
+				warnings := findLogs(logs, "skipping record with empty user ID")
+				if len(warnings) != 1 || warnings[0]["userKey"] != "USER#" {
+					t.Errorf("expected 1 warning for USER#, got %v", warnings)
+				}
+				metrics := findLogs(logs, "metrics")
+				if len(metrics) != 1 || metrics[0]["InvalidUserID"] != float64(1) {
+					t.Errorf("expected InvalidUserID 1, got %v", metrics)
 				}
 			},
 		},
 		{
-			name:     "create delete requests",
-			userPK:   "USER#456",
-			orgs:     []string{"org3", "org4"},
-			isDelete: true,
-			wantLen:  2,
-			verifyResult: func(t *testing.T, requests []types.WriteRequest) {
-				for i, req := range requests {
-					if req.DeleteRequest == nil {
-						t.Errorf("request %d: expected DeleteRequest, got PutRequest", i)
-					}
-					key := req.DeleteRequest.Key
-					pk := key["pk"].(*types.AttributeValueMemberS).Value
-					sk := key["sk"].(*types.AttributeValueMemberS).Value
-					expectedPK := fmt.Sprintf("ORGANIZATION#%s", []string{"org3", "org4"}[i])
-					expectedSK := "MEMBERSHIP#456"
-					if pk != expectedPK || sk != expectedSK {
-						t.Errorf("request %d: got pk=%s, sk=%s, want pk=%s, sk=%s",
-							i, pk, sk, expectedPK, expectedSK)
-					}
+			name: "reverse index written alongside memberships",
+			event: events.SQSEvent{
+				Records: []events.SQSMessage{
+					{
+						Body: `{
+							"eventName": "INSERT",
+							"dynamodb": {
+								"NewImage": {
+									"pk": {"S": "USER#123"},
+									"organizations": {"L": [{"S": "org1"}, {"S": "org2"}]}
+								}
+							}
+						}`,
+					},
+				},
+			},
+			getenv: testEnv(map[string]string{"TABLE_NAME": "test-table", "REVERSE_INDEX_TABLE": "reverse-table"}),
+			mockBatchWrite: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+				if len(params.RequestItems["test-table"]) != 2 {
+					t.Errorf("expected 2 membership requests, got %d", len(params.RequestItems["test-table"]))
+				}
+				if len(params.RequestItems["reverse-table"]) != 2 {
+					t.Errorf("expected 2 reverse index requests, got %d", len(params.RequestItems["reverse-table"]))
+				}
+				return &dynamodb.BatchWriteItemOutput{}, nil
+			},
+		},
+		{
+			name: "logged requests truncated to max log items",
+			event: events.SQSEvent{
+				Records: []events.SQSMessage{
+					{Body: insertBody("USER#123", 12)},
+				},
+			},
+			getenv: testEnv(map[string]string{"TABLE_NAME": "test-table", "MAX_LOG_ITEMS": "5"}),
+			mockBatchWrite: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+				if len(params.RequestItems["test-table"]) != 12 {
+					t.Errorf("expected all 12 requests to be written, got %d", len(params.RequestItems["test-table"]))
+				}
+				return &dynamodb.BatchWriteItemOutput{}, nil
+			},
+			verifyLogs: func(t *testing.T, logs []map[string]any) {
+				writes := findLogs(logs, "batch write input")
+				if len(writes) != 1 {
+					t.Fatalf("expected 1 write input log, got %d", len(writes))
+				}
+				table := writes[0]["input"].(map[string]any)["test-table"].(map[string]any)
+				if n := len(table["requests"].([]any)); n != 5 {
+					t.Errorf("expected 5 logged requests, got %d", n)
+				}
+				if more := table["more"]; more != "...and 7 more" {
+					t.Errorf("expected ...and 7 more, got %v", more)
+				}
+			},
+		},
+		{
+			name: "logged requests truncated to LOG_INPUT_MAX_ITEMS",
+			event: events.SQSEvent{
+				Records: []events.SQSMessage{
+					{Body: insertBody("USER#123", 4)},
+				},
+			},
+			getenv: testEnv(map[string]string{"TABLE_NAME": "test-table", "LOG_INPUT_MAX_ITEMS": "3"}),
+			mockBatchWrite: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+				return &dynamodb.BatchWriteItemOutput{}, nil
+			},
+			verifyLogs: func(t *testing.T, logs []map[string]any) {
+				writes := findLogs(logs, "batch write input")
+				if len(writes) != 1 {
+					t.Fatalf("expected 1 write input log, got %d", len(writes))
+				}
+				table := writes[0]["input"].(map[string]any)["test-table"].(map[string]any)
+				if n := len(table["requests"].([]any)); n != 3 {
+					t.Errorf("expected 3 logged requests, got %d", n)
+				}
+				if more := table["more"]; more != "...and 1 more" {
+					t.Errorf("expected ...and 1 more, got %v", more)
+				}
+			},
+		},
+		{
+			name: "out of order sequence numbers for a user are flagged",
+			event: events.SQSEvent{
+				Records: []events.SQSMessage{
+					{
+						MessageId: "msg-1",
+						Body: `{
+							"eventName": "MODIFY",
+							"dynamodb": {
+								"Keys": {"pk": {"S": "USER#123"}},
+								"SequenceNumber": "200",
+								"OldImage": {"pk": {"S": "USER#123"}, "organizations": {"L": [{"S": "org1"}]}},
+								"NewImage": {"pk": {"S": "USER#123"}, "organizations": {"L": [{"S": "org2"}]}}
+							}
+						}`,
+					},
+					{
+						MessageId: "msg-2",
+						Body: `{
+							"eventName": "MODIFY",
+							"dynamodb": {
+								"Keys": {"pk": {"S": "USER#123"}},
+								"SequenceNumber": "100",
+								"OldImage": {"pk": {"S": "USER#123"}, "organizations": {"L": []}},
+								"NewImage": {"pk": {"S": "USER#123"}, "organizations": {"L": [{"S": "org1"}]}}
+							}
+						}`,
+					},
+				},
+			},
+			getenv: testEnv(map[string]string{"TABLE_NAME": "test-table", "CHECK_SEQUENCE_ORDER": "true"}),
+			mockBatchWrite: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+				return &dynamodb.BatchWriteItemOutput{}, nil
+			},
+			verifyLogs: func(t *testing.T, logs []map[string]any) {
+				warnings := findLogs(logs, "out of order stream record")
+				if len(warnings) != 1 {
+					t.Fatalf("expected 1 out of order warning, got %d", len(warnings))
+				}
+				if warnings[0]["sequenceNumber"] != "100" || warnings[0]["lastSequenceNumber"] != "200" {
+					t.Errorf("unexpected warning attributes: %v", warnings[0])
+				}
+				records := findLogs(logs, "processing dynamo event record")
+				if len(records) != 2 || records[0]["sequenceNumber"] != "200" {
+					t.Errorf("expected sequence numbers logged for both records, got %v", records)
+				}
+			},
+		},
+		{
+			name: "removal exceeding known org count fails sanity check",
+			event: events.SQSEvent{
+				Records: []events.SQSMessage{
+					{Body: insertBody("USER#123", 3)},
+					{
+						Body: `{
+							"eventName": "MODIFY",
+							"dynamodb": {
+								"OldImage": {
+									"pk": {"S": "USER#123"},
+									"organizations": {"L": [
+										{"S": "org0"}, {"S": "org1"}, {"S": "org2"},
+										{"S": "org3"}, {"S": "org4"}, {"S": "org5"}
+									]}
+								},
+								"NewImage": {
+									"pk": {"S": "USER#123"},
+									"organizations": {"L": []}
+								}
+							}
+						}`,
+					},
+				},
+			},
+			getenv:        testEnv(map[string]string{"TABLE_NAME": "test-table", "REMOVAL_SANITY_MARGIN": "1"}),
+			expectedError: fmt.Errorf("record removes 6 organizations but user USER#123 is known to have 3"),
+			mockBatchWrite: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+				for _, req := range params.RequestItems["test-table"] {
+					if req.DeleteRequest != nil {
+						t.Error("over-removal record should not issue deletes")
+					}
+				}
+				return &dynamodb.BatchWriteItemOutput{}, nil
+			},
+			verifyLogs: func(t *testing.T, logs []map[string]any) {
+				if n := len(findLogs(logs, "record removes more organizations than the user is known to have")); n != 1 {
+					t.Errorf("expected 1 over-removal warning, got %d", n)
+				}
+				metrics := findLogs(logs, "metrics")
+				if len(metrics) != 1 || metrics[0]["OverRemovalRecords"] != 1.0 {
+					t.Errorf("expected OverRemovalRecords 1, got %v", metrics)
+				}
+			},
+		},
+		{
+			name: "created at taken from approximate creation time",
+			event: events.SQSEvent{
+				Records: []events.SQSMessage{
+					{
+						Body: `{
+							"eventName": "INSERT",
+							"dynamodb": {
+								"ApproximateCreationDateTime": 1600000000,
+								"NewImage": {
+									"pk": {"S": "USER#123"},
+									"organizations": {"L": [{"S": "org1"}]}
+								}
+							}
+						}`,
+					},
+					{Body: insertBody("USER#456", 1)},
+				},
+			},
+			getenv: testEnv(map[string]string{"TABLE_NAME": "test-table"}),
+			mockBatchWrite: func() func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+				want := []string{"2020-09-13T12:26:40Z", "2023-11-14T22:13:20Z"}
+				var call int
+				return func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+					created := params.RequestItems["test-table"][0].PutRequest.Item["createdAt"].(*types.AttributeValueMemberS).Value
+					if created != want[call] {
+						t.Errorf("call %d: expected createdAt %s, got %s", call, want[call], created)
+					}
+					call++
+					return &dynamodb.BatchWriteItemOutput{}, nil
+				}
+			}(),
+		},
+		{
+			name: "duplicate event id in a batch is applied once",
+			event: events.SQSEvent{
+				Records: []events.SQSMessage{
+					{MessageId: "msg-1", Body: `{"eventID": "event-1", "eventName": "INSERT", "dynamodb": {"NewImage": {"pk": {"S": "USER#123"}, "organizations": {"L": [{"S": "org1"}]}}}}`},
+					{MessageId: "msg-2", Body: `{"eventID": "event-1", "eventName": "INSERT", "dynamodb": {"NewImage": {"pk": {"S": "USER#123"}, "organizations": {"L": [{"S": "org1"}]}}}}`},
+					{MessageId: "msg-3", Body: `{"eventID": "event-2", "eventName": "INSERT", "dynamodb": {"NewImage": {"pk": {"S": "USER#456"}, "organizations": {"L": [{"S": "org1"}]}}}}`},
+				},
+			},
+			getenv: testEnv(map[string]string{"TABLE_NAME": "test-table"}),
+			mockBatchWrite: func() func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+				var calls int
+				return func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+					if calls++; calls > 2 {
+						t.Errorf("expected 2 batch writes, got %d", calls)
+					}
+					return &dynamodb.BatchWriteItemOutput{}, nil
+				}
+			}(),
+			verifyLogs: func(t *testing.T, logs []map[string]any) {
+				skipped := findLogs(logs, "skipping duplicate stream record")
+				if len(skipped) != 1 || skipped[0]["messageId"] != "msg-2" {
+					t.Errorf("expected msg-2 skipped as duplicate, got %v", skipped)
+				}
+				metrics := findLogs(logs, "metrics")
+				if len(metrics) != 1 || metrics[0]["DuplicateRecordsSkipped"] != 1.0 {
+					t.Errorf("expected DuplicateRecordsSkipped 1, got %v", metrics)
+				}
+			},
+		},
+		{
+			name: "records that write nothing are counted as zero write records",
+			event: events.SQSEvent{
+				Records: []events.SQSMessage{
+					{MessageId: "msg-1", Body: insertBody("USER#123", 1)},
+					{MessageId: "msg-2", Body: `{"eventName": "MODIFY", "dynamodb": {"OldImage": {"pk": {"S": "USER#456"}, "organizations": {"L": [{"S": "org1"}]}}, "NewImage": {"pk": {"S": "USER#456"}, "organizations": {"L": [{"S": "org1"}]}}}}`},
+				},
+			},
+			getenv: testEnv(map[string]string{"TABLE_NAME": "test-table"}),
+			mockBatchWrite: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+				return &dynamodb.BatchWriteItemOutput{}, nil
+			},
+			verifyLogs: func(t *testing.T, logs []map[string]any) {
+				summary := findLogs(logs, "batch summary")
+				if len(summary) != 1 || summary[0]["processed"] != 2.0 || summary[0]["zeroWriteRecords"] != 1.0 {
+					t.Errorf("expected 2 processed and 1 zero write record, got %v", summary)
+				}
+				metrics := findLogs(logs, "metrics")
+				if len(metrics) != 1 || metrics[0]["ZeroWriteRecords"] != 1.0 || metrics[0]["RecordsProcessed"] != 2.0 {
+					t.Errorf("expected ZeroWriteRecords 1 and RecordsProcessed 2, got %v", metrics)
+				}
+			},
+		},
+		{
+			name: "per org metrics aggregate organizations over the cap",
+			event: events.SQSEvent{
+				Records: []events.SQSMessage{
+					{Body: insertBody("USER#123", maxOrgDimensions+5)},
+				},
+			},
+			getenv: testEnv(map[string]string{"TABLE_NAME": "test-table", "PER_ORG_METRICS": "true"}),
+			mockBatchWrite: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+				return &dynamodb.BatchWriteItemOutput{}, nil
+			},
+			verifyLogs: func(t *testing.T, logs []map[string]any) {
+				orgMetrics := findLogs(logs, "organization metrics")
+				if len(orgMetrics) != maxOrgDimensions+1 {
+					t.Fatalf("expected %d organization metrics, got %d", maxOrgDimensions+1, len(orgMetrics))
+				}
+				for _, entry := range orgMetrics {
+					want := 1.0
+					if entry["OrganizationId"] == otherOrgDimension {
+						want = 5.0
+					}
+					if entry["MembershipChanges"] != want {
+						t.Errorf("expected MembershipChanges %v for %v, got %v", want, entry["OrganizationId"], entry["MembershipChanges"])
+					}
+				}
+			},
+		},
+		{
+			name: "user ID is read from USER_ID_ATTRIBUTE",
+			event: events.SQSEvent{
+				Records: []events.SQSMessage{
+					{Body: `{"eventName": "INSERT", "dynamodb": {"NewImage": {"pk": {"S": "PROFILE#abc"}, "user_id": {"N": "42"}, "organizations": {"L": [{"S": "org1"}]}}}}`},
+				},
+			},
+			getenv: testEnv(map[string]string{"TABLE_NAME": "test-table", "USER_ID_ATTRIBUTE": "user_id"}),
+			mockBatchWrite: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+				reqs := params.RequestItems["test-table"]
+				if len(reqs) != 1 || reqs[0].PutRequest.Item["sk"].(*types.AttributeValueMemberS).Value != "MEMBERSHIP#42" {
+					t.Errorf("expected a put with sk MEMBERSHIP#42, got %v", reqs)
+				}
+				return &dynamodb.BatchWriteItemOutput{}, nil
+			},
+		},
+		{
+			name: "insert without organizations attribute is counted",
+			event: events.SQSEvent{
+				Records: []events.SQSMessage{
+					{Body: `{"eventName": "INSERT", "dynamodb": {"NewImage": {"pk": {"S": "USER#123"}, "email": {"S": "user@example.org"}}}}`},
+				},
+			},
+			getenv: testEnv(map[string]string{"TABLE_NAME": "test-table"}),
+			mockBatchWrite: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+				t.Error("expected no batch write for an insert without organizations")
+				return &dynamodb.BatchWriteItemOutput{}, nil
+			},
+			verifyLogs: func(t *testing.T, logs []map[string]any) {
+				if metrics := findLogs(logs, "metrics"); len(metrics) != 1 || metrics[0]["InsertWithoutOrgs"] != 1.0 {
+					t.Errorf("expected InsertWithoutOrgs 1, got %v", metrics)
+				}
+			},
+		},
+		{
+			name: "batch above MAX_BATCH_SIZE is processed with a warning",
+			event: events.SQSEvent{
+				Records: []events.SQSMessage{
+					{Body: insertBody("USER#1", 1)},
+					{Body: insertBody("USER#2", 1)},
+					{Body: insertBody("USER#3", 1)},
+				},
+			},
+			getenv: testEnv(map[string]string{"TABLE_NAME": "test-table", "MAX_BATCH_SIZE": "2"}),
+			mockBatchWrite: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+				return &dynamodb.BatchWriteItemOutput{}, nil
+			},
+			verifyLogs: func(t *testing.T, logs []map[string]any) {
+				warnings := findLogs(logs, "batch exceeds the expected maximum size")
+				if len(warnings) != 1 || warnings[0]["level"] != "WARN" || warnings[0]["records"] != 3.0 || warnings[0]["maxBatchSize"] != 2.0 {
+					t.Errorf("expected a warning for 3 records above 2, got %v", warnings)
+				}
+				if metrics := findLogs(logs, "metrics"); len(metrics) != 1 || metrics[0]["OversizedBatches"] != 1.0 || metrics[0]["RecordsProcessed"] != 3.0 {
+					t.Errorf("expected OversizedBatches 1 with every record processed, got %v", metrics)
+				}
+			},
+		},
+		{
+			name: "large insert is chunked into batch writes",
+			event: events.SQSEvent{
+				Records: []events.SQSMessage{
+					{Body: insertBody("USER#123", 30)},
+				},
+			},
+			getenv: testEnv(map[string]string{"TABLE_NAME": "test-table"}),
+			mockBatchWrite: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+				if n := len(params.RequestItems["test-table"]); n > maxBatchWriteItems {
+					t.Errorf("expected at most %d requests per batch, got %d", maxBatchWriteItems, n)
+				}
+				return &dynamodb.BatchWriteItemOutput{}, nil
+			},
+			verifyLogs: func(t *testing.T, logs []map[string]any) {
+				metrics := findLogs(logs, "metrics")
+				if len(metrics) != 1 || metrics[0]["BatchWriteCalls"] != 2.0 || metrics[0]["WriteRequestsTotal"] != 30.0 {
+					t.Errorf("expected BatchWriteCalls 2 and WriteRequestsTotal 30, got %v", metrics)
+				}
+				summary := findLogs(logs, "batch write summary")
+				if len(summary) != 1 || summary[0]["requestsPerCall"] != 15.0 {
+					t.Errorf("expected 15 requests per call, got %v", summary)
+				}
+			},
+		},
+		{
+			name: "empty event name is malformed",
+			event: events.SQSEvent{
+				Records: []events.SQSMessage{
+					{MessageId: "msg-1", Body: `{"eventName": "", "dynamodb": {"NewImage": {"pk": {"S": "USER#123"}, "organizations": {"L": [{"S": "org1"}]}}}}`},
+				},
+			},
+			getenv:        testEnv(map[string]string{"TABLE_NAME": "test-table"}),
+			expectedError: fmt.Errorf("malformed stream record msg-1: missing eventName"),
+			mockBatchWrite: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+				t.Error("expected no batch write for a malformed record")
+				return &dynamodb.BatchWriteItemOutput{}, nil
+			},
+			verifyLogs: func(t *testing.T, logs []map[string]any) {
+				metrics := findLogs(logs, "metrics")
+				if len(metrics) != 1 || metrics[0]["MalformedRecords"] != 1.0 {
+					t.Errorf("expected MalformedRecords 1, got %v", metrics)
+				}
+			},
+		},
+		{
+			name: "record without a pk or image is malformed",
+			event: events.SQSEvent{
+				Records: []events.SQSMessage{
+					{MessageId: "msg-1", Body: `{"eventName": "REMOVE", "dynamodb": {"NewImage": null}}`},
+				},
+			},
+			getenv:        testEnv(map[string]string{"TABLE_NAME": "test-table"}),
+			expectedError: fmt.Errorf("malformed stream record msg-1: missing pk; missing image for REMOVE"),
+			mockBatchWrite: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+				t.Error("expected no batch write for a malformed record")
+				return &dynamodb.BatchWriteItemOutput{}, nil
+			},
+			verifyLogs: func(t *testing.T, logs []map[string]any) {
+				if logged := findLogs(logs, "malformed stream record"); len(logged) != 1 || logged[0]["error"] != "missing pk; missing image for REMOVE" {
+					t.Errorf("expected a malformed record error listing both problems, got %v", logged)
+				}
+			},
+		},
+		{
+			name: "unknown event name is ignored",
+			event: events.SQSEvent{
+				Records: []events.SQSMessage{
+					{Body: `{"eventName": "FOO", "dynamodb": {"NewImage": {"pk": {"S": "USER#123"}, "organizations": {"L": [{"S": "org1"}]}}}}`},
+				},
+			},
+			getenv: testEnv(map[string]string{"TABLE_NAME": "test-table"}),
+			mockBatchWrite: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+				t.Error("expected no batch write for an unknown event name")
+				return &dynamodb.BatchWriteItemOutput{}, nil
+			},
+			verifyLogs: func(t *testing.T, logs []map[string]any) {
+				warnings := findLogs(logs, "unknown event name")
+				if len(warnings) != 1 || warnings[0]["level"] != "WARN" || warnings[0]["eventName"] != "FOO" {
+					t.Errorf("expected a warning for event name FOO, got %v", warnings)
+				}
+				if metrics := findLogs(logs, "metrics"); len(metrics) != 1 || metrics[0]["UnknownEventName"] != 1.0 {
+					t.Errorf("expected UnknownEventName 1, got %v", metrics)
+				}
+			},
+		},
+		{
+			name: "lowercase insert event name is applied",
+			event: events.SQSEvent{
+				Records: []events.SQSMessage{
+					{Body: `{"eventName": "insert", "dynamodb": {"NewImage": {"pk": {"S": "USER#123"}, "organizations": {"L": [{"S": "org1"}]}}}}`},
+				},
+			},
+			getenv: testEnv(map[string]string{"TABLE_NAME": "test-table"}),
+			mockBatchWrite: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+				reqs := params.RequestItems["test-table"]
+				if len(reqs) != 1 || reqs[0].PutRequest == nil || reqs[0].PutRequest.Item["pk"].(*types.AttributeValueMemberS).Value != "ORGANIZATION#org1" {
+					t.Errorf("expected a put for org1, got %v", reqs)
+				}
+				return &dynamodb.BatchWriteItemOutput{}, nil
+			},
+		},
+		{
+			name: "mixed case modify event name is applied",
+			event: events.SQSEvent{
+				Records: []events.SQSMessage{
+					{Body: `{"eventName": "Modify", "dynamodb": {"OldImage": {"pk": {"S": "USER#123"}, "organizations": {"L": [{"S": "org1"}]}}, "NewImage": {"pk": {"S": "USER#123"}, "organizations": {"L": [{"S": "org2"}]}}}}`},
+				},
+			},
+			getenv: testEnv(map[string]string{"TABLE_NAME": "test-table"}),
+			mockBatchWrite: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+				reqs := params.RequestItems["test-table"]
+				if len(reqs) != 2 || reqs[0].DeleteRequest == nil || reqs[1].PutRequest == nil {
+					t.Errorf("expected a delete for org1 and a put for org2, got %v", reqs)
+				}
+				return &dynamodb.BatchWriteItemOutput{}, nil
+			},
+		},
+		{
+			name: "modify diffs against the baseline instead of the old image",
+			event: events.SQSEvent{
+				Records: []events.SQSMessage{
+					{
+						Body: `{
+							"eventName": "MODIFY",
+							"dynamodb": {
+								"OldImage": {"pk": {"S": "USER#123"}, "organizations": {"L": [{"S": "org1"}]}},
+								"NewImage": {"pk": {"S": "USER#123"}, "organizations": {"L": [{"S": "org1"}, {"S": "org2"}]}}
+							}
+						}`,
+					},
+				},
+			},
+			getenv: testEnv(map[string]string{"TABLE_NAME": "test-table", "BASELINE_SOURCE": "baseline-table"}),
+			mockGetItem: func(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+				return &dynamodb.GetItemOutput{Item: map[string]types.AttributeValue{
+					"pk": &types.AttributeValueMemberS{Value: "USER#123"},
+					"organizations": &types.AttributeValueMemberL{Value: []types.AttributeValue{
+						&types.AttributeValueMemberS{Value: "org2"},
+						&types.AttributeValueMemberS{Value: "org3"},
+					}},
+				}}, nil
+			},
+			mockBatchWrite: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+				// The baseline holds org2 and org3, so org3 is removed and org1 added; a diff
+				// against the old image would have added org2 instead.
+				requests := params.RequestItems["test-table"]
+				if len(requests) != 2 {
+					t.Fatalf("expected 2 write requests, got %d", len(requests))
+				}
+				if pk := requests[0].DeleteRequest.Key["pk"].(*types.AttributeValueMemberS).Value; pk != "ORGANIZATION#org3" {
+					t.Errorf("expected delete of ORGANIZATION#org3, got %s", pk)
+				}
+				if pk := requests[1].PutRequest.Item["pk"].(*types.AttributeValueMemberS).Value; pk != "ORGANIZATION#org1" {
+					t.Errorf("expected put of ORGANIZATION#org1, got %s", pk)
+				}
+				return &dynamodb.BatchWriteItemOutput{}, nil
+			},
+		},
+		{
+			name: "modify falls back to the old image without a baseline entry",
+			event: events.SQSEvent{
+				Records: []events.SQSMessage{
+					{
+						Body: `{
+							"eventName": "MODIFY",
+							"dynamodb": {
+								"OldImage": {"pk": {"S": "USER#123"}, "organizations": {"L": [{"S": "org1"}]}},
+								"NewImage": {"pk": {"S": "USER#123"}, "organizations": {"L": [{"S": "org1"}, {"S": "org2"}]}}
+							}
+						}`,
+					},
+				},
+			},
+			getenv: testEnv(map[string]string{"TABLE_NAME": "test-table", "BASELINE_SOURCE": "baseline-table"}),
+			mockGetItem: func(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+				return &dynamodb.GetItemOutput{}, nil
+			},
+			mockBatchWrite: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+				requests := params.RequestItems["test-table"]
+				if len(requests) != 1 || requests[0].PutRequest.Item["pk"].(*types.AttributeValueMemberS).Value != "ORGANIZATION#org2" {
+					t.Errorf("expected a single put of ORGANIZATION#org2, got %v", requests)
+				}
+				return &dynamodb.BatchWriteItemOutput{}, nil
+			},
+		},
+		{
+			name: "modify with the delete flag true removes every membership",
+			event: events.SQSEvent{
+				Records: []events.SQSMessage{
+					{Body: `{"eventName": "MODIFY", "dynamodb": {
+						"OldImage": {"pk": {"S": "USER#123"}, "organizations": {"L": [{"S": "org1"}, {"S": "org2"}]}},
+						"NewImage": {"pk": {"S": "USER#123"}, "deleted": {"BOOL": true}, "organizations": {"L": [{"S": "org1"}, {"S": "org3"}]}}}}`},
+				},
+			},
+			getenv: testEnv(map[string]string{"TABLE_NAME": "test-table", "DELETE_FLAG_ATTRIBUTE": "deleted"}),
+			mockBatchWrite: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+				var deletes []string
+				for _, req := range params.RequestItems["test-table"] {
+					if req.PutRequest != nil {
+						t.Errorf("expected only deletes for a soft deleted user, got %v", req)
+						continue
+					}
+					deletes = append(deletes, req.DeleteRequest.Key["pk"].(*types.AttributeValueMemberS).Value)
+				}
+				if want := []string{"ORGANIZATION#org1", "ORGANIZATION#org2"}; !reflect.DeepEqual(deletes, want) {
+					t.Errorf("deletes = %v, want %v", deletes, want)
+				}
+				return &dynamodb.BatchWriteItemOutput{}, nil
+			},
+		},
+		{
+			name: "modify with the delete flag false applies the diff",
+			event: events.SQSEvent{
+				Records: []events.SQSMessage{
+					{Body: `{"eventName": "MODIFY", "dynamodb": {
+						"OldImage": {"pk": {"S": "USER#123"}, "organizations": {"L": [{"S": "org1"}, {"S": "org2"}]}},
+						"NewImage": {"pk": {"S": "USER#123"}, "deleted": {"BOOL": false}, "organizations": {"L": [{"S": "org1"}, {"S": "org3"}]}}}}`},
+				},
+			},
+			getenv: testEnv(map[string]string{"TABLE_NAME": "test-table", "DELETE_FLAG_ATTRIBUTE": "deleted"}),
+			mockBatchWrite: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+				reqs := params.RequestItems["test-table"]
+				if len(reqs) != 2 || reqs[0].DeleteRequest == nil || reqs[0].DeleteRequest.Key["pk"].(*types.AttributeValueMemberS).Value != "ORGANIZATION#org2" ||
+					reqs[1].PutRequest == nil || reqs[1].PutRequest.Item["pk"].(*types.AttributeValueMemberS).Value != "ORGANIZATION#org3" {
+					t.Errorf("expected the org2 delete and org3 put of the diff, got %v", reqs)
+				}
+				return &dynamodb.BatchWriteItemOutput{}, nil
+			},
+		},
+		{
+			name: "modify without the delete flag applies the diff",
+			event: events.SQSEvent{
+				Records: []events.SQSMessage{
+					{Body: `{"eventName": "MODIFY", "dynamodb": {
+						"OldImage": {"pk": {"S": "USER#123"}, "organizations": {"L": [{"S": "org1"}, {"S": "org2"}]}},
+						"NewImage": {"pk": {"S": "USER#123"}, "organizations": {"L": [{"S": "org1"}, {"S": "org3"}]}}}}`},
+				},
+			},
+			getenv: testEnv(map[string]string{"TABLE_NAME": "test-table", "DELETE_FLAG_ATTRIBUTE": "deleted"}),
+			mockBatchWrite: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+				reqs := params.RequestItems["test-table"]
+				if len(reqs) != 2 || reqs[0].DeleteRequest == nil || reqs[0].DeleteRequest.Key["pk"].(*types.AttributeValueMemberS).Value != "ORGANIZATION#org2" ||
+					reqs[1].PutRequest == nil || reqs[1].PutRequest.Item["pk"].(*types.AttributeValueMemberS).Value != "ORGANIZATION#org3" {
+					t.Errorf("expected the org2 delete and org3 put of the diff, got %v", reqs)
+				}
+				return &dynamodb.BatchWriteItemOutput{}, nil
+			},
+		},
+		{
+			name: "modify with identical organizations is a noop",
+			event: events.SQSEvent{
+				Records: []events.SQSMessage{
+					{
+						Body: `{
+							"eventName": "MODIFY",
+							"dynamodb": {
+								"OldImage": {"pk": {"S": "USER#123"}, "email": {"S": "old@example.org"}, "organizations": {"L": [{"S": "org1"}, {"S": "org2"}]}},
+								"NewImage": {"pk": {"S": "USER#123"}, "email": {"S": "new@example.org"}, "organizations": {"L": [{"S": "org2"}, {"S": "org1"}]}}
+							}
+						}`,
+					},
+				},
+			},
+			getenv: testEnv(map[string]string{"TABLE_NAME": "test-table"}),
+			mockBatchWrite: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+				t.Error("expected no batch write for an unchanged organization list")
+				return &dynamodb.BatchWriteItemOutput{}, nil
+			},
+			verifyLogs: func(t *testing.T, logs []map[string]any) {
+				metrics := findLogs(logs, "metrics")
+				if len(metrics) != 1 || metrics[0]["NoopModify"] != 1.0 {
+					t.Errorf("expected NoopModify 1, got %v", metrics)
+				}
+			},
+		},
+		{
+			name: "large insert records its chunk count",
+			event: events.SQSEvent{
+				Records: []events.SQSMessage{
+					{Body: insertBody("USER#123", 60)},
+					{Body: insertBody("USER#456", 1)},
+				},
+			},
+			getenv: testEnv(map[string]string{"TABLE_NAME": "test-table"}),
+			mockBatchWrite: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+				return &dynamodb.BatchWriteItemOutput{}, nil
+			},
+			verifyLogs: func(t *testing.T, logs []map[string]any) {
+				metrics := findLogs(logs, "metrics")
+				if len(metrics) != 1 {
+					t.Fatalf("expected 1 metrics log, got %d", len(metrics))
+				}
+				if chunks := metrics[0]["BatchChunks"]; !reflect.DeepEqual(chunks, []any{3.0, 1.0}) {
+					t.Errorf("expected BatchChunks [3 1], got %v", chunks)
+				}
+			},
+		},
+		{
+			name: "empty organization IDs are skipped",
+			event: events.SQSEvent{
+				Records: []events.SQSMessage{
+					{Body: `{"eventName": "INSERT", "dynamodb": {"NewImage": {"pk": {"S": "USER#123"}, "organizations": {"L": [{"S": "org1"}, {"S": ""}, {"S": "  "}]}}}}`},
+				},
+			},
+			getenv: testEnv(map[string]string{"TABLE_NAME": "test-table"}),
+			mockBatchWrite: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+				requests := params.RequestItems["test-table"]
+				if len(requests) != 1 || requests[0].PutRequest.Item["pk"].(*types.AttributeValueMemberS).Value != "ORGANIZATION#org1" {
+					t.Errorf("expected a single put of ORGANIZATION#org1, got %v", requests)
+				}
+				return &dynamodb.BatchWriteItemOutput{}, nil
+			},
+			verifyLogs: func(t *testing.T, logs []map[string]any) {
+				warnings := findLogs(logs, "skipping empty organization ID")
+				if len(warnings) != 2 || warnings[0]["userId"] != "123" {
+					t.Errorf("expected 2 warnings for user 123, got %v", warnings)
+				}
+				metrics := findLogs(logs, "metrics")
+				if len(metrics) != 1 || metrics[0]["SkippedEmptyOrg"] != 2.0 {
+					t.Errorf("expected SkippedEmptyOrg 2, got %v", metrics)
+				}
+			},
+		},
+		{
+			name: "modify logs the membership diff",
+			event: events.SQSEvent{
+				Records: []events.SQSMessage{
+					{
+						Body: `{
+							"eventName": "MODIFY",
+							"dynamodb": {
+								"OldImage": {"pk": {"S": "USER#123"}, "organizations": {"L": [{"S": "org1"}, {"S": "org2"}]}},
+								"NewImage": {"pk": {"S": "USER#123"}, "organizations": {"L": [{"S": "org2"}, {"S": "org3"}]}}
+							}
+						}`,
+					},
+				},
+			},
+			getenv: testEnv(map[string]string{"TABLE_NAME": "test-table"}),
+			mockBatchWrite: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+				return &dynamodb.BatchWriteItemOutput{}, nil
+			},
+			verifyLogs: func(t *testing.T, logs []map[string]any) {
+				diffs := findLogs(logs, "membership diff")
+				if len(diffs) != 1 {
+					t.Fatalf("expected 1 membership diff log, got %d", len(diffs))
+				}
+				diff := diffs[0]
+				if diff["level"] != "DEBUG" || diff["userId"] != "123" {
+					t.Errorf("expected a debug log for user 123, got %v", diff)
+				}
+				if !reflect.DeepEqual(diff["added"], []any{"org3"}) || !reflect.DeepEqual(diff["removed"], []any{"org1"}) {
+					t.Errorf("expected added [org3] and removed [org1], got %v and %v", diff["added"], diff["removed"])
+				}
+				for _, entry := range findLogs(logs, "writing organization memberships") {
+					if _, ok := entry["input"]; ok {
+						t.Errorf("expected no raw input on the info write log, got %v", entry["input"])
+					}
+				}
+			},
+		},
+		{
+			name: "organizations outside the allowlist are filtered",
+			event: events.SQSEvent{
+				Records: []events.SQSMessage{
+					{
+						Body: `{
+							"eventName": "MODIFY",
+							"dynamodb": {
+								"OldImage": {"pk": {"S": "USER#123"}, "organizations": {"L": [{"S": "org1"}, {"S": "org2"}]}},
+								"NewImage": {"pk": {"S": "USER#123"}, "organizations": {"L": [{"S": "org3"}, {"S": "org4"}]}}
+							}
+						}`,
+					},
+				},
+			},
+			getenv: testEnv(map[string]string{"TABLE_NAME": "test-table", "ORG_ALLOWLIST": "org1, org3"}),
+			mockBatchWrite: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+				requests := params.RequestItems["test-table"]
+				if len(requests) != 2 {
+					t.Fatalf("expected 2 write requests, got %d", len(requests))
+				}
+				if pk := requests[0].DeleteRequest.Key["pk"].(*types.AttributeValueMemberS).Value; pk != "ORGANIZATION#org1" {
+					t.Errorf("expected delete of ORGANIZATION#org1, got %s", pk)
+				}
+				if pk := requests[1].PutRequest.Item["pk"].(*types.AttributeValueMemberS).Value; pk != "ORGANIZATION#org3" {
+					t.Errorf("expected put of ORGANIZATION#org3, got %s", pk)
+				}
+				return &dynamodb.BatchWriteItemOutput{}, nil
+			},
+			verifyLogs: func(t *testing.T, logs []map[string]any) {
+				metrics := findLogs(logs, "metrics")
+				if len(metrics) != 1 || metrics[0]["FilteredOrgs"] != 2.0 {
+					t.Errorf("expected FilteredOrgs 2, got %v", metrics)
+				}
+			},
+		},
+		{
+			name: "record with only filtered organizations writes nothing",
+			event: events.SQSEvent{
+				Records: []events.SQSMessage{
+					{Body: insertBody("USER#123", 2)},
+				},
+			},
+			getenv: testEnv(map[string]string{"TABLE_NAME": "test-table", "ORG_ALLOWLIST": "org9"}),
+			mockBatchWrite: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+				t.Error("expected no batch write when every organization is filtered")
+				return &dynamodb.BatchWriteItemOutput{}, nil
+			},
+		},
+		{
+			name: "modify with null organizations leaves memberships unchanged",
+			event: events.SQSEvent{
+				Records: []events.SQSMessage{
+					{
+						Body: `{
+							"eventName": "MODIFY",
+							"dynamodb": {
+								"OldImage": {"pk": {"S": "USER#123"}, "organizations": {"L": [{"S": "org1"}]}},
+								"NewImage": {"pk": {"S": "USER#123"}, "organizations": {"NULL": true}}
+							}
+						}`,
+					},
+				},
+			},
+			getenv: testEnv(map[string]string{"TABLE_NAME": "test-table"}),
+			mockBatchWrite: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+				t.Error("expected no batch write for a NULL organizations attribute")
+				return &dynamodb.BatchWriteItemOutput{}, nil
+			},
+		},
+		{
+			name: "modify with empty organizations clears memberships",
+			event: events.SQSEvent{
+				Records: []events.SQSMessage{
+					{
+						Body: `{
+							"eventName": "MODIFY",
+							"dynamodb": {
+								"OldImage": {"pk": {"S": "USER#123"}, "organizations": {"L": [{"S": "org1"}]}},
+								"NewImage": {"pk": {"S": "USER#123"}, "organizations": {"L": []}}
+							}
+						}`,
+					},
+				},
+			},
+			getenv: testEnv(map[string]string{"TABLE_NAME": "test-table"}),
+			mockBatchWrite: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+				requests := params.RequestItems["test-table"]
+				if len(requests) != 1 || requests[0].DeleteRequest == nil {
+					t.Errorf("expected a single delete, got %v", requests)
+				}
+				return &dynamodb.BatchWriteItemOutput{}, nil
+			},
+		},
+		{
+			name: "numeric organization IDs in the list",
+			event: events.SQSEvent{
+				Records: []events.SQSMessage{
+					{
+						Body: `{
+							"eventName": "INSERT",
+							"dynamodb": {
+								"NewImage": {"pk": {"S": "USER#123"}, "organizations": {"L": [{"S": "org1"}, {"N": "42"}]}}
+							}
+						}`,
+					},
+				},
+			},
+			getenv: testEnv(map[string]string{"TABLE_NAME": "test-table"}),
+			mockBatchWrite: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+				var pks []string
+				for _, req := range params.RequestItems["test-table"] {
+					pks = append(pks, req.PutRequest.Item["pk"].(*types.AttributeValueMemberS).Value)
+				}
+				if want := []string{"ORGANIZATION#42", "ORGANIZATION#org1"}; !reflect.DeepEqual(pks, want) {
+					t.Errorf("expected membership keys %v, got %v", want, pks)
+				}
+				return &dynamodb.BatchWriteItemOutput{}, nil
+			},
+		},
+		{
+			name: "organizations read from a custom attribute name",
+			event: events.SQSEvent{
+				Records: []events.SQSMessage{
+					{
+						Body: `{
+							"eventName": "MODIFY",
+							"dynamodb": {
+								"OldImage": {"pk": {"S": "USER#123"}, "org_ids": {"L": [{"S": "org1"}]}, "organizations": {"L": [{"S": "ignored"}]}},
+								"NewImage": {"pk": {"S": "USER#123"}, "org_ids": {"L": [{"S": "org2"}]}}
+							}
+						}`,
+					},
+				},
+			},
+			getenv: testEnv(map[string]string{"TABLE_NAME": "test-table", "ORG_ATTRIBUTE_NAME": "org_ids"}),
+			mockBatchWrite: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+				requests := params.RequestItems["test-table"]
+				if len(requests) != 2 {
+					t.Fatalf("expected 2 write requests, got %d", len(requests))
+				}
+				if pk := requests[0].DeleteRequest.Key["pk"].(*types.AttributeValueMemberS).Value; pk != "ORGANIZATION#org1" {
+					t.Errorf("expected delete of ORGANIZATION#org1, got %s", pk)
+				}
+				if pk := requests[1].PutRequest.Item["pk"].(*types.AttributeValueMemberS).Value; pk != "ORGANIZATION#org2" {
+					t.Errorf("expected put of ORGANIZATION#org2, got %s", pk)
+				}
+				return &dynamodb.BatchWriteItemOutput{}, nil
+			},
+		},
+		{
+			name: "modify counts put and delete requests",
+			event: events.SQSEvent{
+				Records: []events.SQSMessage{
+					{
+						Body: `{
+							"eventName": "MODIFY",
+							"dynamodb": {
+								"OldImage": {"pk": {"S": "USER#123"}, "organizations": {"L": [{"S": "org1"}, {"S": "org2"}]}},
+								"NewImage": {"pk": {"S": "USER#123"}, "organizations": {"L": [{"S": "org2"}, {"S": "org3"}]}}
+							}
+						}`,
+					},
+				},
+			},
+			getenv: testEnv(map[string]string{"TABLE_NAME": "test-table"}),
+			mockBatchWrite: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+				return &dynamodb.BatchWriteItemOutput{}, nil
+			},
+			verifyLogs: func(t *testing.T, logs []map[string]any) {
+				metrics := findLogs(logs, "metrics")
+				if len(metrics) != 1 {
+					t.Fatalf("expected 1 metrics log, got %d", len(metrics))
+				}
+				if metrics[0]["PutRequests"] != 1.0 || metrics[0]["DeleteRequests"] != 1.0 {
+					t.Errorf("expected PutRequests 1 and DeleteRequests 1, got %v and %v", metrics[0]["PutRequests"], metrics[0]["DeleteRequests"])
+				}
+			},
+		},
+		{
+			name: "projected attributes copied onto memberships",
+			event: events.SQSEvent{
+				Records: []events.SQSMessage{
+					{
+						Body: `{
+							"eventName": "INSERT",
+							"dynamodb": {
+								"NewImage": {
+									"pk": {"S": "USER#123"},
+									"display_name": {"S": "Ada"},
+									"tier": {"S": "gold"},
+									"login_count": {"N": "7"},
+									"organizations": {"L": [{"S": "org1"}]}
+								}
+							}
+						}`,
+					},
+				},
+			},
+			getenv: testEnv(map[string]string{"TABLE_NAME": "test-table", "PROJECT_ATTRIBUTES": "display_name, tier,region,login_count,pk"}),
+			mockBatchWrite: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+				item := params.RequestItems["test-table"][0].PutRequest.Item
+				if item["pk"].(*types.AttributeValueMemberS).Value != "ORGANIZATION#org1" {
+					t.Errorf("expected pk ORGANIZATION#org1, got %v", item["pk"])
+				}
+				for name, want := range map[string]string{"display_name": "Ada", "tier": "gold"} {
+					if got, ok := item[name].(*types.AttributeValueMemberS); !ok || got.Value != want {
+						t.Errorf("expected %s %q, got %v", name, want, item[name])
+					}
+				}
+				for _, name := range []string{"region", "login_count"} {
+					if _, ok := item[name]; ok {
+						t.Errorf("expected %s to be skipped, got %v", name, item[name])
+					}
+				}
+				return &dynamodb.BatchWriteItemOutput{}, nil
+			},
+			verifyLogs: func(t *testing.T, logs []map[string]any) {
+				skipped := findLogs(logs, "skipping projected attribute")
+				if len(skipped) != 2 || skipped[0]["attribute"] != "region" || skipped[0]["present"] != false || skipped[1]["attribute"] != "login_count" {
+					t.Errorf("expected region and login_count to be skipped, got %v", skipped)
+				}
+				if reserved := findLogs(logs, "ignoring reserved PROJECT_ATTRIBUTES attribute"); len(reserved) != 1 || reserved[0]["attribute"] != "pk" {
+					t.Errorf("expected pk to be ignored as reserved, got %v", reserved)
+				}
+			},
+		},
+		{
+			name: "time-prefixed sort keys skip deletes",
+			event: events.SQSEvent{
+				Records: []events.SQSMessage{
+					{
+						Body: `{
+							"eventName": "MODIFY",
+							"dynamodb": {
+								"OldImage": {"pk": {"S": "USER#123"}, "organizations": {"L": [{"S": "org1"}, {"S": "org2"}]}},
+								"NewImage": {"pk": {"S": "USER#123"}, "organizations": {"L": [{"S": "org2"}, {"S": "org3"}]}}
+							}
+						}`,
+					},
+				},
+			},
+			getenv: testEnv(map[string]string{"TABLE_NAME": "test-table", "SK_TIME_PREFIX": "true"}),
+			mockBatchWrite: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+				requests := params.RequestItems["test-table"]
+				if len(requests) != 1 || requests[0].PutRequest == nil {
+					t.Fatalf("expected a single put, got %v", requests)
+				}
+				if sk := requests[0].PutRequest.Item["sk"].(*types.AttributeValueMemberS).Value; sk != "MEMBERSHIP#1700000000000#123" {
+					t.Errorf("expected sk MEMBERSHIP#1700000000000#123, got %s", sk)
+				}
+				return &dynamodb.BatchWriteItemOutput{}, nil
+			},
+			verifyLogs: func(t *testing.T, logs []map[string]any) {
+				warnings := findLogs(logs, "cannot delete time-prefixed memberships")
+				if len(warnings) != 1 || !reflect.DeepEqual(warnings[0]["organizations"], []any{"org1"}) {
+					t.Errorf("expected a warning for org1, got %v", warnings)
+				}
+				if metrics := findLogs(logs, "metrics"); len(metrics) != 1 || metrics[0]["UnresolvedDeletes"] != 1.0 {
+					t.Errorf("expected UnresolvedDeletes 1, got %v", metrics)
+				}
+			},
+		},
+		{
+			name: "insert with map organizations",
+			event: events.SQSEvent{
+				Records: []events.SQSMessage{
+					{
+						Body: `{
+							"eventName": "INSERT",
+							"dynamodb": {
+								"NewImage": {
+									"pk": {"S": "USER#123"},
+									"organizations": {"M": {
+										"org2": {"M": {"role": {"S": "member"}}},
+										"org1": {"M": {"role": {"S": "admin"}}}
+									}}
+								}
+							}
+						}`,
+					},
+				},
+			},
+			getenv: testEnv(map[string]string{"TABLE_NAME": "test-table"}),
+			mockBatchWrite: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+				requests := params.RequestItems["test-table"]
+				if len(requests) != 2 {
+					t.Fatalf("expected 2 write requests, got %d", len(requests))
+				}
+				for i, want := range []struct{ pk, role string }{
+					{"ORGANIZATION#org1", "admin"},
+					{"ORGANIZATION#org2", "member"},
+				} {
+					item := requests[i].PutRequest.Item
+					pk := item["pk"].(*types.AttributeValueMemberS).Value
+					role := item["role"].(*types.AttributeValueMemberS).Value
+					if pk != want.pk || role != want.role {
+						t.Errorf("request %d: got pk=%s, role=%s, want pk=%s, role=%s", i, pk, role, want.pk, want.role)
+					}
+				}
+				return &dynamodb.BatchWriteItemOutput{}, nil
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			logger := slog.New(slog.NewJSONHandler(io.MultiWriter(os.Stdout, &buf), &slog.HandlerOptions{Level: slog.LevelDebug}))
+			mockClient := &mockDynamoDBClient{
+				batchWriteItemFunc: tt.mockBatchWrite,
+				getItemFunc:        tt.mockGetItem,
+			}
+
+			h := handler(logger, mockClient, nil, nil, nil, mustLoadConfig(t, tt.getenv), fixedClock, nil)
+			_, err := h(context.Background(), tt.event)
+
+			if tt.expectedError == nil {
+				if err != nil {
+					t.Errorf("handler() unexpected error = %v", err)
+				}
+			} else if err == nil || err.Error() != tt.expectedError.Error() {
+				t.Errorf("handler() error = %v, want %v", err, tt.expectedError)
+			}
+			if tt.verifyLogs != nil {
+				tt.verifyLogs(t, parseLogs(t, &buf))
+			}
+		})
+	}
+}
+
+// Test_processBatch_recoversPanics verifies a panicking record is reported failed while the rest of the batch continues
+func Test_processBatch_recoversPanics(t *testing.T) {
+	var buf bytes.Buffer
+	var processed []string
+	p := &processor{
+		logger: slog.New(slog.NewJSONHandler(&buf, nil)),
+		now:    fixedClock,
+		process: func(ctx context.Context, inv *invocation, record events.SQSMessage) error {
+			if record.MessageId == "msg-2" {
+				var image map[string]*events.DynamoDBAttributeValue
+				_ = image["pk"].String() // nil pointer dereference
+			}
+			processed = append(processed, record.MessageId)
+			return nil
+		},
+	}
+
+	_, resp, err := p.processBatch(context.Background(), events.SQSEvent{Records: []events.SQSMessage{
+		{MessageId: "msg-1"}, {MessageId: "msg-2"}, {MessageId: "msg-3"},
+	}})
+	if err != nil {
+		t.Fatalf("processBatch() unexpected error = %v", err)
+	}
+	if want := []events.SQSBatchItemFailure{{ItemIdentifier: "msg-2"}}; !reflect.DeepEqual(resp.BatchItemFailures, want) {
+		t.Errorf("BatchItemFailures = %v, want %v", resp.BatchItemFailures, want)
+	}
+	if want := []string{"msg-1", "msg-3"}; !reflect.DeepEqual(processed, want) {
+		t.Errorf("processed = %v, want %v", processed, want)
+	}
+
+	logs := parseLogs(t, &buf)
+	panics := findLogs(logs, "recovered panic processing record")
+	if len(panics) != 1 || panics[0]["messageId"] != "msg-2" || !strings.Contains(panics[0]["stack"].(string), "goroutine") {
+		t.Errorf("expected a panic log with a stack for msg-2, got %v", panics)
+	}
+	if metrics := findLogs(logs, "metrics"); len(metrics) != 1 || metrics[0]["RecordPanics"] != 1.0 {
+		t.Errorf("expected RecordPanics 1, got %v", metrics)
+	}
+}
+
+// Test_processBatch_recordTimeout verifies a record that runs past its share of the remaining
+// invocation time is reported as a batch item failure while the rest of the batch continues
+func Test_processBatch_recordTimeout(t *testing.T) {
+	var buf bytes.Buffer
+	var processed []string
+	p := &processor{
+		logger: slog.New(slog.NewJSONHandler(&buf, nil)),
+		now:    fixedClock,
+		process: func(ctx context.Context, inv *invocation, record events.SQSMessage) error {
+			if record.MessageId == "msg-1" {
+				<-ctx.Done()
+				return ctx.Err()
+			}
+			processed = append(processed, record.MessageId)
+			return nil
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), responseMargin+200*time.Millisecond)
+	defer cancel()
+	_, resp, err := p.processBatch(ctx, events.SQSEvent{Records: []events.SQSMessage{
+		{MessageId: "msg-1"}, {MessageId: "msg-2"},
+	}})
+	if err != nil {
+		t.Fatalf("processBatch() unexpected error = %v", err)
+	}
+	if want := []events.SQSBatchItemFailure{{ItemIdentifier: "msg-1"}}; !reflect.DeepEqual(resp.BatchItemFailures, want) {
+		t.Errorf("BatchItemFailures = %v, want %v", resp.BatchItemFailures, want)
+	}
+	if want := []string{"msg-2"}; !reflect.DeepEqual(processed, want) {
+		t.Errorf("processed = %v, want %v", processed, want)
+	}
+	if metrics := findLogs(parseLogs(t, &buf), "metrics"); len(metrics) != 1 || metrics[0]["RecordTimeouts"] != 1.0 {
+		t.Errorf("expected RecordTimeouts 1, got %v", metrics)
+	}
+}
+
+// Test_processBatch_textLogsMetrics verifies metrics are written as JSON EMF lines through
+// metricsLogger while the rest of the logs use the text format
+func Test_processBatch_textLogsMetrics(t *testing.T) {
+	var logBuf, metricsBuf bytes.Buffer
+	p := &processor{
+		logger:        newLogger(&logBuf, "text", ""),
+		metricsLogger: newLogger(&metricsBuf, "json", ""),
+		now:           fixedClock,
+		process: func(ctx context.Context, inv *invocation, record events.SQSMessage) error {
+			return nil
+		},
+	}
+
+	if _, _, err := p.processBatch(context.Background(), events.SQSEvent{Records: []events.SQSMessage{{MessageId: "msg-1"}}}); err != nil {
+		t.Fatalf("processBatch() unexpected error = %v", err)
+	}
+
+	if strings.Contains(logBuf.String(), "_aws") {
+		t.Errorf("expected no EMF metadata in the text logs, got %s", logBuf.String())
+	}
+	metrics := findLogs(parseLogs(t, &metricsBuf), "metrics")
+	if len(metrics) != 1 || metrics[0]["_aws"] == nil {
+		t.Errorf("expected one JSON EMF metrics line, got %v", metrics)
+	}
+}
+
+// Test_recordContext verifies the last record's deadline leaves responseMargin before the
+// invocation deadline to return the batch response
+func Test_recordContext(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	invocationDeadline, _ := ctx.Deadline()
+
+	recordCtx, recordCancel := recordContext(ctx, 1)
+	defer recordCancel()
+	deadline, ok := recordCtx.Deadline()
+	if !ok {
+		t.Fatal("expected the record context to have a deadline")
+	}
+	if margin := invocationDeadline.Sub(deadline); margin < responseMargin {
+		t.Errorf("expected at least %v before the invocation deadline, got %v", responseMargin, margin)
+	}
+}
+
+// Test_handler_eventTypes verifies records whose event name is not in EVENT_TYPES are skipped
+func Test_handler_eventTypes(t *testing.T) {
+	var writes []types.WriteRequest
+	client := &mockDynamoDBClient{
+		batchWriteItemFunc: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+			writes = append(writes, params.RequestItems["test-table"]...)
+			return &dynamodb.BatchWriteItemOutput{}, nil
+		},
+	}
+
+	var buf bytes.Buffer
+	env := testEnv(map[string]string{"TABLE_NAME": "test-table", "EVENT_TYPES": "INSERT"})
+	h := handler(slog.New(slog.NewJSONHandler(&buf, nil)), client, nil, nil, nil, mustLoadConfig(t, env), fixedClock, nil)
+	_, err := h(context.Background(), events.SQSEvent{Records: []events.SQSMessage{
+		{MessageId: "insert", Body: insertBody("USER#123", 1)},
+		{MessageId: "remove", Body: `{"eventName": "REMOVE", "dynamodb": {"OldImage": {"pk": {"S": "USER#456"}, "organizations": {"L": [{"S": "org1"}]}}}}`},
+	}})
+	if err != nil {
+		t.Fatalf("handler() unexpected error = %v", err)
+	}
+
+	if len(writes) != 1 || writes[0].PutRequest == nil {
+		t.Fatalf("expected only the INSERT to be written, got %+v", writes)
+	}
+	logs := parseLogs(t, &buf)
+	if skipped := findLogs(logs, "skipping filtered event type"); len(skipped) != 1 || skipped[0]["eventName"] != "REMOVE" {
+		t.Errorf("expected the REMOVE to be skipped, got %v", skipped)
+	}
+	if metrics := findLogs(logs, "metrics"); len(metrics) != 1 || metrics[0]["FilteredByEventType"] != 1.0 {
+		t.Errorf("expected FilteredByEventType 1, got %v", metrics)
+	}
+}
+
+// Test_handler_includeUserSK verifies memberships for a user's profile records are kept apart
+// by the user's sort key when INCLUDE_USER_SK is set, and share a key by default
+func Test_handler_includeUserSK(t *testing.T) {
+	tests := []struct {
+		name   string
+		env    map[string]string
+		wantSK []string
+	}{
+		{name: "ignored by default", env: map[string]string{}, wantSK: []string{"MEMBERSHIP#123", "MEMBERSHIP#123"}},
+		{name: "included when enabled", env: map[string]string{"INCLUDE_USER_SK": "true"}, wantSK: []string{"MEMBERSHIP#123#PROFILE#work", "MEMBERSHIP#123#PROFILE#home"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sks []string
+			client := &mockDynamoDBClient{
+				batchWriteItemFunc: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+					for _, req := range params.RequestItems["test-table"] {
+						sks = append(sks, req.PutRequest.Item["sk"].(*types.AttributeValueMemberS).Value)
+					}
+					return &dynamodb.BatchWriteItemOutput{}, nil
+				},
+			}
+
+			tt.env["TABLE_NAME"] = "test-table"
+			h := handler(slog.New(slog.NewJSONHandler(io.Discard, nil)), client, nil, nil, nil, mustLoadConfig(t, testEnv(tt.env)), fixedClock, nil)
+			_, err := h(context.Background(), events.SQSEvent{Records: []events.SQSMessage{
+				{MessageId: "work", Body: `{"eventName": "INSERT", "dynamodb": {"Keys": {"pk": {"S": "USER#123"}, "sk": {"S": "PROFILE#work"}}, "NewImage": {"pk": {"S": "USER#123"}, "sk": {"S": "PROFILE#work"}, "organizations": {"L": [{"S": "org1"}]}}}}`},
+				{MessageId: "home", Body: `{"eventName": "INSERT", "dynamodb": {"Keys": {"pk": {"S": "USER#123"}, "sk": {"S": "PROFILE#home"}}, "NewImage": {"pk": {"S": "USER#123"}, "sk": {"S": "PROFILE#home"}, "organizations": {"L": [{"S": "org1"}]}}}}`},
+			}})
+			if err != nil {
+				t.Fatalf("handler() unexpected error = %v", err)
+			}
+			if !reflect.DeepEqual(sks, tt.wantSK) {
+				t.Errorf("wrote sort keys %v, want %v", sks, tt.wantSK)
+			}
+		})
+	}
+}
+
+// Test_handler_failureMode verifies fail-fast stops at the first failing record while best-effort
+// processes the whole batch and reports every failure
+func Test_handler_failureMode(t *testing.T) {
+	tests := []struct {
+		name         string
+		mode         string
+		wantErr      bool
+		wantWrites   int
+		wantFailures []events.SQSBatchItemFailure
+	}{
+		{
+			name:    "fail fast by default",
+			wantErr: true,
+		},
+		{
+			name:    "fail fast",
+			mode:    "fail_fast",
+			wantErr: true,
+		},
+		{
+			name:         "best effort",
+			mode:         "best_effort",
+			wantWrites:   1,
+			wantFailures: []events.SQSBatchItemFailure{{ItemIdentifier: "bad-1"}, {ItemIdentifier: "bad-2"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var writes int
+			client := &mockDynamoDBClient{
+				batchWriteItemFunc: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+					writes++
+					return &dynamodb.BatchWriteItemOutput{}, nil
+				},
+			}
+
+			var results []result
+			env := testEnv(map[string]string{"TABLE_NAME": "test-table", "FAILURE_MODE": tt.mode})
+			h := handler(slog.New(slog.NewJSONHandler(io.Discard, nil)), client, nil, nil, nil, mustLoadConfig(t, env), fixedClock, func(r result) {
+				results = append(results, r)
+			})
+
+			resp, err := h(context.Background(), events.SQSEvent{Records: []events.SQSMessage{
+				{MessageId: "bad-1", Body: `{not json`},
+				{MessageId: "good", Body: insertBody("USER#123", 1)},
+				{MessageId: "bad-2", Body: `{not json`},
+			}})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("handler() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(resp.BatchItemFailures, tt.wantFailures) {
+				t.Errorf("BatchItemFailures = %v, want %v", resp.BatchItemFailures, tt.wantFailures)
+			}
+			if writes != tt.wantWrites {
+				t.Errorf("expected %d batch writes, got %d", tt.wantWrites, writes)
+			}
+			if !tt.wantErr && (len(results) != 1 || results[0].Failed != 2 || results[0].Processed != 1) {
+				t.Errorf("expected 1 processed and 2 failed records, got %+v", results)
+			}
+		})
+	}
+}
+
+// Test_handler_fifoFailure verifies a failed FIFO record stops the batch, reporting it with every
+// record after it so none of them is applied ahead of the redelivered failure
+func Test_handler_fifoFailure(t *testing.T) {
+	var written []string
+	client := &mockDynamoDBClient{
+		batchWriteItemFunc: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+			for _, req := range params.RequestItems["test-table"] {
+				written = append(written, req.PutRequest.Item["sk"].(*types.AttributeValueMemberS).Value)
+			}
+			return &dynamodb.BatchWriteItemOutput{}, nil
+		},
+	}
+
+	var buf bytes.Buffer
+	env := testEnv(map[string]string{"TABLE_NAME": "test-table", "FAILURE_MODE": "best_effort"})
+	h := handler(slog.New(slog.NewJSONHandler(&buf, nil)), client, nil, nil, nil, mustLoadConfig(t, env), fixedClock, nil)
+	group := map[string]string{"MessageGroupId": "USER#1"}
+	resp, err := h(context.Background(), events.SQSEvent{Records: []events.SQSMessage{
+		{MessageId: "msg-1", Attributes: group, Body: insertBody("USER#1", 1)},
+		{MessageId: "msg-2", Attributes: group, Body: `{not json`},
+		{MessageId: "msg-3", Attributes: group, Body: insertBody("USER#3", 1)},
+	}})
+	if err != nil {
+		t.Fatalf("handler() unexpected error = %v", err)
+	}
+
+	if want := []events.SQSBatchItemFailure{{ItemIdentifier: "msg-2"}, {ItemIdentifier: "msg-3"}}; !reflect.DeepEqual(resp.BatchItemFailures, want) {
+		t.Errorf("BatchItemFailures = %v, want %v", resp.BatchItemFailures, want)
+	}
+	if want := []string{"MEMBERSHIP#1"}; !reflect.DeepEqual(written, want) {
+		t.Errorf("wrote %v, want %v", written, want)
+	}
+	if metrics := findLogs(parseLogs(t, &buf), "metrics"); len(metrics) != 1 || metrics[0]["UnprocessedRecords"] != 1.0 {
+		t.Errorf("expected UnprocessedRecords 1, got %v", metrics)
+	}
+}
+
+// Test_handler_maxFailureRatio verifies the whole batch fails once the fraction of failed records
+// exceeds MAX_FAILURE_RATIO
+func Test_handler_maxFailureRatio(t *testing.T) {
+	tests := []struct {
+		name    string
+		failing int
+		wantErr bool
+	}{
+		{name: "80% failing exceeds the ratio", failing: 4, wantErr: true},
+		{name: "20% failing is reported per record", failing: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &mockDynamoDBClient{
+				batchWriteItemFunc: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+					return &dynamodb.BatchWriteItemOutput{}, nil
+				},
+			}
+
+			var records []events.SQSMessage
+			for i := 0; i < 5; i++ {
+				body := insertBody(fmt.Sprintf("USER#%d", i), 1)
+				if i < tt.failing {
+					body = `{not json`
+				}
+				records = append(records, events.SQSMessage{MessageId: fmt.Sprintf("msg-%d", i), Body: body})
+			}
+
+			env := testEnv(map[string]string{"TABLE_NAME": "test-table", "FAILURE_MODE": "best_effort", "MAX_FAILURE_RATIO": "0.5"})
+			h := handler(slog.New(slog.NewJSONHandler(io.Discard, nil)), client, nil, nil, nil, mustLoadConfig(t, env), fixedClock, nil)
+			resp, err := h(context.Background(), events.SQSEvent{Records: records})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("handler() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr && len(resp.BatchItemFailures) != 0 {
+				t.Errorf("expected no partial response with a full-batch error, got %v", resp.BatchItemFailures)
+			}
+			if !tt.wantErr && len(resp.BatchItemFailures) != tt.failing {
+				t.Errorf("expected %d batch item failures, got %v", tt.failing, resp.BatchItemFailures)
+			}
+		})
+	}
+}
+
+// Test_handler_normalizeOrgIDs verifies a delete read from a mixed-casing image matches the key
+// of a put read from a normalized one, and that normalizing can reveal an unchanged MODIFY
+func Test_handler_normalizeOrgIDs(t *testing.T) {
+	var keys []string
+	client := &mockDynamoDBClient{
+		batchWriteItemFunc: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+			for _, req := range params.RequestItems["test-table"] {
+				if req.PutRequest != nil {
+					keys = append(keys, "put "+req.PutRequest.Item["pk"].(*types.AttributeValueMemberS).Value)
+				} else {
+					keys = append(keys, "delete "+req.DeleteRequest.Key["pk"].(*types.AttributeValueMemberS).Value)
+				}
+			}
+			return &dynamodb.BatchWriteItemOutput{}, nil
+		},
+	}
+
+	env := testEnv(map[string]string{"TABLE_NAME": "test-table", "NORMALIZE_ORG_IDS": "true", "LOWERCASE_ORG_IDS": "true"})
+	h := handler(slog.New(slog.NewJSONHandler(io.Discard, nil)), client, nil, nil, nil, mustLoadConfig(t, env), fixedClock, nil)
+	_, err := h(context.Background(), events.SQSEvent{Records: []events.SQSMessage{
+		{MessageId: "insert", Body: `{"eventName": "INSERT", "dynamodb": {"NewImage": {"pk": {"S": "USER#123"}, "organizations": {"L": [{"S": "org1"}, {"S": "Org1"}]}}}}`},
+		{MessageId: "modify", Body: `{"eventName": "MODIFY", "dynamodb": {"OldImage": {"pk": {"S": "USER#123"}, "organizations": {"L": [{"S": "org1"}]}}, "NewImage": {"pk": {"S": "USER#123"}, "organizations": {"L": [{"S": "ORG1 "}]}}}}`},
+		{MessageId: "remove", Body: `{"eventName": "REMOVE", "dynamodb": {"OldImage": {"pk": {"S": "USER#123"}, "organizations": {"L": [{"S": " Org1"}]}}}}`},
+	}})
+	if err != nil {
+		t.Fatalf("handler() unexpected error = %v", err)
+	}
+	if want := []string{"put ORGANIZATION#org1", "delete ORGANIZATION#org1"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("wrote %v, want %v", keys, want)
+	}
+}
+
+// Test_handler_onComplete verifies the batch result handed to onComplete for a mixed batch
+func Test_handler_onComplete(t *testing.T) {
+	client := &mockDynamoDBClient{
+		batchWriteItemFunc: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+			return &dynamodb.BatchWriteItemOutput{}, nil
+		},
+	}
+	dlq := &mockSQSClient{
+		sendMessageFunc: func(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error) {
+			return &sqs.SendMessageOutput{}, nil
+		},
+	}
+
+	var results []result
+	env := testEnv(map[string]string{"TABLE_NAME": "test-table", "DLQ_URL": "https://sqs.us-east-1.amazonaws.com/123456789012/dlq"})
+	h := handler(slog.New(slog.NewJSONHandler(io.Discard, nil)), client, dlq, nil, nil, mustLoadConfig(t, env), fixedClock, func(r result) {
+		results = append(results, r)
+	})
+
+	_, err := h(context.Background(), events.SQSEvent{Records: []events.SQSMessage{
+		{MessageId: "insert", Body: `{"eventID": "event-1", "eventName": "INSERT", "dynamodb": {"NewImage": {"pk": {"S": "USER#123"}, "organizations": {"L": [{"S": "org1"}, {"S": "org2"}]}}}}`},
+		{MessageId: "duplicate", Body: `{"eventID": "event-1", "eventName": "INSERT", "dynamodb": {"NewImage": {"pk": {"S": "USER#123"}, "organizations": {"L": [{"S": "org1"}, {"S": "org2"}]}}}}`},
+		{MessageId: "modify", Body: `{"eventID": "event-2", "eventName": "MODIFY", "dynamodb": {"OldImage": {"pk": {"S": "USER#123"}, "organizations": {"L": [{"S": "org1"}, {"S": "org2"}]}}, "NewImage": {"pk": {"S": "USER#123"}, "organizations": {"L": [{"S": "org2"}, {"S": "org3"}]}}}}`},
+		{MessageId: "malformed", Body: `{not json`},
+	}})
+	if err != nil {
+		t.Fatalf("handler() unexpected error = %v", err)
+	}
+
+	want := []result{{Processed: 3, Adds: 3, Removes: 1, Skipped: 1, Failed: 1}}
+	if !reflect.DeepEqual(results, want) {
+		t.Errorf("onComplete results = %+v, want %+v", results, want)
+	}
+}
+
+// Test_handler_requestID verifies log lines carry the Lambda request ID when the context has one
+func Test_handler_requestID(t *testing.T) {
+	tests := []struct {
+		name          string
+		ctx           context.Context
+		wantRequestID any
+	}{
+		{
+			name:          "lambda context",
+			ctx:           lambdacontext.NewContext(context.Background(), &lambdacontext.LambdaContext{AwsRequestID: "req-123"}),
+			wantRequestID: "req-123",
+		},
+		{
+			name:          "no lambda context",
+			ctx:           context.Background(),
+			wantRequestID: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			client := &mockDynamoDBClient{
+				batchWriteItemFunc: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+					return &dynamodb.BatchWriteItemOutput{}, nil
+				},
+			}
+			h := handler(slog.New(slog.NewJSONHandler(&buf, nil)), client, nil, nil, nil, mustLoadConfig(t, testEnv(map[string]string{"TABLE_NAME": "test-table"})), fixedClock, nil)
+			if _, err := h(tt.ctx, events.SQSEvent{Records: []events.SQSMessage{{Body: insertBody("USER#123", 1)}}}); err != nil {
+				t.Fatalf("handler() unexpected error = %v", err)
+			}
+
+			logs := parseLogs(t, &buf)
+			if len(logs) == 0 {
+				t.Fatal("expected log output")
+			}
+			for _, entry := range logs {
+				if entry["requestId"] != tt.wantRequestID {
+					t.Errorf("log %q: requestId = %v, want %v", entry["msg"], entry["requestId"], tt.wantRequestID)
+				}
+			}
+		})
+	}
+}
+
+// Test_handler_coldStart verifies only the first invocation in an execution environment is
+// logged as a cold start
+func Test_handler_coldStart(t *testing.T) {
+	coldStart = true
+	var buf bytes.Buffer
+	client := &mockDynamoDBClient{
+		batchWriteItemFunc: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+			return &dynamodb.BatchWriteItemOutput{}, nil
+		},
+	}
+	h := handler(slog.New(slog.NewJSONHandler(&buf, nil)), client, nil, nil, nil, mustLoadConfig(t, testEnv(map[string]string{"TABLE_NAME": "test-table"})), fixedClock, nil)
+	for range 2 {
+		if _, err := h(context.Background(), events.SQSEvent{Records: []events.SQSMessage{{Body: insertBody("USER#123", 1)}}}); err != nil {
+			t.Fatalf("handler() unexpected error = %v", err)
+		}
+	}
+
+	starts := findLogs(parseLogs(t, &buf), "invocation started")
+	if len(starts) != 2 {
+		t.Fatalf("expected 2 invocation started logs, got %d", len(starts))
+	}
+	if starts[0]["coldStart"] != true || starts[1]["coldStart"] != false {
+		t.Errorf("expected coldStart true then false, got %v then %v", starts[0]["coldStart"], starts[1]["coldStart"])
+	}
+}
+
+// Test_newLogger verifies LOG_FORMAT selects text or JSON output, falling back to JSON
+func Test_newLogger(t *testing.T) {
+	tests := []struct {
+		name     string
+		format   string
+		wantJSON bool
+	}{
+		{name: "default", format: "", wantJSON: true},
+		{name: "json", format: "json", wantJSON: true},
+		{name: "text", format: "text", wantJSON: false},
+		{name: "invalid falls back to json", format: "yaml", wantJSON: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			newLogger(&buf, tt.format, "").Info("hello", slog.String("key", "value"))
+
+			if isJSON := json.Valid(buf.Bytes()); isJSON != tt.wantJSON {
+				t.Errorf("newLogger(%q) JSON output = %v, want %v: %s", tt.format, isJSON, tt.wantJSON, buf.String())
+			}
+			if !tt.wantJSON && !strings.Contains(buf.String(), "msg=hello key=value") {
+				t.Errorf("expected text output, got %s", buf.String())
+			}
+		})
+	}
+}
+
+// Test_configOptions verifies SDK_MAX_RETRIES configures the SDK retryer's max attempts
+func Test_configOptions(t *testing.T) {
+	tests := []struct {
+		name         string
+		env          map[string]string
+		wantAttempts int
+	}{
+		{name: "unset keeps the SDK default", env: map[string]string{}, wantAttempts: 0},
+		{name: "retries plus the initial attempt", env: map[string]string{"SDK_MAX_RETRIES": "5"}, wantAttempts: 6},
+		{name: "zero disables retries", env: map[string]string{"SDK_MAX_RETRIES": "0"}, wantAttempts: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var opts awsconfig.LoadOptions
+			for _, opt := range configOptions(mustLoadConfig(t, testEnv(tt.env))) {
+				if err := opt(&opts); err != nil {
+					t.Fatalf("config option returned error: %v", err)
+				}
+			}
+			if opts.RetryMaxAttempts != tt.wantAttempts {
+				t.Errorf("RetryMaxAttempts = %d, want %d", opts.RetryMaxAttempts, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+// Test_dynamoDBConfig verifies ASSUME_ROLE_ARN swaps DynamoDB credentials for an assumed role
+// provider, without calling STS, and leaves the config untouched when unset
+func Test_dynamoDBConfig(t *testing.T) {
+	base := aws.Config{Region: "us-east-1", Credentials: aws.AnonymousCredentials{}}
+
+	if cfg := dynamoDBConfig(base, mustLoadConfig(t, testEnv(nil))); cfg.Credentials != base.Credentials {
+		t.Errorf("expected the base credentials without ASSUME_ROLE_ARN, got %T", cfg.Credentials)
+	}
+
+	cfg := dynamoDBConfig(base, mustLoadConfig(t, testEnv(map[string]string{"ASSUME_ROLE_ARN": "arn:aws:iam::123456789012:role/poc-organizations-writer"})))
+	cache, ok := cfg.Credentials.(*aws.CredentialsCache)
+	if !ok {
+		t.Fatalf("expected cached credentials, got %T", cfg.Credentials)
+	}
+	if !cache.IsCredentialsProvider(&stscreds.AssumeRoleProvider{}) {
+		t.Error("expected credentials from an assume role provider")
+	}
+	if cfg.Region != base.Region {
+		t.Errorf("expected region %s, got %s", base.Region, cfg.Region)
+	}
+	if _, ok := base.Credentials.(aws.AnonymousCredentials); !ok {
+		t.Error("expected the base config to keep its own credentials")
+	}
+}
+
+// Test_newLogger_level verifies LOG_LEVEL sets the minimum level logged, falling back to info
+func Test_newLogger_level(t *testing.T) {
+	tests := []struct {
+		level     string
+		wantDebug bool
+		wantInfo  bool
+	}{
+		{level: "", wantDebug: false, wantInfo: true},
+		{level: "debug", wantDebug: true, wantInfo: true},
+		{level: "WARN", wantDebug: false, wantInfo: false},
+		{level: "verbose", wantDebug: false, wantInfo: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.level, func(t *testing.T) {
+			var buf bytes.Buffer
+			logger := newLogger(&buf, "json", tt.level)
+			logger.Debug("debug")
+			logger.Info("info")
+
+			logs := parseLogs(t, &buf)
+			if got := len(findLogs(logs, "debug")) == 1; got != tt.wantDebug {
+				t.Errorf("debug logged = %v, want %v", got, tt.wantDebug)
+			}
+			if got := len(findLogs(logs, "info")) == 1; got != tt.wantInfo {
+				t.Errorf("info logged = %v, want %v", got, tt.wantInfo)
+			}
+		})
+	}
+}
+
+// Test_extractUserID verifies the user ID extraction from composite keys
+func Test_extractUserID(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{
+			name:     "valid composite key",
+			input:    "USER#123",
+			expected: "123",
+		},
+		{
+			name:     "no separator",
+			input:    "USER123",
+			expected: "USER123",
+		},
+		{
+			name:     "empty string",
+			input:    "",
+			expected: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := extractUserID(tt.input)
+			if result != tt.expected {
+				t.Errorf("extractUserID() = %v, want %v", result, tt.expected)
+			}
+		})
+	}
+}
+
+// Test_extractPK verifies string and binary partition keys yield the user ID
+func Test_extractPK(t *testing.T) {
+	tests := []struct {
+		name       string
+		image      map[string]events.DynamoDBAttributeValue
+		wantPK     string
+		wantUserID string
+	}{
+		{
+			name:       "string key",
+			image:      map[string]events.DynamoDBAttributeValue{"pk": events.NewStringAttribute("USER#123")},
+			wantPK:     "USER#123",
+			wantUserID: "123",
+		},
+		{
+			name:       "binary key",
+			image:      map[string]events.DynamoDBAttributeValue{"pk": events.NewBinaryAttribute([]byte("USER#123"))},
+			wantPK:     "USER#123",
+			wantUserID: "123",
+		},
+		{
+			name:  "number key",
+			image: map[string]events.DynamoDBAttributeValue{"pk": events.NewNumberAttribute("123")},
+		},
+		{
+			name:  "missing key",
+			image: map[string]events.DynamoDBAttributeValue{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pk := extractPK(tt.image)
+			if pk != tt.wantPK {
+				t.Errorf("extractPK() = %v, want %v", pk, tt.wantPK)
+			}
+			if userID := extractUserID(pk); userID != tt.wantUserID {
+				t.Errorf("extractUserID() = %v, want %v", userID, tt.wantUserID)
+			}
+		})
+	}
+}
+
+// Test_processor_userPK verifies the user ID is read from USER_ID_ATTRIBUTE as a string or
+// number when set, and parsed from the pk otherwise
+func Test_processor_userPK(t *testing.T) {
+	tests := []struct {
+		name      string
+		attribute string
+		image     map[string]events.DynamoDBAttributeValue
+		want      string
+	}{
+		{
+			name:      "number attribute",
+			attribute: "user_id",
+			image:     map[string]events.DynamoDBAttributeValue{"pk": events.NewStringAttribute("PROFILE#abc"), "user_id": events.NewNumberAttribute("42")},
+			want:      "USER#42",
+		},
+		{
+			name:      "string attribute",
+			attribute: "user_id",
+			image:     map[string]events.DynamoDBAttributeValue{"pk": events.NewStringAttribute("PROFILE#abc"), "user_id": events.NewStringAttribute("auth0|42")},
+			want:      "USER#auth0|42",
+		},
+		{
+			name:      "missing attribute falls back to the pk",
+			attribute: "user_id",
+			image:     map[string]events.DynamoDBAttributeValue{"pk": events.NewStringAttribute("USER#123")},
+			want:      "USER#123",
+		},
+		{
+			name:      "unsupported attribute type falls back to the pk",
+			attribute: "user_id",
+			image:     map[string]events.DynamoDBAttributeValue{"pk": events.NewStringAttribute("USER#123"), "user_id": events.NewBooleanAttribute(true)},
+			want:      "USER#123",
+		},
+		{
+			name:  "unset attribute parses the pk",
+			image: map[string]events.DynamoDBAttributeValue{"pk": events.NewStringAttribute("USER#123"), "user_id": events.NewNumberAttribute("42")},
+			want:  "USER#123",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &processor{userIDAttribute: tt.attribute}
+			if got := p.userPK(tt.image, "USER#fallback"); got != tt.want {
+				t.Errorf("userPK() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// Test_extractOrganizations verifies organization IDs are read from List and Map attributes
+func Test_extractOrganizations(t *testing.T) {
+	tests := []struct {
+		name        string
+		image       map[string]events.DynamoDBAttributeValue
+		wantOrgs    []string
+		wantPresent bool
+		wantMeta    map[string]organizationMetadata
+	}{
+		{
+			name: "list attribute",
+			image: map[string]events.DynamoDBAttributeValue{
+				"organizations": events.NewListAttribute([]events.DynamoDBAttributeValue{
+					events.NewStringAttribute("org1"),
+					events.NewStringAttribute("org2"),
+				}),
+			},
+			wantOrgs:    []string{"org1", "org2"},
+			wantPresent: true,
+		},
+		{
+			name: "list attribute mixing strings and numbers",
+			image: map[string]events.DynamoDBAttributeValue{
+				"organizations": events.NewListAttribute([]events.DynamoDBAttributeValue{
+					events.NewStringAttribute("org1"),
+					events.NewNumberAttribute("42"),
+					events.NewNumberAttribute("007"),
+				}),
+			},
+			wantOrgs:    []string{"org1", "42", "7"},
+			wantPresent: true,
+		},
+		{
+			name: "empty list attribute",
+			image: map[string]events.DynamoDBAttributeValue{
+				"organizations": events.NewListAttribute([]events.DynamoDBAttributeValue{}),
+			},
+			wantOrgs:    nil,
+			wantPresent: true,
+		},
+		{
+			name: "null attribute",
+			image: map[string]events.DynamoDBAttributeValue{
+				"organizations": events.NewNullAttribute(),
+			},
+			wantOrgs:    nil,
+			wantPresent: false,
+		},
+		{
+			name: "map attribute with and without roles",
+			image: map[string]events.DynamoDBAttributeValue{
+				"organizations": events.NewMapAttribute(map[string]events.DynamoDBAttributeValue{
+					"org3": events.NewMapAttribute(map[string]events.DynamoDBAttributeValue{}),
+					"org1": events.NewMapAttribute(map[string]events.DynamoDBAttributeValue{
+						"role": events.NewStringAttribute("admin"),
+					}),
+					"org2": events.NewBooleanAttribute(true),
+				}),
+			},
+			wantOrgs:    []string{"org1", "org2", "org3"},
+			wantPresent: true,
+			wantMeta:    map[string]organizationMetadata{"org1": {Role: "admin"}},
+		},
+		{
+			name: "map attribute with and without metadata fields",
+			image: map[string]events.DynamoDBAttributeValue{
+				"organizations": events.NewMapAttribute(map[string]events.DynamoDBAttributeValue{
+					"org1": events.NewMapAttribute(map[string]events.DynamoDBAttributeValue{
+						"role":     events.NewStringAttribute("admin"),
+						"joinedAt": events.NewNumberAttribute("1700000000"),
+					}),
+					"org2": events.NewMapAttribute(map[string]events.DynamoDBAttributeValue{
+						"joinedAt": events.NewNumberAttribute("1600000000"),
+					}),
+					"org3": events.NewMapAttribute(map[string]events.DynamoDBAttributeValue{
+						"role":     events.NewNumberAttribute("1"),
+						"joinedAt": events.NewStringAttribute("yesterday"),
+					}),
+				}),
+			},
+			wantOrgs:    []string{"org1", "org2", "org3"},
+			wantPresent: true,
+			wantMeta: map[string]organizationMetadata{
+				"org1": {Role: "admin", JoinedAt: time.Unix(1700000000, 0).UTC()},
+				"org2": {JoinedAt: time.Unix(1600000000, 0).UTC()},
+			},
+		},
+		{
+			name:        "missing attribute",
+			image:       map[string]events.DynamoDBAttributeValue{},
+			wantOrgs:    nil,
+			wantPresent: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			orgs, present := extractOrganizations(tt.image, defaultOrgAttribute)
+			if !reflect.DeepEqual(orgs, tt.wantOrgs) || present != tt.wantPresent {
+				t.Errorf("extractOrganizations() = %v, %v, want %v, %v", orgs, present, tt.wantOrgs, tt.wantPresent)
+			}
+			meta := extractOrganizationMetadata(tt.image, defaultOrgAttribute)
+			if len(meta) != len(tt.wantMeta) || (len(meta) > 0 && !reflect.DeepEqual(meta, tt.wantMeta)) {
+				t.Errorf("extractOrganizationMetadata() = %v, want %v", meta, tt.wantMeta)
+			}
+		})
+	}
+}
+
+// Test_diffOrganizations verifies additions and removals keep new and old image order
+func Test_diffOrganizations(t *testing.T) {
+	toAdd, toRemove := diffOrganizations([]string{"org3", "org1", "org2"}, []string{"org5", "org2", "org4"})
+	if want := []string{"org5", "org4"}; !reflect.DeepEqual(toAdd, want) {
+		t.Errorf("toAdd = %v, want %v", toAdd, want)
+	}
+	if want := []string{"org3", "org1"}; !reflect.DeepEqual(toRemove, want) {
+		t.Errorf("toRemove = %v, want %v", toRemove, want)
+	}
+}
+
+// BenchmarkModifyDiff measures the MODIFY diff for a user replacing half of 500 organizations
+func BenchmarkModifyDiff(b *testing.B) {
+	oldOrgs := make([]string, 500)
+	newOrgs := make([]string, 500)
+	for i := range oldOrgs {
+		oldOrgs[i] = fmt.Sprintf("org%d", i)
+		newOrgs[i] = fmt.Sprintf("org%d", i+250)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		diffOrganizations(oldOrgs, newOrgs)
+	}
+}
+
+// Test_sameOrganizations verifies organization lists are compared as sets
+func Test_sameOrganizations(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b []string
+		want bool
+	}{
+		{name: "both empty", want: true},
+		{name: "same order", a: []string{"org1", "org2"}, b: []string{"org1", "org2"}, want: true},
+		{name: "different order", a: []string{"org1", "org2"}, b: []string{"org2", "org1"}, want: true},
+		{name: "duplicates ignored", a: []string{"org1", "org1"}, b: []string{"org1"}, want: true},
+		{name: "added organization", a: []string{"org1"}, b: []string{"org1", "org2"}, want: false},
+		{name: "removed organization", a: []string{"org1", "org2"}, b: []string{"org1"}, want: false},
+		{name: "replaced organization", a: []string{"org1"}, b: []string{"org2"}, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sameOrganizations(tt.a, tt.b); got != tt.want {
+				t.Errorf("sameOrganizations(%v, %v) = %v, want %v", tt.a, tt.b, got, tt.want)
+			}
+		})
+	}
+}
+
+// Test_hasMembershipChange verifies MODIFY images are only treated as a membership change when
+// the user's set of organizations differs
+func Test_hasMembershipChange(t *testing.T) {
+	list := func(ids ...string) events.DynamoDBAttributeValue {
+		orgs := make([]events.DynamoDBAttributeValue, len(ids))
+		for i, id := range ids {
+			orgs[i] = events.NewStringAttribute(id)
+		}
+		return events.NewListAttribute(orgs)
+	}
+	image := func(orgs *events.DynamoDBAttributeValue) map[string]events.DynamoDBAttributeValue {
+		img := map[string]events.DynamoDBAttributeValue{"pk": events.NewStringAttribute("USER#123")}
+		if orgs != nil {
+			img["organizations"] = *orgs
+		}
+		return img
+	}
+	ptr := func(v events.DynamoDBAttributeValue) *events.DynamoDBAttributeValue { return &v }
+	roles := func(role string) events.DynamoDBAttributeValue {
+		return events.NewMapAttribute(map[string]events.DynamoDBAttributeValue{
+			"org1": events.NewMapAttribute(map[string]events.DynamoDBAttributeValue{"role": events.NewStringAttribute(role)}),
+		})
+	}
+
+	tests := []struct {
+		name     string
+		old, new map[string]events.DynamoDBAttributeValue
+		env      map[string]string
+		want     bool
+	}{
+		{name: "unchanged organizations", old: image(ptr(list("org1", "org2"))), new: image(ptr(list("org1", "org2"))), want: false},
+		{name: "reordered organizations", old: image(ptr(list("org1", "org2"))), new: image(ptr(list("org2", "org1"))), want: false},
+		{name: "role change only", old: image(ptr(roles("member"))), new: image(ptr(roles("admin"))), want: false},
+		{name: "missing from new image", old: image(ptr(list("org1"))), new: image(nil), want: false},
+		{name: "NULL in new image", old: image(ptr(list("org1"))), new: image(ptr(events.NewNullAttribute())), want: false},
+		{name: "empty in both images", old: image(nil), new: image(ptr(list())), want: false},
+		{name: "case change normalized away", old: image(ptr(list("org1"))), new: image(ptr(list("ORG1"))), env: map[string]string{"LOWERCASE_ORG_IDS": "true"}, want: false},
+		{name: "added organization", old: image(ptr(list("org1"))), new: image(ptr(list("org1", "org2"))), want: true},
+		{name: "removed organization", old: image(ptr(list("org1", "org2"))), new: image(ptr(list("org1"))), want: true},
+		{name: "cleared organizations", old: image(ptr(list("org1"))), new: image(ptr(list())), want: true},
+		{name: "no old image", old: nil, new: image(ptr(list("org1"))), want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := map[string]string{"TABLE_NAME": "test-table"}
+			for k, v := range tt.env {
+				env[k] = v
+			}
+			p := newProcessor(slog.New(slog.NewJSONHandler(io.Discard, nil)), nil, nil, nil, nil, mustLoadConfig(t, testEnv(env)), fixedClock)
+			if got := p.hasMembershipChange(tt.old, tt.new); got != tt.want {
+				t.Errorf("hasMembershipChange() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// Test_createReverseWriteRequests verifies reverse index requests are keyed by user, in
+// organization ID order
+func Test_createReverseWriteRequests(t *testing.T) {
+	puts := createReverseWriteRequests("USER#123", []string{"org2", "org1"}, membershipAttributes{}, false)
+	if len(puts) != 2 {
+		t.Fatalf("expected 2 put requests, got %d", len(puts))
+	}
+	for i, req := range puts {
+		if req.PutRequest == nil {
+			t.Fatalf("request %d: expected PutRequest", i)
+		}
+		pk := req.PutRequest.Item["pk"].(*types.AttributeValueMemberS).Value
+		sk := req.PutRequest.Item["sk"].(*types.AttributeValueMemberS).Value
+		expectedSK := fmt.Sprintf("ORGANIZATION#%s", []string{"org1", "org2"}[i])
+		if pk != "USER#123" || sk != expectedSK {
+			t.Errorf("request %d: got pk=%s, sk=%s, want pk=USER#123, sk=%s", i, pk, sk, expectedSK)
+		}
+	}
+
+	deletes := createReverseWriteRequests("USER#123", []string{"org1"}, membershipAttributes{}, true)
+	if len(deletes) != 1 || deletes[0].DeleteRequest == nil {
+		t.Fatalf("expected 1 delete request, got %v", deletes)
+	}
+	if sk := deletes[0].DeleteRequest.Key["sk"].(*types.AttributeValueMemberS).Value; sk != "ORGANIZATION#org1" {
+		t.Errorf("got sk=%s, want ORGANIZATION#org1", sk)
+	}
+}
+
+// Test_compareSequenceNumbers verifies sequence numbers compare numerically regardless of length
+func Test_compareSequenceNumbers(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"100", "200", -1},
+		{"200", "100", 1},
+		{"99", "100", -1},
+		{"111100000000000000000000001", "111100000000000000000000002", -1},
+		{"0100", "100", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.a+"_"+tt.b, func(t *testing.T) {
+			if got := compareSequenceNumbers(tt.a, tt.b); got != tt.want {
+				t.Errorf("compareSequenceNumbers(%s, %s) = %d, want %d", tt.a, tt.b, got, tt.want)
+			}
+		})
+	}
+}
+
+// Test_ingestLatency verifies the latency calculation from the SQS SentTimestamp attribute
+func Test_ingestLatency(t *testing.T) {
+	tests := []struct {
+		name    string
+		sent    string
+		want    time.Duration
+		wantErr bool
+	}{
+		{
+			name: "valid timestamp",
+			sent: "1699999990000",
+			want: 10 * time.Second,
+		},
+		{
+			name:    "invalid timestamp",
+			sent:    "yesterday",
+			wantErr: true,
+		},
+		{
+			name:    "empty timestamp",
+			sent:    "",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ingestLatency(tt.sent, fixedClock())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ingestLatency() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ingestLatency() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// Test_changeTime verifies the stream creation time is preferred over the clock
+func Test_changeTime(t *testing.T) {
+	approximate := time.Unix(1600000000, 0)
+
+	var der events.DynamoDBEventRecord
+	if got := changeTime(der, fixedClock); !got.Equal(fixedClock()) {
+		t.Errorf("changeTime() without approximate time = %v, want %v", got, fixedClock())
+	}
+
+	der.Change.ApproximateCreationDateTime = events.SecondsEpochTime{Time: approximate}
+	if got := changeTime(der, fixedClock); !got.Equal(approximate) {
+		t.Errorf("changeTime() with approximate time = %v, want %v", got, approximate)
+	}
+}
+
+// Test_createWriteRequests verifies the creation of DynamoDB write requests
+func Test_createWriteRequests(t *testing.T) {
+	tests := []struct {
+		name      string
+		userPK    string
+		orgs      []string
+		orgPrefix string
+		namespace string
+		userSK    string
+		metadata  map[string]organizationMetadata
+		createdAt time.Time
+		gsiKeys   bool
+		version   bool
+		joinOrder bool
+		source    string
+		isDelete  bool
+
+		wantLen      int
+		verifyResult func(t *testing.T, requests []types.WriteRequest)
+	}{
+		{
+			name:     "create put requests",
+			userPK:   "USER#123",
+			orgs:     []string{"org1", "org2"},
+			isDelete: false,
+			wantLen:  2,
+			verifyResult: func(t *testing.T, requests []types.WriteRequest) {
+				for i, req := range requests {
+					if req.PutRequest == nil {
+						t.Errorf("request %d: expected PutRequest, got DeleteRequest", i)
+					}
+					item := req.PutRequest.Item
+					pk := item["pk"].(*types.AttributeValueMemberS).Value
+					sk := item["sk"].(*types.AttributeValueMemberS).Value
+					expectedPK := fmt.Sprintf("ORGANIZATION#%s", []string{"org1", "org2"}[i])
+					expectedSK := "MEMBERSHIP#123"
+					if pk != expectedPK || sk != expectedSK {
+						t.Errorf("request %d: got pk=%s, sk=%s, want pk=%s, sk=%s",
+							i, pk, sk, expectedPK, expectedSK)
+					}
+				}
+			},
+		},
+		{
+			name:     "requests are sorted by organization ID",
+			userPK:   "USER#123",
+			orgs:     []string{"org3", "org1", "org2"},
+			isDelete: true,
+			wantLen:  3,
+			verifyResult: func(t *testing.T, requests []types.WriteRequest) {
+				var pks []string
+				for _, req := range requests {
+					pks = append(pks, req.DeleteRequest.Key["pk"].(*types.AttributeValueMemberS).Value)
+				}
+				if want := []string{"ORGANIZATION#org1", "ORGANIZATION#org2", "ORGANIZATION#org3"}; !reflect.DeepEqual(pks, want) {
+					t.Errorf("got pks %v, want %v", pks, want)
+				}
+			},
+		},
+		{
+			name:     "create delete requests",
+			userPK:   "USER#456",
+			orgs:     []string{"org3", "org4"},
+			isDelete: true,
+			wantLen:  2,
+			verifyResult: func(t *testing.T, requests []types.WriteRequest) {
+				for i, req := range requests {
+					if req.DeleteRequest == nil {
+						t.Errorf("request %d: expected DeleteRequest, got PutRequest", i)
+					}
+					key := req.DeleteRequest.Key
+					pk := key["pk"].(*types.AttributeValueMemberS).Value
+					sk := key["sk"].(*types.AttributeValueMemberS).Value
+					expectedPK := fmt.Sprintf("ORGANIZATION#%s", []string{"org3", "org4"}[i])
+					expectedSK := "MEMBERSHIP#456"
+					if pk != expectedPK || sk != expectedSK {
+						t.Errorf("request %d: got pk=%s, sk=%s, want pk=%s, sk=%s",
+							i, pk, sk, expectedPK, expectedSK)
+					}
+				}
+			},
+		},
+		{
+			name:      "namespaced put requests",
+			userPK:    "USER#123",
+			orgs:      []string{"org1"},
+			namespace: "billing",
+			isDelete:  false,
+			wantLen:   1,
+			verifyResult: func(t *testing.T, requests []types.WriteRequest) {
+				if sk := requests[0].PutRequest.Item["sk"].(*types.AttributeValueMemberS).Value; sk != "MEMBERSHIP#billing#123" {
+					t.Errorf("expected sk MEMBERSHIP#billing#123, got %s", sk)
+				}
+			},
+		},
+		{
+			name:      "namespaced delete requests",
+			userPK:    "USER#123",
+			orgs:      []string{"org1"},
+			namespace: "billing",
+			isDelete:  true,
+			wantLen:   1,
+			verifyResult: func(t *testing.T, requests []types.WriteRequest) {
+				if sk := requests[0].DeleteRequest.Key["sk"].(*types.AttributeValueMemberS).Value; sk != "MEMBERSHIP#billing#123" {
+					t.Errorf("expected sk MEMBERSHIP#billing#123, got %s", sk)
+				}
+			},
+		},
+		{
+			name:     "put requests carry gsi keys when enabled",
+			userPK:   "USER#123",
+			orgs:     []string{"org1"},
+			gsiKeys:  true,
+			isDelete: false,
+			wantLen:  1,
+			verifyResult: func(t *testing.T, requests []types.WriteRequest) {
+				item := requests[0].PutRequest.Item
+				gsi1pk, _ := item["gsi1pk"].(*types.AttributeValueMemberS)
+				gsi1sk, _ := item["gsi1sk"].(*types.AttributeValueMemberS)
+				if gsi1pk == nil || gsi1pk.Value != "USER#123" || gsi1sk == nil || gsi1sk.Value != "ORG#org1" {
+					t.Errorf("expected gsi1pk USER#123 and gsi1sk ORG#org1, got %v and %v", item["gsi1pk"], item["gsi1sk"])
+				}
+			},
+		},
+		{
+			name:     "put requests omit gsi keys by default",
+			userPK:   "USER#123",
+			orgs:     []string{"org1"},
+			isDelete: false,
+			wantLen:  1,
+			verifyResult: func(t *testing.T, requests []types.WriteRequest) {
+				item := requests[0].PutRequest.Item
+				if _, ok := item["gsi1pk"]; ok {
+					t.Errorf("expected no gsi1pk attribute, got %v", item["gsi1pk"])
+				}
+				if _, ok := item["gsi1sk"]; ok {
+					t.Errorf("expected no gsi1sk attribute, got %v", item["gsi1sk"])
+				}
+			},
+		},
+		{
+			name:     "put requests carry version 1 when enabled",
+			userPK:   "USER#123",
+			orgs:     []string{"org1", "org2"},
+			version:  true,
+			isDelete: false,
+			wantLen:  2,
+			verifyResult: func(t *testing.T, requests []types.WriteRequest) {
+				for i, req := range requests {
+					version, ok := req.PutRequest.Item["version"].(*types.AttributeValueMemberN)
+					if !ok || version.Value != "1" {
+						t.Errorf("request %d: expected version 1, got %v", i, req.PutRequest.Item["version"])
+					}
+				}
+			},
+		},
+		{
+			name:     "put requests omit version by default",
+			userPK:   "USER#123",
+			orgs:     []string{"org1"},
+			isDelete: false,
+			wantLen:  1,
+			verifyResult: func(t *testing.T, requests []types.WriteRequest) {
+				if _, ok := requests[0].PutRequest.Item["version"]; ok {
+					t.Errorf("expected no version attribute, got %v", requests[0].PutRequest.Item["version"])
+				}
+			},
+		},
+		{
+			name:      "put requests prefix the sort key with the join time when enabled",
+			userPK:    "USER#123",
+			orgs:      []string{"org1"},
+			createdAt: fixedClock(),
+			joinOrder: true,
+			isDelete:  false,
+			wantLen:   1,
+			verifyResult: func(t *testing.T, requests []types.WriteRequest) {
+				sk := requests[0].PutRequest.Item["sk"].(*types.AttributeValueMemberS).Value
+				if sk != "MEMBERSHIP#1700000000000#123" {
+					t.Errorf("expected sk MEMBERSHIP#1700000000000#123, got %s", sk)
+				}
+			},
+		},
+		{
+			name:      "namespaced join order sort key",
+			userPK:    "USER#123",
+			orgs:      []string{"org1"},
+			namespace: "billing",
+			createdAt: time.UnixMilli(42),
+			joinOrder: true,
+			isDelete:  false,
+			wantLen:   1,
+			verifyResult: func(t *testing.T, requests []types.WriteRequest) {
+				sk := requests[0].PutRequest.Item["sk"].(*types.AttributeValueMemberS).Value
+				if sk != "MEMBERSHIP#billing#0000000000042#123" {
+					t.Errorf("expected sk MEMBERSHIP#billing#0000000000042#123, got %s", sk)
+				}
+			},
+		},
+		{
+			name:     "put requests carry the source tag",
+			userPK:   "USER#123",
+			orgs:     []string{"org1"},
+			source:   "us-west-2",
+			isDelete: false,
+			wantLen:  1,
+			verifyResult: func(t *testing.T, requests []types.WriteRequest) {
+				source, ok := requests[0].PutRequest.Item["source"].(*types.AttributeValueMemberS)
+				if !ok || source.Value != "us-west-2" {
+					t.Errorf("expected source us-west-2, got %v", requests[0].PutRequest.Item["source"])
+				}
+			},
+		},
+		{
+			name:     "put requests append the user sort key when set",
+			userPK:   "USER#123",
+			orgs:     []string{"org1"},
+			userSK:   "PROFILE#work",
+			isDelete: false,
+			wantLen:  1,
+			verifyResult: func(t *testing.T, requests []types.WriteRequest) {
+				sk := requests[0].PutRequest.Item["sk"].(*types.AttributeValueMemberS).Value
+				if sk != "MEMBERSHIP#123#PROFILE#work" {
+					t.Errorf("expected sk MEMBERSHIP#123#PROFILE#work, got %s", sk)
+				}
+			},
+		},
+		{
+			name:      "delete keys append the user sort key when set",
+			userPK:    "USER#123",
+			orgs:      []string{"org1"},
+			namespace: "billing",
+			userSK:    "PROFILE#work",
+			isDelete:  true,
+			wantLen:   1,
+			verifyResult: func(t *testing.T, requests []types.WriteRequest) {
+				sk := requests[0].DeleteRequest.Key["sk"].(*types.AttributeValueMemberS).Value
+				if sk != "MEMBERSHIP#billing#123#PROFILE#work" {
+					t.Errorf("expected sk MEMBERSHIP#billing#123#PROFILE#work, got %s", sk)
+				}
+			},
+		},
+		{
+			name:     "delete keys omit gsi keys",
+			userPK:   "USER#123",
+			orgs:     []string{"org1"},
+			gsiKeys:  true,
+			isDelete: true,
+			wantLen:  1,
+			verifyResult: func(t *testing.T, requests []types.WriteRequest) {
+				if n := len(requests[0].DeleteRequest.Key); n != 2 {
+					t.Errorf("expected delete key with pk and sk only, got %v", requests[0].DeleteRequest.Key)
+				}
+			},
+		},
+		{
+			name:      "put requests use a custom org pk prefix",
+			userPK:    "USER#123",
+			orgs:      []string{"org1"},
+			orgPrefix: "ORG#",
+			isDelete:  false,
+			wantLen:   1,
+			verifyResult: func(t *testing.T, requests []types.WriteRequest) {
+				if pk := requests[0].PutRequest.Item["pk"].(*types.AttributeValueMemberS).Value; pk != "ORG#org1" {
+					t.Errorf("expected pk ORG#org1, got %s", pk)
+				}
+			},
+		},
+		{
+			name:      "delete requests use a custom org pk prefix",
+			userPK:    "USER#123",
+			orgs:      []string{"org1"},
+			orgPrefix: "ORG#",
+			isDelete:  true,
+			wantLen:   1,
+			verifyResult: func(t *testing.T, requests []types.WriteRequest) {
+				if pk := requests[0].DeleteRequest.Key["pk"].(*types.AttributeValueMemberS).Value; pk != "ORG#org1" {
+					t.Errorf("expected pk ORG#org1, got %s", pk)
+				}
+			},
+		},
+		{
+			name:     "put requests carry roles",
+			userPK:   "USER#123",
+			orgs:     []string{"org1", "org2"},
+			metadata: map[string]organizationMetadata{"org1": {Role: "admin"}},
+			isDelete: false,
+			wantLen:  2,
+			verifyResult: func(t *testing.T, requests []types.WriteRequest) {
+				role, ok := requests[0].PutRequest.Item["role"].(*types.AttributeValueMemberS)
+				if !ok || role.Value != "admin" {
+					t.Errorf("request 0: expected role admin, got %v", requests[0].PutRequest.Item["role"])
+				}
+				if _, ok := requests[1].PutRequest.Item["role"]; ok {
+					t.Errorf("request 1: expected no role attribute, got %v", requests[1].PutRequest.Item["role"])
+				}
+			},
+		},
+		{
+			name:     "put requests carry joined at",
+			userPK:   "USER#123",
+			orgs:     []string{"org1", "org2"},
+			metadata: map[string]organizationMetadata{"org1": {JoinedAt: time.Unix(1600000000, 0)}},
+			isDelete: false,
+			wantLen:  2,
+			verifyResult: func(t *testing.T, requests []types.WriteRequest) {
+				joined, ok := requests[0].PutRequest.Item["joinedAt"].(*types.AttributeValueMemberS)
+				if !ok || joined.Value != "2020-09-13T12:26:40Z" {
+					t.Errorf("request 0: expected joinedAt 2020-09-13T12:26:40Z, got %v", requests[0].PutRequest.Item["joinedAt"])
+				}
+				if _, ok := requests[1].PutRequest.Item["joinedAt"]; ok {
+					t.Errorf("request 1: expected no joinedAt attribute, got %v", requests[1].PutRequest.Item["joinedAt"])
+				}
+			},
+		},
+		{
+			name:      "put requests carry created at",
+			userPK:    "USER#123",
+			orgs:      []string{"org1"},
+			createdAt: fixedClock(),
+			isDelete:  false,
+			wantLen:   1,
+			verifyResult: func(t *testing.T, requests []types.WriteRequest) {
+				created, ok := requests[0].PutRequest.Item["createdAt"].(*types.AttributeValueMemberS)
+				if !ok || created.Value != "2023-11-14T22:13:20Z" {
+					t.Errorf("expected createdAt 2023-11-14T22:13:20Z, got %v", requests[0].PutRequest.Item["createdAt"])
 				}
 			},
 		},
@@ -318,7 +2889,7 @@ func Test_createWriteRequests(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			result := createWriteRequests(tt.userPK, tt.orgs, tt.isDelete)
+			result := createWriteRequests(tt.userPK, tt.orgs, membershipAttributes{OrgPKPrefix: tt.orgPrefix, Namespace: tt.namespace, UserSK: tt.userSK, Metadata: tt.metadata, CreatedAt: tt.createdAt, GSIKeys: tt.gsiKeys, Version: tt.version, TimePrefix: tt.joinOrder, Source: tt.source}, tt.isDelete)
 			if len(result) != tt.wantLen {
 				t.Errorf("createWriteRequests() returned %d requests, want %d", len(result), tt.wantLen)
 			}
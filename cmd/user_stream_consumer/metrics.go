@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+)
+
+// metricsNamespace is the CloudWatch namespace metrics are published under.
+const metricsNamespace = "poc-dynamostreams"
+
+// maxOrgDimensions caps the distinct organizations given their own OrganizationId dimension
+// per invocation. Each dimension value is a separate custom metric, so changes for any further
+// organizations are aggregated under otherOrgDimension.
+const maxOrgDimensions = 20
+
+// otherOrgDimension is the OrganizationId dimension value organizations over maxOrgDimensions
+// are aggregated under.
+const otherOrgDimension = "other"
+
+// Metric units understood by CloudWatch.
+const (
+	unitCount        = "Count"
+	unitMilliseconds = "Milliseconds"
+)
+
+// metrics accumulates the metrics recorded during a single invocation. Counters are summed
+// into a single value while observations keep every recorded value. The accumulated metrics
+// are published as one CloudWatch Embedded Metric Format (EMF) log line by emit. It is safe for
+// concurrent use, so records processed in parallel can share an invocation's metrics.
+type metrics struct {
+	mu     sync.Mutex
+	units  map[string]string
+	values map[string][]float64
+	orgs   map[string]float64 // Membership changes per OrganizationId dimension value
+}
+
+// newMetrics creates an empty metrics accumulator.
+func newMetrics() *metrics {
+	return &metrics{
+		units:  make(map[string]string),
+		values: make(map[string][]float64),
+		orgs:   make(map[string]float64),
+	}
+}
+
+// increment adds delta to the named counter.
+func (m *metrics) increment(name string, delta int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.units[name] = unitCount
+	if len(m.values[name]) == 0 {
+		m.values[name] = []float64{0}
+	}
+	m.values[name][0] += float64(delta)
+}
+
+// count returns the current value of the named counter, or zero if it was never incremented.
+func (m *metrics) count(name string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.values[name]) == 0 {
+		return 0
+	}
+	return int(m.values[name][0])
+}
+
+// incrementOrg adds delta to the membership changes counted for an organization, or for
+// otherOrgDimension once maxOrgDimensions other organizations have been counted.
+func (m *metrics) incrementOrg(org string, delta int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.orgs[org]; !ok && len(m.orgs) >= maxOrgDimensions {
+		org = otherOrgDimension
+	}
+	m.orgs[org] += float64(delta)
+}
+
+// observe records a single value for the named metric.
+func (m *metrics) observe(name, unit string, value float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.units[name] = unit
+	m.values[name] = append(m.values[name], value)
+}
+
+// emit writes the accumulated metrics as an EMF log line. The "_aws" metadata key must be at
+// the top level of the JSON document for CloudWatch to extract the metrics, which the JSON
+// handler produces when it is passed as a plain attribute. Nothing is written if no metrics
+// were recorded. Per organization counts are written as one further line per organization,
+// since an EMF document carries a single value for each dimension.
+func (m *metrics) emit(ctx context.Context, logger *slog.Logger, now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.emitOrgs(ctx, logger, now)
+	if len(m.values) == 0 {
+		return
+	}
+
+	names := make([]string, 0, len(m.values))
+	for name := range m.values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	definitions := make([]map[string]string, 0, len(names))
+	attrs := make([]any, 0, len(names)+1)
+	for _, name := range names {
+		definitions = append(definitions, map[string]string{"Name": name, "Unit": m.units[name]})
+		values := m.values[name]
+		if len(values) == 1 {
+			attrs = append(attrs, slog.Float64(name, values[0]))
+			continue
+		}
+		attrs = append(attrs, slog.Any(name, values))
+	}
+
+	attrs = append([]any{slog.Any("_aws", map[string]any{
+		"Timestamp": now.UnixMilli(),
+		"CloudWatchMetrics": []map[string]any{{
+			"Namespace":  metricsNamespace,
+			"Dimensions": [][]string{{}},
+			"Metrics":    definitions,
+		}},
+	})}, attrs...)
+
+	logger.InfoContext(ctx, "metrics", attrs...)
+}
+
+// emitOrgs writes a MembershipChanges EMF log line dimensioned by OrganizationId for each
+// organization counted by incrementOrg. m.mu must be held.
+func (m *metrics) emitOrgs(ctx context.Context, logger *slog.Logger, now time.Time) {
+	orgs := make([]string, 0, len(m.orgs))
+	for org := range m.orgs {
+		orgs = append(orgs, org)
+	}
+	sort.Strings(orgs)
+
+	for _, org := range orgs {
+		logger.InfoContext(ctx, "organization metrics",
+			slog.Any("_aws", map[string]any{
+				"Timestamp": now.UnixMilli(),
+				"CloudWatchMetrics": []map[string]any{{
+					"Namespace":  metricsNamespace,
+					"Dimensions": [][]string{{"OrganizationId"}},
+					"Metrics":    []map[string]string{{"Name": "MembershipChanges", "Unit": unitCount}},
+				}},
+			}),
+			slog.String("OrganizationId", org),
+			slog.Float64("MembershipChanges", m.orgs[org]))
+	}
+}
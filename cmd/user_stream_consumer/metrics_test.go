@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"testing"
+)
+
+// Test_metrics verifies counters are summed, observations are kept, and the EMF document is emitted
+func Test_metrics(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, nil))
+
+	m := newMetrics()
+	m.increment("Records", 1)
+	m.increment("Records", 2)
+	m.observe("LatencyMillis", unitMilliseconds, 10)
+	m.observe("LatencyMillis", unitMilliseconds, 20)
+	m.emit(context.Background(), logger, fixedClock())
+
+	logs := findLogs(parseLogs(t, &buf), "metrics")
+	if len(logs) != 1 {
+		t.Fatalf("expected 1 metrics log, got %d", len(logs))
+	}
+	entry := logs[0]
+	if entry["Records"] != 3.0 {
+		t.Errorf("expected Records 3, got %v", entry["Records"])
+	}
+	latencies, ok := entry["LatencyMillis"].([]any)
+	if !ok || len(latencies) != 2 || latencies[0] != 10.0 || latencies[1] != 20.0 {
+		t.Errorf("expected LatencyMillis [10 20], got %v", entry["LatencyMillis"])
+	}
+
+	aws, ok := entry["_aws"].(map[string]any)
+	if !ok {
+		t.Fatalf("expected _aws metadata, got %v", entry["_aws"])
+	}
+	if aws["Timestamp"] != float64(fixedClock().UnixMilli()) {
+		t.Errorf("expected Timestamp %d, got %v", fixedClock().UnixMilli(), aws["Timestamp"])
+	}
+	directives := aws["CloudWatchMetrics"].([]any)
+	definitions := directives[0].(map[string]any)["Metrics"].([]any)
+	if len(definitions) != 2 {
+		t.Errorf("expected 2 metric definitions, got %d", len(definitions))
+	}
+}
+
+// Test_metrics_emitEmpty verifies nothing is logged when no metrics were recorded
+func Test_metrics_emitEmpty(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, nil))
+
+	newMetrics().emit(context.Background(), logger, fixedClock())
+
+	if buf.Len() != 0 {
+		t.Errorf("expected no output, got %s", buf.String())
+	}
+}
+
+// Test_metrics_concurrent verifies counters and observations recorded from many goroutines are
+// all kept. Run with -race to check for data races
+func Test_metrics_concurrent(t *testing.T) {
+	const goroutines, perGoroutine = 8, 100
+
+	m := newMetrics()
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < perGoroutine; j++ {
+				m.increment("Records", 1)
+				m.observe("LatencyMillis", unitMilliseconds, float64(j))
+				_ = m.count("Records")
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := m.count("Records"); got != goroutines*perGoroutine {
+		t.Errorf("expected Records %d, got %d", goroutines*perGoroutine, got)
+	}
+	if got := len(m.values["LatencyMillis"]); got != goroutines*perGoroutine {
+		t.Errorf("expected %d LatencyMillis observations, got %d", goroutines*perGoroutine, got)
+	}
+}
+
+// Test_metrics_incrementOrg verifies membership changes are counted per organization, with
+// organizations over maxOrgDimensions aggregated under other
+func Test_metrics_incrementOrg(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, nil))
+
+	m := newMetrics()
+	m.incrementOrg("org0", 2)
+	for i := range maxOrgDimensions + 2 {
+		m.incrementOrg(fmt.Sprintf("org%d", i), 1)
+	}
+	m.emit(context.Background(), logger, fixedClock())
+
+	counts := make(map[string]any)
+	for _, entry := range findLogs(parseLogs(t, &buf), "organization metrics") {
+		counts[entry["OrganizationId"].(string)] = entry["MembershipChanges"]
+	}
+	if len(counts) != maxOrgDimensions+1 {
+		t.Errorf("expected %d organization dimensions, got %d", maxOrgDimensions+1, len(counts))
+	}
+	if counts["org0"] != 3.0 {
+		t.Errorf("expected org0 3, got %v", counts["org0"])
+	}
+	if counts["org1"] != 1.0 {
+		t.Errorf("expected org1 1, got %v", counts["org1"])
+	}
+	if counts[otherOrgDimension] != 2.0 {
+		t.Errorf("expected other 2, got %v", counts[otherOrgDimension])
+	}
+}
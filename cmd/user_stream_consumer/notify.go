@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	snstypes "github.com/aws/aws-sdk-go-v2/service/sns/types"
+)
+
+// snsClient defines the SNS operations used to notify subscribers of membership changes.
+type snsClient interface {
+	Publish(ctx context.Context, params *sns.PublishInput, optFns ...func(*sns.Options)) (*sns.PublishOutput, error)
+}
+
+// publishMembershipChanges publishes a message to the SNS topic for every membership change,
+// carrying the change's audit event as JSON and its action as the action message attribute, so
+// subscriptions can filter adds from removes. Publishes wait on the publish limiter, so a large
+// sync is spread out instead of flooding the topic.
+//
+// A failed publish is logged and counted as SNSPublishFailures. It only fails the record when
+// SNS_FAIL_ON_ERROR is set; the memberships are already written and the writes are idempotent,
+// so a redelivered record applies them again, but changes published before the failure are
+// published again too.
+func (p *processor) publishMembershipChanges(ctx context.Context, inv *invocation, audit []auditEvent) error {
+	if p.notifier == nil {
+		return nil
+	}
+	for _, e := range audit {
+		if err := p.publishMembershipChange(ctx, e); err != nil {
+			inv.metrics.increment("SNSPublishFailures", 1)
+			p.logger.ErrorContext(ctx, "failed to publish membership change",
+				slog.String("error", err.Error()),
+				slog.String("topicArn", p.snsTopicARN),
+				slog.String("action", e.Action),
+				slog.String("userId", e.UserID),
+				slog.String("organizationId", e.OrganizationID))
+			if p.snsFailOnError {
+				return fmt.Errorf("failed to publish membership change: %w", err)
+			}
+			continue
+		}
+		inv.metrics.increment("SNSPublished", 1)
+	}
+	return nil
+}
+
+// publishMembershipChange publishes the message for a single membership change. FIFO topics
+// also need a message group, the user so their changes stay in order, and a deduplication ID,
+// derived from the message.
+func (p *processor) publishMembershipChange(ctx context.Context, e auditEvent) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("failed to marshal membership change: %w", err)
+	}
+	if p.publishLimiter != nil {
+		if err := p.publishLimiter.Wait(ctx); err != nil {
+			return fmt.Errorf("failed to wait for publish capacity: %w", err)
+		}
+	}
+	input := &sns.PublishInput{
+		TopicArn: aws.String(p.snsTopicARN),
+		Message:  aws.String(string(b)),
+		MessageAttributes: map[string]snstypes.MessageAttributeValue{
+			"action": {DataType: aws.String("String"), StringValue: aws.String(e.Action)},
+		},
+	}
+	if strings.HasSuffix(p.snsTopicARN, ".fifo") {
+		sum := sha256.Sum256(b)
+		input.MessageGroupId = aws.String(e.UserID)
+		input.MessageDeduplicationId = aws.String(hex.EncodeToString(sum[:]))
+	}
+	_, err = p.notifier.Publish(ctx, input)
+	return err
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+)
+
+// mockSNSClient records the messages published and fails every publish when err is set.
+type mockSNSClient struct {
+	inputs []*sns.PublishInput
+	err    error
+}
+
+func (m *mockSNSClient) Publish(ctx context.Context, params *sns.PublishInput, optFns ...func(*sns.Options)) (*sns.PublishOutput, error) {
+	m.inputs = append(m.inputs, params)
+	if m.err != nil {
+		return nil, m.err
+	}
+	return &sns.PublishOutput{}, nil
+}
+
+// Test_handler_snsNotifications verifies a message is published for every membership change
+// and that a failed publish only fails the record with SNS_FAIL_ON_ERROR
+func Test_handler_snsNotifications(t *testing.T) {
+	const body = `{"eventName": "MODIFY", "dynamodb": {
+		"OldImage": {"pk": {"S": "USER#123"}, "organizations": {"L": [{"S": "org1"}]}},
+		"NewImage": {"pk": {"S": "USER#123"}, "organizations": {"L": [{"S": "org2"}]}}}}`
+	tests := []struct {
+		name        string
+		topicARN    string
+		failOnError string
+		publishErr  error
+		wantActions []string
+		wantErr     bool
+		wantMetric  string
+	}{
+		{
+			name:        "publishes each change",
+			topicARN:    "arn:aws:sns:us-east-1:123456789012:memberships",
+			wantActions: []string{"add", "remove"},
+			wantMetric:  "SNSPublished",
+		},
+		{
+			name:        "fifo topic",
+			topicARN:    "arn:aws:sns:us-east-1:123456789012:memberships.fifo",
+			wantActions: []string{"add", "remove"},
+			wantMetric:  "SNSPublished",
+		},
+		{
+			name:        "failed publish is logged",
+			topicARN:    "arn:aws:sns:us-east-1:123456789012:memberships",
+			publishErr:  errors.New("throttled"),
+			wantActions: []string{"add", "remove"},
+			wantMetric:  "SNSPublishFailures",
+		},
+		{
+			name:        "failed publish fails the record",
+			topicARN:    "arn:aws:sns:us-east-1:123456789012:memberships",
+			failOnError: "true",
+			publishErr:  errors.New("throttled"),
+			wantActions: []string{"remove"},
+			wantErr:     true,
+			wantMetric:  "SNSPublishFailures",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &mockDynamoDBClient{batchWriteItemFunc: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+				return &dynamodb.BatchWriteItemOutput{}, nil
+			}}
+			var buf bytes.Buffer
+			env := testEnv(map[string]string{
+				"TABLE_NAME":        "test-table",
+				"SNS_TOPIC_ARN":     tt.topicARN,
+				"SNS_FAIL_ON_ERROR": tt.failOnError,
+			})
+			p := newProcessor(slog.New(slog.NewJSONHandler(&buf, nil)), client, nil, nil, nil, mustLoadConfig(t, env), fixedClock)
+			notifier := &mockSNSClient{err: tt.publishErr}
+			p.notifier = notifier
+
+			_, err := p.lambdaHandler(nil)(context.Background(), events.SQSEvent{Records: []events.SQSMessage{{MessageId: "1", Body: body}}})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("handler() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			var actions []string
+			for _, input := range notifier.inputs {
+				if *input.TopicArn != tt.topicARN {
+					t.Errorf("expected topic %s, got %s", tt.topicARN, *input.TopicArn)
+				}
+				if fifo := input.MessageGroupId != nil; fifo != strings.HasSuffix(tt.topicARN, ".fifo") {
+					t.Errorf("unexpected MessageGroupId %v for topic %s", input.MessageGroupId, tt.topicARN)
+				}
+				actions = append(actions, *input.MessageAttributes["action"].StringValue)
+			}
+			sort.Strings(actions)
+			if !reflect.DeepEqual(actions, tt.wantActions) {
+				t.Errorf("published actions = %v, want %v", actions, tt.wantActions)
+			}
+
+			var found bool
+			for _, entry := range findLogs(parseLogs(t, &buf), "metrics") {
+				if _, ok := entry[tt.wantMetric]; ok {
+					found = true
+				}
+			}
+			if !found {
+				t.Errorf("expected %s metric", tt.wantMetric)
+			}
+		})
+	}
+}
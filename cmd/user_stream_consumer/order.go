@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// sortRecords returns a batch's records in stream sequence number order, so when records for
+// the same user arrive out of order, such as a remove and a later re-add split across message
+// groups or redelivered, the last write for a membership is always the one from the latest
+// change, whatever order the queue delivered them in. Records with equal sequence numbers keep
+// their delivery order.
+//
+// Sequence numbers are read from inline bodies only. When any record's cannot be read, such as
+// an offloaded or undecodable body, there is no position to sort it into, so the batch is
+// processed in delivery order and counted as UnsortedBatches. records is not modified.
+func (p *processor) sortRecords(ctx context.Context, inv *invocation, records []events.SQSMessage) []events.SQSMessage {
+	type sequenced struct {
+		record         events.SQSMessage
+		sequenceNumber string
+	}
+	sorted := make([]sequenced, len(records))
+	for i, record := range records {
+		der, ok := inlineRecord(record)
+		if !ok || der.Change.SequenceNumber == "" {
+			p.logger.WarnContext(ctx, "cannot sort batch by sequence number, processing in delivery order",
+				slog.String("messageId", record.MessageId))
+			inv.metrics.increment("UnsortedBatches", 1)
+			return records
+		}
+		sorted[i] = sequenced{record: record, sequenceNumber: der.Change.SequenceNumber}
+	}
+
+	slices.SortStableFunc(sorted, func(a, b sequenced) int {
+		return compareSequenceNumbers(a.sequenceNumber, b.sequenceNumber)
+	})
+	ordered := make([]events.SQSMessage, len(sorted))
+	for i, s := range sorted {
+		ordered[i] = s.record
+	}
+	return ordered
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Test_handler_sortBySequence verifies SORT_BY_SEQUENCE applies a batch's records in sequence
+// number order, so the final memberships do not depend on delivery order
+func Test_handler_sortBySequence(t *testing.T) {
+	// The re-add at 300 is delivered before the remove at 200 it follows.
+	outOfOrder := []events.SQSMessage{
+		sequenceRecord("insert", "INSERT", "100", "", `{"S": "org1"}`),
+		sequenceRecord("readd", "MODIFY", "300", ``, `{"S": "org1"}`),
+		sequenceRecord("remove", "MODIFY", "200", `{"S": "org1"}`, ``),
+	}
+	tests := []struct {
+		name         string
+		sort         string
+		records      []events.SQSMessage
+		want         map[string]bool
+		wantUnsorted bool
+	}{
+		{
+			name:    "sorted",
+			sort:    "true",
+			records: outOfOrder,
+			want:    map[string]bool{"ORGANIZATION#org1": true},
+		},
+		{
+			name:    "delivery order",
+			records: outOfOrder,
+			want:    map[string]bool{},
+		},
+		{
+			name: "record without a sequence number",
+			sort: "true",
+			records: append(outOfOrder[:3:3], events.SQSMessage{MessageId: "unsequenced",
+				Body: `{"eventName": "INSERT", "dynamodb": {"NewImage": {"pk": {"S": "USER#456"}, "organizations": {"L": [{"S": "org2"}]}}}}`}),
+			want:         map[string]bool{"ORGANIZATION#org2": true},
+			wantUnsorted: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			members := map[string]bool{}
+			client := &mockDynamoDBClient{batchWriteItemFunc: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+				for _, req := range params.RequestItems["test-table"] {
+					if req.DeleteRequest != nil {
+						delete(members, req.DeleteRequest.Key["pk"].(*types.AttributeValueMemberS).Value)
+						continue
+					}
+					members[req.PutRequest.Item["pk"].(*types.AttributeValueMemberS).Value] = true
+				}
+				return &dynamodb.BatchWriteItemOutput{}, nil
+			}}
+
+			var buf bytes.Buffer
+			env := testEnv(map[string]string{"TABLE_NAME": "test-table", "SORT_BY_SEQUENCE": tt.sort})
+			h := handler(slog.New(slog.NewJSONHandler(&buf, nil)), client, nil, nil, nil, mustLoadConfig(t, env), fixedClock, nil)
+			if _, err := h(context.Background(), events.SQSEvent{Records: tt.records}); err != nil {
+				t.Fatalf("handler() unexpected error = %v", err)
+			}
+
+			if !reflect.DeepEqual(members, tt.want) {
+				t.Errorf("memberships = %v, want %v", members, tt.want)
+			}
+			var unsorted bool
+			for _, entry := range findLogs(parseLogs(t, &buf), "metrics") {
+				if _, ok := entry["UnsortedBatches"]; ok {
+					unsorted = true
+				}
+			}
+			if unsorted != tt.wantUnsorted {
+				t.Errorf("expected UnsortedBatches %v, got %v", tt.wantUnsorted, unsorted)
+			}
+		})
+	}
+}
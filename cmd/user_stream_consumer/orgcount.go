@@ -0,0 +1,46 @@
+package main
+
+import "sync"
+
+// maxOrgCountEntries bounds the number of users held by an orgCountCache. The cache is
+// cleared when the bound is reached rather than tracking recency, since it only needs to
+// catch obviously corrupt records for recently seen users.
+const maxOrgCountEntries = 10000
+
+// orgCountCache remembers the number of organizations each user had after the last record
+// processed for them. It lives for the lifetime of the Lambda execution environment, so
+// counts carry across warm invocations but start empty on a cold start.
+type orgCountCache struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+// newOrgCountCache creates an empty orgCountCache.
+func newOrgCountCache() *orgCountCache {
+	return &orgCountCache{counts: make(map[string]int)}
+}
+
+// get returns the last known organization count for userKey.
+func (c *orgCountCache) get(userKey string) (int, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	count, ok := c.counts[userKey]
+	return count, ok
+}
+
+// set records the organization count for userKey.
+func (c *orgCountCache) set(userKey string, count int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.counts[userKey]; !ok && len(c.counts) >= maxOrgCountEntries {
+		c.counts = make(map[string]int)
+	}
+	c.counts[userKey] = count
+}
+
+// remove forgets the organization count for userKey.
+func (c *orgCountCache) remove(userKey string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.counts, userKey)
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// Test_orgCountCache verifies counts are stored, removed, and bounded
+func Test_orgCountCache(t *testing.T) {
+	c := newOrgCountCache()
+
+	if _, ok := c.get("USER#1"); ok {
+		t.Error("expected unknown user to be absent")
+	}
+
+	c.set("USER#1", 3)
+	if count, ok := c.get("USER#1"); !ok || count != 3 {
+		t.Errorf("get() = %d, %v, want 3, true", count, ok)
+	}
+
+	c.remove("USER#1")
+	if _, ok := c.get("USER#1"); ok {
+		t.Error("expected removed user to be absent")
+	}
+
+	for i := 0; i < maxOrgCountEntries; i++ {
+		c.set(fmt.Sprintf("USER#%d", i), i)
+	}
+	c.set("USER#overflow", 1)
+	if len(c.counts) != 1 {
+		t.Errorf("expected cache to reset at capacity, got %d entries", len(c.counts))
+	}
+}
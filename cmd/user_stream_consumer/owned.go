@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// ownedDeleteCondition lets a membership delete through only when the item was written by this
+// consumer, as identified by its SOURCE_TAG, or no longer exists, such as a role variant the
+// user never held.
+const ownedDeleteCondition = "attribute_not_exists(pk) OR #source = :source"
+
+// ownedWriteMemberships writes the membership requests like batchWriteMemberships, except that
+// membership deletes are conditioned on the item's source matching SOURCE_TAG, so memberships
+// created by another process are left in place. BatchWriteItem deletes cannot be conditioned,
+// so the deletes are made with TransactWriteItems instead, after collapsing duplicate keys that
+// would fail the transaction. Reverse index requests carry no source and are written
+// unconditionally, except that the reverse index row is kept for an organization whose
+// membership delete was refused, so the two tables still agree. The refused deletes are
+// returned.
+func (p *processor) ownedWriteMemberships(ctx context.Context, inv *invocation, writeRequests, reverseRequests []types.WriteRequest) ([]types.WriteRequest, error) {
+	var deletes, puts []types.WriteRequest
+	for _, req := range writeRequests {
+		if req.DeleteRequest != nil {
+			deletes = append(deletes, req)
+			continue
+		}
+		puts = append(puts, req)
+	}
+	deletes, dropped := dedupeWriteRequests(deletes)
+	if dropped > 0 {
+		inv.metrics.increment("DedupedWrites", dropped)
+	}
+
+	var skippedDeletes []types.WriteRequest
+	refused := make(map[string]bool)
+	orgPrefix := membershipPK("", p.orgPKPrefix)
+	for start := 0; start < len(deletes); start += maxTransactItems {
+		skipped, err := p.transactOwnedDeletes(ctx, inv, deletes[start:min(start+maxTransactItems, len(deletes))])
+		if err != nil {
+			return nil, err
+		}
+		skippedDeletes = append(skippedDeletes, skipped...)
+		for _, req := range skipped {
+			pk, _, _ := strings.Cut(writeRequestKey(req), "\x00")
+			refused["ORGANIZATION#"+strings.TrimPrefix(pk, orgPrefix)] = true
+		}
+	}
+	if len(refused) > 0 {
+		reverseRequests = slices.DeleteFunc(slices.Clone(reverseRequests), func(req types.WriteRequest) bool {
+			_, sk, _ := strings.Cut(writeRequestKey(req), "\x00")
+			return req.DeleteRequest != nil && refused[sk]
+		})
+	}
+
+	if len(puts) == 0 && len(reverseRequests) == 0 {
+		return skippedDeletes, nil
+	}
+	return skippedDeletes, p.batchWriteMemberships(ctx, inv, puts, reverseRequests)
+}
+
+// transactOwnedDeletes deletes up to maxTransactItems memberships in a transaction, each
+// conditioned on ownedDeleteCondition. A failed condition cancels the whole transaction, so the
+// memberships owned by another writer are logged, counted as ForeignDeletesSkipped and dropped,
+// and the transaction is retried with the rest; the dropped deletes are returned. Any other
+// cancellation reason fails the record.
+func (p *processor) transactOwnedDeletes(ctx context.Context, inv *invocation, deletes []types.WriteRequest) ([]types.WriteRequest, error) {
+	var skipped []types.WriteRequest
+	for len(deletes) > 0 {
+		items := make([]types.TransactWriteItem, len(deletes))
+		for i, req := range deletes {
+			items[i] = types.TransactWriteItem{Delete: &types.Delete{
+				TableName:                 aws.String(p.tableName),
+				Key:                       req.DeleteRequest.Key,
+				ConditionExpression:       aws.String(ownedDeleteCondition),
+				ExpressionAttributeNames:  map[string]string{"#source": "source"},
+				ExpressionAttributeValues: map[string]types.AttributeValue{":source": &types.AttributeValueMemberS{Value: p.sourceTag}},
+			}}
+		}
+
+		p.logger.InfoContext(ctx, "deleting owned organization memberships",
+			slog.String("table", p.tableName),
+			slog.String("source", p.sourceTag),
+			slog.Int("requestCount", len(items)))
+		inv.metrics.increment("OwnedDeleteTransactions", 1)
+		_, err := p.client.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: items})
+		if err == nil {
+			return skipped, nil
+		}
+
+		var canceled *types.TransactionCanceledException
+		if !errors.As(err, &canceled) || len(canceled.CancellationReasons) != len(deletes) {
+			p.logger.ErrorContext(ctx, "failed to delete owned memberships",
+				slog.String("error", err.Error()),
+				slog.String("table", p.tableName),
+				slog.Int("requestCount", len(items)))
+			return nil, fmt.Errorf("failed to delete owned organization memberships: %w", err)
+		}
+		var remaining []types.WriteRequest
+		for i, reason := range canceled.CancellationReasons {
+			switch code := aws.ToString(reason.Code); code {
+			case "ConditionalCheckFailed":
+				inv.metrics.increment("ForeignDeletesSkipped", 1)
+				skipped = append(skipped, deletes[i])
+				pk, sk, _ := strings.Cut(writeRequestKey(deletes[i]), "\x00")
+				p.logger.WarnContext(ctx, "skipping delete of membership owned by another writer",
+					slog.String("table", p.tableName),
+					slog.String("pk", pk),
+					slog.String("sk", sk))
+			case "", "None":
+				remaining = append(remaining, deletes[i])
+			default:
+				p.logger.ErrorContext(ctx, "failed to delete owned memberships",
+					slog.String("error", err.Error()),
+					slog.String("reason", code),
+					slog.String("table", p.tableName))
+				return nil, fmt.Errorf("failed to delete owned organization memberships: %w", err)
+			}
+		}
+		if len(remaining) == len(deletes) {
+			// Cancelled without any failed condition to drop, so retrying would not make progress.
+			return nil, fmt.Errorf("failed to delete owned organization memberships: %w", err)
+		}
+		deletes = remaining
+	}
+	return skipped, nil
+}
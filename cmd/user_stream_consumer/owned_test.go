@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Test_handler_ownedDeletes verifies OWNED_DELETES deletes memberships in a transaction
+// conditioned on the consumer's SOURCE_TAG, skipping and logging those another writer owns and
+// leaving them in place on the replicas too
+func Test_handler_ownedDeletes(t *testing.T) {
+	const body = `{"eventName": "MODIFY", "dynamodb": {
+		"OldImage": {"pk": {"S": "USER#123"}, "organizations": {"L": [{"S": "org1"}, {"S": "org2"}]}},
+		"NewImage": {"pk": {"S": "USER#123"}, "organizations": {"L": [{"S": "org3"}]}}}}`
+	tests := []struct {
+		name        string
+		owners      map[string]string // Source of each existing membership, by pk
+		wantDeleted []string
+		wantReverse []string // Reverse index rows deleted, by sk
+		wantSkipped int
+		wantCalls   int
+	}{
+		{
+			name:        "condition met",
+			owners:      map[string]string{"ORGANIZATION#org1": "consumer-a", "ORGANIZATION#org2": "consumer-a"},
+			wantDeleted: []string{"ORGANIZATION#org1", "ORGANIZATION#org2"},
+			wantReverse: []string{"ORGANIZATION#org1", "ORGANIZATION#org2"},
+			wantCalls:   1,
+		},
+		{
+			name:        "condition failed",
+			owners:      map[string]string{"ORGANIZATION#org1": "consumer-a", "ORGANIZATION#org2": "admin-console"},
+			wantDeleted: []string{"ORGANIZATION#org1"},
+			wantReverse: []string{"ORGANIZATION#org1"},
+			wantSkipped: 1,
+			wantCalls:   2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int
+			var deleted, reverseDeleted, puts []string
+			client := &mockDynamoDBClient{
+				transactWriteFunc: func(ctx context.Context, params *dynamodb.TransactWriteItemsInput, optFns ...func(*dynamodb.Options)) (*dynamodb.TransactWriteItemsOutput, error) {
+					calls++
+					// Like DynamoDB, a single failed condition cancels the whole transaction.
+					reasons := make([]types.CancellationReason, len(params.TransactItems))
+					var failed bool
+					for i, item := range params.TransactItems {
+						reasons[i].Code = aws.String("None")
+						source := item.Delete.ExpressionAttributeValues[":source"].(*types.AttributeValueMemberS).Value
+						if owner, ok := tt.owners[item.Delete.Key["pk"].(*types.AttributeValueMemberS).Value]; ok && owner != source {
+							reasons[i].Code = aws.String("ConditionalCheckFailed")
+							failed = true
+						}
+					}
+					if failed {
+						return nil, &types.TransactionCanceledException{CancellationReasons: reasons}
+					}
+					for _, item := range params.TransactItems {
+						deleted = append(deleted, item.Delete.Key["pk"].(*types.AttributeValueMemberS).Value)
+					}
+					return &dynamodb.TransactWriteItemsOutput{}, nil
+				},
+				batchWriteItemFunc: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+					for _, req := range params.RequestItems["reverse-table"] {
+						if req.DeleteRequest != nil {
+							reverseDeleted = append(reverseDeleted, req.DeleteRequest.Key["sk"].(*types.AttributeValueMemberS).Value)
+						}
+					}
+					for _, req := range params.RequestItems["test-table"] {
+						if req.DeleteRequest != nil {
+							t.Errorf("expected no unconditional deletes, got %v", req.DeleteRequest.Key)
+							continue
+						}
+						puts = append(puts, req.PutRequest.Item["pk"].(*types.AttributeValueMemberS).Value)
+					}
+					return &dynamodb.BatchWriteItemOutput{}, nil
+				},
+			}
+
+			var replicaDeleted []string
+			replicas := []replica{{region: "us-west-2", tableName: "orgs-west", client: &mockDynamoDBClient{
+				batchWriteItemFunc: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+					for _, req := range params.RequestItems["orgs-west"] {
+						if req.DeleteRequest != nil {
+							replicaDeleted = append(replicaDeleted, req.DeleteRequest.Key["pk"].(*types.AttributeValueMemberS).Value)
+						}
+					}
+					return &dynamodb.BatchWriteItemOutput{}, nil
+				},
+			}}}
+
+			var buf bytes.Buffer
+			env := testEnv(map[string]string{"TABLE_NAME": "test-table", "REVERSE_INDEX_TABLE": "reverse-table", "SOURCE_TAG": "consumer-a", "OWNED_DELETES": "true"})
+			h := handler(slog.New(slog.NewJSONHandler(&buf, nil)), client, nil, nil, replicas, mustLoadConfig(t, env), fixedClock, nil)
+			if _, err := h(context.Background(), events.SQSEvent{Records: []events.SQSMessage{{Body: body}}}); err != nil {
+				t.Fatalf("handler() unexpected error = %v", err)
+			}
+
+			sort.Strings(deleted)
+			if !reflect.DeepEqual(deleted, tt.wantDeleted) {
+				t.Errorf("deleted = %v, want %v", deleted, tt.wantDeleted)
+			}
+			sort.Strings(replicaDeleted)
+			if !reflect.DeepEqual(replicaDeleted, tt.wantDeleted) {
+				t.Errorf("replica deleted = %v, want the primary's deletes %v", replicaDeleted, tt.wantDeleted)
+			}
+			sort.Strings(reverseDeleted)
+			if !reflect.DeepEqual(reverseDeleted, tt.wantReverse) {
+				t.Errorf("reverse index deleted = %v, want %v", reverseDeleted, tt.wantReverse)
+			}
+			if want := []string{"ORGANIZATION#org3"}; !reflect.DeepEqual(puts, want) {
+				t.Errorf("puts = %v, want %v", puts, want)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("expected %d TransactWriteItems calls, got %d", tt.wantCalls, calls)
+			}
+			logs := parseLogs(t, &buf)
+			if n := len(findLogs(logs, "skipping delete of membership owned by another writer")); n != tt.wantSkipped {
+				t.Errorf("expected %d skipped delete logs, got %d", tt.wantSkipped, n)
+			}
+			var skipped int
+			for _, entry := range findLogs(logs, "metrics") {
+				if n, ok := entry["ForeignDeletesSkipped"].(float64); ok {
+					skipped += int(n)
+				}
+			}
+			if skipped != tt.wantSkipped {
+				t.Errorf("expected ForeignDeletesSkipped %d, got %d", tt.wantSkipped, skipped)
+			}
+		})
+	}
+}
+
+// Test_ownedWriteMemberships_duplicateDeletes verifies duplicate deletes are collapsed before
+// the transaction, which DynamoDB would otherwise reject for touching a key twice
+func Test_ownedWriteMemberships_duplicateDeletes(t *testing.T) {
+	var keys []string
+	client := &mockDynamoDBClient{
+		transactWriteFunc: func(ctx context.Context, params *dynamodb.TransactWriteItemsInput, optFns ...func(*dynamodb.Options)) (*dynamodb.TransactWriteItemsOutput, error) {
+			for _, item := range params.TransactItems {
+				keys = append(keys, item.Delete.Key["pk"].(*types.AttributeValueMemberS).Value)
+			}
+			return &dynamodb.TransactWriteItemsOutput{}, nil
+		},
+	}
+	p := &processor{
+		logger:    slog.New(slog.NewJSONHandler(io.Discard, nil)),
+		client:    client,
+		tableName: "test-table",
+		sourceTag: "consumer-a",
+	}
+
+	deletes := createWriteRequests("USER#123", []string{"org1", "org2"}, membershipAttributes{}, true)
+	inv := newInvocation()
+	if _, err := p.ownedWriteMemberships(context.Background(), inv, append(deletes, deletes[0]), nil); err != nil {
+		t.Fatalf("ownedWriteMemberships() unexpected error = %v", err)
+	}
+
+	if want := []string{"ORGANIZATION#org1", "ORGANIZATION#org2"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("transaction deleted %v, want %v", keys, want)
+	}
+	if n := inv.metrics.count("DedupedWrites"); n != 1 {
+		t.Errorf("expected DedupedWrites 1, got %d", n)
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// maxBatchStatements is the maximum number of statements DynamoDB accepts in a single
+// BatchExecuteStatement call.
+const maxBatchStatements = 25
+
+// Write APIs selected by WRITE_API.
+const (
+	writeAPIBatch   = "batch"
+	writeAPIPartiQL = "partiql"
+)
+
+// partiqlWrite is a PartiQL statement for a write request, with the UPDATE that applies a put
+// to an item that already exists. update is nil for deletes and for puts with only key
+// attributes.
+type partiqlWrite struct {
+	statement types.BatchStatementRequest
+	update    *types.BatchStatementRequest
+}
+
+// partiqlWriteMemberships writes the membership requests, and the reverse index requests when
+// present, as parameterized PartiQL INSERT and DELETE statements with BatchExecuteStatement.
+// Statements are chunked and deduplicated the same way as batchWrite and wait on the same write
+// limiter and in-flight write slots. Like BatchWriteItem, a batch is not transactional.
+func (p *processor) partiqlWriteMemberships(ctx context.Context, inv *invocation, writeRequests, reverseRequests []types.WriteRequest) error {
+	requestItems := map[string][]types.WriteRequest{p.tableName: writeRequests}
+	if len(reverseRequests) > 0 {
+		requestItems[p.reverseIndexTable] = reverseRequests
+	}
+	tables := make([]string, 0, len(requestItems))
+	for table := range requestItems {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+
+	var statements []partiqlWrite
+	for _, table := range tables {
+		deduped, dropped := dedupeWriteRequests(requestItems[table])
+		if dropped > 0 {
+			inv.metrics.increment("DedupedWrites", dropped)
+		}
+		for _, req := range deduped {
+			statements = append(statements, partiqlWrite{statement: partiqlStatement(table, req), update: partiqlUpdate(table, req)})
+		}
+	}
+
+	chunkSize := min(p.chunkSize(), maxBatchStatements)
+	for start := 0; start < len(statements); start += chunkSize {
+		end := min(start+chunkSize, len(statements))
+		p.logger.InfoContext(ctx, "executing organization membership statements",
+			slog.String("table", p.tableName),
+			slog.Int("statementCount", end-start))
+		if err := p.executeStatements(ctx, inv, statements[start:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// executeStatements makes a single BatchExecuteStatement call, whose responses are in statement
+// order, then retries any statements that failed with a throttling or internal error until they
+// are all applied or the retry budget runs out. INSERT fails with DuplicateItem when the
+// membership already exists, such as when a record is redelivered or changes a membership's role
+// or metadata; it is counted as DuplicateInserts and the put is applied to the existing item with
+// its UPDATE, so the item's attributes are refreshed as a PutItem would. Any other statement
+// error fails the record.
+func (p *processor) executeStatements(ctx context.Context, inv *invocation, statements []partiqlWrite) error {
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			if inv.retries >= p.retryBudget {
+				inv.metrics.increment("RetryBudgetExhausted", 1)
+				p.logger.ErrorContext(ctx, "retry budget exhausted with unprocessed membership statements",
+					slog.String("table", p.tableName),
+					slog.Int("retryBudget", p.retryBudget),
+					slog.Int("statementCount", len(statements)))
+				return fmt.Errorf("retry budget exhausted with %d unprocessed organization membership statements", len(statements))
+			}
+			inv.retries++
+			if err := sleep(ctx, retryDelay(p.retryBaseDelay, attempt)); err != nil {
+				return fmt.Errorf("failed to retry unprocessed membership statements: %w", err)
+			}
+		}
+		if p.writeLimiter != nil {
+			if err := p.writeLimiter.Wait(ctx); err != nil {
+				return fmt.Errorf("failed to wait for write capacity: %w", err)
+			}
+		}
+
+		out, err := p.sendStatements(ctx, inv, statements)
+		if err != nil {
+			return err
+		}
+		if out == nil {
+			// Not expected from the SDK, but a nil output carries no statement errors to retry.
+			p.logger.DebugContext(ctx, "batch execute statement returned no output, treating statements as applied",
+				slog.String("table", p.tableName),
+				slog.Int("statementCount", len(statements)))
+			return nil
+		}
+
+		var retry, updates []partiqlWrite
+		for i, resp := range out.Responses {
+			if resp.Error == nil {
+				continue
+			}
+			switch resp.Error.Code {
+			case types.BatchStatementErrorCodeEnumDuplicateItem:
+				inv.metrics.increment("DuplicateInserts", 1)
+				if update := statements[i].update; update != nil {
+					updates = append(updates, partiqlWrite{statement: *update})
+				}
+			case types.BatchStatementErrorCodeEnumThrottlingError,
+				types.BatchStatementErrorCodeEnumProvisionedThroughputExceeded,
+				types.BatchStatementErrorCodeEnumRequestLimitExceeded,
+				types.BatchStatementErrorCodeEnumInternalServerError:
+				retry = append(retry, statements[i])
+			default:
+				p.logger.ErrorContext(ctx, "membership statement failed",
+					slog.String("code", string(resp.Error.Code)),
+					slog.String("message", aws.ToString(resp.Error.Message)),
+					slog.String("table", aws.ToString(resp.TableName)))
+				return fmt.Errorf("organization membership statement failed with %s: %s", resp.Error.Code, aws.ToString(resp.Error.Message))
+			}
+		}
+		if len(updates) > 0 {
+			if err := p.executeStatements(ctx, inv, updates); err != nil {
+				return err
+			}
+		}
+		if len(retry) == 0 {
+			return nil
+		}
+		statements = retry
+	}
+}
+
+// partiqlStatement renders a write request as a parameterized PartiQL statement. Every value is
+// passed as a parameter; only table and attribute names are written into the statement, quoted
+// and escaped. Attributes are listed in name order so statements are deterministic.
+func partiqlStatement(table string, req types.WriteRequest) types.BatchStatementRequest {
+	if req.DeleteRequest != nil {
+		names := sortedAttributeNames(req.DeleteRequest.Key)
+		conditions := make([]string, len(names))
+		params := make([]types.AttributeValue, len(names))
+		for i, name := range names {
+			conditions[i] = quoteIdentifier(name) + " = ?"
+			params[i] = req.DeleteRequest.Key[name]
+		}
+		return types.BatchStatementRequest{
+			Statement:  aws.String(fmt.Sprintf("DELETE FROM %s WHERE %s", quoteIdentifier(table), strings.Join(conditions, " AND "))),
+			Parameters: params,
+		}
+	}
+
+	names := sortedAttributeNames(req.PutRequest.Item)
+	fields := make([]string, len(names))
+	params := make([]types.AttributeValue, len(names))
+	for i, name := range names {
+		fields[i] = quoteString(name) + ": ?"
+		params[i] = req.PutRequest.Item[name]
+	}
+	return types.BatchStatementRequest{
+		Statement:  aws.String(fmt.Sprintf("INSERT INTO %s VALUE {%s}", quoteIdentifier(table), strings.Join(fields, ", "))),
+		Parameters: params,
+	}
+}
+
+// partiqlUpdate renders a put request as a parameterized PartiQL UPDATE that sets the item's
+// non-key attributes on the existing item with its pk and sk. Unlike a put, attributes the
+// request does not carry are left in place. It returns nil for deletes and for items with no
+// attributes besides the key.
+func partiqlUpdate(table string, req types.WriteRequest) *types.BatchStatementRequest {
+	if req.PutRequest == nil {
+		return nil
+	}
+	var sets []string
+	var params []types.AttributeValue
+	for _, name := range sortedAttributeNames(req.PutRequest.Item) {
+		if name == "pk" || name == "sk" {
+			continue
+		}
+		sets = append(sets, "SET "+quoteIdentifier(name)+" = ?")
+		params = append(params, req.PutRequest.Item[name])
+	}
+	if len(sets) == 0 {
+		return nil
+	}
+	return &types.BatchStatementRequest{
+		Statement:  aws.String(fmt.Sprintf(`UPDATE %s %s WHERE "pk" = ? AND "sk" = ?`, quoteIdentifier(table), strings.Join(sets, " "))),
+		Parameters: append(params, req.PutRequest.Item["pk"], req.PutRequest.Item["sk"]),
+	}
+}
+
+// sortedAttributeNames returns the attribute names of an item in lexical order.
+func sortedAttributeNames(item map[string]types.AttributeValue) []string {
+	names := make([]string, 0, len(item))
+	for name := range item {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// quoteIdentifier quotes a table or attribute name for a PartiQL statement, doubling any
+// embedded double quotes.
+func quoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// quoteString quotes an attribute name as a PartiQL string literal, as used for the keys of an
+// INSERT tuple, doubling any embedded single quotes.
+func quoteString(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// sendStatements makes one BatchExecuteStatement call for executeStatements while holding an
+// in-flight write slot, which is released however the call returns.
+func (p *processor) sendStatements(ctx context.Context, inv *invocation, statements []partiqlWrite) (*dynamodb.BatchExecuteStatementOutput, error) {
+	if err := p.acquireWriteSlot(ctx); err != nil {
+		return nil, fmt.Errorf("failed to wait for an in-flight write slot: %w", err)
+	}
+	defer p.releaseWriteSlot()
+	inv.metrics.increment("BatchExecuteStatementCalls", 1)
+	inv.metrics.increment("WriteRequestsTotal", len(statements))
+	requests := make([]types.BatchStatementRequest, len(statements))
+	for i, st := range statements {
+		requests[i] = st.statement
+	}
+	out, err := p.client.BatchExecuteStatement(ctx, &dynamodb.BatchExecuteStatementInput{Statements: requests})
+	if err != nil {
+		p.logger.ErrorContext(ctx, "failed to execute membership statements",
+			slog.String("error", err.Error()),
+			slog.String("table", p.tableName),
+			slog.Int("statementCount", len(statements)))
+		return nil, fmt.Errorf("failed to execute organization membership statements: %w", err)
+	}
+	return out, nil
+}
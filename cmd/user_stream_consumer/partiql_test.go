@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Test_handler_partiqlWrites verifies WRITE_API=partiql writes a MODIFY record's put and delete
+// as parameterized statements instead of calling BatchWriteItem
+func Test_handler_partiqlWrites(t *testing.T) {
+	var calls []*dynamodb.BatchExecuteStatementInput
+	client := &mockDynamoDBClient{
+		batchWriteItemFunc: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+			t.Error("BatchWriteItem should not be called with WRITE_API=partiql")
+			return &dynamodb.BatchWriteItemOutput{}, nil
+		},
+		executeBatchFunc: func(ctx context.Context, params *dynamodb.BatchExecuteStatementInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchExecuteStatementOutput, error) {
+			calls = append(calls, params)
+			return &dynamodb.BatchExecuteStatementOutput{Responses: make([]types.BatchStatementResponse, len(params.Statements))}, nil
+		},
+	}
+
+	env := testEnv(map[string]string{"TABLE_NAME": "test-table", "WRITE_API": "partiql"})
+	h := handler(slog.New(slog.NewJSONHandler(io.Discard, nil)), client, nil, nil, nil, mustLoadConfig(t, env), fixedClock, nil)
+	body := `{
+		"eventName": "MODIFY",
+		"dynamodb": {
+			"OldImage": {"pk": {"S": "USER#123"}, "organizations": {"L": [{"S": "org1"}]}},
+			"NewImage": {"pk": {"S": "USER#123"}, "organizations": {"L": [{"S": "org2"}]}}
+		}
+	}`
+	if _, err := h(context.Background(), events.SQSEvent{Records: []events.SQSMessage{{Body: body}}}); err != nil {
+		t.Fatalf("handler() unexpected error = %v", err)
+	}
+
+	if len(calls) != 1 {
+		t.Fatalf("expected 1 BatchExecuteStatement call, got %d", len(calls))
+	}
+	s := func(v string) types.AttributeValue { return &types.AttributeValueMemberS{Value: v} }
+	want := []types.BatchStatementRequest{
+		{
+			Statement:  aws.String(`DELETE FROM "test-table" WHERE "pk" = ? AND "sk" = ?`),
+			Parameters: []types.AttributeValue{s("ORGANIZATION#org1"), s("MEMBERSHIP#123")},
+		},
+		{
+			Statement: aws.String(`INSERT INTO "test-table" VALUE {'createdAt': ?, 'pk': ?, 'schemaVersion': ?, 'sk': ?}`),
+			Parameters: []types.AttributeValue{
+				s(fixedClock().UTC().Format(time.RFC3339)),
+				s("ORGANIZATION#org2"),
+				&types.AttributeValueMemberN{Value: "1"},
+				s("MEMBERSHIP#123"),
+			},
+		},
+	}
+	if !reflect.DeepEqual(calls[0].Statements, want) {
+		t.Errorf("statements = %#v, want %#v", calls[0].Statements, want)
+	}
+}
+
+// Test_executeStatements verifies throttled statements are retried alone and a duplicate insert
+// is applied to the existing item with an UPDATE, as a put would overwrite it
+func Test_executeStatements(t *testing.T) {
+	var calls [][]string
+	client := &mockDynamoDBClient{
+		executeBatchFunc: func(ctx context.Context, params *dynamodb.BatchExecuteStatementInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchExecuteStatementOutput, error) {
+			var statements []string
+			responses := make([]types.BatchStatementResponse, len(params.Statements))
+			for i, st := range params.Statements {
+				statements = append(statements, aws.ToString(st.Statement))
+				if len(calls) > 0 {
+					continue
+				}
+				switch i {
+				case 0:
+					responses[i].Error = &types.BatchStatementError{Code: types.BatchStatementErrorCodeEnumDuplicateItem}
+				case 1:
+					responses[i].Error = &types.BatchStatementError{Code: types.BatchStatementErrorCodeEnumThrottlingError}
+				}
+			}
+			calls = append(calls, statements)
+			return &dynamodb.BatchExecuteStatementOutput{Responses: responses}, nil
+		},
+	}
+	p := &processor{
+		logger:      slog.New(slog.NewJSONHandler(io.Discard, nil)),
+		client:      client,
+		tableName:   "test-table",
+		retryBudget: defaultRetryBudget,
+	}
+
+	inv := newInvocation()
+	requests := createWriteRequests("USER#123", []string{"org1", "org2"}, membershipAttributes{Metadata: map[string]organizationMetadata{"org1": {Role: "admin"}}}, false)
+	if err := p.partiqlWriteMemberships(context.Background(), inv, requests, nil); err != nil {
+		t.Fatalf("partiqlWriteMemberships() unexpected error = %v", err)
+	}
+
+	insert := `INSERT INTO "test-table" VALUE {'pk': ?, 'schemaVersion': ?, 'sk': ?}`
+	want := [][]string{
+		{`INSERT INTO "test-table" VALUE {'pk': ?, 'role': ?, 'schemaVersion': ?, 'sk': ?}`, insert},
+		{`UPDATE "test-table" SET "role" = ? SET "schemaVersion" = ? WHERE "pk" = ? AND "sk" = ?`},
+		{insert},
+	}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("calls = %v, want %v", calls, want)
+	}
+	if n := inv.metrics.count("DuplicateInserts"); n != 1 {
+		t.Errorf("expected 1 DuplicateInserts, got %d", n)
+	}
+	if inv.retries != 1 {
+		t.Errorf("expected 1 retry, got %d", inv.retries)
+	}
+}
+
+// Test_executeStatements_nilOutput verifies a BatchExecuteStatement call returning neither output
+// nor error is treated as applied instead of panicking on the missing responses
+func Test_executeStatements_nilOutput(t *testing.T) {
+	client := &mockDynamoDBClient{
+		executeBatchFunc: func(ctx context.Context, params *dynamodb.BatchExecuteStatementInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchExecuteStatementOutput, error) {
+			return nil, nil
+		},
+	}
+	p := &processor{
+		logger:    slog.New(slog.NewJSONHandler(io.Discard, nil)),
+		client:    client,
+		tableName: "test-table",
+	}
+
+	requests := createWriteRequests("USER#123", []string{"org1"}, membershipAttributes{}, false)
+	if err := p.partiqlWriteMemberships(context.Background(), newInvocation(), requests, nil); err != nil {
+		t.Errorf("partiqlWriteMemberships() unexpected error = %v", err)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// s3PointerClass is the class name the SQS extended client library writes ahead of the pointer
+// to a message body it offloaded to S3.
+const s3PointerClass = "software.amazon.payloadoffloading.PayloadS3Pointer"
+
+// s3Client is the subset of the S3 API used to read offloaded message bodies.
+type s3Client interface {
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+}
+
+// s3Pointer locates a message body offloaded to S3.
+type s3Pointer struct {
+	Bucket string `json:"s3BucketName"`
+	Key    string `json:"s3Key"`
+}
+
+// parseS3Pointer reports whether body is an SQS extended client pointer, of the form
+// ["software.amazon.payloadoffloading.PayloadS3Pointer", {"s3BucketName": ..., "s3Key": ...}],
+// returning the location it points to. Any other body is inline.
+func parseS3Pointer(body string) (s3Pointer, bool) {
+	var parts []json.RawMessage
+	if err := json.Unmarshal([]byte(body), &parts); err != nil || len(parts) != 2 {
+		return s3Pointer{}, false
+	}
+	var class string
+	if err := json.Unmarshal(parts[0], &class); err != nil || class != s3PointerClass {
+		return s3Pointer{}, false
+	}
+	var pointer s3Pointer
+	if err := json.Unmarshal(parts[1], &pointer); err != nil || pointer.Bucket == "" || pointer.Key == "" {
+		return s3Pointer{}, false
+	}
+	return pointer, true
+}
+
+// fetchPayload reads an offloaded message body from S3.
+func (p *processor) fetchPayload(ctx context.Context, pointer s3Pointer) (string, error) {
+	if p.payloads == nil {
+		return "", &permanentError{err: errors.New("message body offloaded to S3 but no S3 client is configured")}
+	}
+	out, err := p.payloads.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(pointer.Bucket),
+		Key:    aws.String(pointer.Key),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to get offloaded message body s3://%s/%s: %w", pointer.Bucket, pointer.Key, err)
+	}
+	defer out.Body.Close()
+	body, err := io.ReadAll(out.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read offloaded message body s3://%s/%s: %w", pointer.Bucket, pointer.Key, err)
+	}
+	return string(body), nil
+}
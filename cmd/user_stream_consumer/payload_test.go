@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// mockS3Client implements s3Client interface for testing
+type mockS3Client struct {
+	getObjectFunc func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+}
+
+func (m *mockS3Client) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	return m.getObjectFunc(ctx, params, optFns...)
+}
+
+// Test_handler_s3Pointer verifies bodies offloaded by the SQS extended client are read from S3
+// and produce the same writes as an inline body
+func Test_handler_s3Pointer(t *testing.T) {
+	const pointer = `["software.amazon.payloadoffloading.PayloadS3Pointer", {"s3BucketName": "payload-bucket", "s3Key": "payload-key"}]`
+	body := insertBody("USER#123", 3)
+
+	tests := []struct {
+		name    string
+		getErr  error
+		wantErr bool
+	}{
+		{name: "pointer read from s3"},
+		{name: "failed s3 read fails the batch", getErr: errors.New("simulated outage"), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payloads := &mockS3Client{
+				getObjectFunc: func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+					if *params.Bucket != "payload-bucket" || *params.Key != "payload-key" {
+						t.Errorf("expected s3://payload-bucket/payload-key, got s3://%s/%s", *params.Bucket, *params.Key)
+					}
+					if tt.getErr != nil {
+						return nil, tt.getErr
+					}
+					return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(body))}, nil
+				},
+			}
+			var writes []map[string][]types.WriteRequest
+			client := &mockDynamoDBClient{
+				batchWriteItemFunc: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+					writes = append(writes, params.RequestItems)
+					return &dynamodb.BatchWriteItemOutput{}, nil
+				},
+			}
+
+			h := handler(slog.New(slog.NewJSONHandler(io.Discard, nil)), client, nil, payloads, nil, mustLoadConfig(t, testEnv(map[string]string{"TABLE_NAME": "test-table"})), fixedClock, nil)
+			_, err := h(context.Background(), events.SQSEvent{Records: []events.SQSMessage{
+				{MessageId: "inline", Body: body},
+				{MessageId: "offloaded", Body: pointer},
+			}})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("handler() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if !isRetryable(err) {
+					t.Errorf("expected a retryable error, got %v", err)
+				}
+				return
+			}
+			if len(writes) != 2 {
+				t.Fatalf("expected 2 batch writes, got %d", len(writes))
+			}
+			if !reflect.DeepEqual(writes[0], writes[1]) {
+				t.Errorf("offloaded body wrote %v, inline body wrote %v", writes[1], writes[0])
+			}
+		})
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// Long polling settings for poll mode. Ten messages is the most ReceiveMessage returns, and
+// twenty seconds the longest it waits.
+const (
+	pollMaxMessages = 10
+	pollWaitSeconds = 20
+)
+
+// A failed receive is retried after defaultPollRetryDelay, doubling with each consecutive
+// failure up to maxPollRetryDelay.
+const (
+	defaultPollRetryDelay = time.Second
+	maxPollRetryDelay     = 30 * time.Second
+)
+
+// queueClient defines the SQS operations used to consume the queue directly in poll mode.
+type queueClient interface {
+	ReceiveMessage(ctx context.Context, params *sqs.ReceiveMessageInput, optFns ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error)
+	DeleteMessage(ctx context.Context, params *sqs.DeleteMessageInput, optFns ...func(*sqs.Options)) (*sqs.DeleteMessageOutput, error)
+	ChangeMessageVisibility(ctx context.Context, params *sqs.ChangeMessageVisibilityInput, optFns ...func(*sqs.Options)) (*sqs.ChangeMessageVisibilityOutput, error)
+}
+
+// poll consumes queueURL directly when running outside Lambda, such as for local development.
+// It long polls for batches and processes each as the Lambda handler would. Deletions follow
+// the same partial batch response the Lambda runtime acts on: records reported as batch item
+// failures are left on the queue, the rest are deleted, and a batch that fails as a whole is
+// left for SQS to redeliver in full. A dry run deletes nothing. A failed receive, such as
+// during a network blip, is logged and retried with backoff rather than ending the poller. When
+// ctx is canceled, such as by SIGTERM, the loop stops receiving but finishes the batch in
+// flight first, so shutdown never drops work part way through.
+func (p *processor) poll(ctx context.Context, queue queueClient, queueURL string) error {
+	handle := p.lambdaHandler(nil)
+	p.logger.InfoContext(ctx, "polling queue", slog.String("queueUrl", queueURL))
+
+	var failures int
+	for ctx.Err() == nil {
+		out, err := queue.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:                    aws.String(queueURL),
+			MaxNumberOfMessages:         pollMaxMessages,
+			WaitTimeSeconds:             pollWaitSeconds,
+			MessageSystemAttributeNames: []sqstypes.MessageSystemAttributeName{sqstypes.MessageSystemAttributeNameAll},
+			MessageAttributeNames:       []string{"All"},
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			failures++
+			delay := pollBackoff(p.pollRetryDelay, failures)
+			p.logger.ErrorContext(ctx, "failed to receive messages",
+				slog.String("error", err.Error()),
+				slog.Int("consecutiveFailures", failures),
+				slog.Duration("retryIn", delay))
+			if sleep(ctx, delay) != nil {
+				break
+			}
+			continue
+		}
+		failures = 0
+		if len(out.Messages) == 0 {
+			continue
+		}
+
+		batchCtx := context.WithoutCancel(ctx)
+		stopHeartbeat := p.heartbeat(batchCtx, queue, queueURL, out.Messages)
+		response, err := handle(batchCtx, sqsEvent(out.Messages))
+		stopHeartbeat()
+		if err != nil {
+			// The handler has already logged the failure; the batch becomes visible again once
+			// its visibility timeout expires.
+			continue
+		}
+		if p.dryRun {
+			// Leave the batch on the queue, so a later real run still applies it.
+			p.logger.InfoContext(ctx, "dry run: skipping message deletes",
+				slog.Int("messageCount", len(out.Messages)))
+			continue
+		}
+		p.deleteMessages(batchCtx, queue, queueURL, succeeded(out.Messages, response))
+	}
+
+	p.logger.InfoContext(ctx, "poller stopped")
+	return nil
+}
+
+// pollBackoff returns the backoff after the given number of consecutive failed receives,
+// doubling from base and capped at maxPollRetryDelay.
+func pollBackoff(base time.Duration, failures int) time.Duration {
+	delay := base
+	for i := 1; i < failures && delay < maxPollRetryDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, maxPollRetryDelay)
+}
+
+// heartbeat keeps the messages in a batch hidden from other consumers while it is processed, by
+// extending their visibility timeout every heartbeat interval to twice the interval. The
+// returned function stops the heartbeat and waits for any extension in progress to finish, so
+// no extension races the batch's deletes. No heartbeat runs when the interval is zero.
+func (p *processor) heartbeat(ctx context.Context, queue queueClient, queueURL string, messages []sqstypes.Message) (stop func()) {
+	if p.heartbeatInterval <= 0 {
+		return func() {}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	timeout := int32(math.Ceil((2 * p.heartbeatInterval).Seconds()))
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(p.heartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			for _, m := range messages {
+				_, err := queue.ChangeMessageVisibility(ctx, &sqs.ChangeMessageVisibilityInput{
+					QueueUrl:          aws.String(queueURL),
+					ReceiptHandle:     m.ReceiptHandle,
+					VisibilityTimeout: timeout,
+				})
+				if err != nil && ctx.Err() == nil {
+					p.logger.WarnContext(ctx, "failed to extend message visibility",
+						slog.String("error", err.Error()),
+						slog.String("messageId", aws.ToString(m.MessageId)))
+				}
+			}
+		}
+	}()
+
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// deleteMessages deletes processed messages from the queue. A failed delete is logged rather
+// than returned, since the message is only redelivered and applied again.
+func (p *processor) deleteMessages(ctx context.Context, queue queueClient, queueURL string, messages []sqstypes.Message) {
+	for _, m := range messages {
+		if _, err := queue.DeleteMessage(ctx, &sqs.DeleteMessageInput{QueueUrl: aws.String(queueURL), ReceiptHandle: m.ReceiptHandle}); err != nil {
+			p.logger.WarnContext(ctx, "failed to delete processed message",
+				slog.String("error", err.Error()),
+				slog.String("messageId", aws.ToString(m.MessageId)))
+		}
+	}
+}
+
+// succeeded returns the messages not reported as batch item failures in response.
+func succeeded(messages []sqstypes.Message, response events.SQSEventResponse) []sqstypes.Message {
+	failed := make(map[string]struct{}, len(response.BatchItemFailures))
+	for _, f := range response.BatchItemFailures {
+		failed[f.ItemIdentifier] = struct{}{}
+	}
+	ok := make([]sqstypes.Message, 0, len(messages))
+	for _, m := range messages {
+		if _, isFailed := failed[aws.ToString(m.MessageId)]; !isFailed {
+			ok = append(ok, m)
+		}
+	}
+	return ok
+}
+
+// sqsEvent converts received messages into the event the Lambda runtime would deliver for them.
+func sqsEvent(messages []sqstypes.Message) events.SQSEvent {
+	event := events.SQSEvent{Records: make([]events.SQSMessage, 0, len(messages))}
+	for _, m := range messages {
+		record := events.SQSMessage{
+			MessageId:     aws.ToString(m.MessageId),
+			ReceiptHandle: aws.ToString(m.ReceiptHandle),
+			Body:          aws.ToString(m.Body),
+			Md5OfBody:     aws.ToString(m.MD5OfBody),
+			Attributes:    m.Attributes,
+			EventSource:   "aws:sqs",
+		}
+		if len(m.MessageAttributes) > 0 {
+			record.MessageAttributes = make(map[string]events.SQSMessageAttribute, len(m.MessageAttributes))
+			for name, attr := range m.MessageAttributes {
+				record.MessageAttributes[name] = events.SQSMessageAttribute{
+					StringValue: attr.StringValue,
+					BinaryValue: attr.BinaryValue,
+					DataType:    aws.ToString(attr.DataType),
+				}
+			}
+		}
+		event.Records = append(event.Records, record)
+	}
+	return event
+}
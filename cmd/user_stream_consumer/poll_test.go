@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// mockQueueClient implements queueClient interface for testing
+type mockQueueClient struct {
+	receiveMessageFunc   func(ctx context.Context, params *sqs.ReceiveMessageInput, optFns ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error)
+	deleteMessageFunc    func(ctx context.Context, params *sqs.DeleteMessageInput, optFns ...func(*sqs.Options)) (*sqs.DeleteMessageOutput, error)
+	changeVisibilityFunc func(ctx context.Context, params *sqs.ChangeMessageVisibilityInput, optFns ...func(*sqs.Options)) (*sqs.ChangeMessageVisibilityOutput, error)
+}
+
+func (m *mockQueueClient) ReceiveMessage(ctx context.Context, params *sqs.ReceiveMessageInput, optFns ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error) {
+	return m.receiveMessageFunc(ctx, params, optFns...)
+}
+
+func (m *mockQueueClient) DeleteMessage(ctx context.Context, params *sqs.DeleteMessageInput, optFns ...func(*sqs.Options)) (*sqs.DeleteMessageOutput, error) {
+	return m.deleteMessageFunc(ctx, params, optFns...)
+}
+
+func (m *mockQueueClient) ChangeMessageVisibility(ctx context.Context, params *sqs.ChangeMessageVisibilityInput, optFns ...func(*sqs.Options)) (*sqs.ChangeMessageVisibilityOutput, error) {
+	return m.changeVisibilityFunc(ctx, params, optFns...)
+}
+
+// Test_poll_shutdown verifies a canceled context stops the poller cleanly, after finishing and
+// deleting the batch already in flight
+func Test_poll_shutdown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var writes int
+	client := &mockDynamoDBClient{
+		batchWriteItemFunc: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+			if ctx.Err() != nil {
+				t.Error("expected the in-flight batch to be written with a live context")
+			}
+			writes++
+			return &dynamodb.BatchWriteItemOutput{}, nil
+		},
+	}
+
+	var receives int
+	var deleted []string
+	queue := &mockQueueClient{
+		receiveMessageFunc: func(ctx context.Context, params *sqs.ReceiveMessageInput, optFns ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error) {
+			receives++
+			// SIGTERM arrives while the batch is in flight.
+			cancel()
+			return &sqs.ReceiveMessageOutput{Messages: []sqstypes.Message{
+				{MessageId: aws.String("msg-1"), ReceiptHandle: aws.String("receipt-1"), Body: aws.String(insertBody("USER#123", 1))},
+			}}, nil
+		},
+		deleteMessageFunc: func(ctx context.Context, params *sqs.DeleteMessageInput, optFns ...func(*sqs.Options)) (*sqs.DeleteMessageOutput, error) {
+			deleted = append(deleted, *params.ReceiptHandle)
+			return &sqs.DeleteMessageOutput{}, nil
+		},
+	}
+
+	env := testEnv(map[string]string{"TABLE_NAME": "test-table"})
+	p := newProcessor(slog.New(slog.NewJSONHandler(io.Discard, nil)), client, nil, nil, nil, mustLoadConfig(t, env), fixedClock)
+	if err := p.poll(ctx, queue, "https://sqs.us-east-1.amazonaws.com/123456789012/user-dynamo-stream.fifo"); err != nil {
+		t.Fatalf("poll() unexpected error = %v", err)
+	}
+
+	if receives != 1 {
+		t.Errorf("expected to stop receiving after shutdown, got %d receives", receives)
+	}
+	if writes != 1 {
+		t.Errorf("expected the in-flight batch to be written, got %d writes", writes)
+	}
+	if len(deleted) != 1 || deleted[0] != "receipt-1" {
+		t.Errorf("expected the in-flight batch to be deleted, got %v", deleted)
+	}
+}
+
+// Test_poll verifies every processed message is deleted and those reported as batch item
+// failures are left on the queue, across a batch followed by an empty poll
+func Test_poll(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := &mockDynamoDBClient{
+		batchWriteItemFunc: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+			return &dynamodb.BatchWriteItemOutput{}, nil
+		},
+	}
+
+	responses := []*sqs.ReceiveMessageOutput{
+		{Messages: []sqstypes.Message{
+			{MessageId: aws.String("msg-1"), ReceiptHandle: aws.String("receipt-1"), Body: aws.String(insertBody("USER#123", 1))},
+			{MessageId: aws.String("msg-2"), ReceiptHandle: aws.String("receipt-2"), Body: aws.String(`{not json`)},
+			{MessageId: aws.String("msg-3"), ReceiptHandle: aws.String("receipt-3"), Body: aws.String(insertBody("USER#456", 2))},
+		}},
+		{},
+	}
+	var receives int
+	var deleted []string
+	queue := &mockQueueClient{
+		receiveMessageFunc: func(ctx context.Context, params *sqs.ReceiveMessageInput, optFns ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error) {
+			if *params.QueueUrl != "https://sqs.us-east-1.amazonaws.com/123456789012/user-dynamo-stream.fifo" {
+				t.Errorf("unexpected queue URL %s", *params.QueueUrl)
+			}
+			receives++
+			if receives == len(responses) {
+				cancel()
+			}
+			return responses[receives-1], nil
+		},
+		deleteMessageFunc: func(ctx context.Context, params *sqs.DeleteMessageInput, optFns ...func(*sqs.Options)) (*sqs.DeleteMessageOutput, error) {
+			deleted = append(deleted, *params.ReceiptHandle)
+			return &sqs.DeleteMessageOutput{}, nil
+		},
+	}
+
+	env := testEnv(map[string]string{"TABLE_NAME": "test-table", "FAILURE_MODE": "best_effort"})
+	p := newProcessor(slog.New(slog.NewJSONHandler(io.Discard, nil)), client, nil, nil, nil, mustLoadConfig(t, env), fixedClock)
+	if err := p.poll(ctx, queue, "https://sqs.us-east-1.amazonaws.com/123456789012/user-dynamo-stream.fifo"); err != nil {
+		t.Fatalf("poll() unexpected error = %v", err)
+	}
+
+	if receives != 2 {
+		t.Errorf("expected 2 receives, got %d", receives)
+	}
+	if want := []string{"receipt-1", "receipt-3"}; !reflect.DeepEqual(deleted, want) {
+		t.Errorf("deleted %v, want %v", deleted, want)
+	}
+}
+
+// Test_poll_failedBatch verifies nothing is deleted when the batch fails as a whole
+func Test_poll_failedBatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := &mockDynamoDBClient{
+		batchWriteItemFunc: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+			return nil, errors.New("throttled")
+		},
+	}
+	queue := &mockQueueClient{
+		receiveMessageFunc: func(ctx context.Context, params *sqs.ReceiveMessageInput, optFns ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error) {
+			cancel()
+			return &sqs.ReceiveMessageOutput{Messages: []sqstypes.Message{
+				{MessageId: aws.String("msg-1"), ReceiptHandle: aws.String("receipt-1"), Body: aws.String(insertBody("USER#123", 1))},
+			}}, nil
+		},
+		deleteMessageFunc: func(ctx context.Context, params *sqs.DeleteMessageInput, optFns ...func(*sqs.Options)) (*sqs.DeleteMessageOutput, error) {
+			t.Error("expected no deletes for a failed batch")
+			return &sqs.DeleteMessageOutput{}, nil
+		},
+	}
+
+	p := newProcessor(slog.New(slog.NewJSONHandler(io.Discard, nil)), client, nil, nil, nil, mustLoadConfig(t, testEnv(map[string]string{"TABLE_NAME": "test-table"})), fixedClock)
+	if err := p.poll(ctx, queue, "https://sqs.us-east-1.amazonaws.com/123456789012/user-dynamo-stream.fifo"); err != nil {
+		t.Fatalf("poll() unexpected error = %v", err)
+	}
+}
+
+// Test_poll_canceledReceive verifies a receive interrupted by shutdown is not reported as an error
+func Test_poll_canceledReceive(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	queue := &mockQueueClient{
+		receiveMessageFunc: func(ctx context.Context, params *sqs.ReceiveMessageInput, optFns ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error) {
+			cancel()
+			return nil, ctx.Err()
+		},
+	}
+
+	p := newProcessor(slog.New(slog.NewJSONHandler(io.Discard, nil)), &mockDynamoDBClient{}, nil, nil, nil, mustLoadConfig(t, testEnv(nil)), fixedClock)
+	if err := p.poll(ctx, queue, "https://sqs.us-east-1.amazonaws.com/123456789012/user-dynamo-stream.fifo"); err != nil {
+		t.Errorf("poll() unexpected error = %v", err)
+	}
+}
+
+// Test_poll_heartbeat verifies the visibility of a batch is extended while processing outlasts
+// the heartbeat interval, and that the heartbeat stops before the batch is deleted
+func Test_poll_heartbeat(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := &mockDynamoDBClient{
+		batchWriteItemFunc: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+			time.Sleep(100 * time.Millisecond)
+			return &dynamodb.BatchWriteItemOutput{}, nil
+		},
+	}
+
+	var mu sync.Mutex
+	var extensions []*sqs.ChangeMessageVisibilityInput
+	var deleted bool
+	queue := &mockQueueClient{
+		receiveMessageFunc: func(ctx context.Context, params *sqs.ReceiveMessageInput, optFns ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error) {
+			cancel()
+			return &sqs.ReceiveMessageOutput{Messages: []sqstypes.Message{
+				{MessageId: aws.String("msg-1"), ReceiptHandle: aws.String("receipt-1"), Body: aws.String(insertBody("USER#123", 1))},
+			}}, nil
+		},
+		deleteMessageFunc: func(ctx context.Context, params *sqs.DeleteMessageInput, optFns ...func(*sqs.Options)) (*sqs.DeleteMessageOutput, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			deleted = true
+			return &sqs.DeleteMessageOutput{}, nil
+		},
+		changeVisibilityFunc: func(ctx context.Context, params *sqs.ChangeMessageVisibilityInput, optFns ...func(*sqs.Options)) (*sqs.ChangeMessageVisibilityOutput, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if deleted {
+				t.Error("expected no visibility extension after the batch was deleted")
+			}
+			extensions = append(extensions, params)
+			return &sqs.ChangeMessageVisibilityOutput{}, nil
+		},
+	}
+
+	env := testEnv(map[string]string{"TABLE_NAME": "test-table", "HEARTBEAT_INTERVAL": "20ms"})
+	p := newProcessor(slog.New(slog.NewJSONHandler(io.Discard, nil)), client, nil, nil, nil, mustLoadConfig(t, env), fixedClock)
+	if err := p.poll(ctx, queue, "https://sqs.us-east-1.amazonaws.com/123456789012/user-dynamo-stream.fifo"); err != nil {
+		t.Fatalf("poll() unexpected error = %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(extensions) == 0 {
+		t.Fatal("expected the visibility to be extended during the slow batch")
+	}
+	for _, e := range extensions {
+		if *e.ReceiptHandle != "receipt-1" || e.VisibilityTimeout != 1 {
+			t.Errorf("unexpected visibility extension %+v", e)
+		}
+	}
+	if !deleted {
+		t.Error("expected the batch to be deleted")
+	}
+}
+
+// Test_poll_receiveError verifies a failed receive is logged and retried with backoff instead of
+// stopping the poller
+func Test_poll_receiveError(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var receives int
+	queue := &mockQueueClient{
+		receiveMessageFunc: func(ctx context.Context, params *sqs.ReceiveMessageInput, optFns ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error) {
+			receives++
+			if receives < 3 {
+				return nil, errors.New("simulated network error")
+			}
+			cancel()
+			return &sqs.ReceiveMessageOutput{}, nil
+		},
+	}
+
+	var buf bytes.Buffer
+	p := newProcessor(slog.New(slog.NewJSONHandler(&buf, nil)), &mockDynamoDBClient{}, nil, nil, nil, mustLoadConfig(t, testEnv(nil)), fixedClock)
+	p.pollRetryDelay = time.Millisecond
+	if err := p.poll(ctx, queue, "https://sqs.us-east-1.amazonaws.com/123456789012/user-dynamo-stream.fifo"); err != nil {
+		t.Fatalf("poll() unexpected error = %v", err)
+	}
+
+	if receives != 3 {
+		t.Errorf("expected polling to continue after 2 failed receives, got %d receives", receives)
+	}
+	if n := len(findLogs(parseLogs(t, &buf), "failed to receive messages")); n != 2 {
+		t.Errorf("expected 2 failed receive logs, got %d", n)
+	}
+}
+
+// Test_pollBackoff verifies the receive backoff doubles with each consecutive failure up to the cap
+func Test_pollBackoff(t *testing.T) {
+	for failures, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 10: maxPollRetryDelay} {
+		if got := pollBackoff(defaultPollRetryDelay, failures); got != want {
+			t.Errorf("pollBackoff(%d) = %v, want %v", failures, got, want)
+		}
+	}
+}
+
+// Test_poll_dryRun verifies a dry run neither deletes processed messages nor dead-letters
+// permanently failing ones
+func Test_poll_dryRun(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	queue := &mockQueueClient{
+		receiveMessageFunc: func(ctx context.Context, params *sqs.ReceiveMessageInput, optFns ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error) {
+			cancel()
+			return &sqs.ReceiveMessageOutput{Messages: []sqstypes.Message{
+				{MessageId: aws.String("msg-1"), ReceiptHandle: aws.String("receipt-1"), Body: aws.String(insertBody("USER#123", 1))},
+				{MessageId: aws.String("msg-2"), ReceiptHandle: aws.String("receipt-2"), Body: aws.String(`{not json`)},
+			}}, nil
+		},
+		deleteMessageFunc: func(ctx context.Context, params *sqs.DeleteMessageInput, optFns ...func(*sqs.Options)) (*sqs.DeleteMessageOutput, error) {
+			t.Errorf("expected no deletes in a dry run, got %s", *params.ReceiptHandle)
+			return &sqs.DeleteMessageOutput{}, nil
+		},
+	}
+	dlq := &mockSQSClient{
+		sendMessageFunc: func(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error) {
+			t.Errorf("expected no dead-letter sends in a dry run, got %s", *params.MessageBody)
+			return &sqs.SendMessageOutput{}, nil
+		},
+	}
+	client := &mockDynamoDBClient{
+		batchWriteItemFunc: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+			t.Error("expected no writes in a dry run")
+			return &dynamodb.BatchWriteItemOutput{}, nil
+		},
+	}
+
+	env := testEnv(map[string]string{"TABLE_NAME": "test-table", "DRY_RUN": "true", "DLQ_URL": "https://sqs.us-east-1.amazonaws.com/123456789012/user-dynamo-stream-deadletter"})
+	p := newProcessor(slog.New(slog.NewJSONHandler(io.Discard, nil)), client, dlq, nil, nil, mustLoadConfig(t, env), fixedClock)
+	if err := p.poll(ctx, queue, "https://sqs.us-east-1.amazonaws.com/123456789012/user-dynamo-stream.fifo"); err != nil {
+		t.Fatalf("poll() unexpected error = %v", err)
+	}
+}
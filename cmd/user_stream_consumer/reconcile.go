@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// reconcileMemberships returns the organizations the reverse index holds a membership for,
+// standing in for the old image of a REMOVE record that does not carry one. Every page of the
+// user's reverse index partition is read; a failed Query is retryable. With ENCODE_IDS, the
+// partition is read by the encoded user ID and the organization IDs are decoded.
+func (p *processor) reconcileMemberships(ctx context.Context, inv *invocation, userPK string) ([]string, error) {
+	if userPK == "" {
+		return nil, nil
+	}
+
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(p.reverseIndexTable),
+		KeyConditionExpression: aws.String("pk = :pk"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":pk": &types.AttributeValueMemberS{Value: fmt.Sprintf("USER#%s", extractUserID(membershipAttributes{EncodeIDs: p.encodeIDs}.keyUserPK(userPK)))},
+		},
+		// Tombstones left by SEQUENCE_CONDITIONS deletes are not memberships.
+		FilterExpression:         aws.String("attribute_not_exists(#deleted)"),
+		ExpressionAttributeNames: map[string]string{"#deleted": tombstoneAttribute},
+		ProjectionExpression:     aws.String("sk"),
+	}
+
+	var orgs []string
+	for {
+		out, err := p.client.Query(ctx, input)
+		if err != nil {
+			p.logger.ErrorContext(ctx, "failed to query reverse index memberships",
+				slog.String("error", err.Error()),
+				slog.String("table", p.reverseIndexTable),
+				slog.String("userId", extractUserID(userPK)))
+			return nil, fmt.Errorf("failed to reconcile memberships for %s: %w", userPK, err)
+		}
+		for _, item := range out.Items {
+			sk, ok := item["sk"].(*types.AttributeValueMemberS)
+			if !ok {
+				continue
+			}
+			org, ok := strings.CutPrefix(sk.Value, "ORGANIZATION#")
+			if !ok {
+				continue
+			}
+			if p.encodeIDs {
+				decoded, err := decodeID(org)
+				if err != nil {
+					p.logger.WarnContext(ctx, "skipping reverse index membership with an undecodable organization ID",
+						slog.String("error", err.Error()),
+						slog.String("sk", sk.Value))
+					continue
+				}
+				org = decoded
+			}
+			orgs = append(orgs, org)
+		}
+		if len(out.LastEvaluatedKey) == 0 {
+			break
+		}
+		input.ExclusiveStartKey = out.LastEvaluatedKey
+	}
+
+	p.logger.InfoContext(ctx, "reconciled memberships from the reverse index",
+		slog.String("userId", extractUserID(userPK)),
+		slog.Int("organizations", len(orgs)))
+	inv.metrics.increment("ReconciledRemoves", 1)
+	return orgs, nil
+}
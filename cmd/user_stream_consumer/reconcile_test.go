@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Test_handler_reconcileRemoves verifies a REMOVE record without an old image deletes every
+// membership the reverse index holds for the user, across Query pages
+func Test_handler_reconcileRemoves(t *testing.T) {
+	pages := []*dynamodb.QueryOutput{
+		{
+			Items: []map[string]types.AttributeValue{
+				{"pk": &types.AttributeValueMemberS{Value: "USER#123"}, "sk": &types.AttributeValueMemberS{Value: "ORGANIZATION#org1"}},
+			},
+			LastEvaluatedKey: map[string]types.AttributeValue{
+				"pk": &types.AttributeValueMemberS{Value: "USER#123"}, "sk": &types.AttributeValueMemberS{Value: "ORGANIZATION#org1"},
+			},
+		},
+		{
+			Items: []map[string]types.AttributeValue{
+				{"pk": &types.AttributeValueMemberS{Value: "USER#123"}, "sk": &types.AttributeValueMemberS{Value: "ORGANIZATION#org2"}},
+			},
+		},
+	}
+
+	var queries int
+	var deleted []string
+	client := &mockDynamoDBClient{
+		queryFunc: func(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error) {
+			if *params.TableName != "reverse-table" {
+				t.Errorf("expected Query on reverse-table, got %s", *params.TableName)
+			}
+			if pk := params.ExpressionAttributeValues[":pk"].(*types.AttributeValueMemberS).Value; pk != "USER#123" {
+				t.Errorf("expected Query for USER#123, got %s", pk)
+			}
+			if (queries == 0) != (params.ExclusiveStartKey == nil) {
+				t.Errorf("query %d: unexpected ExclusiveStartKey %v", queries, params.ExclusiveStartKey)
+			}
+			page := pages[queries]
+			queries++
+			return page, nil
+		},
+		batchWriteItemFunc: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+			for _, req := range params.RequestItems["test-table"] {
+				if req.DeleteRequest == nil {
+					t.Errorf("expected only deletes, got %v", req)
+					continue
+				}
+				deleted = append(deleted, req.DeleteRequest.Key["pk"].(*types.AttributeValueMemberS).Value)
+			}
+			if n := len(params.RequestItems["reverse-table"]); n != 2 {
+				t.Errorf("expected 2 reverse index deletes, got %d", n)
+			}
+			return &dynamodb.BatchWriteItemOutput{}, nil
+		},
+	}
+
+	env := testEnv(map[string]string{"TABLE_NAME": "test-table", "REVERSE_INDEX_TABLE": "reverse-table", "RECONCILE_REMOVES": "true"})
+	h := handler(slog.New(slog.NewJSONHandler(io.Discard, nil)), client, nil, nil, nil, mustLoadConfig(t, env), fixedClock, nil)
+	_, err := h(context.Background(), events.SQSEvent{Records: []events.SQSMessage{
+		{MessageId: "remove", Body: `{"eventName": "REMOVE", "dynamodb": {"Keys": {"pk": {"S": "USER#123"}, "sk": {"S": "METADATA"}}}}`},
+	}})
+	if err != nil {
+		t.Fatalf("handler() unexpected error = %v", err)
+	}
+	if queries != 2 {
+		t.Errorf("expected 2 queries, got %d", queries)
+	}
+	if want := []string{"ORGANIZATION#org1", "ORGANIZATION#org2"}; !reflect.DeepEqual(deleted, want) {
+		t.Errorf("deleted %v, want %v", deleted, want)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// emailPattern matches email addresses embedded in logged text, such as a raw message body.
+var emailPattern = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`)
+
+// maskEmail masks an email address down to the first character of its local part and domain,
+// keeping the top-level domain, so "jane@doe.com" becomes "j***@d***.com".
+func maskEmail(email string) string {
+	local, domain, ok := strings.Cut(email, "@")
+	if !ok || local == "" || domain == "" {
+		return email
+	}
+	masked := local[:1] + "***@" + domain[:1] + "***"
+	if i := strings.LastIndex(domain, "."); i > 0 {
+		masked += domain[i:]
+	}
+	return masked
+}
+
+// redactEmails masks every email address in s.
+func redactEmails(s string) string {
+	return emailPattern.ReplaceAllStringFunc(s, maskEmail)
+}
+
+// redact masks email addresses in user data about to be logged when email redaction is enabled.
+// Values written to DynamoDB are never passed through it.
+func (p *processor) redact(s string) string {
+	if !p.redactEmail {
+		return s
+	}
+	return redactEmails(s)
+}
+
+// redactRequests returns copies of requests with email addresses in their string attributes
+// masked, leaving the original requests untouched for writing.
+func redactRequests(requests []types.WriteRequest) []types.WriteRequest {
+	redacted := make([]types.WriteRequest, 0, len(requests))
+	for _, req := range requests {
+		switch {
+		case req.PutRequest != nil:
+			req = types.WriteRequest{PutRequest: &types.PutRequest{Item: redactItem(req.PutRequest.Item)}}
+		case req.DeleteRequest != nil:
+			req = types.WriteRequest{DeleteRequest: &types.DeleteRequest{Key: redactItem(req.DeleteRequest.Key)}}
+		}
+		redacted = append(redacted, req)
+	}
+	return redacted
+}
+
+// redactItem returns a copy of item with email addresses in its String attributes masked.
+func redactItem(item map[string]types.AttributeValue) map[string]types.AttributeValue {
+	redacted := make(map[string]types.AttributeValue, len(item))
+	for name, value := range item {
+		if s, ok := value.(*types.AttributeValueMemberS); ok {
+			value = &types.AttributeValueMemberS{Value: redactEmails(s.Value)}
+		}
+		redacted[name] = value
+	}
+	return redacted
+}
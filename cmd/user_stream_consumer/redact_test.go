@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Test_maskEmail verifies email addresses are masked down to their first characters
+func Test_maskEmail(t *testing.T) {
+	tests := []struct {
+		email string
+		want  string
+	}{
+		{email: "jane@doe.com", want: "j***@d***.com"},
+		{email: "j.smith+test@mail.example.co.uk", want: "j***@m***.uk"},
+		{email: "admin@localhost", want: "a***@l***"},
+		{email: "not-an-email", want: "not-an-email"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.email, func(t *testing.T) {
+			if got := maskEmail(tt.email); got != tt.want {
+				t.Errorf("maskEmail(%q) = %q, want %q", tt.email, got, tt.want)
+			}
+		})
+	}
+}
+
+// Test_handler_redactEmail verifies emails are masked in log output while the real value is
+// still written to DynamoDB
+func Test_handler_redactEmail(t *testing.T) {
+	var written string
+	client := &mockDynamoDBClient{
+		batchWriteItemFunc: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+			written = params.RequestItems["test-table"][0].PutRequest.Item["email"].(*types.AttributeValueMemberS).Value
+			return &dynamodb.BatchWriteItemOutput{}, nil
+		},
+	}
+
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	env := testEnv(map[string]string{"TABLE_NAME": "test-table", "PROJECT_ATTRIBUTES": "email", "REDACT_EMAIL": "true"})
+	h := handler(logger, client, nil, nil, nil, mustLoadConfig(t, env), fixedClock, nil)
+	_, err := h(context.Background(), events.SQSEvent{Records: []events.SQSMessage{
+		{MessageId: "insert", Body: `{"eventName": "INSERT", "dynamodb": {"NewImage": {"pk": {"S": "USER#123"}, "email": {"S": "jane@doe.com"}, "modified_by": {"S": "admin@doe.com"}, "organizations": {"L": [{"S": "org1"}]}}}}`},
+	}})
+	if err != nil {
+		t.Fatalf("handler() unexpected error = %v", err)
+	}
+
+	if written != "jane@doe.com" {
+		t.Errorf("expected the full email to be written, got %q", written)
+	}
+	output := buf.String()
+	if strings.Contains(output, "jane@doe.com") || strings.Contains(output, "admin@doe.com") {
+		t.Errorf("expected no unmasked emails in logs, got %s", output)
+	}
+
+	logs := parseLogs(t, &buf)
+	input := findLogs(logs, "batch write input")
+	if len(input) != 1 {
+		t.Fatalf("expected 1 batch write input log, got %d", len(input))
+	}
+	if logged, _ := json.Marshal(input[0]); !strings.Contains(string(logged), "j***@d***.com") {
+		t.Errorf("expected the masked email in the batch write input log, got %s", logged)
+	}
+	if processing := findLogs(logs, "processing dynamo event record"); len(processing) != 1 || processing[0]["actor"] != "a***@d***.com" {
+		t.Errorf("expected a masked actor, got %v", processing)
+	}
+}
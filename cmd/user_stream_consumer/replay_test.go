@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+)
+
+// Test_replay verifies every line of a replay file is processed, blank lines are ignored, and a
+// failing record does not stop the replay
+func Test_replay(t *testing.T) {
+	var writes int
+	client := &mockDynamoDBClient{
+		batchWriteItemFunc: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+			writes++
+			return &dynamodb.BatchWriteItemOutput{}, nil
+		},
+	}
+	var buf bytes.Buffer
+	p := newProcessor(slog.New(slog.NewJSONHandler(&buf, nil)), client, nil, nil, nil, mustLoadConfig(t, testEnv(map[string]string{"TABLE_NAME": "test-table"})), fixedClock)
+
+	records := strings.Join([]string{
+		strings.ReplaceAll(insertBody("USER#1", 2), "\n", ""),
+		"",
+		`{not json`,
+		strings.ReplaceAll(insertBody("USER#2", 1), "\n", ""),
+	}, "\n")
+
+	res, err := p.replay(context.Background(), strings.NewReader(records))
+	if err == nil || err.Error() != "1 of 3 records failed to replay" {
+		t.Errorf("replay() error = %v, want 1 of 3 records failed", err)
+	}
+	if res.Processed != 2 || res.Failed != 1 || res.Adds != 3 {
+		t.Errorf("replay() = %+v, want 2 processed, 1 failed and 3 adds", res)
+	}
+	if writes != 2 {
+		t.Errorf("expected 2 batch writes, got %d", writes)
+	}
+
+	logs := parseLogs(t, &buf)
+	if failures := findLogs(logs, "failed to replay record"); len(failures) != 1 || failures[0]["line"] != 3.0 {
+		t.Errorf("expected a replay failure for line 3, got %v", failures)
+	}
+	if summaries := findLogs(logs, "replay summary"); len(summaries) != 1 || summaries[0]["processed"] != 2.0 {
+		t.Errorf("expected a replay summary with 2 processed, got %v", summaries)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// replica is a regional copy of the organizations table that membership writes are fanned
+// out to, for multi-region deployments that do not use DynamoDB Global Tables.
+type replica struct {
+	region    string
+	tableName string
+	client    dynamoDBClient
+}
+
+// parseReplicaTables parses a comma-separated list of region=table pairs, such as
+// "us-west-2=poc-organizations,eu-west-1=poc-organizations", creating a client for each
+// region with newClient. An empty value yields no replicas.
+func parseReplicaTables(value string, newClient func(region string) dynamoDBClient) ([]replica, error) {
+	var replicas []replica
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		region, tableName, ok := strings.Cut(entry, "=")
+		region, tableName = strings.TrimSpace(region), strings.TrimSpace(tableName)
+		if !ok || region == "" || tableName == "" {
+			return nil, fmt.Errorf("invalid replica table %q: expected region=table", entry)
+		}
+		replicas = append(replicas, replica{region: region, tableName: tableName, client: newClient(region)})
+	}
+	return replicas, nil
+}
+
+// writeReplicas writes the membership requests to every replica table. Each region is written
+// independently so one region's outage does not block the others; failures are logged and
+// counted as degraded replication rather than failing the record.
+func (p *processor) writeReplicas(ctx context.Context, inv *invocation, writeRequests []types.WriteRequest) {
+	writeRequests, _ = dedupeWriteRequests(writeRequests)
+	for _, r := range p.replicas {
+		if err := p.writeReplica(ctx, inv, r, writeRequests); err != nil {
+			p.logger.WarnContext(ctx, "degraded replication: failed to write replica memberships",
+				slog.String("error", err.Error()),
+				slog.String("region", r.region),
+				slog.String("table", r.tableName),
+				slog.Int("requestCount", len(writeRequests)))
+			inv.metrics.increment("ReplicaWriteFailures", 1)
+			continue
+		}
+		inv.metrics.increment("ReplicaWrites", 1)
+	}
+}
+
+// acceptedWrites returns the write requests whose key is not among those the primary table
+// refused, such as a delete OWNED_DELETES left in place or a put SEQUENCE_CONDITIONS found
+// superseded, so replicas only receive the writes the primary applied.
+func acceptedWrites(writeRequests, refused []types.WriteRequest) []types.WriteRequest {
+	if len(refused) == 0 {
+		return writeRequests
+	}
+	keys := make(map[string]bool, len(refused))
+	for _, req := range refused {
+		keys[writeRequestKey(req)] = true
+	}
+	return slices.DeleteFunc(slices.Clone(writeRequests), func(req types.WriteRequest) bool {
+		return keys[writeRequestKey(req)]
+	})
+}
+
+// writeReplica writes deduplicated requests to a single replica table in chunks of
+// maxBatchWriteItems, as batchWrite does for the primary table. UnprocessedItems are retried
+// with backoff while the invocation's retry budget lasts, so a throttled replica is reported as
+// failed rather than silently missing the items.
+func (p *processor) writeReplica(ctx context.Context, inv *invocation, r replica, writeRequests []types.WriteRequest) error {
+	for start := 0; start < len(writeRequests); start += maxBatchWriteItems {
+		end := min(start+maxBatchWriteItems, len(writeRequests))
+		requestItems := map[string][]types.WriteRequest{r.tableName: writeRequests[start:end]}
+		for attempt := 0; ; attempt++ {
+			if attempt > 0 {
+				if inv.retries >= p.retryBudget {
+					return fmt.Errorf("retry budget exhausted with %d unprocessed replica membership writes", countRequests(requestItems))
+				}
+				inv.retries++
+				if err := sleep(ctx, retryDelay(p.retryBaseDelay, attempt)); err != nil {
+					return fmt.Errorf("failed to retry unprocessed replica memberships: %w", err)
+				}
+			}
+			out, err := r.client.BatchWriteItem(ctx, &dynamodb.BatchWriteItemInput{RequestItems: requestItems})
+			if err != nil {
+				return err
+			}
+			if out == nil || len(out.UnprocessedItems) == 0 {
+				break
+			}
+			requestItems = out.UnprocessedItems
+		}
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Test_parseReplicaTables verifies region=table pairs are parsed into replicas
+func Test_parseReplicaTables(t *testing.T) {
+	tests := []struct {
+		name        string
+		value       string
+		wantRegions []string
+		wantErr     bool
+	}{
+		{
+			name:        "two replicas",
+			value:       "us-west-2=orgs-west, eu-west-1=orgs-eu",
+			wantRegions: []string{"us-west-2", "eu-west-1"},
+		},
+		{
+			name:  "empty value",
+			value: "",
+		},
+		{
+			name:    "missing table",
+			value:   "us-west-2",
+			wantErr: true,
+		},
+		{
+			name:    "missing region",
+			value:   "=orgs-west",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var created []string
+			replicas, err := parseReplicaTables(tt.value, func(region string) dynamoDBClient {
+				created = append(created, region)
+				return &mockDynamoDBClient{}
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseReplicaTables() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(replicas) != len(tt.wantRegions) || len(created) != len(tt.wantRegions) {
+				t.Fatalf("expected %d replicas, got %d", len(tt.wantRegions), len(replicas))
+			}
+			for i, r := range replicas {
+				if r.region != tt.wantRegions[i] {
+					t.Errorf("replica %d: got region %s, want %s", i, r.region, tt.wantRegions[i])
+				}
+			}
+		})
+	}
+}
+
+// Test_handler_replicaFailureIsolation verifies one failing region does not block writes to the others
+func Test_handler_replicaFailureIsolation(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, nil))
+
+	ok := func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+		return &dynamodb.BatchWriteItemOutput{}, nil
+	}
+	var westWrites int
+	replicas := []replica{
+		{
+			region:    "eu-west-1",
+			tableName: "orgs-eu",
+			client: &mockDynamoDBClient{batchWriteItemFunc: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+				return nil, errors.New("simulated regional outage")
+			}},
+		},
+		{
+			region:    "us-west-2",
+			tableName: "orgs-west",
+			client: &mockDynamoDBClient{batchWriteItemFunc: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+				westWrites += len(params.RequestItems["orgs-west"])
+				return &dynamodb.BatchWriteItemOutput{}, nil
+			}},
+		},
+	}
+
+	h := handler(logger, &mockDynamoDBClient{batchWriteItemFunc: ok}, nil, nil, replicas, mustLoadConfig(t, testEnv(map[string]string{"TABLE_NAME": "test-table"})), fixedClock, nil)
+	_, err := h(context.Background(), events.SQSEvent{Records: []events.SQSMessage{{Body: insertBody("USER#123", 2)}}})
+	if err != nil {
+		t.Fatalf("handler() unexpected error = %v", err)
+	}
+
+	if westWrites != 2 {
+		t.Errorf("expected 2 writes to the healthy replica, got %d", westWrites)
+	}
+	logs := parseLogs(t, &buf)
+	degraded := findLogs(logs, "degraded replication: failed to write replica memberships")
+	if len(degraded) != 1 || degraded[0]["region"] != "eu-west-1" {
+		t.Errorf("expected degraded replication logged for eu-west-1, got %v", degraded)
+	}
+	metrics := findLogs(logs, "metrics")
+	if len(metrics) != 1 || metrics[0]["ReplicaWriteFailures"] != 1.0 || metrics[0]["ReplicaWrites"] != 1.0 {
+		t.Errorf("expected 1 replica failure and 1 replica write, got %v", metrics)
+	}
+}
+
+// Test_writeReplicas_chunking verifies replica writes are deduplicated, chunked to the
+// BatchWriteItem limit and have their unprocessed items retried
+func Test_writeReplicas_chunking(t *testing.T) {
+	var batches [][]types.WriteRequest
+	client := &mockDynamoDBClient{batchWriteItemFunc: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+		requests := params.RequestItems["orgs-west"]
+		batches = append(batches, requests)
+		if len(batches) == 1 {
+			return &dynamodb.BatchWriteItemOutput{UnprocessedItems: map[string][]types.WriteRequest{"orgs-west": requests[:2]}}, nil
+		}
+		return &dynamodb.BatchWriteItemOutput{}, nil
+	}}
+	p := &processor{
+		logger:      slog.New(slog.NewJSONHandler(io.Discard, nil)),
+		replicas:    []replica{{region: "us-west-2", tableName: "orgs-west", client: client}},
+		retryBudget: defaultRetryBudget,
+	}
+
+	orgs := make([]string, 30)
+	for i := range orgs {
+		orgs[i] = fmt.Sprintf("org%02d", i)
+	}
+	writeRequests := append(createWriteRequests("USER#123", orgs[:1], membershipAttributes{}, true),
+		createWriteRequests("USER#123", orgs, membershipAttributes{}, false)...)
+	inv := newInvocation()
+	p.writeReplicas(context.Background(), inv, writeRequests)
+
+	sizes := make([]int, len(batches))
+	for i, batch := range batches {
+		sizes[i] = len(batch)
+	}
+	if want := []int{25, 2, 5}; !slices.Equal(sizes, want) {
+		t.Fatalf("expected batches of %v requests, got %v", want, sizes)
+	}
+	for _, req := range batches[0] {
+		if req.DeleteRequest != nil {
+			t.Errorf("expected the delete to be replaced by the later put, got %v", req.DeleteRequest.Key)
+		}
+	}
+	if inv.metrics.count("ReplicaWrites") != 1 || inv.metrics.count("ReplicaWriteFailures") != 0 {
+		t.Errorf("expected 1 replica write and no failures, got %v", inv.metrics.values)
+	}
+}
+
+// Test_writeReplicas_retryBudget verifies a replica whose unprocessed items outlast the retry
+// budget is counted as a failed replica write
+func Test_writeReplicas_retryBudget(t *testing.T) {
+	client := &mockDynamoDBClient{batchWriteItemFunc: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+		return &dynamodb.BatchWriteItemOutput{UnprocessedItems: params.RequestItems}, nil
+	}}
+	p := &processor{
+		logger:   slog.New(slog.NewJSONHandler(io.Discard, nil)),
+		replicas: []replica{{region: "us-west-2", tableName: "orgs-west", client: client}},
+	}
+
+	inv := newInvocation()
+	p.writeReplicas(context.Background(), inv, createWriteRequests("USER#123", []string{"org1"}, membershipAttributes{}, false))
+
+	if inv.metrics.count("ReplicaWrites") != 0 || inv.metrics.count("ReplicaWriteFailures") != 1 {
+		t.Errorf("expected 1 replica failure and no writes, got %v", inv.metrics.values)
+	}
+}
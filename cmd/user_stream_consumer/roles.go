@@ -0,0 +1,95 @@
+package main
+
+import (
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// membershipRoles returns the roles membership items are written for in an organization, where
+// an empty role is the single item without a role suffix. Without RoleSKs, or when the
+// organization lists no roles, only that item is written. Deletes also remove the unsuffixed
+// item alongside every role listed, since it may have been written before the user had roles
+// or before ROLE_MEMBERSHIPS was enabled.
+func membershipRoles(attrs membershipAttributes, orgID string, isDelete bool) []string {
+	roles := attrs.Metadata[orgID].Roles
+	if !attrs.RoleSKs || len(roles) == 0 {
+		return []string{""}
+	}
+	if isDelete {
+		return append([]string{""}, roles...)
+	}
+	return roles
+}
+
+// createRoleChangeRequests creates the write requests that rewrite the memberships of
+// organizations whose roles changed. Each organization's current role items are put with attrs,
+// and only the role items from oldAttrs it no longer holds are deleted, so a role held before
+// and after is a single put rather than a delete and a put.
+func createRoleChangeRequests(userPK string, organizations []string, oldAttrs, attrs membershipAttributes) []types.WriteRequest {
+	if len(organizations) == 0 {
+		return nil
+	}
+	puts := createWriteRequests(userPK, organizations, attrs, false)
+	kept := make(map[string]bool, len(puts))
+	for _, req := range puts {
+		kept[writeRequestKey(req)] = true
+	}
+	var requests []types.WriteRequest
+	for _, req := range createWriteRequests(userPK, organizations, oldAttrs, true) {
+		if !kept[writeRequestKey(req)] {
+			requests = append(requests, req)
+		}
+	}
+	return append(requests, puts...)
+}
+
+// roleSK appends a role to a membership sort key, as <sk>#<role>. sk is returned unchanged
+// when role is empty.
+func roleSK(sk, role string) string {
+	if role == "" {
+		return sk
+	}
+	return sk + "#" + role
+}
+
+// extractRoles reads role names from a list of strings or a string set. Other element and
+// attribute types are ignored.
+func extractRoles(attr events.DynamoDBAttributeValue) []string {
+	switch attr.DataType() {
+	case events.DataTypeStringSet:
+		return attr.StringSet()
+	case events.DataTypeList:
+		var roles []string
+		for _, role := range attr.List() {
+			if role.DataType() == events.DataTypeString && role.String() != "" {
+				roles = append(roles, role.String())
+			}
+		}
+		return roles
+	default:
+		return nil
+	}
+}
+
+// roleChangedOrgs returns the organizations held in both the old and new images whose roles
+// differ between them, in newOrgs order. Roles only shape membership items with
+// ROLE_MEMBERSHIPS, so nil is returned when it is disabled.
+func (p *processor) roleChangedOrgs(oldMetadata, newMetadata map[string]organizationMetadata, oldOrgs, newOrgs []string) []string {
+	if !p.roleMemberships {
+		return nil
+	}
+	held := make(map[string]struct{}, len(oldOrgs))
+	for _, org := range oldOrgs {
+		held[org] = struct{}{}
+	}
+	var changed []string
+	for _, org := range newOrgs {
+		if _, ok := held[org]; !ok {
+			continue
+		}
+		if !sameOrganizations(oldMetadata[org].Roles, newMetadata[org].Roles) {
+			changed = append(changed, org)
+		}
+	}
+	return changed
+}
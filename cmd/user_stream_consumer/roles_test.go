@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Test_handler_roleMemberships verifies ROLE_MEMBERSHIPS writes a membership item per role a
+// user holds in an organization and deletes every role variant of a removed membership
+func Test_handler_roleMemberships(t *testing.T) {
+	const roles = `{"M": {"org1": {"M": {"roles": {"L": [{"S": "admin"}, {"S": "viewer"}]}}}}}`
+	tests := []struct {
+		name string
+		body string
+		want []string
+	}{
+		{
+			name: "insert writes an item per role",
+			body: `{"eventName": "INSERT", "dynamodb": {"NewImage": {"pk": {"S": "USER#123"}, "organizations": ` + roles + `}}}`,
+			want: []string{"put MEMBERSHIP#123#admin admin", "put MEMBERSHIP#123#viewer viewer"},
+		},
+		{
+			name: "remove deletes every role variant",
+			body: `{"eventName": "REMOVE", "dynamodb": {"OldImage": {"pk": {"S": "USER#123"}, "organizations": ` + roles + `}}}`,
+			want: []string{"delete MEMBERSHIP#123", "delete MEMBERSHIP#123#admin", "delete MEMBERSHIP#123#viewer"},
+		},
+		{
+			name: "modify rewrites a membership whose roles changed",
+			body: `{"eventName": "MODIFY", "dynamodb": {
+				"OldImage": {"pk": {"S": "USER#123"}, "organizations": ` + roles + `},
+				"NewImage": {"pk": {"S": "USER#123"}, "organizations": {"M": {"org1": {"M": {"roles": {"SS": ["admin"]}}}}}}}}`,
+			want: []string{"delete MEMBERSHIP#123", "delete MEMBERSHIP#123#viewer", "put MEMBERSHIP#123#admin admin"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var writes []string
+			client := &mockDynamoDBClient{batchWriteItemFunc: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+				for _, req := range params.RequestItems["test-table"] {
+					if req.DeleteRequest != nil {
+						writes = append(writes, "delete "+req.DeleteRequest.Key["sk"].(*types.AttributeValueMemberS).Value)
+						continue
+					}
+					item := req.PutRequest.Item
+					writes = append(writes, "put "+item["sk"].(*types.AttributeValueMemberS).Value+" "+item["role"].(*types.AttributeValueMemberS).Value)
+				}
+				return &dynamodb.BatchWriteItemOutput{}, nil
+			}}
+
+			env := testEnv(map[string]string{"TABLE_NAME": "test-table", "ROLE_MEMBERSHIPS": "true"})
+			h := handler(slog.New(slog.NewJSONHandler(io.Discard, nil)), client, nil, nil, nil, mustLoadConfig(t, env), fixedClock, nil)
+			if _, err := h(context.Background(), events.SQSEvent{Records: []events.SQSMessage{{Body: tt.body}}}); err != nil {
+				t.Fatalf("handler() unexpected error = %v", err)
+			}
+
+			sort.Strings(writes)
+			if !reflect.DeepEqual(writes, tt.want) {
+				t.Errorf("writes = %v, want %v", writes, tt.want)
+			}
+		})
+	}
+}
+
+// Test_membershipRoles verifies the role variants written for puts and deletes
+func Test_membershipRoles(t *testing.T) {
+	metadata := map[string]organizationMetadata{"org1": {Roles: []string{"admin", "viewer"}}}
+	tests := []struct {
+		name     string
+		attrs    membershipAttributes
+		isDelete bool
+		want     []string
+	}{
+		{name: "disabled", attrs: membershipAttributes{Metadata: metadata}, want: []string{""}},
+		{name: "put", attrs: membershipAttributes{RoleSKs: true, Metadata: metadata}, want: []string{"admin", "viewer"}},
+		{name: "delete", attrs: membershipAttributes{RoleSKs: true, Metadata: metadata}, isDelete: true, want: []string{"", "admin", "viewer"}},
+		{name: "no roles", attrs: membershipAttributes{RoleSKs: true}, want: []string{""}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := membershipRoles(tt.attrs, "org1", tt.isDelete); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("membershipRoles() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// Test_handler_roleChange verifies a membership whose roles changed is counted and audited as
+// a single role change rather than a removal and an addition
+func Test_handler_roleChange(t *testing.T) {
+	const body = `{"eventName": "MODIFY", "dynamodb": {
+		"OldImage": {"pk": {"S": "USER#123"}, "organizations": {"M": {"org1": {"M": {"roles": {"SS": ["viewer"]}}}}}},
+		"NewImage": {"pk": {"S": "USER#123"}, "organizations": {"M": {"org1": {"M": {"roles": {"SS": ["admin"]}}}}}}}}`
+	client := &mockDynamoDBClient{batchWriteItemFunc: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+		return &dynamodb.BatchWriteItemOutput{}, nil
+	}}
+
+	var buf bytes.Buffer
+	var results []result
+	env := testEnv(map[string]string{"TABLE_NAME": "test-table", "ROLE_MEMBERSHIPS": "true", "AUDIT_EVENTS": "true"})
+	h := handler(slog.New(slog.NewJSONHandler(&buf, nil)), client, nil, nil, nil, mustLoadConfig(t, env), fixedClock, func(r result) { results = append(results, r) })
+	if _, err := h(context.Background(), events.SQSEvent{Records: []events.SQSMessage{{Body: body}}}); err != nil {
+		t.Fatalf("handler() unexpected error = %v", err)
+	}
+
+	if want := []result{{Processed: 1, Updates: 1}}; !reflect.DeepEqual(results, want) {
+		t.Errorf("results = %+v, want %+v", results, want)
+	}
+	audit := findLogs(parseLogs(t, &buf), "membership audit event")
+	if len(audit) != 1 || audit[0]["action"] != auditActionRoleChange || audit[0]["organizationId"] != "org1" {
+		t.Errorf("expected a single role_change audit event for org1, got %v", audit)
+	}
+}
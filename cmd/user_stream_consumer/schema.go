@@ -0,0 +1,10 @@
+package main
+
+// membershipSchemaVersion is written as schemaVersion on every membership put, so readers can
+// tell which shape of item they are looking at. Bump it whenever the item shape changes in a way
+// readers must account for and note the change below; readers can branch on schemaVersion, with
+// items written before versions were stamped carrying none and having version 1's shape.
+//
+//   - 1: pk and sk, with the optional role, createdAt, joinedAt, gsi1pk, gsi1sk, version and
+//     source attributes and any projected user attributes
+const membershipSchemaVersion = 1
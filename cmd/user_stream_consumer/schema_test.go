@@ -0,0 +1,31 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Test_createWriteRequests_schemaVersion verifies every membership put is stamped with the
+// current schema version and deletes are left as bare keys
+func Test_createWriteRequests_schemaVersion(t *testing.T) {
+	puts := createWriteRequests("USER#123", []string{"org1", "org2"}, membershipAttributes{GSIKeys: true, Version: true}, false)
+	if len(puts) != 2 {
+		t.Fatalf("expected 2 put requests, got %d", len(puts))
+	}
+	for _, req := range puts {
+		v, ok := req.PutRequest.Item["schemaVersion"].(*types.AttributeValueMemberN)
+		if !ok {
+			t.Fatalf("expected a number schemaVersion attribute, got %v", req.PutRequest.Item["schemaVersion"])
+		}
+		if want := strconv.Itoa(membershipSchemaVersion); v.Value != want {
+			t.Errorf("schemaVersion = %s, want %s", v.Value, want)
+		}
+	}
+
+	deletes := createWriteRequests("USER#123", []string{"org1"}, membershipAttributes{}, true)
+	if _, ok := deletes[0].DeleteRequest.Key["schemaVersion"]; ok {
+		t.Error("expected delete keys without schemaVersion")
+	}
+}
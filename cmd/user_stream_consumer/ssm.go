@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+// ssmClient defines the SSM Parameter Store operations used to resolve configuration.
+type ssmClient interface {
+	GetParameter(ctx context.Context, params *ssm.GetParameterInput, optFns ...func(*ssm.Options)) (*ssm.GetParameterOutput, error)
+}
+
+// resolveTableName returns cfg with TableName read from the SSM parameter named by
+// TABLE_NAME_PARAM, for platforms that distribute table names through Parameter Store. It is
+// resolved once at startup, so the value is cached for the life of the execution environment
+// and a changed parameter takes effect on the next cold start. cfg is returned unchanged, keeping
+// TABLE_NAME, when no parameter is configured. The resolved table is held to
+// ALLOWED_TABLE_PREFIX in the local environment, like TABLE_NAME.
+func resolveTableName(ctx context.Context, client ssmClient, cfg config) (config, error) {
+	if cfg.TableNameParam == "" {
+		return cfg, nil
+	}
+	out, err := client.GetParameter(ctx, &ssm.GetParameterInput{
+		Name:           aws.String(cfg.TableNameParam),
+		WithDecryption: aws.Bool(true),
+	})
+	if err != nil {
+		return cfg, fmt.Errorf("failed to get parameter %s: %w", cfg.TableNameParam, err)
+	}
+	if out.Parameter == nil || aws.ToString(out.Parameter.Value) == "" {
+		return cfg, fmt.Errorf("parameter %s has no value", cfg.TableNameParam)
+	}
+	table := aws.ToString(out.Parameter.Value)
+	if cfg.Environment == environmentLocal && !strings.HasPrefix(table, cfg.AllowedTablePrefix) {
+		return cfg, fmt.Errorf("parameter %s table %q does not start with ALLOWED_TABLE_PREFIX %q in the local environment", cfg.TableNameParam, table, cfg.AllowedTablePrefix)
+	}
+	cfg.TableName = table
+	return cfg, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+)
+
+// mockSSMClient serves parameters from a map, failing with err when it is set.
+type mockSSMClient struct {
+	parameters map[string]string
+	err        error
+	calls      int
+}
+
+func (m *mockSSMClient) GetParameter(ctx context.Context, params *ssm.GetParameterInput, optFns ...func(*ssm.Options)) (*ssm.GetParameterOutput, error) {
+	m.calls++
+	if m.err != nil {
+		return nil, m.err
+	}
+	value, ok := m.parameters[*params.Name]
+	if !ok {
+		return nil, &ssmtypes.ParameterNotFound{}
+	}
+	return &ssm.GetParameterOutput{Parameter: &ssmtypes.Parameter{Name: params.Name, Value: aws.String(value)}}, nil
+}
+
+// Test_resolveTableName verifies TABLE_NAME_PARAM overrides TABLE_NAME with the parameter's
+// value, and that TABLE_NAME is kept without making a call when it is unset
+func Test_resolveTableName(t *testing.T) {
+	parameters := map[string]string{"/platform/organizations-table": "platform-organizations", "/platform/empty": ""}
+	tests := []struct {
+		name      string
+		env       map[string]string
+		err       error
+		want      string
+		wantCalls int
+		wantErr   string
+	}{
+		{
+			name:      "parameter",
+			env:       map[string]string{"TABLE_NAME": "ignored", "TABLE_NAME_PARAM": "/platform/organizations-table"},
+			want:      "platform-organizations",
+			wantCalls: 1,
+		},
+		{
+			name: "no parameter",
+			env:  map[string]string{"TABLE_NAME": "test-table"},
+			want: "test-table",
+		},
+		{
+			name:      "missing parameter",
+			env:       map[string]string{"TABLE_NAME_PARAM": "/platform/missing"},
+			wantCalls: 1,
+			wantErr:   "failed to get parameter /platform/missing",
+		},
+		{
+			name:      "empty parameter",
+			env:       map[string]string{"TABLE_NAME_PARAM": "/platform/empty"},
+			wantCalls: 1,
+			wantErr:   "parameter /platform/empty has no value",
+		},
+		{
+			name:      "ssm error",
+			env:       map[string]string{"TABLE_NAME_PARAM": "/platform/organizations-table"},
+			err:       errors.New("access denied"),
+			wantCalls: 1,
+			wantErr:   "access denied",
+		},
+		{
+			name:      "local environment outside the allowed prefix",
+			env:       map[string]string{"ENVIRONMENT": "local", "TABLE_NAME": "local-organizations", "TABLE_NAME_PARAM": "/platform/organizations-table"},
+			wantCalls: 1,
+			wantErr:   `does not start with ALLOWED_TABLE_PREFIX "local-"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &mockSSMClient{parameters: parameters, err: tt.err}
+			cfg, err := resolveTableName(context.Background(), client, mustLoadConfig(t, testEnv(tt.env)))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("resolveTableName() error = %v, want %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatalf("resolveTableName() unexpected error = %v", err)
+			} else if cfg.TableName != tt.want {
+				t.Errorf("TableName = %q, want %q", cfg.TableName, tt.want)
+			}
+			if client.calls != tt.wantCalls {
+				t.Errorf("expected %d GetParameter calls, got %d", tt.wantCalls, client.calls)
+			}
+		})
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// checkStreamViewType warns when the users table's stream does not carry both old and new
+// images. MODIFY records need the old image to diff organizations and REMOVE records need it to
+// know which memberships to delete, so any other view type silently leaves memberships stale.
+// The check only logs; a failed DescribeTable call is logged rather than failing startup.
+func checkStreamViewType(ctx context.Context, logger *slog.Logger, client dynamoDBClient, tableName string) {
+	out, err := client.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(tableName)})
+	if err != nil {
+		logger.WarnContext(ctx, "failed to describe stream table",
+			slog.String("error", err.Error()),
+			slog.String("table", tableName))
+		return
+	}
+
+	var viewType types.StreamViewType
+	if out.Table != nil && out.Table.StreamSpecification != nil && aws.ToBool(out.Table.StreamSpecification.StreamEnabled) {
+		viewType = out.Table.StreamSpecification.StreamViewType
+	}
+	if viewType != types.StreamViewTypeNewAndOldImages {
+		logger.WarnContext(ctx, "stream view type is not NEW_AND_OLD_IMAGES",
+			slog.String("table", tableName),
+			slog.String("streamViewType", string(viewType)))
+	}
+}
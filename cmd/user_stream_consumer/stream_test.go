@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Test_checkStreamViewType verifies a warning is logged unless the stream carries both images
+func Test_checkStreamViewType(t *testing.T) {
+	tests := []struct {
+		name        string
+		stream      *types.StreamSpecification
+		describeErr error
+		wantWarning string
+	}{
+		{
+			name:   "new and old images",
+			stream: &types.StreamSpecification{StreamEnabled: aws.Bool(true), StreamViewType: types.StreamViewTypeNewAndOldImages},
+		},
+		{
+			name:        "keys only",
+			stream:      &types.StreamSpecification{StreamEnabled: aws.Bool(true), StreamViewType: types.StreamViewTypeKeysOnly},
+			wantWarning: "stream view type is not NEW_AND_OLD_IMAGES",
+		},
+		{
+			name:        "stream disabled",
+			wantWarning: "stream view type is not NEW_AND_OLD_IMAGES",
+		},
+		{
+			name:        "describe failure",
+			describeErr: errors.New("access denied"),
+			wantWarning: "failed to describe stream table",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &mockDynamoDBClient{
+				describeTableFunc: func(ctx context.Context, params *dynamodb.DescribeTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DescribeTableOutput, error) {
+					if *params.TableName != "poc-users" {
+						t.Errorf("expected DescribeTable on poc-users, got %s", *params.TableName)
+					}
+					if tt.describeErr != nil {
+						return nil, tt.describeErr
+					}
+					return &dynamodb.DescribeTableOutput{Table: &types.TableDescription{StreamSpecification: tt.stream}}, nil
+				},
+			}
+
+			var buf bytes.Buffer
+			checkStreamViewType(context.Background(), slog.New(slog.NewJSONHandler(&buf, nil)), client, "poc-users")
+
+			logs := parseLogs(t, &buf)
+			if tt.wantWarning == "" {
+				if len(logs) != 0 {
+					t.Errorf("expected no logs, got %v", logs)
+				}
+				return
+			}
+			if warnings := findLogs(logs, tt.wantWarning); len(warnings) != 1 || warnings[0]["level"] != "WARN" {
+				t.Errorf("expected a %q warning, got %v", tt.wantWarning, logs)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// validationProblem identifies one way a stream record is unusable.
+type validationProblem int
+
+const (
+	problemMissingEventName validationProblem = iota
+	problemUnknownEventName
+	problemMissingPK
+	problemMissingImage
+)
+
+// validationError enumerates every problem found with a stream record, so a single log line
+// describes all of them.
+type validationError struct {
+	eventName string
+	problems  []validationProblem
+}
+
+func (e *validationError) Error() string {
+	messages := make([]string, 0, len(e.problems))
+	for _, problem := range e.problems {
+		switch problem {
+		case problemMissingEventName:
+			messages = append(messages, "missing eventName")
+		case problemUnknownEventName:
+			messages = append(messages, fmt.Sprintf("unknown eventName %q", e.eventName))
+		case problemMissingPK:
+			messages = append(messages, "missing pk")
+		case problemMissingImage:
+			messages = append(messages, fmt.Sprintf("missing image for %s", e.eventName))
+		}
+	}
+	return strings.Join(messages, "; ")
+}
+
+// has reports whether problem was found.
+func (e *validationError) has(problem validationProblem) bool {
+	for _, p := range e.problems {
+		if p == problem {
+			return true
+		}
+	}
+	return false
+}
+
+// onlyUnknownEventName reports whether an otherwise valid record carries an event name this
+// consumer does not handle, which is skipped rather than rejected.
+func onlyUnknownEventName(err error) bool {
+	var verr *validationError
+	return errors.As(err, &verr) && len(verr.problems) == 1 && verr.has(problemUnknownEventName)
+}
+
+// validateRecord checks that a decoded stream record carries an event name this consumer
+// handles, a pk for the user in its Keys or images, and the image its event type is read from:
+// the NewImage for INSERT and MODIFY and the OldImage for REMOVE. Keys stand in for a missing
+// image, since KEYS_ONLY records are backfilled or reconciled from them. The image is only
+// checked for recognised event names.
+func validateRecord(der events.DynamoDBEventRecord) error {
+	verr := &validationError{eventName: der.EventName}
+
+	var image map[string]events.DynamoDBAttributeValue
+	switch der.EventName {
+	case "":
+		verr.problems = append(verr.problems, problemMissingEventName)
+	case string(events.DynamoDBOperationTypeInsert), string(events.DynamoDBOperationTypeModify):
+		image = der.Change.NewImage
+	case string(events.DynamoDBOperationTypeRemove):
+		image = der.Change.OldImage
+	default:
+		verr.problems = append(verr.problems, problemUnknownEventName)
+	}
+
+	if recordUserKey(der) == "" {
+		verr.problems = append(verr.problems, problemMissingPK)
+	}
+	if !verr.has(problemMissingEventName) && !verr.has(problemUnknownEventName) && image == nil && len(der.Change.Keys) == 0 {
+		verr.problems = append(verr.problems, problemMissingImage)
+	}
+
+	if len(verr.problems) > 0 {
+		return verr
+	}
+	return nil
+}
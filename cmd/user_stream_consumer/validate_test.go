@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// Test_validateRecord verifies every problem with a stream record is reported
+func Test_validateRecord(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		wantErr string
+	}{
+		{
+			name: "valid insert",
+			body: `{"eventName": "INSERT", "dynamodb": {"NewImage": {"pk": {"S": "USER#123"}}}}`,
+		},
+		{
+			name: "valid remove",
+			body: `{"eventName": "REMOVE", "dynamodb": {"OldImage": {"pk": {"S": "USER#123"}}}}`,
+		},
+		{
+			name: "keys stand in for a missing image",
+			body: `{"eventName": "MODIFY", "dynamodb": {"Keys": {"pk": {"S": "USER#123"}}}}`,
+		},
+		{
+			name:    "missing event name",
+			body:    `{"dynamodb": {"NewImage": {"pk": {"S": "USER#123"}}}}`,
+			wantErr: "missing eventName",
+		},
+		{
+			name:    "unknown event name",
+			body:    `{"eventName": "FOO", "dynamodb": {"NewImage": {"pk": {"S": "USER#123"}}}}`,
+			wantErr: `unknown eventName "FOO"`,
+		},
+		{
+			name:    "missing pk",
+			body:    `{"eventName": "INSERT", "dynamodb": {"NewImage": {"organizations": {"L": []}}}}`,
+			wantErr: "missing pk",
+		},
+		{
+			name:    "non-string pk",
+			body:    `{"eventName": "INSERT", "dynamodb": {"NewImage": {"pk": {"N": "123"}}}}`,
+			wantErr: "missing pk",
+		},
+		{
+			name:    "insert without a new image",
+			body:    `{"eventName": "INSERT", "dynamodb": {"OldImage": {"pk": {"S": "USER#123"}}}}`,
+			wantErr: "missing image for INSERT",
+		},
+		{
+			name:    "remove without an old image",
+			body:    `{"eventName": "REMOVE", "dynamodb": {"NewImage": {"pk": {"S": "USER#123"}}}}`,
+			wantErr: "missing image for REMOVE",
+		},
+		{
+			name:    "every problem is listed",
+			body:    `{"eventName": "MODIFY", "dynamodb": {}}`,
+			wantErr: "missing pk; missing image for MODIFY",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var der events.DynamoDBEventRecord
+			if err := json.Unmarshal([]byte(tt.body), &der); err != nil {
+				t.Fatalf("failed to unmarshal record: %v", err)
+			}
+
+			err := validateRecord(der)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("validateRecord() unexpected error = %v", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("validateRecord() error = %v, want %s", err, tt.wantErr)
+			}
+		})
+	}
+}
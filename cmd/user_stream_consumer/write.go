@@ -0,0 +1,471 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// maxBatchWriteItems is the maximum number of requests, across all tables, DynamoDB accepts in a
+// single BatchWriteItem call.
+const maxBatchWriteItems = 25
+
+// defaultRetryBudget is the number of unprocessed item retries an invocation makes, across all
+// records and chunks, unless RETRY_BUDGET overrides it. Bounding retries in-process keeps them
+// from compounding SDK retries and SQS redelivery during an outage.
+const defaultRetryBudget = 10
+
+// Unprocessed item retries back off exponentially from defaultRetryBaseDelay up to
+// maxRetryDelay.
+const (
+	defaultRetryBaseDelay = 50 * time.Millisecond
+	maxRetryDelay         = time.Second
+)
+
+// defaultAdaptiveBackoffBase is the pause before new BatchWriteItem calls after the first
+// throttled call of an invocation, unless ADAPTIVE_BACKOFF_BASE overrides it.
+const defaultAdaptiveBackoffBase = 50 * time.Millisecond
+
+// maxTransactItems is the maximum number of actions DynamoDB accepts in a single
+// TransactWriteItems call.
+const maxTransactItems = 100
+
+// batchWriteMemberships writes the membership requests, and the reverse index requests when
+// present, with BatchWriteItem. BatchWriteItem is not transactional, so a failure can leave some
+// requests applied and others not. When separate passes are enabled, every delete is written
+// before any put, so a batch never carries a put and a delete for the same key. The number of
+// chunks the record needed is observed as BatchChunks.
+func (p *processor) batchWriteMemberships(ctx context.Context, inv *invocation, writeRequests, reverseRequests []types.WriteRequest) error {
+	requestItems := map[string][]types.WriteRequest{p.tableName: writeRequests}
+	if len(reverseRequests) > 0 {
+		requestItems[p.reverseIndexTable] = reverseRequests
+	}
+
+	passes := []map[string][]types.WriteRequest{requestItems}
+	if p.separatePasses {
+		deletes, puts := make(map[string][]types.WriteRequest), make(map[string][]types.WriteRequest)
+		for table, requests := range requestItems {
+			deletes[table], puts[table] = splitDeletes(requests)
+		}
+		passes = []map[string][]types.WriteRequest{deletes, puts}
+	}
+
+	var chunks int
+	for _, pass := range passes {
+		n, err := p.batchWrite(ctx, inv, pass)
+		chunks += n
+		if err != nil {
+			return err
+		}
+	}
+	inv.metrics.observe("BatchChunks", unitCount, float64(chunks))
+	return nil
+}
+
+// batchWrite writes the requests for every table in requestItems in as few BatchWriteItem calls
+// as the maxBatchWriteItems limit allows, returning the number of calls made. The limit applies
+// to the total across tables, so a call may carry requests for several tables; tables are packed
+// in name order. Calls are flushed early at the flush threshold when one is configured below the
+// limit. BatchWriteItem rejects a call that touches the same key twice, so requests for a key
+// already seen in the same table are collapsed into the last one and counted as DedupedWrites.
+// Only the requests passed in are deduped and packed together; each record's writes are flushed
+// on their own, so requests are not collected across records. Calls wait on the write limiter
+// when one is configured. UnprocessedItems returned by a call are retried with backoff while the
+// invocation's retry budget lasts; once it is spent the record fails with the items still
+// unwritten and RetryBudgetExhausted is counted. With adaptive backoff enabled, each call that
+// returns UnprocessedItems also slows down the calls for the following chunks; see
+// adaptWriteDelay.
+func (p *processor) batchWrite(ctx context.Context, inv *invocation, requestItems map[string][]types.WriteRequest) (int, error) {
+	tables := make([]string, 0, len(requestItems))
+	for table := range requestItems {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+
+	type tableRequest struct {
+		table   string
+		request types.WriteRequest
+	}
+	var requests []tableRequest
+	for _, table := range tables {
+		deduped, dropped := dedupeWriteRequests(requestItems[table])
+		if dropped > 0 {
+			inv.metrics.increment("DedupedWrites", dropped)
+		}
+		for _, req := range deduped {
+			requests = append(requests, tableRequest{table: table, request: req})
+		}
+	}
+
+	var calls int
+	chunkSize := p.chunkSize()
+	for start := 0; start < len(requests); start += chunkSize {
+		end := min(start+chunkSize, len(requests))
+
+		input := &dynamodb.BatchWriteItemInput{RequestItems: make(map[string][]types.WriteRequest)}
+		var chunkTables []string
+		for _, req := range requests[start:end] {
+			if _, ok := input.RequestItems[req.table]; !ok {
+				chunkTables = append(chunkTables, req.table)
+			}
+			input.RequestItems[req.table] = append(input.RequestItems[req.table], req.request)
+		}
+
+		p.logger.InfoContext(ctx, "writing organization memberships",
+			slog.Any("tables", chunkTables),
+			slog.Int("requestCount", end-start))
+		p.logger.DebugContext(ctx, "batch write input",
+			slog.Any("input", loggedRequests{requestItems: input.RequestItems, maxItems: p.maxLogItems, redactEmail: p.redactEmail}))
+
+		calls++
+		if err := p.writeChunk(ctx, inv, input); err != nil {
+			return calls, err
+		}
+	}
+
+	return calls, nil
+}
+
+// chunkSize returns the number of requests sent per BatchWriteItem call: the flush threshold,
+// capped at maxBatchWriteItems, or maxBatchWriteItems when none is configured.
+func (p *processor) chunkSize() int {
+	if p.flushThreshold <= 0 {
+		return maxBatchWriteItems
+	}
+	return min(p.flushThreshold, maxBatchWriteItems)
+}
+
+// writeChunk makes a single BatchWriteItem call, then retries any UnprocessedItems it returns
+// until they are all written or the retry budget runs out. The duration of each call, from
+// sending the request to its response and excluding time spent waiting for write capacity, is
+// observed as BatchWriteLatencyMillis; retries are left out when latencyFirstCalls is set, so
+// the metric reflects the table's latency rather than its throttling.
+func (p *processor) writeChunk(ctx context.Context, inv *invocation, input *dynamodb.BatchWriteItemInput) error {
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			if inv.retries >= p.retryBudget {
+				inv.metrics.increment("RetryBudgetExhausted", 1)
+				p.logger.ErrorContext(ctx, "retry budget exhausted with unprocessed memberships",
+					slog.String("table", p.tableName),
+					slog.Int("retryBudget", p.retryBudget),
+					slog.Int("requestCount", countRequests(input.RequestItems)))
+				return fmt.Errorf("retry budget exhausted with %d unprocessed organization membership writes", countRequests(input.RequestItems))
+			}
+			inv.retries++
+			if err := sleep(ctx, retryDelay(p.retryBaseDelay, attempt)); err != nil {
+				return fmt.Errorf("failed to retry unprocessed memberships: %w", err)
+			}
+		}
+
+		if attempt == 0 && inv.writeDelay > 0 {
+			inv.metrics.observe("AdaptiveWriteDelayMillis", unitMilliseconds, float64(inv.writeDelay.Milliseconds()))
+			if err := sleep(ctx, inv.writeDelay); err != nil {
+				return fmt.Errorf("failed to wait for write capacity: %w", err)
+			}
+		}
+		if p.writeLimiter != nil {
+			if err := p.writeLimiter.Wait(ctx); err != nil {
+				return fmt.Errorf("failed to wait for write capacity: %w", err)
+			}
+		}
+
+		out, err := p.sendChunk(ctx, inv, input, attempt)
+		if err != nil {
+			return err
+		}
+		if out == nil {
+			// Not expected from the SDK, but a nil output carries no UnprocessedItems to retry.
+			p.logger.DebugContext(ctx, "batch write returned no output, treating chunk as fully processed",
+				slog.String("table", p.tableName),
+				slog.Int("requestCount", countRequests(input.RequestItems)))
+		}
+		throttled := out != nil && len(out.UnprocessedItems) > 0
+		if attempt == 0 {
+			p.adaptWriteDelay(inv, throttled)
+		}
+		if !throttled {
+			return nil
+		}
+		input = &dynamodb.BatchWriteItemInput{RequestItems: out.UnprocessedItems}
+	}
+}
+
+// sendChunk makes one BatchWriteItem call for writeChunk while holding an in-flight write slot,
+// which is released however the call returns.
+func (p *processor) sendChunk(ctx context.Context, inv *invocation, input *dynamodb.BatchWriteItemInput, attempt int) (*dynamodb.BatchWriteItemOutput, error) {
+	requestCount := countRequests(input.RequestItems)
+	if err := p.acquireWriteSlot(ctx); err != nil {
+		return nil, fmt.Errorf("failed to wait for an in-flight write slot: %w", err)
+	}
+	defer p.releaseWriteSlot()
+	inv.metrics.increment("BatchWriteCalls", 1)
+	inv.metrics.increment("WriteRequestsTotal", requestCount)
+	start := p.now()
+	out, err := p.client.BatchWriteItem(ctx, input)
+	if attempt == 0 || !p.latencyFirstCalls {
+		inv.metrics.observe("BatchWriteLatencyMillis", unitMilliseconds, float64(p.now().Sub(start).Milliseconds()))
+	}
+	if err != nil {
+		p.logger.ErrorContext(ctx, "failed to batch write memberships",
+			slog.String("error", err.Error()),
+			slog.String("table", p.tableName),
+			slog.Int("requestCount", requestCount))
+		return nil, fmt.Errorf("failed to batch write organization memberships: %w", err)
+	}
+	return out, nil
+}
+
+// acquireWriteSlot waits for one of the processor's in-flight write slots, so that no more than
+// MAX_INFLIGHT_WRITES BatchWriteItem calls are outstanding at once however many records or
+// chunks are being written concurrently. It returns immediately when the number is unlimited.
+func (p *processor) acquireWriteSlot(ctx context.Context) error {
+	if p.writeSlots == nil {
+		return nil
+	}
+	select {
+	case p.writeSlots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// releaseWriteSlot returns a slot taken by acquireWriteSlot.
+func (p *processor) releaseWriteSlot() {
+	if p.writeSlots != nil {
+		<-p.writeSlots
+	}
+}
+
+// adaptWriteDelay adjusts the pause before each new chunk's BatchWriteItem call for the rest of
+// the invocation, after the first call for a chunk returns. UnprocessedItems are DynamoDB's
+// signal that the table is short of write capacity, so a throttled call starts the delay at the
+// adaptive backoff base, or doubles it up to the maximum; a call written in full halves it,
+// dropping it entirely once it falls below the base. Retries of unprocessed items have their own
+// backoff and do not adjust the delay. Nothing is adjusted when adaptive backoff is disabled.
+func (p *processor) adaptWriteDelay(inv *invocation, throttled bool) {
+	if p.adaptiveBackoffMax <= 0 {
+		return
+	}
+	switch {
+	case throttled && inv.writeDelay == 0:
+		inv.writeDelay = min(p.adaptiveBackoffBase, p.adaptiveBackoffMax)
+	case throttled:
+		inv.writeDelay = min(inv.writeDelay*2, p.adaptiveBackoffMax)
+	default:
+		if inv.writeDelay /= 2; inv.writeDelay < p.adaptiveBackoffBase {
+			inv.writeDelay = 0
+		}
+	}
+}
+
+// retryDelay returns the backoff before the given retry attempt, doubling from base and capped
+// at maxRetryDelay.
+func retryDelay(base time.Duration, attempt int) time.Duration {
+	delay := base
+	for i := 1; i < attempt && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, maxRetryDelay)
+}
+
+// sleep waits for d or until ctx is done, whichever is first.
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// countRequests returns the number of requests across every table.
+func countRequests(requestItems map[string][]types.WriteRequest) int {
+	var n int
+	for _, requests := range requestItems {
+		n += len(requests)
+	}
+	return n
+}
+
+// transactWriteMemberships writes the membership requests with TransactWriteItems. The
+// requests are deduped by key and grouped by organization, and each organization's membership
+// requests are placed in the same transaction as its reverse index request, so the forward and
+// reverse records for an organization are written or rejected together. Pairing is by
+// organization key rather than position, so a request dropped from one list does not shift the
+// rest; a reverse index request without a membership request for its organization is logged and
+// skipped. Organizations are packed into transactions of at most maxTransactItems actions;
+// atomicity holds within a transaction, not across them.
+func (p *processor) transactWriteMemberships(ctx context.Context, inv *invocation, writeRequests, reverseRequests []types.WriteRequest) error {
+	writeRequests, dropped := dedupeWriteRequests(writeRequests)
+	reverseRequests, reverseDropped := dedupeWriteRequests(reverseRequests)
+	if dropped+reverseDropped > 0 {
+		inv.metrics.increment("DedupedWrites", dropped+reverseDropped)
+	}
+
+	reverseByOrg := make(map[string]types.WriteRequest, len(reverseRequests))
+	for _, req := range reverseRequests {
+		_, sk, _ := strings.Cut(writeRequestKey(req), "\x00")
+		reverseByOrg[sk] = req
+	}
+
+	// Membership requests are grouped under the reverse index sort key of their organization.
+	var orgs []string
+	groups := make(map[string][]types.TransactWriteItem)
+	orgPrefix := membershipPK("", p.orgPKPrefix)
+	for _, req := range writeRequests {
+		pk, _, _ := strings.Cut(writeRequestKey(req), "\x00")
+		org := "ORGANIZATION#" + strings.TrimPrefix(pk, orgPrefix)
+		if _, ok := groups[org]; !ok {
+			orgs = append(orgs, org)
+		}
+		groups[org] = append(groups[org], transactWriteItem(p.tableName, req))
+	}
+	for _, org := range orgs {
+		if req, ok := reverseByOrg[org]; ok {
+			groups[org] = append(groups[org], transactWriteItem(p.reverseIndexTable, req))
+			delete(reverseByOrg, org)
+		}
+	}
+	for _, req := range reverseRequests {
+		_, sk, _ := strings.Cut(writeRequestKey(req), "\x00")
+		if _, ok := reverseByOrg[sk]; ok {
+			p.logger.WarnContext(ctx, "skipping reverse index write without a membership write",
+				slog.String("table", p.reverseIndexTable),
+				slog.String("sk", sk))
+		}
+	}
+
+	var items []types.TransactWriteItem
+	for i, org := range orgs {
+		items = append(items, groups[org]...)
+		if i+1 < len(orgs) && len(items)+len(groups[orgs[i+1]]) <= maxTransactItems {
+			continue
+		}
+
+		p.logger.InfoContext(ctx, "transact writing organization memberships",
+			slog.String("table", p.tableName),
+			slog.Int("requestCount", len(items)))
+
+		if _, err := p.client.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: items}); err != nil {
+			p.logger.ErrorContext(ctx, "failed to transact write memberships",
+				slog.String("error", err.Error()),
+				slog.String("table", p.tableName),
+				slog.Int("requestCount", len(items)))
+			return fmt.Errorf("failed to transact write organization memberships: %w", err)
+		}
+		items = nil
+	}
+
+	return nil
+}
+
+// loggedRequests renders batch write request items for logging, keeping at most maxItems
+// requests per table and summarising the remainder as "...and M more". A maxItems of zero or
+// less logs every request. When redactEmail is set, email addresses in string attributes are
+// masked.
+type loggedRequests struct {
+	requestItems map[string][]types.WriteRequest
+	maxItems     int
+	redactEmail  bool
+}
+
+// LogValue implements slog.LogValuer.
+func (l loggedRequests) LogValue() slog.Value {
+	tables := make([]string, 0, len(l.requestItems))
+	for table := range l.requestItems {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+
+	attrs := make([]slog.Attr, 0, len(tables))
+	for _, table := range tables {
+		requests := l.requestItems[table]
+		if l.redactEmail {
+			requests = redactRequests(requests)
+		}
+		if l.maxItems <= 0 || len(requests) <= l.maxItems {
+			attrs = append(attrs, slog.Any(table, requests))
+			continue
+		}
+		attrs = append(attrs, slog.Group(table,
+			slog.Any("requests", requests[:l.maxItems]),
+			slog.String("more", fmt.Sprintf("...and %d more", len(requests)-l.maxItems))))
+	}
+	return slog.GroupValue(attrs...)
+}
+
+// dedupeWriteRequests collapses requests targeting the same pk and sk into the last of them,
+// so a later put or delete for a key replaces an earlier one. Each surviving request keeps the
+// position of the first request for its key. dropped is the number of requests removed.
+func dedupeWriteRequests(requests []types.WriteRequest) (deduped []types.WriteRequest, dropped int) {
+	positions := make(map[string]int, len(requests))
+	deduped = make([]types.WriteRequest, 0, len(requests))
+	for _, req := range requests {
+		key := writeRequestKey(req)
+		if i, ok := positions[key]; ok {
+			deduped[i] = req
+			dropped++
+			continue
+		}
+		positions[key] = len(deduped)
+		deduped = append(deduped, req)
+	}
+	return deduped, dropped
+}
+
+// writeRequestKey identifies the item a put or delete request targets by its pk and sk.
+func writeRequestKey(req types.WriteRequest) string {
+	var item map[string]types.AttributeValue
+	switch {
+	case req.DeleteRequest != nil:
+		item = req.DeleteRequest.Key
+	case req.PutRequest != nil:
+		item = req.PutRequest.Item
+	}
+	var pk, sk string
+	if v, ok := item["pk"].(*types.AttributeValueMemberS); ok {
+		pk = v.Value
+	}
+	if v, ok := item["sk"].(*types.AttributeValueMemberS); ok {
+		sk = v.Value
+	}
+	return pk + "\x00" + sk
+}
+
+// splitDeletes partitions write requests into deletes and puts, preserving their order.
+func splitDeletes(requests []types.WriteRequest) (deletes, puts []types.WriteRequest) {
+	for _, req := range requests {
+		if req.DeleteRequest != nil {
+			deletes = append(deletes, req)
+		} else {
+			puts = append(puts, req)
+		}
+	}
+	return deletes, puts
+}
+
+// transactWriteItem converts a batch WriteRequest into the equivalent TransactWriteItem
+// targeting tableName.
+func transactWriteItem(tableName string, req types.WriteRequest) types.TransactWriteItem {
+	if req.DeleteRequest != nil {
+		return types.TransactWriteItem{
+			Delete: &types.Delete{TableName: aws.String(tableName), Key: req.DeleteRequest.Key},
+		}
+	}
+	return types.TransactWriteItem{
+		Put: &types.Put{TableName: aws.String(tableName), Item: req.PutRequest.Item},
+	}
+}
@@ -0,0 +1,803 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"golang.org/x/time/rate"
+)
+
+// Test_transactWriteMemberships verifies forward and reverse writes share a transaction and are chunked
+func Test_transactWriteMemberships(t *testing.T) {
+	orgs := func(n int) []string {
+		ids := make([]string, n)
+		for i := range ids {
+			ids[i] = fmt.Sprintf("org%d", i)
+		}
+		return ids
+	}
+
+	tests := []struct {
+		name              string
+		orgs              []string
+		reverseIndexTable string
+		transactErr       error
+		wantErr           bool
+		wantTransactions  []int
+	}{
+		{
+			name:              "forward and reverse paired in one transaction",
+			orgs:              orgs(2),
+			reverseIndexTable: "reverse-table",
+			wantTransactions:  []int{4},
+		},
+		{
+			name:              "chunked at the transaction item limit",
+			orgs:              orgs(60),
+			reverseIndexTable: "reverse-table",
+			wantTransactions:  []int{100, 20},
+		},
+		{
+			name:             "forward only without a reverse index",
+			orgs:             orgs(120),
+			wantTransactions: []int{100, 20},
+		},
+		{
+			name:              "cancelled transaction applies nothing",
+			orgs:              orgs(2),
+			reverseIndexTable: "reverse-table",
+			transactErr:       &types.TransactionCanceledException{Message: new(string)},
+			wantErr:           true,
+			wantTransactions:  []int{4},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var transactions [][]types.TransactWriteItem
+			client := &mockDynamoDBClient{
+				transactWriteFunc: func(ctx context.Context, params *dynamodb.TransactWriteItemsInput, optFns ...func(*dynamodb.Options)) (*dynamodb.TransactWriteItemsOutput, error) {
+					transactions = append(transactions, params.TransactItems)
+					if tt.transactErr != nil {
+						return nil, tt.transactErr
+					}
+					return &dynamodb.TransactWriteItemsOutput{}, nil
+				},
+			}
+			p := &processor{
+				logger:            slog.New(slog.NewJSONHandler(io.Discard, nil)),
+				client:            client,
+				now:               fixedClock,
+				tableName:         "test-table",
+				reverseIndexTable: tt.reverseIndexTable,
+			}
+
+			writes := createWriteRequests("USER#123", tt.orgs, membershipAttributes{}, false)
+			var reverse []types.WriteRequest
+			if tt.reverseIndexTable != "" {
+				reverse = createReverseWriteRequests("USER#123", tt.orgs, membershipAttributes{}, false)
+			}
+
+			err := p.transactWriteMemberships(context.Background(), newInvocation(), writes, reverse)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("transactWriteMemberships() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.transactErr != nil && !errors.Is(err, tt.transactErr) {
+				t.Errorf("expected error to wrap %v, got %v", tt.transactErr, err)
+			}
+
+			if len(transactions) != len(tt.wantTransactions) {
+				t.Fatalf("expected %d transactions, got %d", len(tt.wantTransactions), len(transactions))
+			}
+			for i, items := range transactions {
+				if len(items) != tt.wantTransactions[i] {
+					t.Errorf("transaction %d: expected %d items, got %d", i, tt.wantTransactions[i], len(items))
+				}
+				if tt.reverseIndexTable == "" {
+					continue
+				}
+				for j := 0; j < len(items); j += 2 {
+					if *items[j].Put.TableName != "test-table" || *items[j+1].Put.TableName != "reverse-table" {
+						t.Errorf("transaction %d: items %d and %d are not a forward/reverse pair", i, j, j+1)
+					}
+				}
+			}
+		})
+	}
+}
+
+// Test_transactWriteMemberships_pairing verifies forward and reverse writes are paired by
+// organization rather than position, and duplicate keys are written once
+func Test_transactWriteMemberships_pairing(t *testing.T) {
+	tests := []struct {
+		name    string
+		writes  []types.WriteRequest
+		reverse []types.WriteRequest
+		want    []string // Transaction items, as table and key
+	}{
+		{
+			name:    "membership write missing for an organization",
+			writes:  createWriteRequests("USER#123", []string{"org2", "org3"}, membershipAttributes{}, false),
+			reverse: createReverseWriteRequests("USER#123", []string{"org1", "org2", "org3"}, membershipAttributes{}, false),
+			want: []string{
+				"test-table ORGANIZATION#org2", "reverse-table ORGANIZATION#org2",
+				"test-table ORGANIZATION#org3", "reverse-table ORGANIZATION#org3",
+			},
+		},
+		{
+			name:    "duplicate organization",
+			writes:  createWriteRequests("USER#123", []string{"org1", "org1", "org2"}, membershipAttributes{}, false),
+			reverse: createReverseWriteRequests("USER#123", []string{"org1", "org1", "org2"}, membershipAttributes{}, false),
+			want: []string{
+				"test-table ORGANIZATION#org1", "reverse-table ORGANIZATION#org1",
+				"test-table ORGANIZATION#org2", "reverse-table ORGANIZATION#org2",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			client := &mockDynamoDBClient{
+				transactWriteFunc: func(ctx context.Context, params *dynamodb.TransactWriteItemsInput, optFns ...func(*dynamodb.Options)) (*dynamodb.TransactWriteItemsOutput, error) {
+					for _, item := range params.TransactItems {
+						key := item.Put.Item["pk"].(*types.AttributeValueMemberS).Value
+						if *item.Put.TableName == "reverse-table" {
+							key = item.Put.Item["sk"].(*types.AttributeValueMemberS).Value
+						}
+						got = append(got, *item.Put.TableName+" "+key)
+					}
+					return &dynamodb.TransactWriteItemsOutput{}, nil
+				},
+			}
+			p := &processor{
+				logger:            slog.New(slog.NewJSONHandler(io.Discard, nil)),
+				client:            client,
+				now:               fixedClock,
+				tableName:         "test-table",
+				reverseIndexTable: "reverse-table",
+			}
+
+			if err := p.transactWriteMemberships(context.Background(), newInvocation(), tt.writes, tt.reverse); err != nil {
+				t.Fatalf("transactWriteMemberships() unexpected error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("transaction items = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// Test_batchWriteMemberships_separatePasses verifies deletes are flushed before puts and no batch mixes a key
+func Test_batchWriteMemberships_separatePasses(t *testing.T) {
+	tests := []struct {
+		name           string
+		separatePasses bool
+		wantBatches    int
+	}{
+		{name: "single pass", separatePasses: false, wantBatches: 1},
+		{name: "deletes then puts", separatePasses: true, wantBatches: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var batches []map[string][]types.WriteRequest
+			client := &mockDynamoDBClient{
+				batchWriteItemFunc: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+					batches = append(batches, params.RequestItems)
+					return &dynamodb.BatchWriteItemOutput{}, nil
+				},
+			}
+			p := &processor{
+				logger:            slog.New(slog.NewJSONHandler(io.Discard, nil)),
+				client:            client,
+				now:               fixedClock,
+				tableName:         "test-table",
+				reverseIndexTable: "reverse-table",
+				separatePasses:    tt.separatePasses,
+			}
+
+			// org2 is both removed and re-added, so a mixed batch would carry a conflicting key.
+			removed, added := []string{"org1", "org2"}, []string{"org2", "org3"}
+			writes := append(createWriteRequests("USER#123", removed, membershipAttributes{}, true), createWriteRequests("USER#123", added, membershipAttributes{}, false)...)
+			reverse := append(createReverseWriteRequests("USER#123", removed, membershipAttributes{}, true), createReverseWriteRequests("USER#123", added, membershipAttributes{}, false)...)
+
+			if err := p.batchWriteMemberships(context.Background(), newInvocation(), writes, reverse); err != nil {
+				t.Fatalf("batchWriteMemberships() unexpected error = %v", err)
+			}
+			if len(batches) != tt.wantBatches {
+				t.Fatalf("expected %d batches, got %d", tt.wantBatches, len(batches))
+			}
+			if !tt.separatePasses {
+				return
+			}
+
+			for i, wantDelete := range []bool{true, false} {
+				for table, requests := range batches[i] {
+					if len(requests) != 2 {
+						t.Errorf("batch %d table %s: expected 2 requests, got %d", i, table, len(requests))
+					}
+					for _, req := range requests {
+						if (req.DeleteRequest != nil) != wantDelete {
+							t.Errorf("batch %d table %s: expected only deletes=%v, got %+v", i, table, wantDelete, req)
+						}
+					}
+				}
+			}
+		})
+	}
+}
+
+// Test_batchWrite_multipleTables verifies requests for several tables are packed and chunked by their total
+func Test_batchWrite_multipleTables(t *testing.T) {
+	var batches []map[string][]types.WriteRequest
+	client := &mockDynamoDBClient{
+		batchWriteItemFunc: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+			batches = append(batches, params.RequestItems)
+			return &dynamodb.BatchWriteItemOutput{}, nil
+		},
+	}
+	p := &processor{
+		logger:    slog.New(slog.NewJSONHandler(io.Discard, nil)),
+		client:    client,
+		now:       fixedClock,
+		tableName: "table-a",
+	}
+
+	orgs := make([]string, 20)
+	for i := range orgs {
+		orgs[i] = fmt.Sprintf("org%d", i)
+	}
+	calls, err := p.batchWrite(context.Background(), newInvocation(), map[string][]types.WriteRequest{
+		"table-a": createWriteRequests("USER#123", orgs, membershipAttributes{}, false),
+		"table-b": createReverseWriteRequests("USER#123", orgs[:10], membershipAttributes{}, false),
+	})
+	if err != nil {
+		t.Fatalf("batchWrite() unexpected error = %v", err)
+	}
+	if calls != 2 || len(batches) != 2 {
+		t.Fatalf("expected 2 batch writes, got %d calls and %d batches", calls, len(batches))
+	}
+
+	want := []map[string]int{{"table-a": 20, "table-b": 5}, {"table-b": 5}}
+	for i, batch := range batches {
+		got := make(map[string]int, len(batch))
+		for table, requests := range batch {
+			got[table] = len(requests)
+		}
+		if !reflect.DeepEqual(got, want[i]) {
+			t.Errorf("batch %d: got request counts %v, want %v", i, got, want[i])
+		}
+	}
+}
+
+// Test_batchWrite_flushThreshold verifies calls are flushed early at the flush threshold, and
+// that a threshold above the BatchWriteItem limit is capped at it
+func Test_batchWrite_flushThreshold(t *testing.T) {
+	tests := []struct {
+		name      string
+		threshold int
+		wantSizes []int
+	}{
+		{name: "default packs up to the limit", threshold: 0, wantSizes: []int{25, 5}},
+		{name: "early flush at ten", threshold: 10, wantSizes: []int{10, 10, 10}},
+		{name: "capped at the limit", threshold: 100, wantSizes: []int{25, 5}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sizes []int
+			client := &mockDynamoDBClient{
+				batchWriteItemFunc: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+					sizes = append(sizes, len(params.RequestItems["test-table"]))
+					return &dynamodb.BatchWriteItemOutput{}, nil
+				},
+			}
+			p := &processor{
+				logger:         slog.New(slog.NewJSONHandler(io.Discard, nil)),
+				client:         client,
+				now:            fixedClock,
+				tableName:      "test-table",
+				flushThreshold: tt.threshold,
+			}
+
+			orgs := make([]string, 30)
+			for i := range orgs {
+				orgs[i] = fmt.Sprintf("org%d", i)
+			}
+			if _, err := p.batchWrite(context.Background(), newInvocation(), map[string][]types.WriteRequest{
+				"test-table": createWriteRequests("USER#123", orgs, membershipAttributes{}, false),
+			}); err != nil {
+				t.Fatalf("batchWrite() unexpected error = %v", err)
+			}
+			if !reflect.DeepEqual(sizes, tt.wantSizes) {
+				t.Errorf("wrote chunks of %v, want %v", sizes, tt.wantSizes)
+			}
+		})
+	}
+}
+
+// Test_batchWrite_nilOutput verifies a BatchWriteItem call returning neither output nor error is
+// treated as fully written and logged, since a nil output carries no UnprocessedItems to retry
+func Test_batchWrite_nilOutput(t *testing.T) {
+	client := &mockDynamoDBClient{
+		batchWriteItemFunc: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+			return nil, nil
+		},
+	}
+	var buf bytes.Buffer
+	p := &processor{
+		logger:    slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})),
+		client:    client,
+		now:       fixedClock,
+		tableName: "test-table",
+	}
+
+	calls, err := p.batchWrite(context.Background(), newInvocation(), map[string][]types.WriteRequest{
+		"test-table": createWriteRequests("USER#123", []string{"org1", "org2"}, membershipAttributes{}, false),
+	})
+	if err != nil {
+		t.Fatalf("batchWrite() unexpected error = %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("expected 1 batch write, got %d", calls)
+	}
+	if n := len(findLogs(parseLogs(t, &buf), "batch write returned no output, treating chunk as fully processed")); n != 1 {
+		t.Errorf("expected 1 nil output debug log, got %d", n)
+	}
+}
+
+// Test_batchWrite_dedupe verifies requests in one write targeting the same membership key are
+// collapsed into the last one before the chunk is written
+func Test_batchWrite_dedupe(t *testing.T) {
+	var batches []map[string][]types.WriteRequest
+	client := &mockDynamoDBClient{
+		batchWriteItemFunc: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+			batches = append(batches, params.RequestItems)
+			return &dynamodb.BatchWriteItemOutput{}, nil
+		},
+	}
+	p := &processor{
+		logger:    slog.New(slog.NewJSONHandler(io.Discard, nil)),
+		client:    client,
+		now:       fixedClock,
+		tableName: "test-table",
+	}
+
+	// The write adds org1 and org2, then removes org1 again.
+	first := createWriteRequests("USER#123", []string{"org1", "org2"}, membershipAttributes{}, false)
+	second := createWriteRequests("USER#123", []string{"org1"}, membershipAttributes{}, true)
+
+	inv := newInvocation()
+	if _, err := p.batchWrite(context.Background(), inv, map[string][]types.WriteRequest{
+		"test-table": append(first, second...),
+	}); err != nil {
+		t.Fatalf("batchWrite() unexpected error = %v", err)
+	}
+	if len(batches) != 1 {
+		t.Fatalf("expected 1 batch write, got %d", len(batches))
+	}
+
+	requests := batches[0]["test-table"]
+	if len(requests) != 2 {
+		t.Fatalf("expected 2 requests after dedupe, got %d", len(requests))
+	}
+	if requests[0].DeleteRequest == nil {
+		t.Errorf("expected the later delete for org1 to win, got %+v", requests[0])
+	}
+	if requests[1].PutRequest == nil {
+		t.Errorf("expected the put for org2 to be kept, got %+v", requests[1])
+	}
+	if got := inv.metrics.count("DedupedWrites"); got != 1 {
+		t.Errorf("expected DedupedWrites 1, got %d", got)
+	}
+}
+
+// Test_batchWrite_chunkTables verifies each chunk's write log names the tables the chunk carries
+func Test_batchWrite_chunkTables(t *testing.T) {
+	orgs := make([]string, 20)
+	for i := range orgs {
+		orgs[i] = fmt.Sprintf("org%d", i)
+	}
+	client := &mockDynamoDBClient{
+		batchWriteItemFunc: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+			return &dynamodb.BatchWriteItemOutput{}, nil
+		},
+	}
+	var buf bytes.Buffer
+	p := &processor{
+		logger:    slog.New(slog.NewJSONHandler(&buf, nil)),
+		client:    client,
+		now:       fixedClock,
+		tableName: "test-table",
+	}
+
+	if _, err := p.batchWrite(context.Background(), newInvocation(), map[string][]types.WriteRequest{
+		"test-table":    createWriteRequests("USER#123", orgs, membershipAttributes{}, false),
+		"reverse-table": createReverseWriteRequests("USER#123", orgs, membershipAttributes{}, false),
+	}); err != nil {
+		t.Fatalf("batchWrite() unexpected error = %v", err)
+	}
+
+	var got [][]any
+	for _, entry := range findLogs(parseLogs(t, &buf), "writing organization memberships") {
+		tables, _ := entry["tables"].([]any)
+		got = append(got, tables)
+	}
+	want := [][]any{{"reverse-table", "test-table"}, {"test-table"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("logged tables = %v, want %v", got, want)
+	}
+}
+
+// Test_batchWrite_retryBudget verifies UnprocessedItems are retried until the invocation's retry
+// budget is spent, capping the total number of BatchWriteItem calls
+func Test_batchWrite_retryBudget(t *testing.T) {
+	tests := []struct {
+		name        string
+		unprocessed int // Calls that return every request as unprocessed before one succeeds; -1 never succeeds
+		wantCalls   int
+		wantErr     bool
+	}{
+		{name: "unprocessed items retried until written", unprocessed: 2, wantCalls: 4},
+		{name: "always unprocessed stops at the budget", unprocessed: -1, wantCalls: 4, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int
+			client := &mockDynamoDBClient{
+				batchWriteItemFunc: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+					calls++
+					if tt.unprocessed >= 0 && calls > tt.unprocessed {
+						return &dynamodb.BatchWriteItemOutput{}, nil
+					}
+					return &dynamodb.BatchWriteItemOutput{UnprocessedItems: params.RequestItems}, nil
+				},
+			}
+			p := &processor{
+				logger:      slog.New(slog.NewJSONHandler(io.Discard, nil)),
+				client:      client,
+				now:         fixedClock,
+				tableName:   "test-table",
+				retryBudget: 3,
+			}
+
+			// Two chunks, so an exhausted budget must also stop the second chunk from being written.
+			orgs := make([]string, 30)
+			for i := range orgs {
+				orgs[i] = fmt.Sprintf("org%d", i)
+			}
+			inv := newInvocation()
+			_, err := p.batchWrite(context.Background(), inv, map[string][]types.WriteRequest{
+				"test-table": createWriteRequests("USER#123", orgs, membershipAttributes{}, false),
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("batchWrite() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("expected %d BatchWriteItem calls, got %d", tt.wantCalls, calls)
+			}
+			wantExhausted := 0
+			if tt.wantErr {
+				wantExhausted = 1
+			}
+			if got := inv.metrics.count("RetryBudgetExhausted"); got != wantExhausted {
+				t.Errorf("expected RetryBudgetExhausted %d, got %d", wantExhausted, got)
+			}
+		})
+	}
+}
+
+// Test_batchWrite_writeLimiter verifies BatchWriteItem calls are spaced out by the write limiter
+// and that waiting honours context cancellation
+func Test_batchWrite_writeLimiter(t *testing.T) {
+	var callTimes []time.Time
+	client := &mockDynamoDBClient{
+		batchWriteItemFunc: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+			callTimes = append(callTimes, time.Now())
+			return &dynamodb.BatchWriteItemOutput{}, nil
+		},
+	}
+	p := &processor{
+		logger:       slog.New(slog.NewJSONHandler(io.Discard, nil)),
+		client:       client,
+		now:          fixedClock,
+		tableName:    "test-table",
+		writeLimiter: rate.NewLimiter(rate.Limit(20), 1),
+	}
+
+	orgs := make([]string, 3*maxBatchWriteItems)
+	for i := range orgs {
+		orgs[i] = fmt.Sprintf("org%d", i)
+	}
+	requestItems := map[string][]types.WriteRequest{"test-table": createWriteRequests("USER#123", orgs, membershipAttributes{}, false)}
+
+	if _, err := p.batchWrite(context.Background(), newInvocation(), requestItems); err != nil {
+		t.Fatalf("batchWrite() unexpected error = %v", err)
+	}
+	if len(callTimes) != 3 {
+		t.Fatalf("expected 3 batch writes, got %d", len(callTimes))
+	}
+	// 20 calls per second spaces calls 50ms apart; allow for timer slack.
+	for i := 1; i < len(callTimes); i++ {
+		if gap := callTimes[i].Sub(callTimes[i-1]); gap < 40*time.Millisecond {
+			t.Errorf("call %d: expected calls spaced at least 40ms apart, got %v", i, gap)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	callTimes = nil
+	if _, err := p.batchWrite(ctx, newInvocation(), requestItems); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	if len(callTimes) != 0 {
+		t.Errorf("expected no batch writes after cancellation, got %d", len(callTimes))
+	}
+}
+
+// Test_batchWrite_maxInflightWrites verifies concurrent writers never have more BatchWriteItem
+// calls outstanding than the processor's in-flight write slots
+func Test_batchWrite_maxInflightWrites(t *testing.T) {
+	const maxInflight = 2
+	var inflight, peak, calls atomic.Int32
+	client := &mockDynamoDBClient{
+		batchWriteItemFunc: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+			calls.Add(1)
+			n := inflight.Add(1)
+			defer inflight.Add(-1)
+			for {
+				if prev := peak.Load(); n <= prev || peak.CompareAndSwap(prev, n) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			return &dynamodb.BatchWriteItemOutput{}, nil
+		},
+	}
+	p := &processor{
+		logger:     slog.New(slog.NewJSONHandler(io.Discard, nil)),
+		client:     client,
+		now:        fixedClock,
+		tableName:  "test-table",
+		writeSlots: make(chan struct{}, maxInflight),
+	}
+
+	orgs := make([]string, 3*maxBatchWriteItems)
+	for i := range orgs {
+		orgs[i] = fmt.Sprintf("org%d", i)
+	}
+	requests := createWriteRequests("USER#123", orgs, membershipAttributes{}, false)
+
+	const writers = 5
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := p.batchWrite(context.Background(), newInvocation(), map[string][]types.WriteRequest{"test-table": requests}); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("batchWrite() unexpected error = %v", err)
+	}
+
+	if n := calls.Load(); n != 3*writers {
+		t.Errorf("expected %d batch writes, got %d", 3*writers, n)
+	}
+	if n := peak.Load(); n > maxInflight {
+		t.Errorf("expected at most %d in-flight batch writes, got %d", maxInflight, n)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for range maxInflight {
+		p.writeSlots <- struct{}{}
+	}
+	if _, err := p.batchWrite(ctx, newInvocation(), map[string][]types.WriteRequest{"test-table": requests}); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled while every slot is taken, got %v", err)
+	}
+}
+
+// Test_batchWrite_panicReleasesWriteSlot verifies a write that panics gives its in-flight slot
+// back, so writes after the recovered panic are not starved of slots
+func Test_batchWrite_panicReleasesWriteSlot(t *testing.T) {
+	var panicked bool
+	client := &mockDynamoDBClient{
+		batchWriteItemFunc: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+			if !panicked {
+				panicked = true
+				panic("simulated SDK panic")
+			}
+			return &dynamodb.BatchWriteItemOutput{}, nil
+		},
+	}
+	p := &processor{
+		logger:     slog.New(slog.NewJSONHandler(io.Discard, nil)),
+		client:     client,
+		now:        fixedClock,
+		tableName:  "test-table",
+		writeSlots: make(chan struct{}, 1),
+	}
+	requestItems := map[string][]types.WriteRequest{"test-table": createWriteRequests("USER#123", []string{"org1"}, membershipAttributes{}, false)}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("expected the first write to panic")
+			}
+		}()
+		p.batchWrite(context.Background(), newInvocation(), requestItems)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := p.batchWrite(ctx, newInvocation(), requestItems); err != nil {
+		t.Errorf("batchWrite() after a recovered panic error = %v", err)
+	}
+}
+
+// Test_batchWrite_adaptiveBackoff verifies a throttled call slows down the calls for the following
+// chunks, and that the delay recovers once calls are written in full
+func Test_batchWrite_adaptiveBackoff(t *testing.T) {
+	var callTimes []time.Time
+	client := &mockDynamoDBClient{
+		batchWriteItemFunc: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+			callTimes = append(callTimes, time.Now())
+			if len(callTimes) == 1 {
+				return &dynamodb.BatchWriteItemOutput{UnprocessedItems: params.RequestItems}, nil
+			}
+			return &dynamodb.BatchWriteItemOutput{}, nil
+		},
+	}
+	p := &processor{
+		logger:              slog.New(slog.NewJSONHandler(io.Discard, nil)),
+		client:              client,
+		now:                 fixedClock,
+		tableName:           "test-table",
+		retryBudget:         1,
+		adaptiveBackoffBase: 50 * time.Millisecond,
+		adaptiveBackoffMax:  time.Second,
+	}
+
+	orgs := make([]string, 3*maxBatchWriteItems)
+	for i := range orgs {
+		orgs[i] = fmt.Sprintf("org%d", i)
+	}
+	inv := newInvocation()
+	if _, err := p.batchWrite(context.Background(), inv, map[string][]types.WriteRequest{
+		"test-table": createWriteRequests("USER#123", orgs, membershipAttributes{}, false),
+	}); err != nil {
+		t.Fatalf("batchWrite() unexpected error = %v", err)
+	}
+
+	// The first chunk is throttled once and retried, after which the second chunk waits out the
+	// adaptive delay and, being written in full, lets the third go at full speed.
+	if len(callTimes) != 4 {
+		t.Fatalf("expected 4 batch writes, got %d", len(callTimes))
+	}
+	if gap := callTimes[2].Sub(callTimes[1]); gap < 40*time.Millisecond {
+		t.Errorf("expected the chunk after a throttled call to wait at least 40ms, got %v", gap)
+	}
+	if want := []float64{50}; !reflect.DeepEqual(inv.metrics.values["AdaptiveWriteDelayMillis"], want) {
+		t.Errorf("expected AdaptiveWriteDelayMillis %v, got %v", want, inv.metrics.values["AdaptiveWriteDelayMillis"])
+	}
+	if inv.writeDelay != 0 {
+		t.Errorf("expected the write delay to recover to zero, got %v", inv.writeDelay)
+	}
+}
+
+// Test_batchWrite_latency verifies the duration of each BatchWriteItem call is observed as
+// BatchWriteLatencyMillis, with retries left out when latencyFirstCalls is set
+func Test_batchWrite_latency(t *testing.T) {
+	tests := []struct {
+		name              string
+		latencyFirstCalls bool
+		want              []float64
+	}{
+		{name: "every call", want: []float64{40, 80}},
+		{name: "first calls only", latencyFirstCalls: true, want: []float64{40}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The clock advances while each call is in flight, by longer for the retry.
+			now := fixedClock()
+			var calls int
+			client := &mockDynamoDBClient{
+				batchWriteItemFunc: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+					calls++
+					now = now.Add(time.Duration(calls) * 40 * time.Millisecond)
+					if calls == 1 {
+						return &dynamodb.BatchWriteItemOutput{UnprocessedItems: params.RequestItems}, nil
+					}
+					return &dynamodb.BatchWriteItemOutput{}, nil
+				},
+			}
+			p := &processor{
+				logger:            slog.New(slog.NewJSONHandler(io.Discard, nil)),
+				client:            client,
+				now:               func() time.Time { return now },
+				tableName:         "test-table",
+				retryBudget:       1,
+				latencyFirstCalls: tt.latencyFirstCalls,
+			}
+
+			inv := newInvocation()
+			if _, err := p.batchWrite(context.Background(), inv, map[string][]types.WriteRequest{
+				"test-table": createWriteRequests("USER#123", []string{"org1"}, membershipAttributes{}, false),
+			}); err != nil {
+				t.Fatalf("batchWrite() unexpected error = %v", err)
+			}
+			if got := inv.metrics.values["BatchWriteLatencyMillis"]; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected BatchWriteLatencyMillis %v, got %v", tt.want, got)
+			}
+			if unit := inv.metrics.units["BatchWriteLatencyMillis"]; unit != unitMilliseconds {
+				t.Errorf("expected unit %s, got %s", unitMilliseconds, unit)
+			}
+		})
+	}
+}
+
+// Test_adaptWriteDelay verifies throttled calls double the write delay up to the maximum and
+// calls written in full halve it until it drops below the base
+func Test_adaptWriteDelay(t *testing.T) {
+	p := &processor{adaptiveBackoffBase: 50 * time.Millisecond, adaptiveBackoffMax: 150 * time.Millisecond}
+	inv := newInvocation()
+
+	var delays []time.Duration
+	for _, throttled := range []bool{true, true, true, false, false, false} {
+		p.adaptWriteDelay(inv, throttled)
+		delays = append(delays, inv.writeDelay)
+	}
+	want := []time.Duration{50 * time.Millisecond, 100 * time.Millisecond, 150 * time.Millisecond, 75 * time.Millisecond, 0, 0}
+	if !reflect.DeepEqual(delays, want) {
+		t.Errorf("delays = %v, want %v", delays, want)
+	}
+
+	p.adaptiveBackoffMax = 0
+	p.adaptWriteDelay(inv, true)
+	if inv.writeDelay != 0 {
+		t.Errorf("expected no delay with adaptive backoff disabled, got %v", inv.writeDelay)
+	}
+}
+
+// Test_loggedRequests verifies logged request lists are truncated with a count of the omitted requests
+func Test_loggedRequests(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, nil))
+
+	requests := createWriteRequests("USER#123", []string{"org1", "org2", "org3"}, membershipAttributes{}, false)
+	logger.Info("test",
+		slog.Any("truncated", loggedRequests{requestItems: map[string][]types.WriteRequest{"t": requests}, maxItems: 1}),
+		slog.Any("untruncated", loggedRequests{requestItems: map[string][]types.WriteRequest{"t": requests}}))
+
+	entry := parseLogs(t, &buf)[0]
+	truncated := entry["truncated"].(map[string]any)["t"].(map[string]any)
+	if n := len(truncated["requests"].([]any)); n != 1 {
+		t.Errorf("expected 1 logged request, got %d", n)
+	}
+	if truncated["more"] != "...and 2 more" {
+		t.Errorf("expected ...and 2 more, got %v", truncated["more"])
+	}
+	if n := len(entry["untruncated"].(map[string]any)["t"].([]any)); n != 3 {
+		t.Errorf("expected 3 logged requests without a limit, got %d", n)
+	}
+}